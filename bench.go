@@ -0,0 +1,27 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/xjdrew/gotunnel/tunnel"
+)
+
+// connect tunnels like client, report throughput, rtt and fairness of them
+// to stdout. Interrupt stops it early.
+func runBench(app *tunnel.App, opts tunnel.BenchOptions) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	result, err := app.Bench(ctx, opts)
+	if err != nil {
+		return err
+	}
+	_, err = result.WriteTo(os.Stdout)
+	return err
+}
@@ -0,0 +1,176 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package main
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+
+	"github.com/xjdrew/gotunnel/tunnel"
+)
+
+// ends a flag applies to
+const (
+	forClient = 1 << iota
+	forServer
+	forAll = forClient | forServer
+)
+
+// comma separated list
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = nil
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
+
+// level of tunnel logs, set at once as it's read by loggers
+type levelFlag struct{}
+
+func (levelFlag) String() string {
+	return strconv.FormatUint(uint64(tunnel.GetLogLevel()), 10)
+}
+
+func (levelFlag) Set(s string) error {
+	level, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	tunnel.SetLogLevel(uint(level))
+	return nil
+}
+
+// options of command besides config
+type options struct {
+	config    string
+	service   string
+	logFormat string
+}
+
+// flags of options applying to role, bound to c and o
+func configFlags(fs *flag.FlagSet, role int, c *tunnel.Config, o *options) {
+	client, server := role&forClient != 0, role&forServer != 0
+
+	switch role {
+	case forClient:
+		fs.StringVar(&c.Listen, "listen", ":8001", "local listen address")
+		fs.StringVar(&c.Backend, "backend", "127.0.0.1:1234", "tunnel server address")
+		fs.UintVar(&c.Tunnels, "tunnels", 1, "low level tunnel count")
+	case forServer:
+		fs.StringVar(&c.Listen, "listen", ":8001", "tunnel listen address")
+		fs.StringVar(&c.Backend, "backend", "127.0.0.1:1234", "backend address")
+	default:
+		fs.StringVar(&c.Listen, "listen", ":8001", "listen address")
+		fs.StringVar(&c.Backend, "backend", "127.0.0.1:1234", "backend address")
+		fs.UintVar(&c.Tunnels, "tunnels", 1, "low level tunnel count, 0 if work as server")
+	}
+	fs.StringVar(&o.config, "config", "", "config file of options, rules, acl and more, toml if named *.toml, json otherwise, flags given on command line override it")
+	fs.StringVar(&c.Secret, "secret", "the answer to life, the universe and everything", "tunnel secret, or env:NAME, file:PATH or exec:COMMAND to load it")
+	fs.StringVar(&c.Cipher, "cipher", tunnel.CipherAES256GCM, "tunnel cipher: aes-256-gcm or rc4(legacy)")
+	fs.BoolVar(&c.LegacyHandshake, "legacy-handshake", false, "accept old peers whose handshake has no forward secrecy")
+	fs.IntVar(&c.HandshakeTimeout, "handshake-timeout", 0, "seconds a tunnel connection has to finish handshake, default timeout")
+	fs.BoolVar(&c.TLS, "tls", false, "use tls transport for tunnel connections")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "tls certificate file, required by server")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "tls private key file, or env:NAME, file:PATH or exec:COMMAND to load pem, required by server")
+	fs.StringVar(&c.TLSCA, "tls-ca", "", "tls ca file to verify peer certificate")
+	fs.Var((*listFlag)(&c.TLSPins), "tls-pins", "comma separated hex sha256 of pinned public keys, one must be in peer's certificate chain")
+	fs.StringVar(&c.Obfs, "obfs", tunnel.ObfsNone, "obfuscate tunnel connections against dpi: none, padding or tls, both ends must match")
+	fs.StringVar(&c.ObfsKey, "obfs-key", "", "key masking obfuscated tunnel connections, secret if empty, could be loaded like secret")
+	fs.IntVar(&c.KCPMtu, "kcp-mtu", tunnel.DefaultKCPMtu, "kcp transport: max bytes of udp packets")
+	fs.IntVar(&c.KCPWindow, "kcp-window", tunnel.DefaultKCPWindow, "kcp transport: send and receive window in packets")
+	fs.IntVar(&c.KCPDataShards, "kcp-data-shards", tunnel.DefaultKCPDataShards, "kcp transport: packets of a fec group")
+	fs.IntVar(&c.KCPParityShards, "kcp-parity-shards", 0, "kcp transport: parity packets following a fec group, fec is disabled if 0, both ends must match")
+	fs.IntVar(&c.CompressThreshold, "compress-threshold", tunnel.DefaultCompressThreshold, "min payload size in bytes to compress")
+	fs.StringVar(&c.Admin, "admin", "", "admin api listen address, disabled if empty, keep it local")
+	fs.StringVar(&c.StateDir, "state-dir", "", "directory of state kept across restarts, such as traffic of clients and failing servers, disabled if empty")
+	fs.StringVar(&c.StatusFile, "status-file", "", "write full json snapshot of hubs and links to the file on status signal, besides logging")
+	fs.StringVar(&c.Debug, "debug", "", "pprof, expvar and goroutine dump listen address, disabled if empty, keep it local")
+	fs.StringVar(&c.Metrics, "metrics", "", "prometheus metrics listen address, disabled if empty")
+	fs.IntVar(&c.MaxLinks, "max-links", tunnel.MaxLinkPerTunnel-1, "max links created by this end per tunnel, at most 8388607, or 32767 with old peers")
+	fs.IntVar(&c.LinkIdAudit, "linkid-audit", 0, "seconds between audits of link ids of each tunnel for leaked ones, 0 to disable")
+	fs.IntVar(&c.LinkIdReclaim, "linkid-reclaim", 0, "reclaim link ids found leaked for seconds by audit, 0 to disable")
+	fs.IntVar(&c.DialTimeout, "dial-timeout", 0, "connect timeout in seconds of tunnel and backend connections, system default if 0")
+	fs.StringVar(&c.DialBind, "dial-bind", "", "local ip to dial tunnel and backend connections from")
+	fs.BoolVar(&c.Nagle, "nagle", false, "enable nagle's algorithm on tunnel and backend connections")
+	fs.IntVar(&c.TOS, "tos", 0, "ip tos/dscp byte of tunnel and backend connections, linux only")
+	fs.BoolVar(&c.FastOpen, "fast-open", false, "use tcp fast open to dial tunnel and backend connections, linux only")
+	fs.IntVar(&c.ResolveTTL, "resolve-ttl", tunnel.DefaultResolveTTL, "seconds to cache names of backends and destinations resolved per link, negative to disable")
+	fs.IntVar(&c.IdleTimeout, "idle-timeout", 0, "close links without traffic in seconds, 0 to disable")
+	fs.IntVar(&c.LinkMaxAge, "link-max-age", 0, "close links older than seconds, 0 to disable")
+	fs.IntVar(&c.TunnelMaxAge, "tunnel-max-age", 0, "replace tunnels older than seconds by new handshakes, 0 to disable")
+	fs.StringVar(&c.AccessLog, "access-log", "", "json record of every closed link to a file, syslog or syslog://host:port, disabled if empty")
+	fs.Int64Var(&c.AccessLogSize, "access-log-size", tunnel.DefaultAccessLogSize, "max bytes of access log file before it's rotated")
+	fs.IntVar(&c.AccessLogBackups, "access-log-backups", tunnel.DefaultAccessLogBackups, "rotated access log files kept, none if negative")
+	fs.StringVar(&c.Tracing, "tracing", "", "otlp/http url of opentelemetry collector links are traced to, such as http://127.0.0.1:4318/v1/traces, disabled if empty")
+	fs.StringVar(&c.PolicyExec, "policy-exec", "", "command deciding links created by peer, json request on stdin and decision on stdout, disabled if empty")
+	fs.IntVar(&c.PolicyTimeout, "policy-timeout", tunnel.DefaultPolicyTimeout, "max milliseconds of a decision of policy-exec, link is denied after it")
+	fs.Float64Var(&c.TraceSample, "trace-sample", 1, "ratio of links starting new traces, negative to only follow traces of peer")
+	fs.Int64Var(&c.LinkRate, "link-rate", 0, "rate limit of each link in bytes per second for each direction, 0 means unlimited")
+	fs.Int64Var(&c.HubRate, "hub-rate", 0, "rate limit of all links in a tunnel in bytes per second for each direction, 0 means unlimited")
+	fs.Int64Var(&c.BulkRate, "bulk-rate", 0, "rate limit of bulk links in a tunnel in bytes per second for each direction, 0 means unlimited")
+	fs.Int64Var(&c.SendQueue, "send-queue", tunnel.DefaultSendQueue, "max bytes of data frames queued to write to a tunnel, links wait when it's full")
+	fs.BoolVar(&c.NoCrypt, "nocrypt", false, "send link data authenticated but not encrypted, for tls traffic over trusted networks, needs aes-256-gcm")
+	fs.StringVar(&c.Priority, "priority", "", "priority of links: interactive, normal or bulk, default normal")
+	fs.BoolVar(&c.Socks5, "socks5", false, "client listener speaks socks5, server dials destination requested by socks5 client")
+	fs.BoolVar(&c.HTTPProxy, "http-proxy", false, "client listener accepts http CONNECT requests, server dials requested destination")
+	fs.BoolVar(&c.Transparent, "transparent", false, "client listener takes connections redirected by iptables REDIRECT or TPROXY, server dials original destination")
+	fs.BoolVar(&c.UDP, "udp", false, "forward udp instead of tcp, listen on udp port as client and relay to udp backend as server")
+	fs.IntVar(&c.Heartbeat, "heartbeat", 0, "tunnel heartbeat interval in seconds, 0 to disable")
+	fs.IntVar(&c.HeartbeatTimeout, "heartbeat-timeout", 0, "reconnect tunnel if no heartbeat in seconds, default 3 intervals")
+	fs.IntVar(&c.Resume, "resume", 0, "seconds a broken tunnel keeps its links waiting to resume over another connection, 0 to disable")
+	fs.Int64Var(&c.ResumeBuffer, "resume-buffer", tunnel.DefaultResumeBuffer, "max bytes of frames kept for replay until peer acks them")
+	fs.IntVar(&c.Ticket, "ticket", 0, "seconds a session ticket is valid, client reconnects in one round trip by it, 0 to disable")
+	fs.Int64Var(&c.RekeyBytes, "rekey-bytes", 0, "ratchet tunnel key after bytes written under it, 0 to disable")
+	fs.IntVar(&c.RekeyInterval, "rekey-interval", 0, "ratchet tunnel key after seconds, 0 to disable")
+	fs.Int64Var(&tunnel.Timeout, "timeout", 10, "tunnel read/write timeout")
+	fs.Var(levelFlag{}, "log", "log level")
+	fs.StringVar(&o.logFormat, "log-format", tunnel.LogFormatText, "log format: text or json")
+	fs.StringVar(&o.service, "service", "", "run as windows service of the name, windows only")
+
+	if server {
+		fs.IntVar(&c.ReplayWindow, "replay-window", tunnel.DefaultReplayWindow, "server rejects tokens seen in seconds, and ticket hellos older than it")
+		fs.IntVar(&c.BanThreshold, "ban-threshold", 0, "server bans a source ip after failed handshakes in ban-window, 0 to disable")
+		fs.IntVar(&c.BanWindow, "ban-window", tunnel.DefaultBanWindow, "seconds to count failed handshakes of a source ip")
+		fs.IntVar(&c.BanTime, "ban-time", tunnel.DefaultBanTime, "seconds a source ip is banned")
+		fs.IntVar(&c.MaxHandshakes, "max-handshakes", 0, "max tunnel connections of server in handshake, excess ones are closed, 0 means unlimited")
+		fs.BoolVar(&c.TLSClientAuth, "tls-client-auth", false, "server requires client certificates verified by tls-ca")
+		fs.IntVar(&c.ProxyProtocol, "proxy-protocol", 0, "server sends PROXY protocol header of version 1 or 2 to backend, 0 to disable")
+	}
+
+	if client {
+		fs.Var((*listFlag)(&c.Servers), "servers", "comma separated tunnel servers of client besides backend, tunnels are spread over them")
+		fs.StringVar(&c.ClientID, "client-id", "", "client identity presented to server, secret is the client's own secret if set")
+		fs.BoolVar(&c.Integrity, "integrity", false, "append crc32c checksum to every tunnel frame to detect corruption, chosen by client")
+		fs.StringVar(&c.Compress, "compress", tunnel.CompressNone, "compress link data: none or deflate, chosen by client")
+		fs.StringVar(&c.Balance, "balance", tunnel.BalanceLinks, "tunnel selection of client: links, throughput, rtt, round-robin or affinity")
+		fs.StringVar(&c.LinkIdPolicy, "linkid-policy", tunnel.LinkIdReject, "when link ids of all tunnels are exhausted: reject, wait, spill (same as reject) or reply busy")
+		fs.IntVar(&c.LinkIdTimeout, "linkid-timeout", tunnel.DefaultLinkIdTimeout, "max milliseconds to wait for a free link id with wait policy")
+		fs.Var((*listFlag)(&c.Uplinks), "uplinks", "comma separated local ips or interfaces of client, tunnels are spread over them")
+		fs.IntVar(&c.MaxConns, "max-conns", 0, "max concurrent local connections of client listeners, excess ones are reset, 0 means unlimited")
+		fs.IntVar(&c.AcceptRate, "accept-rate", 0, "max local connections accepted per second by client listeners, 0 means unlimited")
+		fs.IntVar(&c.MaxConnsPerIP, "max-conns-per-ip", 0, "max concurrent local connections of each source ip, excess ones are reset, 0 means unlimited")
+		fs.IntVar(&c.AcceptRatePerIP, "accept-rate-per-ip", 0, "max local connections per second of each source ip, excess ones are reset, 0 means unlimited")
+		fs.BoolVar(&c.EarlyData, "early-data", false, "send first bytes of connections with link creation, saving a round trip of request/response protocols")
+		fs.BoolVar(&c.Direct, "direct", false, "client connects destination directly when no tunnel could take a connection, the one requested by proxy client or direct-backend")
+		fs.StringVar(&c.DirectBackend, "direct-backend", "", "address client connects directly for static default rule with direct")
+		fs.IntVar(&c.HealthCheck, "health-check", 0, "seconds between echo checks of client tunnels end to end, unhealthy ones reconnect, 0 to disable")
+		fs.IntVar(&c.Standby, "standby", 0, "idle tunnels kept connected by client, taken at once when a tunnel breaks")
+		fs.IntVar(&c.TunnelsMax, "tunnels-max", 0, "client opens extra tunnels up to it under load, autoscaling disabled if not above tunnels")
+		fs.IntVar(&c.ScaleLinks, "scale-links", tunnel.DefaultScaleLinks, "links per tunnel to open an extra tunnel when autoscaling")
+		fs.Int64Var(&c.ScaleRate, "scale-rate", 0, "bytes per second per tunnel to open an extra tunnel when autoscaling, 0 to ignore")
+		fs.IntVar(&c.ReconnectMin, "reconnect-min", 1, "min tunnel reconnect delay in seconds")
+		fs.IntVar(&c.ReconnectMax, "reconnect-max", 60, "max tunnel reconnect delay in seconds")
+		fs.IntVar(&c.ReconnectRetries, "reconnect-retries", 0, "give up a tunnel after retries, 0 means forever")
+	}
+}
@@ -6,60 +6,241 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/xjdrew/gotunnel/tunnel"
 )
 
-const SIG_STATUS = syscall.Signal(36)
+// max time to wait active links finish when stopping
+const drainTimeout = time.Second * 30
 
-func handleSignal(app *tunnel.App) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, SIG_STATUS, syscall.SIGTERM, syscall.SIGHUP)
+// operator requests, from unix signals or windows service controls
+type control int
 
-	for sig := range c {
-		switch sig {
-		case SIG_STATUS:
+const (
+	ctrlStatus control = iota
+	ctrlReload
+	ctrlStop
+	ctrlUpgrade
+)
+
+// reload rules, acl, secrets, clients and log level from config file
+func reload(app *tunnel.App, file string) {
+	if file == "" {
+		tunnel.Log("no config file, ignore reload")
+		return
+	}
+	c, err := tunnel.LoadConfig(file)
+	if err != nil {
+		tunnel.Error("reload failed:%s", err)
+		return
+	}
+	if err := app.Reload(c); err != nil {
+		tunnel.Error("reload failed:%s", err)
+	}
+}
+
+func handleControl(app *tunnel.App, config string, ctrls <-chan control) {
+	for ctrl := range ctrls {
+		switch ctrl {
+		case ctrlStatus:
 			app.Status()
-		default:
-			tunnel.Log("catch signal:%v, ignore", sig)
+		case ctrlStop:
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			app.Stop(ctx)
+			cancel()
+		case ctrlReload:
+			reload(app, config)
+		case ctrlUpgrade:
+			if err := upgrade(app); err != nil {
+				tunnel.Error("upgrade failed:%s", err)
+			}
 		}
 	}
 }
 
+// start app and serve controls until it quits, ready is called once started
+func run(app *tunnel.App, config string, ctrls <-chan control, ready func()) error {
+	if err := app.Start(context.Background()); err != nil {
+		return fmt.Errorf("start failed:%s", err)
+	}
+	go handleControl(app, config, ctrls)
+	ready()
+
+	app.Wait()
+	return nil
+}
+
+// options in config file override defaults of flags, flags given on command
+// line override config file. A flag is named after json key of its option,
+// with '-' instead of '_'
+func loadConfig(fs *flag.FlagSet, file string, c *tunnel.Config) error {
+	flags := *c
+	if err := tunnel.LoadConfigInto(file, c); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	v, fv := reflect.ValueOf(c).Elem(), reflect.ValueOf(flags)
+	for i := 0; i < v.NumField(); i++ {
+		key, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if set[strings.ReplaceAll(key, "_", "-")] {
+			v.Field(i).Set(fv.Field(i))
+		}
+	}
+	if c.LogLevel != nil && !set["log"] {
+		tunnel.SetLogLevel(*c.LogLevel)
+	}
+	return nil
+}
+
+// commands and ends their flags apply to, flags of all ends without a
+// command, where tunnels decides the end
+var commands = []struct {
+	name  string
+	role  int
+	usage string
+}{
+	{"server", forServer, "run tunnel server"},
+	{"client", forClient, "run tunnel client"},
+	{"status", 0, "query admin api of a running client or server"},
+	{"verify", forClient, "handshake with every tunnel server of client and exit"},
+	{"bench", forClient, "measure throughput and rtt of client tunnels"},
+	{"stdio", forClient, "relay a link over stdin and stdout"},
+	{"check-config", forAll, "check options and config file without starting"},
+}
+
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: %s\n", os.Args[0])
-	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s%s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun %s <command> -h for flags of command. Without command, flags of both ends are accepted and tunnels=0 runs server.\n", os.Args[0])
+	os.Exit(1)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
 	os.Exit(1)
 }
 
 func main() {
-	laddr := flag.String("listen", ":8001", "listen address")
-	baddr := flag.String("backend", "127.0.0.1:1234", "backend address")
-	secret := flag.String("secret", "the answer to life, the universe and everything", "tunnel secret")
-	tunnels := flag.Uint("tunnels", 1, "low level tunnel count, 0 if work as server")
-	flag.Int64Var(&tunnel.Timeout, "timeout", 10, "tunnel read/write timeout")
-	flag.UintVar(&tunnel.LogLevel, "log", 1, "log level")
-
-	flag.Usage = usage
-	flag.Parse()
-
-	app := &tunnel.App{
-		Listen:  *laddr,
-		Backend: *baddr,
-		Secret:  *secret,
-		Tunnels: *tunnels,
-	}
-	err := app.Start()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "start failed:%s\n", err.Error())
+	name, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	role := forAll
+	if name != "" {
+		role = -1
+		for _, cmd := range commands {
+			if cmd.name == name {
+				role = cmd.role
+			}
+		}
+		if role < 0 {
+			usage()
+		}
+	}
+	if name == "status" {
+		if err := runStatus(args); err != nil {
+			fatalf("status failed:%s", err)
+		}
 		return
 	}
-	go handleSignal(app)
 
-	app.Wait()
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	app := &tunnel.App{}
+	var o options
+	configFlags(fs, role, &app.Config, &o)
+
+	var benchOpts tunnel.BenchOptions
+	var stdioService, stdioDest string
+	switch name {
+	case "bench":
+		fs.IntVar(&benchOpts.Links, "bench-links", tunnel.DefaultBenchLinks, "parallel links sending data, spread over tunnels")
+		fs.DurationVar(&benchOpts.Duration, "bench-duration", tunnel.DefaultBenchDuration, "time of sending data")
+		fs.IntVar(&benchOpts.Size, "bench-size", tunnel.DefaultBenchSize, "bytes of each write")
+		fs.IntVar(&benchOpts.Pings, "bench-pings", tunnel.DefaultBenchPings, "rtt samples of each tunnel")
+	case "stdio":
+		fs.StringVar(&stdioService, "stdio-service", "", "service of the link, default rule if empty")
+		fs.StringVar(&stdioDest, "stdio-dest", "", "destination host:port of a proxy service")
+	}
+	fs.Usage = func() {
+		cmd := name
+		if cmd == "" {
+			cmd = "[command]"
+		}
+		fmt.Fprintf(os.Stderr, "usage: %s %s [flags]\n", os.Args[0], cmd)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fatalf("unexpected arguments:%s", strings.Join(fs.Args(), " "))
+	}
+
+	if err := tunnel.SetLogFormat(o.logFormat); err != nil {
+		fatalf("%s", err)
+	}
+	if o.config != "" {
+		if err := loadConfig(fs, o.config, &app.Config); err != nil {
+			fatalf("load config failed:%s", err)
+		}
+	}
+	switch role {
+	case forServer:
+		app.Tunnels = 0
+	case forClient:
+		if app.Tunnels == 0 {
+			fatalf("client needs tunnels")
+		}
+	}
+
+	switch name {
+	case "check-config":
+		if err := app.Validate(); err != nil {
+			fatalf("bad config:\n%s", err)
+		}
+		fmt.Println("config ok")
+		return
+	case "verify":
+		if err := runVerify(app); err != nil {
+			fatalf("verify failed:%s", err)
+		}
+		return
+	case "bench":
+		if err := runBench(app, benchOpts); err != nil {
+			fatalf("bench failed:%s", err)
+		}
+		return
+	case "stdio":
+		if err := runStdio(app, stdioService, stdioDest); err != nil {
+			fatalf("stdio failed:%s", err)
+		}
+		return
+	}
+
+	if err := tunnel.InheritListeners(); err != nil {
+		fmt.Fprintf(os.Stderr, "inherit listeners failed:%s\n", err.Error())
+		return
+	}
+
+	var err error
+	if o.service != "" {
+		err = runService(o.service, func(ctrls <-chan control, ready func()) error {
+			return run(app, o.config, ctrls, ready)
+		})
+	} else {
+		err = run(app, o.config, notifyControls(), notifyReady)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
 }
@@ -0,0 +1,162 @@
+//
+//   date  : 2015-09-28
+//   author: xjdrew
+//
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+
+	"github.com/xjdrew/gotunnel/tunnel"
+)
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceControlParamChange = 6
+	// user defined, sent by `sc control <name> 128`
+	serviceControlStatus = 128
+
+	serviceAcceptStop        = 1
+	serviceAcceptShutdown    = 4
+	serviceAcceptParamChange = 8
+
+	errorCallNotImplemented   = 120
+	errorServiceSpecificError = 1066
+)
+
+// SERVICE_STATUS
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// SERVICE_TABLE_ENTRYW
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// only one service runs in a process, callbacks of service control manager
+// find it here
+var theService struct {
+	name   *uint16
+	handle uintptr
+	status serviceStatus
+	ctrls  chan control
+	run    func(ctrls <-chan control, ready func()) error
+	err    error
+}
+
+// controls from console: ctrl-c and close stop
+func notifyControls() <-chan control {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	ctrls := make(chan control)
+	go func() {
+		for sig := range c {
+			tunnel.Log("catch signal:%v, stop", sig)
+			ctrls <- ctrlStop
+		}
+	}()
+	return ctrls
+}
+
+// run as windows service of name, block until it's stopped. Stop and
+// shutdown stop the service, paramchange reloads and user control 128
+// dumps status.
+func runService(name string, run func(ctrls <-chan control, ready func()) error) error {
+	theService.name = syscall.StringToUTF16Ptr(name)
+	theService.ctrls = make(chan control)
+	theService.run = run
+
+	table := []serviceTableEntry{
+		{name: theService.name, proc: syscall.NewCallback(serviceMain)},
+		{},
+	}
+	r, _, err := procStartServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0])))
+	if r == 0 {
+		return err
+	}
+	return theService.err
+}
+
+func setServiceState(state, accepts uint32) {
+	theService.status.ServiceType = serviceWin32OwnProcess
+	theService.status.CurrentState = state
+	theService.status.ControlsAccepted = accepts
+	procSetServiceStatus.Call(theService.handle, uintptr(unsafe.Pointer(&theService.status)))
+}
+
+// called by service control manager in its own thread
+func serviceMain(argc, argv uintptr) uintptr {
+	h, _, err := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(theService.name)), syscall.NewCallback(serviceHandler), 0)
+	if h == 0 {
+		theService.err = err
+		return 0
+	}
+	theService.handle = h
+	setServiceState(serviceStartPending, 0)
+
+	theService.err = theService.run(theService.ctrls, func() {
+		setServiceState(serviceRunning, serviceAcceptStop|serviceAcceptShutdown|serviceAcceptParamChange)
+	})
+	if theService.err != nil {
+		tunnel.Error("service quit:%s", theService.err)
+		theService.status.Win32ExitCode = errorServiceSpecificError
+		theService.status.ServiceSpecificExitCode = 1
+	}
+	setServiceState(serviceStopped, 0)
+	return 0
+}
+
+func serviceHandler(ctl, evtype, evdata, context uintptr) uintptr {
+	var ctrl control
+	switch ctl {
+	case serviceControlStop, serviceControlShutdown:
+		tunnel.Log("service control:%d, stop", ctl)
+		setServiceState(serviceStopPending, 0)
+		ctrl = ctrlStop
+	case serviceControlParamChange:
+		tunnel.Log("service control:%d, reload", ctl)
+		ctrl = ctrlReload
+	case serviceControlStatus:
+		ctrl = ctrlStatus
+	case serviceControlInterrogate:
+		procSetServiceStatus.Call(theService.handle, uintptr(unsafe.Pointer(&theService.status)))
+		return 0
+	default:
+		return errorCallNotImplemented
+	}
+	// handler must return quickly
+	go func() {
+		theService.ctrls <- ctrl
+	}()
+	return 0
+}
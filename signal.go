@@ -0,0 +1,52 @@
+//
+//   date  : 2015-09-28
+//   author: xjdrew
+//
+
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/xjdrew/gotunnel/tunnel"
+)
+
+const SIG_STATUS = syscall.Signal(36)
+
+// controls from signals: SIG_STATUS or SIGQUIT dumps status, SIGHUP reloads,
+// SIGTERM stops and SIG_UPGRADE restarts gracefully
+func notifyControls() <-chan control {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, SIG_STATUS, syscall.SIGQUIT, SIG_UPGRADE, syscall.SIGTERM, syscall.SIGHUP)
+
+	ctrls := make(chan control)
+	go func() {
+		for sig := range c {
+			switch sig {
+			case SIG_STATUS, syscall.SIGQUIT:
+				ctrls <- ctrlStatus
+			case syscall.SIGTERM:
+				tunnel.Log("catch signal:%v, stop", sig)
+				ctrls <- ctrlStop
+			case SIG_UPGRADE:
+				tunnel.Log("catch signal:%v, upgrade", sig)
+				ctrls <- ctrlUpgrade
+			case syscall.SIGHUP:
+				tunnel.Log("catch signal:%v, reload", sig)
+				ctrls <- ctrlReload
+			default:
+				tunnel.Log("catch signal:%v, ignore", sig)
+			}
+		}
+	}()
+	return ctrls
+}
+
+func runService(name string, run func(ctrls <-chan control, ready func()) error) error {
+	return errors.New("service is only supported on windows")
+}
@@ -0,0 +1,95 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/xjdrew/gotunnel/tunnel"
+)
+
+// pages of admin api could be queried
+var statusPages = map[string]bool{
+	"status": true,
+	"health": true,
+	"bans":   true,
+	"usage":  true,
+}
+
+// query admin api of a running client or server and print the answer to
+// stdout:
+//
+//	gotunnel status -admin 127.0.0.1:8002 [status|health|bans|usage]
+//
+// admin address could be taken from config file of the end instead. It fails
+// unless the answer is 200, so an unhealthy client fails health.
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	admin := fs.String("admin", "", "admin api address of the running end")
+	config := fs.String("config", "", "config file of the running end, admin address is read from it")
+	timeout := fs.Duration("timeout", 5*time.Second, "max time to wait for the answer")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s status [flags] [status|health|bans|usage]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	page := "status"
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		page = fs.Arg(0)
+	default:
+		return errors.New("too many arguments")
+	}
+	if !statusPages[page] {
+		return fmt.Errorf("unknown page %s", page)
+	}
+
+	addr := *admin
+	if addr == "" && *config != "" {
+		c, err := tunnel.LoadConfig(*config)
+		if err != nil {
+			return err
+		}
+		addr = c.Admin
+	}
+	if addr == "" {
+		return errors.New("no admin address, set admin or config")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	// admin api listening on all addresses is queried by loopback
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/" + page)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//
+//   date  : 2015-10-12
+//   author: xjdrew
+//
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/xjdrew/gotunnel/tunnel"
+)
+
+// relay a link of service over stdin and stdout until it's done, such as
+// for ProxyCommand of ssh. Interrupt stops it early.
+func runStdio(app *tunnel.App, service, dest string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return app.Stdio(ctx, service, dest, os.Stdin, os.Stdout)
+}
@@ -0,0 +1,166 @@
+//
+//   date  : 2015-10-08
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// delay of accept retries after temporary errors such as EMFILE, doubled
+// every failure instead of spinning on the error
+const (
+	acceptDelayMin = 5 * time.Millisecond
+	acceptDelayMax = time.Second
+)
+
+// take a slot of local connections from ip, fails if MaxConns or limits of
+// the ip are reached
+func (cli *Client) acquireConn(ip string) error {
+	if !cli.sources.acquire(ip, time.Now()) {
+		return fmt.Errorf("too many connections from %s", ip)
+	}
+	n := atomic.AddInt32(&cli.conns, 1)
+	if max := cli.app.MaxConns; max > 0 && int(n) > max {
+		atomic.AddInt32(&cli.conns, -1)
+		cli.sources.release(ip, time.Now())
+		return fmt.Errorf("too many connections(%d)", max)
+	}
+	return nil
+}
+
+func (cli *Client) releaseConn(ip string) {
+	atomic.AddInt32(&cli.conns, -1)
+	cli.sources.release(ip, time.Now())
+}
+
+// connections of each source ip of client listeners, so one local process
+// can't take all link ids. Rate is a token bucket with one second of burst.
+type sourceLimits struct {
+	lock    sync.Mutex
+	max     int     // concurrent connections of an ip, 0 means unlimited
+	rate    float64 // new connections per second of an ip, 0 means unlimited
+	entries map[string]*sourceEntry
+	swept   time.Time
+}
+
+type sourceEntry struct {
+	conns  int
+	tokens float64
+	last   time.Time
+}
+
+// nil if both are unlimited, nil limits allow all
+func newSourceLimits(max, rate int) *sourceLimits {
+	if max <= 0 && rate <= 0 {
+		return nil
+	}
+	return &sourceLimits{max: max, rate: float64(rate), entries: make(map[string]*sourceEntry)}
+}
+
+// take a connection of ip, false if it's over limits
+func (s *sourceLimits) acquire(ip string, now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// buckets are full after a second, so idle entries are dropped
+	if now.Sub(s.swept) > time.Second {
+		for k, e := range s.entries {
+			s.forget(k, e, now)
+		}
+		s.swept = now
+	}
+	e := s.entries[ip]
+	if e == nil {
+		e = &sourceEntry{tokens: s.rate, last: now}
+		s.entries[ip] = e
+	}
+	if s.rate > 0 {
+		e.tokens += now.Sub(e.last).Seconds() * s.rate
+		if e.tokens > s.rate {
+			e.tokens = s.rate
+		}
+		e.last = now
+		if e.tokens < 1 {
+			return false
+		}
+	}
+	if s.max > 0 && e.conns >= s.max {
+		return false
+	}
+	if s.rate > 0 {
+		e.tokens--
+	}
+	e.conns++
+	return true
+}
+
+func (s *sourceLimits) release(ip string, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e := s.entries[ip]; e != nil {
+		e.conns--
+		s.forget(ip, e, now)
+	}
+}
+
+// drop entry of ip without connections and with a full bucket, should be
+// called with lock held
+func (s *sourceLimits) forget(ip string, e *sourceEntry, now time.Time) {
+	if e.conns == 0 && (s.rate == 0 || e.tokens+now.Sub(e.last).Seconds()*s.rate >= s.rate) {
+		delete(s.entries, ip)
+	}
+}
+
+// active connections of ip
+func (s *sourceLimits) conns(ip string) int {
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e := s.entries[ip]; e != nil {
+		return e.conns
+	}
+	return 0
+}
+
+// close rejected connection with RST, so peer fails fast
+func rejectConn(conn net.Conn) {
+	atomic.AddInt64(&stats.AcceptRejected, 1)
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// wait until the accept rate allows one more connection, false if client stops
+func (cli *Client) waitAccept() bool {
+	return cli.acceptRate.wait(cli.ctx, 1)
+}
+
+// sleep the backoff delay after a temporary accept error, false if client stops
+func (cli *Client) acceptBackoff(backoff *Backoff, err error) bool {
+	delay := backoff.Next()
+	Log("accept failed:%s, retry in %v", err.Error(), delay)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-cli.ctx.Done():
+		return false
+	}
+}
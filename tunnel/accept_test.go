@@ -0,0 +1,136 @@
+//
+//   date  : 2015-10-08
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPairMaxConns(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{MaxConns: 1})
+	first, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	io.WriteString(first, "hello")
+	if _, err := io.ReadFull(first, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := atomic.LoadInt64(&stats.AcceptRejected)
+	second, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(buf); err != io.EOF {
+		t.Fatalf("connection beyond max conns should be closed, got:%v", err)
+	}
+	if atomic.LoadInt64(&stats.AcceptRejected) != rejected+1 {
+		t.Fatal("rejected accept should be counted")
+	}
+
+	first.Close()
+	waitFor(t, "connection released", func() bool {
+		return atomic.LoadInt32(&p.client.conns) == 0
+	})
+	if echoed := p.roundTrip(t, "again"); echoed != "again" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+}
+
+func TestAcceptRate(t *testing.T) {
+	cli := &Client{ctx: context.Background(), acceptRate: newRateLimiter(10)}
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		if !cli.waitAccept() {
+			t.Fatal("wait should succeed")
+		}
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("accept beyond burst should wait, waited %v", d)
+	}
+}
+
+func TestSourceLimits(t *testing.T) {
+	now := time.Now()
+	s := newSourceLimits(2, 0)
+	if !s.acquire("10.0.0.1", now) || !s.acquire("10.0.0.1", now) || s.acquire("10.0.0.1", now) {
+		t.Fatal("connections of ip should be limited")
+	}
+	if !s.acquire("10.0.0.2", now) {
+		t.Fatal("other ip should be allowed")
+	}
+	s.release("10.0.0.1", now)
+	if !s.acquire("10.0.0.1", now) {
+		t.Fatal("released connection should be taken again")
+	}
+	s.release("10.0.0.2", now)
+	if len(s.entries) != 1 || s.conns("10.0.0.1") != 2 {
+		t.Fatalf("unexpected entries:%v", s.entries)
+	}
+
+	s = newSourceLimits(0, 2)
+	for i := 0; i < 2; i++ {
+		if !s.acquire("10.0.0.1", now) {
+			t.Fatal("burst should be allowed")
+		}
+		s.release("10.0.0.1", now)
+	}
+	if s.acquire("10.0.0.1", now) {
+		t.Fatal("connection over rate should be rejected")
+	}
+	if !s.acquire("10.0.0.1", now.Add(500*time.Millisecond)) {
+		t.Fatal("bucket should be refilled")
+	}
+	s.release("10.0.0.1", now.Add(500*time.Millisecond))
+	// idle entries are swept once buckets are full
+	if !s.acquire("10.0.0.2", now.Add(2*time.Second)) || len(s.entries) != 1 {
+		t.Fatalf("unexpected entries:%v", s.entries)
+	}
+
+	if newSourceLimits(0, 0) != nil {
+		t.Fatal("unlimited sources should be nil")
+	}
+}
+
+func TestPairMaxConnsPerIP(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{MaxConnsPerIP: 1})
+	first, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	io.WriteString(first, "hello")
+	if _, err := io.ReadFull(first, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// all pipe conns come from ip "pipe"
+	second, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(buf); err != io.EOF {
+		t.Fatalf("connection beyond max conns of ip should be closed, got:%v", err)
+	}
+
+	first.Close()
+	waitFor(t, "connection released", func() bool {
+		return p.client.sources.conns("pipe") == 0
+	})
+	if echoed := p.roundTrip(t, "again"); echoed != "again" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+}
@@ -0,0 +1,191 @@
+//
+//   date  : 2015-10-04
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default max bytes of access log file before it's rotated, and rotated
+// files kept
+const (
+	DefaultAccessLogSize    = 100 << 20
+	DefaultAccessLogBackups = 5
+)
+
+// one json line per link when it's released, for audit and billing. Up is
+// bytes from the end accepting connection to the end dialing destination
+type accessRecord struct {
+	Time     time.Time `json:"time"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // seconds
+	Side     string    `json:"side"`     // client or server
+	Client   string    `json:"client,omitempty"`
+	Service  string    `json:"service"`
+	Source   string    `json:"source,omitempty"`
+	Dest     string    `json:"dest,omitempty"`
+	Up       int64     `json:"up"`
+	Down     int64     `json:"down"`
+	Reason   string    `json:"reason"`
+}
+
+// access log writes records to a rotated file or syslog
+type accessLog struct {
+	lock sync.Mutex
+	w    io.WriteCloser
+}
+
+// target is a file path, "syslog" for local syslog, or syslog://host:port
+// for remote syslog over udp
+func openAccessLog(target string, maxSize int64, backups int) (*accessLog, error) {
+	var w io.WriteCloser
+	var err error
+	switch {
+	case target == "syslog":
+		w, err = dialSyslog("", "")
+	case strings.HasPrefix(target, "syslog://"):
+		w, err = dialSyslog("udp", strings.TrimPrefix(target, "syslog://"))
+	default:
+		w, err = openRotateFile(target, maxSize, backups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open access log %s failed: %s", target, err)
+	}
+	return &accessLog{w: w}, nil
+}
+
+func (l *accessLog) write(rec *accessRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.w.Write(data); err != nil {
+		Error("write access log failed:%v", err)
+	}
+}
+
+func (l *accessLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.w.Close()
+}
+
+// file renamed to path.1, path.2... once it would exceed maxSize, at most
+// backups of them are kept
+type rotateFile struct {
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openRotateFile(path string, maxSize int64, backups int) (*rotateFile, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultAccessLogSize
+	}
+	if backups == 0 {
+		backups = DefaultAccessLogBackups
+	} else if backups < 0 {
+		backups = 0
+	}
+	r := &rotateFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotateFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotateFile) rotate() error {
+	r.f.Close()
+	if r.backups == 0 {
+		os.Remove(r.path)
+	} else {
+		for i := r.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	}
+	return r.open()
+}
+
+// a record is never split between files
+func (r *rotateFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotateFile) Close() error {
+	return r.f.Close()
+}
+
+func (self *Hub) side() string {
+	if self.client {
+		return "client"
+	}
+	return "server"
+}
+
+// bytes of link each way, up is sent by creator of the link
+func (self *Hub) linkTraffic(link *Link) (up, down int64) {
+	sent, received := link.transferred()
+	if !self.owns(link.id) {
+		return received, sent
+	}
+	return sent, received
+}
+
+// record a released link
+func (self *Hub) logAccess(link *Link) {
+	up, down := self.linkTraffic(link)
+	now := time.Now()
+	self.access.write(&accessRecord{
+		Time:     now,
+		Start:    link.created,
+		Duration: now.Sub(link.created).Seconds(),
+		Side:     self.side(),
+		Client:   self.tunnel.identity,
+		Service:  link.service,
+		Source:   link.source,
+		Dest:     link.dest,
+		Up:       up,
+		Down:     down,
+		Reason:   link.closeReason(),
+	})
+}
@@ -0,0 +1,17 @@
+//
+//   date  : 2015-10-04
+//   author: xjdrew
+//
+
+//go:build windows || plan9
+
+package tunnel
+
+import (
+	"errors"
+	"io"
+)
+
+func dialSyslog(network, raddr string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//
+//   date  : 2015-10-04
+//   author: xjdrew
+//
+
+//go:build !windows && !plan9
+
+package tunnel
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// records are sent with info severity of local0 facility
+func dialSyslog(network, raddr string) (io.WriteCloser, error) {
+	return syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_LOCAL0, "gotunnel")
+}
@@ -0,0 +1,96 @@
+//
+//   date  : 2015-10-04
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotateFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeeeeeeeeeee\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	for name, want := range map[string]string{
+		path:        "eeeeeeeeeeee\n",
+		path + ".1": "cccc\ndddd\n",
+		path + ".2": "aaaa\nbbbb\n",
+	} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("unexpected %s:%q, want %q", name, data, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("backups should be limited:%v", err)
+	}
+}
+
+func readAccessLog(t *testing.T, path string) []accessRecord {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []accessRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec accessRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("bad record %q:%v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestPairAccessLog(t *testing.T) {
+	dir := t.TempDir()
+	serverLog, clientLog := filepath.Join(dir, "server.log"), filepath.Join(dir, "client.log")
+	p := newTestPair(t, Config{AccessLog: serverLog}, Config{AccessLog: clientLog})
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	waitFor(t, "access records", func() bool {
+		return len(readAccessLog(t, serverLog)) == 1 && len(readAccessLog(t, clientLog)) == 1
+	})
+
+	for _, c := range []struct {
+		path string
+		side string
+		dest string
+	}{
+		{serverLog, "server", testBackendAddr},
+		{clientLog, "client", ""},
+	} {
+		rec := readAccessLog(t, c.path)[0]
+		if rec.Side != c.side || rec.Dest != c.dest || rec.Source == "" || rec.Service == "" {
+			t.Fatalf("unexpected record:%+v", rec)
+		}
+		if rec.Up != 5 || rec.Down != 5 || rec.Reason != "closed" {
+			t.Fatalf("unexpected record:%+v", rec)
+		}
+		if rec.Start.After(rec.Time) || rec.Duration < 0 {
+			t.Fatalf("unexpected time:%+v", rec)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+//
+//   date  : 2015-08-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+var errACLDenied = errors.New("destination denied by acl")
+
+// destination acl rule of server, rules are checked in order and the first
+// matched one wins, destination is allowed if no rule matches.
+//
+// Dest is empty or "*" for any destination, a cidr or ip like "10.0.0.0/8",
+// or a host name pattern like "*.example.com". Ports is a comma separated
+// list of ports and ranges like "80,443,8000-8100", empty for any port.
+// Clients limits the rule to identified clients, empty for any client.
+type ACLRule struct {
+	Action  string   `json:"action"`
+	Dest    string   `json:"dest"`
+	Ports   string   `json:"ports"`
+	Clients []string `json:"clients"`
+
+	allow   bool
+	ipnet   *net.IPNet
+	pattern string
+	ports   [][2]int
+}
+
+func (r *ACLRule) String() string {
+	return fmt.Sprintf("%s %s:%s", r.Action, r.Dest, r.Ports)
+}
+
+func (r *ACLRule) init() error {
+	switch r.Action {
+	case ACLAllow:
+		r.allow = true
+	case ACLDeny:
+	default:
+		return fmt.Errorf("acl %s: unknown action", r)
+	}
+
+	dest := strings.ToLower(strings.TrimSuffix(r.Dest, "."))
+	if strings.Contains(dest, "/") {
+		_, ipnet, err := net.ParseCIDR(dest)
+		if err != nil {
+			return fmt.Errorf("acl %s: %s", r, err)
+		}
+		r.ipnet = ipnet
+	} else if ip := net.ParseIP(dest); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		r.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if dest != "*" {
+		if _, err := path.Match(dest, ""); err != nil {
+			return fmt.Errorf("acl %s: %s", r, err)
+		}
+		r.pattern = dest
+	}
+
+	if r.Ports == "" {
+		return nil
+	}
+	for _, item := range strings.Split(r.Ports, ",") {
+		lo, hi, found := strings.Cut(strings.TrimSpace(item), "-")
+		from, err := strconv.Atoi(lo)
+		if err != nil {
+			return fmt.Errorf("acl %s: bad port %s", r, item)
+		}
+		to := from
+		if found {
+			if to, err = strconv.Atoi(hi); err != nil || to < from {
+				return fmt.Errorf("acl %s: bad port %s", r, item)
+			}
+		}
+		r.ports = append(r.ports, [2]int{from, to})
+	}
+	return nil
+}
+
+// name is empty if destination is an ip address, client is empty if anonymous
+func (r *ACLRule) match(client, name string, ip net.IP, port int) bool {
+	if len(r.Clients) > 0 {
+		found := false
+		for _, c := range r.Clients {
+			if c == client {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.ports) > 0 {
+		found := false
+		for _, p := range r.ports {
+			if port >= p[0] && port <= p[1] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	switch {
+	case r.ipnet != nil:
+		return r.ipnet.Contains(ip)
+	case r.pattern != "":
+		if name == "" {
+			return false
+		}
+		ok, _ := path.Match(r.pattern, strings.ToLower(strings.TrimSuffix(name, ".")))
+		return ok
+	}
+	return true
+}
+
+type ACL []*ACLRule
+
+func (acl ACL) allow(client, name string, ip net.IP, port int) bool {
+	for _, r := range acl {
+		if r.match(client, name, ip, port) {
+			return r.allow
+		}
+	}
+	return true
+}
+
+// resolve destination by lookup and return allowed addresses, so server
+// never dials a name which resolves to a denied ip
+func (acl ACL) resolve(ctx context.Context, lookup lookupFunc, client, dest string) ([]string, error) {
+	host, p, err := net.SplitHostPort(dest)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var name string
+	if net.ParseIP(host) == nil {
+		name = host
+	}
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, ip := range ips {
+		if len(acl) == 0 || acl.allow(client, name, ip, port) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), p))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errACLDenied
+	}
+	return addrs, nil
+}
+
+func (app *App) initACL() error {
+	for _, r := range app.ACL {
+		if err := r.init(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+//
+//   date  : 2015-08-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	acl := ACL{
+		{Action: ACLDeny, Dest: "10.0.0.0/8"},
+		{Action: ACLAllow, Dest: "*.example.com", Ports: "80,443"},
+		{Action: ACLDeny, Dest: "*.example.com"},
+		{Action: ACLAllow, Dest: "192.168.1.1", Ports: "8000-8100"},
+		{Action: ACLDeny, Dest: "*"},
+	}
+	for _, r := range acl {
+		if err := r.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name  string
+		ip    string
+		port  int
+		allow bool
+	}{
+		{"www.example.com", "10.1.1.1", 80, false},
+		{"www.example.com", "1.1.1.1", 443, true},
+		{"WWW.Example.COM.", "1.1.1.1", 443, true},
+		{"www.example.com", "1.1.1.1", 22, false},
+		{"", "192.168.1.1", 8080, true},
+		{"", "192.168.1.1", 22, false},
+		{"", "::ffff:192.168.1.1", 8000, true},
+		{"", "8.8.8.8", 53, false},
+	}
+	for _, c := range cases {
+		if acl.allow("", c.name, net.ParseIP(c.ip), c.port) != c.allow {
+			t.Errorf("%s(%s):%d should be allow=%v", c.name, c.ip, c.port, c.allow)
+		}
+	}
+
+	lookup := newDNSCache(0).resolve
+	if _, err := acl.resolve(context.Background(), lookup, "", "10.0.0.1:80"); err != errACLDenied {
+		t.Fatal("unexpected err:", err)
+	}
+	if addrs, err := acl.resolve(context.Background(), lookup, "", "192.168.1.1:8000"); err != nil || addrs[0] != "192.168.1.1:8000" {
+		t.Fatal("unexpected result:", addrs, err)
+	}
+
+	office := ACL{
+		{Action: ACLAllow, Dest: "10.0.0.0/8", Clients: []string{"office"}},
+		{Action: ACLDeny, Dest: "10.0.0.0/8"},
+	}
+	for _, r := range office {
+		if err := r.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !office.allow("office", "", net.ParseIP("10.0.0.1"), 22) {
+		t.Fatal("office should be allowed")
+	}
+	for _, client := range []string{"", "home"} {
+		if office.allow(client, "", net.ParseIP("10.0.0.1"), 22) {
+			t.Fatalf("client %q should be denied", client)
+		}
+	}
+
+	bad := []*ACLRule{
+		{Action: "drop"},
+		{Action: ACLDeny, Dest: "10.0.0.0/33"},
+		{Action: ACLDeny, Ports: "90-80"},
+		{Action: ACLDeny, Dest: "[a-"},
+	}
+	for _, r := range bad {
+		if err := r.init(); err == nil {
+			t.Errorf("%s should be invalid", r)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+//
+//   date  : 2015-09-26
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// first fd passed by systemd socket activation or graceful upgrade
+const listenFdsStart = 3
+
+// count of listener fds passed to the new process by graceful upgrade,
+// unlike LISTEN_FDS the pid of child is not known before exec
+const UpgradeFdsEnv = "GOTUNNEL_LISTEN_FDS"
+
+// listeners inherited from systemd or parent process, taken by the first
+// tunnel or rule listener of the same address
+var inherited struct {
+	sync.Mutex
+	lns   []*net.TCPListener
+	conns []*net.UDPConn
+}
+
+// InheritListeners takes tcp listening sockets and udp sockets passed by
+// systemd socket activation (LISTEN_PID and LISTEN_FDS) or by the old
+// process of graceful upgrade (GOTUNNEL_LISTEN_FDS), so gotunnel could be
+// restarted without losing its ports. The variables are cleared, so they
+// are not passed to children.
+func InheritListeners() error {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	defer os.Unsetenv(UpgradeFdsEnv)
+
+	if n, err := strconv.Atoi(os.Getenv(UpgradeFdsEnv)); err == nil && n > 0 {
+		return inheritFds(listenFdsStart, n)
+	}
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	return inheritFds(listenFdsStart, n)
+}
+
+func inheritFds(start, n int) error {
+	inherited.Lock()
+	defer inherited.Unlock()
+	for fd := start; fd < start+n; fd++ {
+		f := os.NewFile(uintptr(fd), "listener:"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		if err != nil {
+			// not a stream socket, try udp
+			pc, perr := net.FilePacketConn(f)
+			f.Close()
+			if perr != nil {
+				return fmt.Errorf("inherit fd %d: %s", fd, err)
+			}
+			uc, ok := pc.(*net.UDPConn)
+			if !ok {
+				pc.Close()
+				return fmt.Errorf("inherit fd %d: not a udp socket", fd)
+			}
+			Log("inherit udp socket %v from fd %d", uc.LocalAddr(), fd)
+			inherited.conns = append(inherited.conns, uc)
+			continue
+		}
+		f.Close()
+		tl, ok := ln.(*net.TCPListener)
+		if !ok {
+			ln.Close()
+			return fmt.Errorf("inherit fd %d: not a tcp listener", fd)
+		}
+		Log("inherit listener %v from fd %d", tl.Addr(), fd)
+		inherited.lns = append(inherited.lns, tl)
+	}
+	return nil
+}
+
+// an unspecified ip matches any unspecified ip
+func sameTCPAddr(a, b *net.TCPAddr) bool {
+	if a.Port != b.Port {
+		return false
+	}
+	if len(a.IP) == 0 || a.IP.IsUnspecified() {
+		return len(b.IP) == 0 || b.IP.IsUnspecified()
+	}
+	return a.IP.Equal(b.IP)
+}
+
+// take inherited listener of addr, nil if there is none
+func takeListener(addr *net.TCPAddr) *net.TCPListener {
+	inherited.Lock()
+	defer inherited.Unlock()
+	for i, ln := range inherited.lns {
+		if sameTCPAddr(addr, ln.Addr().(*net.TCPAddr)) {
+			inherited.lns = append(inherited.lns[:i], inherited.lns[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+// listen on addr, or take the inherited listener
+func listenTCP(addr *net.TCPAddr) (net.Listener, error) {
+	if ln := takeListener(addr); ln != nil {
+		return ln, nil
+	}
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listen on udp addr, or take the inherited socket
+func listenUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	inherited.Lock()
+	for i, conn := range inherited.conns {
+		laddr := conn.LocalAddr().(*net.UDPAddr)
+		if sameTCPAddr((*net.TCPAddr)(addr), (*net.TCPAddr)(laddr)) {
+			inherited.conns = append(inherited.conns[:i], inherited.conns[i+1:]...)
+			inherited.Unlock()
+			return conn, nil
+		}
+	}
+	inherited.Unlock()
+	return net.ListenUDP("udp", addr)
+}
+
+// socket could be passed to another process
+type filer interface {
+	File() (*os.File, error)
+}
+
+// duplicate fds of listening sockets, so a new process could take them over
+// by graceful upgrade; listeners without fd, such as in-memory ones, are
+// skipped
+func listenerFiles(lns []io.Closer) ([]*os.File, error) {
+	var files []*os.File
+	for _, ln := range lns {
+		fl, ok := ln.(filer)
+		if _, unix := ln.(*net.UnixListener); !ok || unix {
+			// unix sockets are listened again by path
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
@@ -0,0 +1,51 @@
+//
+//   date  : 2015-09-26
+//   author: xjdrew
+//
+
+//go:build !windows
+
+package tunnel
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestInheritListener(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inheritFds(fd, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := ln.Addr().(*net.TCPAddr)
+	if takeListener(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: addr.Port}) != nil {
+		t.Fatal("listener of other address should not be taken")
+	}
+	inheritedLn := takeListener(addr)
+	if inheritedLn == nil {
+		t.Fatal("inherited listener should be taken")
+	}
+	defer inheritedLn.Close()
+	if takeListener(addr) != nil {
+		t.Fatal("listener should be taken once")
+	}
+
+	if !sameTCPAddr(&net.TCPAddr{Port: 80}, &net.TCPAddr{IP: net.IPv6unspecified, Port: 80}) {
+		t.Fatal("unspecified addresses should match")
+	}
+}
@@ -0,0 +1,396 @@
+//
+//   date  : 2015-08-24
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type linkStatus struct {
+	Id       uint32  `json:"id"`
+	Service  string  `json:"service"`
+	Source   string  `json:"source"`   // address of original client, empty if unknown
+	Age      float64 `json:"age"`      // seconds
+	Sent     int64   `json:"sent"`     // bytes sent to peer
+	Received int64   `json:"received"` // bytes written to local conn
+
+	// details of full snapshot
+	Dest       string    `json:"dest,omitempty"`
+	Priority   string    `json:"priority"`
+	Created    time.Time `json:"created"`
+	LastActive time.Time `json:"last_active"` // last transfer in either direction
+	Sending    bool      `json:"sending"`     // peer still accepts data
+	Buffered   int       `json:"buffered"`    // frames received but not written to local conn
+}
+
+// link ids of this end
+type linkIdStatus struct {
+	Limit  int `json:"limit"`  // ids of this end
+	Free   int `json:"free"`   // could be acquired now
+	Parked int `json:"parked"` // released here, waiting for peer to release
+}
+
+type hubStatus struct {
+	Id       uint32       `json:"id"`
+	Local    string       `json:"local"`
+	Remote   string       `json:"remote"`
+	Client   string       `json:"client"` // client id, empty if anonymous
+	Age      float64      `json:"age"`
+	Priority int          `json:"priority"` // links scheduled to the hub, client only
+	Closing  bool         `json:"closing"`
+	Read     int64        `json:"read"`    // bytes read from tunnel
+	Written  int64        `json:"written"` // bytes written to tunnel
+	Queued   int64        `json:"queued"`  // bytes of data frames waiting to be written
+	Caps     []string     `json:"caps"`    // capabilities supported by both ends
+	Resumed  int          `json:"resumed"` // times tunnel resumed over another connection
+	Links    []linkStatus `json:"links"`
+
+	// details of full snapshot
+	Created  time.Time    `json:"created"`
+	LastRecv time.Time    `json:"last_recv"` // last frame received
+	RTT      float64      `json:"rtt"`       // seconds, 0 if unknown
+	LinkIds  linkIdStatus `json:"link_ids"`
+
+	// path quality measured by heartbeats
+	SRTT     float64 `json:"srtt"` // smoothed rtt in seconds, 0 if unknown
+	Loss     float64 `json:"loss"` // smoothed ratio of pings lost or segments retransmitted
+	Degraded bool    `json:"degraded"`
+
+	Health *healthStatus `json:"health,omitempty"` // echo checks of client, nil if not checked yet
+}
+
+type reconnectEvent struct {
+	Time    time.Time `json:"time"`
+	Tunnel  int       `json:"tunnel"`
+	Attempt int       `json:"attempt"`
+	Error   string    `json:"error,omitempty"` // empty if succeed
+}
+
+type serviceStatus struct {
+	Time       time.Time        `json:"time"`
+	Role       string           `json:"role"`
+	Uptime     float64          `json:"uptime"`
+	Hubs       []hubStatus      `json:"hubs"`
+	Reconnects []reconnectEvent `json:"reconnects,omitempty"`
+	Corrupted  int64            `json:"corrupted"`         // frames failed integrity check, process wide
+	Servers    []endpointStatus `json:"servers,omitempty"` // tunnel servers of client
+	Standby    int              `json:"standby"`           // standby hubs of client
+	Goroutines int              `json:"goroutines"`
+	Pool       int32            `json:"pool"` // buffers allocated by pool
+}
+
+func (self *Hub) snapshot(priority int) hubStatus {
+	now := time.Now()
+	conn := self.tunnel.netConn()
+	status := hubStatus{
+		Id:       self.id,
+		Local:    conn.LocalAddr().String(),
+		Remote:   conn.RemoteAddr().String(),
+		Client:   self.tunnel.identity,
+		Age:      now.Sub(self.created).Seconds(),
+		Priority: priority,
+		Closing:  self.IsClosing(),
+		Read:     atomic.LoadInt64(&self.tunnel.rbytes),
+		Written:  atomic.LoadInt64(&self.tunnel.wbytes),
+		Queued:   self.tunnel.queue.size(),
+		Caps:     capsNames(self.tunnel.caps),
+		Resumed:  self.tunnel.resumedCount(),
+		Links:    []linkStatus{},
+	}
+	status.Created = self.created
+	status.LastRecv = time.Unix(0, atomic.LoadInt64(&self.lastRecv))
+	status.RTT = time.Duration(atomic.LoadInt64(&self.lastRTT)).Seconds()
+	status.LinkIds = self.idStatus()
+	srtt, loss := self.pathQuality()
+	status.SRTT = srtt.Seconds()
+	status.Loss = loss
+	status.Degraded = loss >= degradedLoss
+	status.Health = self.healthStatus()
+	for _, link := range self.activeLinks() {
+		sent, received := link.transferred()
+		ls := linkStatus{
+			Id:       link.id,
+			Service:  link.service,
+			Source:   link.source,
+			Age:      now.Sub(link.created).Seconds(),
+			Sent:     sent,
+			Received: received,
+		}
+		ls.Dest = link.dest
+		ls.Priority = priorityNames[link.priority]
+		ls.Created = link.created
+		ls.LastActive = time.Unix(0, atomic.LoadInt64(&link.lastActive))
+		ls.Sending = link.sending()
+		ls.Buffered = link.rbuf.Len()
+		status.Links = append(status.Links, ls)
+	}
+	return status
+}
+
+// full snapshot of service
+func snapshot(svc Service) *serviceStatus {
+	status := svc.status()
+	status.Time = time.Now()
+	status.Corrupted = atomic.LoadInt64(&stats.FrameCorrupted)
+	status.Goroutines = runtime.NumGoroutine()
+	status.Pool = mpool.Alloced()
+	return status
+}
+
+// write full snapshot of hubs and links as json
+func (app *App) WriteStatus(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snapshot(app.service))
+}
+
+func findHub(svc Service, id uint32) *Hub {
+	for _, hub := range svc.activeHubs() {
+		if hub.id == id {
+			return hub
+		}
+	}
+	return nil
+}
+
+// serve admin api until ctx is done:
+//
+//	GET  /status                            full snapshot of hubs, links, reconnects and uptime
+//	POST /hubs/{hub}/close                  close a hub, client will reconnect
+//	POST /hubs/{hub}/drain?timeout=secs     refuse new links of a hub, close it when its links finish
+//	POST /drain?timeout=secs                stop accepting and drain all hubs, then exit
+//	POST /hubs/{hub}/links/{link}/close     close a link
+//	GET  /bans                              source ips banned or failing handshakes, server only
+//	POST /bans/{ip}/clear                   lift ban of ip
+//	GET  /usage                             traffic and quotas of client identities, server only
+//	POST /usage/{client}/reset              count traffic of client from zero
+//	GET  /capture?hub=&link=&service=...    stream data of matching links as pcapng
+//	GET  /health                            200 if there are hubs and none failed last echo check
+func serveAdmin(ctx context.Context, addr string, svc Service) (net.Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := listenTCP(tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(snapshot(svc))
+	})
+	mux.HandleFunc("/hubs/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// hub/close, hub/drain or hub/links/link/close
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/hubs/"), "/")
+		drain := len(parts) == 2 && parts[1] == "drain"
+		if !drain && ((len(parts) != 2 && len(parts) != 4) || parts[len(parts)-1] != "close" ||
+			(len(parts) == 4 && parts[1] != "links")) {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hub := findHub(svc, uint32(id))
+		if hub == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if drain {
+			timeout, err := drainTimeout(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			hub.log.Log("drained by admin, %d links left", hub.LinkCount())
+			go hub.drainClose(timeout)
+			return
+		}
+		if len(parts) == 2 {
+			hub.log.Log("closed by admin")
+			hub.Close()
+			return
+		}
+
+		id, err = strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		link := hub.getLink(uint32(id))
+		if link == nil {
+			http.NotFound(w, r)
+			return
+		}
+		link.log.Log("closed by admin")
+		link.cancel()
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		timeout, err := drainTimeout(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Log("drained by admin, exit in %v at most", timeout)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			svc.Stop(ctx)
+		}()
+	})
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(svc.bans().list(time.Now()))
+	})
+	mux.HandleFunc("/bans/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/bans/"), "/")
+		if len(parts) != 2 || parts[1] != "clear" {
+			http.NotFound(w, r)
+			return
+		}
+		if !svc.bans().clear(parts[0]) {
+			http.NotFound(w, r)
+			return
+		}
+		Log("ban of %s cleared by admin", parts[0])
+	})
+	mux.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(svc.clientUsage().list())
+	})
+	mux.HandleFunc("/usage/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/usage/"), "/")
+		if len(parts) != 2 || parts[1] != "reset" {
+			http.NotFound(w, r)
+			return
+		}
+		if !svc.clientUsage().reset(parts[0]) {
+			http.NotFound(w, r)
+			return
+		}
+		Log("usage of client %q reset by admin", parts[0])
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		hubs := svc.activeHubs()
+		code := http.StatusOK
+		if len(hubs) == 0 {
+			code = http.StatusServiceUnavailable
+		}
+		health := make(map[uint32]*healthStatus)
+		for _, hub := range hubs {
+			h := hub.healthStatus()
+			if h != nil && !h.OK {
+				code = http.StatusServiceUnavailable
+			}
+			health[hub.id] = h
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(health)
+	})
+	mux.HandleFunc("/capture", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c, err := newLinkCapture(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Log("capture started by admin, filter:%s", r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="gotunnel.pcapng"`)
+		c.serve(r.Context(), w)
+	})
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		server.Shutdown(sctx)
+		cancel()
+	}()
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			Error("admin server quit:%v", err)
+		}
+	}()
+	Info("serve admin api on %v", ln.Addr())
+	return ln, nil
+}
+
+// replace file at once, so readers never see a partial snapshot
+func (app *App) writeStatusFile(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = app.WriteStatus(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,67 @@
+//
+//   date  : 2015-10-07
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPairStatusFile(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{})
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	io.WriteString(conn, "hello")
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// echo may come back before server counts bytes written to backend
+	waitFor(t, "bytes written", func() bool {
+		links := p.server.activeHubs()[0].activeLinks()
+		if len(links) != 1 {
+			return false
+		}
+		_, received := links[0].transferred()
+		return received == 5
+	})
+
+	app := p.server.app
+	app.service = p.server
+	app.StatusFile = filepath.Join(t.TempDir(), "status.json")
+	app.Status()
+
+	data, err := os.ReadFile(app.StatusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status serviceStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatalf("bad snapshot:%v", err)
+	}
+	if status.Role != "server" || len(status.Hubs) != 1 || status.Goroutines == 0 {
+		t.Fatalf("unexpected snapshot:%+v", status)
+	}
+	hub := status.Hubs[0]
+	if hub.LinkIds.Limit == 0 || hub.LinkIds.Free != hub.LinkIds.Limit || hub.LastRecv.IsZero() {
+		t.Fatalf("unexpected hub:%+v", hub)
+	}
+	if len(hub.Links) != 1 {
+		t.Fatalf("unexpected links:%+v", hub.Links)
+	}
+	link := hub.Links[0]
+	if link.Dest != testBackendAddr || link.Received != 5 || !link.Sending || link.LastActive.Before(link.Created) {
+		t.Fatalf("unexpected link:%+v", link)
+	}
+}
@@ -5,8 +5,17 @@
 package tunnel
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -14,34 +23,295 @@ const (
 	PacketSize       = 8192
 )
 
+// control frames usually fit the small class, data frames take PacketSize
+const smallFrameSize = 256
+
 var (
-	mpool = NewMPool(PacketSize)
+	mpool = NewMPool(smallFrameSize, PacketSize)
 )
 
 type Service interface {
-	Start() error
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
 	Wait()
 	Status()
+	activeHubs() []*Hub
+	reloadRules(added, removed []*Rule) error
+	status() *serviceStatus
+	openListeners() []io.Closer
+	bans() *banList
+	clientUsage() *usageTable
 }
 
+// run as client or server according to Tunnels
 type App struct {
-	Listen  string
-	Backend string // tunnel server or client
-	Secret  string
-	Tunnels uint // low level tunnel count; 0 if work as server
-
-	laddr   *net.TCPAddr
-	baddr   *net.TCPAddr
-	service Service
+	Config
+
+	cipher     uint8
+	compress   uint8
+	obfsKey    []byte // nil if obfuscation is disabled
+	laddr      *net.TCPAddr
+	tlsConfig  *tls.Config
+	scheme     string // tcp, ws, wss, kcp or quic
+	transport  Transport
+	tunnelAddr string // host:port of tunnel server
+	wsPath     string // websocket request path
+	rules      map[string]*Rule
+	balancer   balancer
+	bindIP     net.IP // local ip of dialed connections
+	uplinks    []*uplink
+	dns        *dnsCache
+	service    Service
+	network    *pipeNetwork // links use in-memory network instead if set, for tests
+	lock       sync.RWMutex // protect rules and ACL on reload
+
+	// host:port of tunnel servers of client, tunnelAddr first
+	servers []string
+	// ip of each server connected last time, protected by lock
+	tunnelIPs map[string]net.IP
+
+	// records of released links, nil if disabled
+	accessLog *accessLog
+	// spans of links, nil if disabled
+	tracer *tracer
+	// told about tunnels and links, nil if disabled
+	events EventHandler
+	// decides links created by peer, nil if disabled
+	policy Policy
+}
+
+// tunnel address: host:port, ws://host:port/path, wss://host:port/path,
+// kcp://host:port or quic://host:port
+func parseTunnelAddr(addr string) (scheme, host, path string, err error) {
+	if !strings.Contains(addr, "://") {
+		return "tcp", addr, "", nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return
+	}
+	if _, ok := transports[u.Scheme]; !ok {
+		err = fmt.Errorf("unknown transport: %s", u.Scheme)
+		return
+	}
+	path = u.Path
+	if path == "" {
+		path = "/"
+	}
+	return u.Scheme, u.Host, path, nil
 }
 
-func (app *App) Start() error {
+// tunnel address of server or client, client has more in Servers
+func (app *App) initTunnelAddr() error {
+	addr := app.Backend
+	if app.Tunnels == 0 {
+		addr = app.Listen
+	}
 	var err error
-	if app.laddr, err = net.ResolveTCPAddr("tcp", app.Listen); err != nil {
+	if app.scheme, app.tunnelAddr, app.wsPath, err = parseTunnelAddr(addr); err != nil {
+		return err
+	}
+	// tls of quic is part of it
+	if app.scheme == "wss" || app.scheme == "quic" {
+		app.TLS = true
+	}
+	if app.scheme == "kcp" {
+		if err = app.initKCP(); err != nil {
+			return err
+		}
+	}
+	if app.Tunnels == 0 {
+		app.laddr, err = net.ResolveTCPAddr("tcp", app.tunnelAddr)
+		return err
+	}
+
+	// client resolves server addresses when dialing
+	app.servers = []string{app.tunnelAddr}
+	for _, server := range app.Servers {
+		scheme, host, path, err := parseTunnelAddr(server)
+		if err != nil {
+			return err
+		}
+		if scheme != app.scheme || path != app.wsPath {
+			return fmt.Errorf("server %s: scheme and path differ from backend", server)
+		}
+		app.servers = append(app.servers, host)
+	}
+	for _, server := range app.servers {
+		if _, err := splitTunnelAddr(server); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate config and resolve addresses
+func (app *App) init() error {
+	if err := app.check(); err != nil {
+		return err
+	}
+	if err := loadSecrets(&app.Config); err != nil {
+		return err
+	}
+	err := app.initTunnelAddr()
+	if err != nil {
+		return err
+	}
+
+	if app.Cipher == "" {
+		app.Cipher = CipherAES256GCM
+	}
+	var ok bool
+	if app.cipher, ok = cipherSuite(app.Cipher); !ok {
+		return fmt.Errorf("unknown cipher: %s", app.Cipher)
+	}
+	if app.cipher == cipherNone && !app.TLS {
+		return fmt.Errorf("cipher %s need tls transport", app.Cipher)
+	}
+
+	if app.Compress == "" {
+		app.Compress = CompressNone
+	}
+	if app.compress, ok = compressMethod(app.Compress); !ok {
+		return fmt.Errorf("unknown compress method: %s", app.Compress)
+	}
+	if app.Obfs == "" {
+		app.Obfs = ObfsNone
+	}
+	if !obfsMode(app.Obfs) {
+		return fmt.Errorf("unknown obfs mode: %s", app.Obfs)
+	}
+	if app.Obfs != ObfsNone && app.scheme == "quic" {
+		return fmt.Errorf("obfs mode %s doesn't work with quic", app.Obfs)
+	}
+	if app.Obfs != ObfsNone {
+		key := app.ObfsKey
+		if key == "" {
+			key = app.Secret
+		}
+		app.obfsKey = obfsKey(key)
+	}
+	if app.CompressThreshold <= 0 {
+		app.CompressThreshold = DefaultCompressThreshold
+	}
+	if app.ReplayWindow <= 0 {
+		app.ReplayWindow = DefaultReplayWindow
+	}
+	if app.BanWindow <= 0 {
+		app.BanWindow = DefaultBanWindow
+	}
+	if app.BanTime <= 0 {
+		app.BanTime = DefaultBanTime
+	}
+
+	if app.DialBind != "" {
+		if app.bindIP = net.ParseIP(app.DialBind); app.bindIP == nil {
+			return fmt.Errorf("bad dial bind address: %s", app.DialBind)
+		}
+	}
+	if app.uplinks, err = parseUplinks(app.Uplinks); err != nil {
+		return err
+	}
+	if len(app.uplinks) > 0 && app.bindIP != nil {
+		return fmt.Errorf("uplinks and dial bind are exclusive")
+	}
+	if app.TOS < 0 || app.TOS > 255 {
+		return fmt.Errorf("bad tos: %d", app.TOS)
+	}
+	if app.ResolveTTL == 0 {
+		app.ResolveTTL = DefaultResolveTTL
+	}
+	app.dns = newDNSCache(time.Duration(app.ResolveTTL) * time.Second)
+
+	if app.Balance == "" {
+		app.Balance = BalanceLinks
+	}
+	switch app.Balance {
+	case BalanceRoundRobin, BalanceAffinity:
+		// spill over by links
+		app.balancer = balancers[BalanceLinks]
+	default:
+		if app.balancer, ok = balancers[app.Balance]; !ok {
+			return fmt.Errorf("unknown balance strategy: %s", app.Balance)
+		}
+	}
+
+	if app.MaxLinks < 0 || app.MaxLinks > MaxLinkLimit {
+		return fmt.Errorf("max links should be in [0, %d]", MaxLinkLimit)
+	}
+	switch app.LinkIdPolicy {
+	case "":
+		app.LinkIdPolicy = LinkIdReject
+	case LinkIdReject, LinkIdWait, LinkIdSpill, LinkIdBusy:
+	default:
+		return fmt.Errorf("unknown linkid policy: %s", app.LinkIdPolicy)
+	}
+	if app.LinkIdTimeout <= 0 {
+		app.LinkIdTimeout = DefaultLinkIdTimeout
+	}
+	if app.ScaleLinks <= 0 {
+		app.ScaleLinks = DefaultScaleLinks
+	}
+
+	if app.AccessLog != "" && app.accessLog == nil {
+		if app.accessLog, err = openAccessLog(app.AccessLog, app.AccessLogSize, app.AccessLogBackups); err != nil {
+			return err
+		}
+	}
+
+	if app.Tracing != "" && app.tracer == nil {
+		u, err := url.Parse(app.Tracing)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("bad tracing endpoint %s, expect http or https url", app.Tracing)
+		}
+		sample := app.TraceSample
+		if sample == 0 {
+			sample = 1
+		}
+		app.tracer = newTracer(app.Tracing, sample)
+	}
+
+	if app.PolicyExec != "" && app.policy == nil {
+		timeout := app.PolicyTimeout
+		if timeout <= 0 {
+			timeout = DefaultPolicyTimeout
+		}
+		if app.policy, err = newExecPolicy(app.PolicyExec, time.Duration(timeout)*time.Millisecond); err != nil {
+			return err
+		}
+	}
+
+	if err = app.initRules(); err != nil {
+		return err
+	}
+	if err = app.initACL(); err != nil {
 		return err
 	}
+	for _, q := range app.Quotas {
+		if err = q.init(); err != nil {
+			return err
+		}
+	}
 
-	if app.baddr, err = net.ResolveTCPAddr("tcp", app.Backend); err != nil {
+	if app.TLS {
+		if app.tlsConfig, err = newTLSConfig(app); err != nil {
+			return err
+		}
+	} else if app.TLSClientAuth || len(app.TLSPins) > 0 {
+		return fmt.Errorf("tls client auth and pins need tls transport")
+	}
+	// transport may be injected before init
+	if app.transport == nil {
+		app.transport = transports[app.scheme](app)
+	}
+	return nil
+}
+
+// tunnels and links are closed when ctx is done
+func (app *App) Start(ctx context.Context) error {
+	err := app.init()
+	if err != nil {
 		return err
 	}
 
@@ -50,15 +320,55 @@ func (app *App) Start() error {
 	} else {
 		app.service = newClient(app)
 	}
-	err = app.service.Start()
+	err = app.service.Start(ctx)
 	return err
 }
 
+func (app *App) heartbeat() (time.Duration, time.Duration) {
+	return time.Duration(app.Heartbeat) * time.Second, time.Duration(app.HeartbeatTimeout) * time.Second
+}
+
+func (app *App) backoff() *Backoff {
+	b := &Backoff{
+		Min: time.Duration(app.ReconnectMin) * time.Second,
+		Max: time.Duration(app.ReconnectMax) * time.Second,
+	}
+	if b.Min <= 0 {
+		b.Min = time.Second
+	}
+	if b.Max <= 0 {
+		b.Max = time.Minute
+	}
+	if b.Max < b.Min {
+		b.Max = b.Min
+	}
+	return b
+}
+
+// stop accepting, wait active links finish until ctx is done, then close all tunnels
+func (app *App) Stop(ctx context.Context) error {
+	return app.service.Stop(ctx)
+}
+
+// duplicated fds of tunnel and rule listeners, passed to the new process by
+// graceful upgrade; caller should close them
+func (app *App) ListenerFiles() ([]*os.File, error) {
+	return listenerFiles(app.service.openListeners())
+}
+
 func (app *App) Wait() {
 	app.service.Wait()
 }
 
+// log status, and write full snapshot to StatusFile if set
 func (app *App) Status() {
+	if app.StatusFile != "" {
+		if err := app.writeStatusFile(app.StatusFile); err != nil {
+			Error("write status to %s failed:%v", app.StatusFile, err)
+		} else {
+			Log("status written to %s", app.StatusFile)
+		}
+	}
 	app.service.Status()
 	LogStack("<status> num goroutine: %d, pool %d/%d/%d", runtime.NumGoroutine(), mpool.Used(), mpool.Freed(), mpool.Alloced())
 }
@@ -11,10 +11,10 @@ import (
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"hash"
-	"math/rand"
 	"time"
 )
 
@@ -62,6 +62,7 @@ type Taa struct {
 	block cipher.Block
 	mac   hash.Hash
 	token authToken
+	key   []byte // session key derivation key
 }
 
 func NewTaa(key string) *Taa {
@@ -71,16 +72,16 @@ func NewTaa(key string) *Taa {
 	return &Taa{
 		block: block,
 		mac:   mac,
+		key:   token[:],
 	}
 }
 
-func init() {
-	rand.Seed(time.Now().Unix())
-}
-
-// generate new token
+// generate new token, challenge is unpredictable so a captured token can't
+// match a future challenge
 func (a *Taa) GenToken() {
-	a.token.challenge = uint64(rand.Int63())
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	a.token.challenge = binary.LittleEndian.Uint64(nonce[:])
 	a.token.timestamp = uint64(time.Now().UnixNano())
 }
 
@@ -123,6 +124,21 @@ func (a *Taa) ExchangeCipherBlock(src []byte) ([]byte, bool) {
 	return a.GenCipherBlock(&token), true
 }
 
+// exchange cipher block signed by another secret, the result could only be
+// verified by a peer trying all its secrets
+func (a *Taa) ExchangeUnverifiedBlock(src []byte) []byte {
+	a.SetCipherBlock(src)
+	token := a.token.complement()
+	return a.GenCipherBlock(&token)
+}
+
+// take token from cipher block without checking signature
+func (a *Taa) SetCipherBlock(src []byte) {
+	dst := make([]byte, TaaTokenSize)
+	a.block.Decrypt(dst, src)
+	(&a.token).fromBytes(dst)
+}
+
 // verify cipher block
 func (a *Taa) VerifyCipherBlock(src []byte) bool {
 	if !a.CheckSignature(src) {
@@ -139,3 +155,10 @@ func (a *Taa) VerifyCipherBlock(src []byte) bool {
 func (a *Taa) GetRc4key() []byte {
 	return bytes.Repeat(a.token.toBytes(), 8)
 }
+
+// session key for aead ciphers
+func (a *Taa) GetSessionKey() []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(a.token.toBytes())
+	return mac.Sum(nil)
+}
@@ -0,0 +1,101 @@
+//
+//   date  : 2015-09-30
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// interval to check load of tunnels when autoscaling
+const scaleInterval = time.Second * 5
+
+// links per tunnel to open another one
+const DefaultScaleLinks = 256
+
+// +1 to open a tunnel, -1 to close an idle extra one, 0 to keep. A tunnel is
+// opened if links or bytes per second of n tunnels exceed thresholds, and
+// closed if n-1 tunnels would stay below half of them
+func scaleDecision(n, min, max, links int, rate int64, scaleLinks int, scaleRate int64) int {
+	if links > n*scaleLinks || (scaleRate > 0 && rate > int64(n)*scaleRate) {
+		if n < max {
+			return 1
+		}
+		return 0
+	}
+	if n > min && links*2 < (n-1)*scaleLinks && (scaleRate == 0 || rate*2 < int64(n-1)*scaleRate) {
+		return -1
+	}
+	return 0
+}
+
+// extra hub without links, nil if there is none
+func (cli *Client) idleExtraHub() *HubItem {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	for _, item := range cli.cq {
+		if item.tunnel >= int(cli.app.Tunnels) && item.LinkCount() == 0 && !item.IsClosing() {
+			return item
+		}
+	}
+	return nil
+}
+
+// open tunnels up to TunnelsMax when links or throughput of existing ones
+// cross thresholds, and close idle extra ones when load drops
+func (cli *Client) autoscale() {
+	defer cli.wg.Done()
+
+	ticker := time.NewTicker(scaleInterval)
+	defer ticker.Stop()
+	var last int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-cli.ctx.Done():
+			return
+		}
+		if cli.isStopped() {
+			return
+		}
+
+		links, bytes := 0, int64(0)
+		for _, hub := range cli.activeHubs() {
+			links += hub.LinkCount()
+			bytes += atomic.LoadInt64(&hub.tunnel.rbytes) + atomic.LoadInt64(&hub.tunnel.wbytes)
+		}
+		// bytes of closed tunnels are gone
+		rate := (bytes - last) / int64(scaleInterval/time.Second)
+		if rate < 0 {
+			rate = 0
+		}
+		last = bytes
+
+		cli.lock.Lock()
+		n := cli.running
+		cli.lock.Unlock()
+		switch scaleDecision(n, int(cli.app.Tunnels), cli.app.TunnelsMax, links, rate, cli.app.ScaleLinks, cli.app.ScaleRate) {
+		case 1:
+			cli.lock.Lock()
+			index := cli.nextTunnel
+			cli.nextTunnel++
+			cli.lock.Unlock()
+			Info("scale up to %d tunnels, links %d, rate %d", n+1, links, rate)
+			cli.startTunnel(index, make(chan error, 1))
+		case -1:
+			if hub := cli.idleExtraHub(); hub != nil {
+				Info("scale down to %d tunnels, links %d, rate %d", n-1, links, rate)
+				go func() {
+					ctx, cancel := context.WithTimeout(cli.ctx, scaleInterval)
+					defer cancel()
+					hub.Drain(ctx)
+					hub.Close()
+				}()
+			}
+		}
+	}
+}
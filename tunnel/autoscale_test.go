@@ -0,0 +1,32 @@
+//
+//   date  : 2015-09-30
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"testing"
+)
+
+func TestScaleDecision(t *testing.T) {
+	cases := []struct {
+		n, links int
+		rate     int64
+		want     int
+	}{
+		{2, 100, 0, 0},
+		{2, 201, 0, 1},
+		{4, 401, 0, 0}, // max
+		{2, 10, 350, 1},
+		{3, 20, 0, -1},
+		{3, 101, 0, 0}, // 2 tunnels would be above half
+		{3, 20, 150, 0},
+		{2, 0, 0, 0}, // min
+	}
+	for _, c := range cases {
+		if got := scaleDecision(c.n, 2, 4, c.links, c.rate, 100, 100); got != c.want {
+			t.Fatalf("scale %d tunnels of %d links, rate %d: got %d, want %d", c.n, c.links, c.rate, got, c.want)
+		}
+	}
+}
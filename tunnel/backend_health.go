@@ -0,0 +1,140 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// the end dialing backends of a rule probes them and Failover every
+// HealthCheck seconds, by tcp connect or by http GET of HealthCheckHTTP. A
+// backend failing healthFailures probes in a row is down until a probe
+// passes. Links without destination skip backends down, go to Failover if
+// all are down, and are rejected with errBackendDown if there is no healthy
+// one.
+
+var errBackendDown = errors.New("backend is down")
+
+// record result of a probe
+func (t *backendTarget) update(rule *Rule, err error) {
+	if err == nil {
+		atomic.StoreInt32(&t.failures, 0)
+		if atomic.CompareAndSwapInt32(&t.up, 0, 1) {
+			Info("rule %s: backend %s is up", rule, t.addr)
+		}
+		return
+	}
+	failures := atomic.AddInt32(&t.failures, 1)
+	Debug("rule %s: check backend %s failed %d times, err:%v", rule, t.addr, failures, err)
+	if failures >= healthFailures && atomic.CompareAndSwapInt32(&t.up, 1, 0) {
+		Error("rule %s: backend %s is down, err:%v", rule, t.addr, err)
+	}
+}
+
+// connect backend, and request HealthCheckHTTP if it's set
+func (t *backendTarget) probe(ctx context.Context, app *App, rule *Rule, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var nc net.Conn
+	var err error
+	host := t.addr
+	if path, ok := unixPath(t.addr); ok {
+		nc, err = app.dialUnix(ctx, path)
+		host = "localhost"
+	} else {
+		nc, err = app.dialLink(ctx, "tcp", t.addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(timeout))
+
+	conn := nc.(BiConn)
+	if rule.ProxyProtocol > 0 {
+		// there is no source, backend takes it as a local connection
+		if _, err := conn.Write(proxyHeader(rule.ProxyProtocol, "", nil)); err != nil {
+			return err
+		}
+	}
+	if rule.HealthCheckHTTP == "" {
+		return nil
+	}
+	if conn, err = rule.dialTLS(conn, t.addr); err != nil {
+		return err
+	}
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: gotunnel\r\nConnection: close\r\n\r\n", rule.HealthCheckHTTP, host)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("http status %s", resp.Status)
+	}
+	return nil
+}
+
+// probe all backends once
+func (p *backendPool) check(ctx context.Context, app *App, rule *Rule) {
+	targets := p.targets
+	if p.failover != nil {
+		targets = append(targets[:len(targets):len(targets)], p.failover)
+	}
+	for _, t := range targets {
+		t.update(rule, t.probe(ctx, app, rule, p.interval))
+	}
+}
+
+func (p *backendPool) runCheck(ctx context.Context, app *App, rule *Rule) {
+	defer Recover()
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.check(ctx, app, rule)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// start checking backends of rule and dialing them ahead until ctx is done
+// or it's stopped, rules dialed by the other end are skipped. It should be
+// called with lock of service held.
+func (r *Rule) startBackends(ctx context.Context, app *App) {
+	p := r.pool
+	if p == nil || (p.interval == 0 && r.BackendIdle == 0) || p.cancel != nil {
+		return
+	}
+	ctx, p.cancel = context.WithCancel(ctx)
+	if p.interval > 0 {
+		go p.runCheck(ctx, app, r)
+	}
+	for _, t := range p.targets {
+		if t.idle != nil {
+			go t.runIdle(ctx, app, r)
+		}
+	}
+}
+
+// rule is removed by reload
+func (r *Rule) stopBackends() {
+	if r.pool != nil && r.pool.cancel != nil {
+		r.pool.cancel()
+	}
+}
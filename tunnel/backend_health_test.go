@@ -0,0 +1,121 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPairBackendFailover(t *testing.T) {
+	const primaryAddr = "127.0.0.1:8005"
+	server := Config{Rules: []*Rule{{Name: "web", Backend: primaryAddr, Failover: testBackendAddr, HealthCheck: 1}}}
+	client := Config{Rules: []*Rule{{Name: "web", Listen: testListenAddr}}}
+	p := newTestPair(t, server, client)
+	app := p.server.app
+	rule := app.findRule("web")
+
+	// primary is down, links go to echo backend
+	for i := 0; i < healthFailures; i++ {
+		rule.pool.check(context.Background(), app, rule)
+	}
+	if rule.pool.targets[0].isUp() || !rule.pool.failover.isUp() {
+		t.Fatal("primary should be down")
+	}
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+
+	ln, err := p.network.Listen(primaryAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "primary")
+			conn.Close()
+		}
+	}()
+	rule.pool.check(context.Background(), app, rule)
+	if !rule.pool.targets[0].isUp() {
+		t.Fatal("primary should be up")
+	}
+	if got := p.roundTrip(t, ""); got != "primary" {
+		t.Fatalf("unexpected reply:%q", got)
+	}
+}
+
+func TestPairBackendHTTPCheck(t *testing.T) {
+	const primaryAddr = "127.0.0.1:8005"
+	server := Config{Rules: []*Rule{{Name: "web", Backend: primaryAddr, HealthCheck: 1, HealthCheckHTTP: "/healthz"}}}
+	client := Config{Rules: []*Rule{{Name: "web", Listen: testListenAddr}}}
+	p := newTestPair(t, server, client)
+	app := p.server.app
+	rule := app.findRule("web")
+
+	var status int32 = http.StatusServiceUnavailable
+	ln, err := p.network.Listen(primaryAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Host != primaryAddr {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+
+	for i := 0; i < healthFailures; i++ {
+		rule.pool.check(context.Background(), app, rule)
+	}
+	if rule.pool.targets[0].isUp() {
+		t.Fatal("backend should be down")
+	}
+	down := atomic.LoadInt64(&stats.BackendDown)
+	if got := p.roundTrip(t, "hello"); got != "" {
+		t.Fatalf("link should be rejected, got:%q", got)
+	}
+	if atomic.LoadInt64(&stats.BackendDown) != down+1 {
+		t.Fatal("rejected link should be counted")
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	rule.pool.check(context.Background(), app, rule)
+	if !rule.pool.targets[0].isUp() {
+		t.Fatal("backend should be up")
+	}
+}
+
+func TestBackendHealthConfig(t *testing.T) {
+	app := &App{Config: Config{Listen: "127.0.0.1:0", Backend: "127.0.0.1:1"}}
+	for _, rule := range []*Rule{
+		{Name: "a", Backend: "127.0.0.1:80", Failover: "127.0.0.1:81"},
+		{Name: "b", Backend: "127.0.0.1:80", HealthCheck: 1, UDP: true},
+		{Name: "c", Backend: "127.0.0.1:80", HealthCheck: 1, HealthCheckHTTP: "healthz"},
+	} {
+		if _, err := app.buildRules([]*Rule{rule}); err == nil {
+			t.Fatalf("rule %s should be rejected", rule)
+		}
+	}
+	rules, err := app.buildRules([]*Rule{{Name: "a", Backend: "127.0.0.1:80", Failover: "127.0.0.1:81", HealthCheck: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := rules["a"].pool; p.interval != time.Second || p.failover.addr != "127.0.0.1:81" || rules[""].pool.interval != 0 {
+		t.Fatalf("unexpected pool:%+v", p)
+	}
+}
@@ -0,0 +1,177 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the end dialing backends keeps BackendIdle connections of each backend
+// dialed ahead, with tls done if backend is tls, so links of protocols with
+// very short connections don't wait for the handshakes. A connection serves
+// one link and is never reused; it's closed if no link takes it in
+// backendIdleTimeout, before backends drop idle clients. Acl applies when
+// a link takes it, as it's dialed without a client identity.
+
+const (
+	backendIdleTimeout = 30 * time.Second
+	backendIdleRetry   = time.Second // min delay after dialing ahead failed
+)
+
+// backend connection dialed ahead
+type idleConn struct {
+	BiConn
+	created time.Time
+}
+
+type idlePool struct {
+	size  int
+	lock  sync.Mutex
+	conns []*idleConn // oldest first
+	wake  chan struct{}
+}
+
+func newIdlePool(size int) *idlePool {
+	return &idlePool{size: size, wake: make(chan struct{}, 1)}
+}
+
+// take the oldest connection not expired, nil if there is none
+func (p *idlePool) take(now time.Time) *idleConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for len(p.conns) > 0 {
+		c := p.conns[0]
+		p.conns = p.conns[1:]
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+		if now.Sub(c.created) < backendIdleTimeout {
+			return c
+		}
+		c.Close()
+	}
+	return nil
+}
+
+// drop expired connections, and tell how many are missing
+func (p *idlePool) expire(now time.Time) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for len(p.conns) > 0 && now.Sub(p.conns[0].created) >= backendIdleTimeout {
+		p.conns[0].Close()
+		p.conns = p.conns[1:]
+	}
+	return p.size - len(p.conns)
+}
+
+func (p *idlePool) put(c *idleConn) {
+	p.lock.Lock()
+	p.conns = append(p.conns, c)
+	p.lock.Unlock()
+}
+
+func (p *idlePool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+// connect target like a link does, without proxy protocol
+func (t *backendTarget) dialIdle(ctx context.Context, app *App, rule *Rule) (*idleConn, error) {
+	if rule.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(rule.ConnectTimeout)*time.Second)
+		defer cancel()
+	}
+	var c net.Conn
+	var err error
+	if path, ok := unixPath(t.addr); ok {
+		c, err = app.dialUnix(ctx, path)
+	} else {
+		c, err = app.dialLink(ctx, "tcp", t.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		app.tuneConn(tc)
+	}
+	conn, err := rule.dialTLS(c.(BiConn), t.addr)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &idleConn{BiConn: conn, created: time.Now()}, nil
+}
+
+// keep idle connections of target until ctx is done
+func (t *backendTarget) runIdle(ctx context.Context, app *App, rule *Rule) {
+	defer Recover()
+	defer t.idle.close()
+	backoff := Backoff{Min: backendIdleRetry, Max: backendIdleTimeout}
+	for {
+		missing := t.idle.expire(time.Now())
+		for ; missing > 0 && t.isUp(); missing-- {
+			c, err := t.dialIdle(ctx, app, rule)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				Debug("rule %s: dial backend %s ahead failed, err:%v", rule, t.addr, err)
+				break
+			}
+			backoff.Reset()
+			t.idle.put(c)
+		}
+		// wake up to expire connections, or to retry
+		delay := backendIdleTimeout / 4
+		if missing > 0 {
+			delay = backoff.Next()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-t.idle.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// take an idle connection of target allowed by acl for client, nil if
+// there is none
+func (t *backendTarget) takeIdle(acl ACL, client string) *idleConn {
+	if t.idle == nil {
+		return nil
+	}
+	c := t.idle.take(time.Now())
+	if c == nil || len(acl) == 0 {
+		return c
+	}
+	if _, ok := unixPath(t.addr); ok {
+		return c
+	}
+	host, p, _ := net.SplitHostPort(t.addr)
+	port, _ := strconv.Atoi(p)
+	if net.ParseIP(host) != nil {
+		host = ""
+	}
+	if raddr, ok := c.RemoteAddr().(*net.TCPAddr); ok && acl.allow(client, host, raddr.IP, port) {
+		return c
+	}
+	c.Close()
+	return nil
+}
@@ -0,0 +1,65 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdlePool(t *testing.T) {
+	p := newIdlePool(2)
+	now := time.Now()
+	old, _ := memPipe("a", pipeAddr("b"))
+	fresh, _ := memPipe("a", pipeAddr("b"))
+	p.put(&idleConn{BiConn: old, created: now.Add(-backendIdleTimeout)})
+	p.put(&idleConn{BiConn: fresh, created: now})
+	if missing := p.expire(now); missing != 1 || len(p.conns) != 1 {
+		t.Fatalf("expired connection should be dropped, missing:%d", missing)
+	}
+	if _, err := old.Write([]byte("x")); err == nil {
+		t.Fatal("expired connection should be closed")
+	}
+	if c := p.take(now); c == nil || c.BiConn != fresh {
+		t.Fatal("fresh connection should be taken")
+	}
+	if c := p.take(now); c != nil {
+		t.Fatal("pool should be empty")
+	}
+	select {
+	case <-p.wake:
+	default:
+		t.Fatal("filler should be woken")
+	}
+}
+
+func TestPairBackendIdle(t *testing.T) {
+	server := Config{Rules: []*Rule{{Name: "web", Backend: testBackendAddr, BackendIdle: 2}}}
+	client := Config{Rules: []*Rule{{Name: "web", Listen: testListenAddr}}}
+	p := newTestPair(t, server, client)
+	idle := p.server.app.findRule("web").pool.targets[0].idle
+	count := func() int {
+		idle.lock.Lock()
+		defer idle.lock.Unlock()
+		return len(idle.conns)
+	}
+	waitFor(t, "idle connections", func() bool { return count() == 2 })
+	idle.lock.Lock()
+	first := idle.conns[0]
+	idle.lock.Unlock()
+
+	if got := p.roundTrip(t, "hello"); got != "hello" {
+		t.Fatalf("unexpected echo:%q", got)
+	}
+	waitFor(t, "refill", func() bool { return count() == 2 })
+	idle.lock.Lock()
+	defer idle.lock.Unlock()
+	for _, c := range idle.conns {
+		if c == first {
+			t.Fatal("link should take the idle connection")
+		}
+	}
+}
@@ -0,0 +1,207 @@
+//
+//   date  : 2015-10-11
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backends of a rule on the end dialing them. Links without destination go
+// to one of Backends chosen by BackendBalance, or to Backend; a backend
+// failing to connect is skipped and the next one is tried. Names of backends
+// are resolved per link.
+
+const (
+	backendRoundRobin = "round-robin"
+	backendLeastConns = "least-conns"
+	backendWeighted   = "weighted"
+)
+
+// backend of a rule, Weight defaults to 1
+type Target struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+}
+
+type backendTarget struct {
+	addr     string // host:port with numeric port, host is resolved per link
+	weight   int
+	up       int32 // atomic, targets are up until checked down
+	failures int32 // failed checks in a row, atomic
+	conns    int32 // active links, atomic
+	current  int   // of smooth weighted round robin, protected by pool lock
+
+	idle *idlePool // connections dialed ahead, nil if disabled
+}
+
+type backendPool struct {
+	balance  string
+	targets  []*backendTarget
+	failover *backendTarget // nil if rule has no failover
+
+	lock sync.Mutex
+	next int // of round robin
+
+	// health check, disabled if interval is 0
+	interval time.Duration
+	cancel   context.CancelFunc
+}
+
+// unix socket address is kept as is
+func newBackendTarget(addr string, weight int) (*backendTarget, error) {
+	if weight == 0 {
+		weight = 1
+	}
+	if path, ok := unixPath(addr); ok {
+		if path == "" {
+			return nil, fmt.Errorf("backend %s: empty unix socket path", addr)
+		}
+		return &backendTarget{addr: addr, weight: weight, up: 1}, nil
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("tcp", p)
+	if err != nil {
+		return nil, err
+	}
+	return &backendTarget{addr: net.JoinHostPort(host, strconv.Itoa(port)), weight: weight, up: 1}, nil
+}
+
+func (t *backendTarget) isUp() bool {
+	return atomic.LoadInt32(&t.up) == 1
+}
+
+// link of target is released
+func (t *backendTarget) release() {
+	if t != nil {
+		atomic.AddInt32(&t.conns, -1)
+	}
+}
+
+// pool of Backend or Backends, and Failover
+func (r *Rule) newBackendPool() (*backendPool, error) {
+	p := &backendPool{
+		balance:  r.BackendBalance,
+		interval: time.Duration(r.HealthCheck) * time.Second,
+	}
+	targets := r.Backends
+	if len(targets) == 0 {
+		targets = []*Target{{Addr: r.Backend}}
+	}
+	for _, c := range targets {
+		if c.Weight < 0 {
+			return nil, fmt.Errorf("backend %s: negative weight", c.Addr)
+		}
+		t, err := newBackendTarget(c.Addr, c.Weight)
+		if err != nil {
+			return nil, err
+		}
+		if r.BackendIdle > 0 {
+			t.idle = newIdlePool(r.BackendIdle)
+		}
+		p.targets = append(p.targets, t)
+	}
+	if r.Failover != "" {
+		t, err := newBackendTarget(r.Failover, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failover: %s", err)
+		}
+		p.failover = t
+	}
+	return p, nil
+}
+
+func (r *Rule) hasUnixBackend() bool {
+	for _, addr := range []string{r.Backend, r.Failover} {
+		if strings.HasPrefix(addr, unixScheme) {
+			return true
+		}
+	}
+	for _, t := range r.Backends {
+		if strings.HasPrefix(t.Addr, unixScheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func targetsEqual(a, b []*Target) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func targetTried(tried []*backendTarget, t *backendTarget) bool {
+	for _, o := range tried {
+		if o == t {
+			return true
+		}
+	}
+	return false
+}
+
+// choose an up target not tried yet, failover if none, nil if there is
+// nothing left to try. The target counts a link until it's released.
+func (p *backendPool) pick(tried []*backendTarget) *backendTarget {
+	p.lock.Lock()
+	var candidates []*backendTarget
+	for _, t := range p.targets {
+		if t.isUp() && !targetTried(tried, t) {
+			candidates = append(candidates, t)
+		}
+	}
+
+	var best *backendTarget
+	switch {
+	case len(candidates) == 0:
+	case p.balance == backendLeastConns:
+		for _, t := range candidates {
+			if best == nil || atomic.LoadInt32(&t.conns) < atomic.LoadInt32(&best.conns) {
+				best = t
+			}
+		}
+	case p.balance == backendWeighted:
+		// smooth weighted round robin of nginx
+		total := 0
+		for _, t := range candidates {
+			t.current += t.weight
+			total += t.weight
+			if best == nil || t.current > best.current {
+				best = t
+			}
+		}
+		best.current -= total
+	default:
+		best = candidates[p.next%len(candidates)]
+		p.next++
+	}
+	p.lock.Unlock()
+
+	if best == nil {
+		if p.failover == nil || !p.failover.isUp() || targetTried(tried, p.failover) {
+			return nil
+		}
+		atomic.AddInt64(&stats.Failovers, 1)
+		best = p.failover
+	}
+	atomic.AddInt32(&best.conns, 1)
+	return best
+}
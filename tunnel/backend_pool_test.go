@@ -0,0 +1,100 @@
+//
+//   date  : 2015-10-11
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func testBackendPool(t *testing.T, balance string, targets ...*Target) *backendPool {
+	rule := &Rule{Backends: targets, BackendBalance: balance, Failover: "127.0.0.1:9"}
+	p, err := rule.newBackendPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// addresses of n picks, links are released at once
+func pickAddrs(p *backendPool, n int) []string {
+	var addrs []string
+	for i := 0; i < n; i++ {
+		target := p.pick(nil)
+		addrs = append(addrs, target.addr)
+		target.release()
+	}
+	return addrs
+}
+
+func TestBackendPoolPick(t *testing.T) {
+	a, b, c := &Target{Addr: "127.0.0.1:1"}, &Target{Addr: "127.0.0.1:2", Weight: 2}, &Target{Addr: "127.0.0.1:3"}
+
+	p := testBackendPool(t, "", a, b, c)
+	if addrs := pickAddrs(p, 4); addrs[0] != a.Addr || addrs[1] != b.Addr || addrs[2] != c.Addr || addrs[3] != a.Addr {
+		t.Fatalf("unexpected round robin:%v", addrs)
+	}
+
+	p = testBackendPool(t, backendWeighted, a, b, c)
+	count := make(map[string]int)
+	for _, addr := range pickAddrs(p, 8) {
+		count[addr]++
+	}
+	if count[a.Addr] != 2 || count[b.Addr] != 4 || count[c.Addr] != 2 {
+		t.Fatalf("unexpected weighted picks:%v", count)
+	}
+
+	p = testBackendPool(t, backendLeastConns, a, b, c)
+	first := p.pick(nil)
+	second := p.pick(nil)
+	if first.addr != a.Addr || second.addr != b.Addr {
+		t.Fatalf("unexpected least conns:%s, %s", first.addr, second.addr)
+	}
+	first.release()
+	if target := p.pick(nil); target.addr != a.Addr {
+		t.Fatalf("released target should be picked, got:%s", target.addr)
+	}
+
+	// down and tried targets are skipped, failover is the last resort
+	p = testBackendPool(t, "", a, b)
+	p.targets[0].up = 0
+	if target := p.pick(nil); target.addr != b.Addr {
+		t.Fatalf("down target picked:%s", target.addr)
+	}
+	target := p.pick([]*backendTarget{p.targets[1]})
+	if target != p.failover {
+		t.Fatalf("failover should be picked, got:%v", target)
+	}
+	if target := p.pick([]*backendTarget{p.targets[1], p.failover}); target != nil {
+		t.Fatalf("nothing should be left, got:%s", target.addr)
+	}
+}
+
+func TestPairBackends(t *testing.T) {
+	// first backend isn't listened, links retry the echo backend
+	backends := []*Target{{Addr: "127.0.0.1:8005"}, {Addr: testBackendAddr}}
+	server := Config{Rules: []*Rule{{Name: "web", Backends: backends}}}
+	client := Config{Rules: []*Rule{{Name: "web", Listen: testListenAddr}}}
+	p := newTestPair(t, server, client)
+	for i := 0; i < 3; i++ {
+		if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+			t.Fatalf("unexpected echo:%q", echoed)
+		}
+	}
+	pool := p.server.app.findRule("web").pool
+	waitFor(t, "links released", func() bool { return atomic.LoadInt32(&pool.targets[1].conns) == 0 })
+
+	app := &App{Config: Config{Listen: "127.0.0.1:0", Backend: "127.0.0.1:1"}}
+	for _, rule := range []*Rule{
+		{Name: "a", Backend: "127.0.0.1:80", Backends: backends},
+		{Name: "b", Backends: backends, BackendBalance: "random"},
+		{Name: "c", Backends: []*Target{{Addr: "127.0.0.1:80", Weight: -1}}},
+	} {
+		if _, err := app.buildRules([]*Rule{rule}); err == nil {
+			t.Fatalf("rule %s should be rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+//
+//   date  : 2015-07-20
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"math/rand"
+	"time"
+)
+
+// exponential backoff with jitter, delay is in [d/2, d) where d doubles every attempt until Max
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	attempt uint
+}
+
+func (b *Backoff) Next() time.Duration {
+	d := b.Min
+	for i := uint(0); i < b.attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.attempt += 1
+
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// failed attempts since last reset
+func (b *Backoff) Attempt() int {
+	return int(b.attempt)
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
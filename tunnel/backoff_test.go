@@ -0,0 +1,31 @@
+//
+//   date  : 2015-07-20
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: time.Second * 10}
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, e := range expected {
+		d := b.Next()
+		e *= time.Second
+		if d < e/2 || d >= e {
+			t.Errorf("attempt %d: unexpected delay %v, want [%v, %v)", i, d, e/2, e)
+		}
+	}
+	if b.Attempt() != len(expected) {
+		t.Errorf("unexpected attempt:%d", b.Attempt())
+	}
+
+	b.Reset()
+	if d := b.Next(); d >= time.Second {
+		t.Errorf("unexpected delay after reset:%v", d)
+	}
+}
@@ -0,0 +1,148 @@
+//
+//   date  : 2015-09-16
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"hash/fnv"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// hub selection strategies of client
+const (
+	BalanceLinks      = "links"       // fewest links scheduled
+	BalanceThroughput = "throughput"  // fewest bytes transferred recently
+	BalanceRTT        = "rtt"         // lowest smoothed heartbeat rtt weighted by links scheduled
+	BalanceRoundRobin = "round-robin" // next tunnel in turn
+	BalanceAffinity   = "affinity"    // same tunnel for the same source ip while it's alive
+)
+
+// cost of scheduling a new link to hub, the cheapest hub is chosen
+type balancer func(item *HubItem) float64
+
+var balancers = map[string]balancer{
+	BalanceLinks: func(item *HubItem) float64 {
+		return float64(item.priority)
+	},
+	BalanceThroughput: func(item *HubItem) float64 {
+		return item.throughput()
+	},
+	BalanceRTT: func(item *HubItem) float64 {
+		return float64(item.rtt()) * float64(item.priority+1)
+	},
+}
+
+// pick the cheapest hub except skip, ties are broken by links scheduled.
+// Hubs over degraded paths are picked only if all are degraded, and
+// draining ones if all are draining
+func pickHub(hubs []*HubItem, cost balancer, skip ...*HubItem) *HubItem {
+	var best *HubItem
+	var bestCost float64
+	var bestRank int
+	for _, item := range hubs {
+		if containsHub(skip, item) {
+			continue
+		}
+		c := cost(item)
+		rank := 0
+		if item.IsClosing() {
+			rank = 2
+		} else if item.degraded() {
+			rank = 1
+		}
+		if best == nil || rank < bestRank ||
+			rank == bestRank && (c < bestCost || (c == bestCost && item.priority < best.priority)) {
+			best, bestCost, bestRank = item, c, rank
+		}
+	}
+	return best
+}
+
+func containsHub(hubs []*HubItem, item *HubItem) bool {
+	for _, hub := range hubs {
+		if hub == item {
+			return true
+		}
+	}
+	return false
+}
+
+// the first tunnel after last in index order, closing hubs are skipped
+func roundRobinHub(hubs []*HubItem, last int) *HubItem {
+	var next, first *HubItem
+	for _, item := range hubs {
+		if item.IsClosing() {
+			continue
+		}
+		if first == nil || item.tunnel < first.tunnel {
+			first = item
+		}
+		if item.tunnel > last && (next == nil || item.tunnel < next.tunnel) {
+			next = item
+		}
+	}
+	if next == nil {
+		return first
+	}
+	return next
+}
+
+// rendezvous hashing of source ip and tunnel index, so only sources of a
+// broken tunnel move to others, and they move back after reconnecting
+func affinityHub(hubs []*HubItem, src net.Addr) *HubItem {
+	key := src.String()
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+
+	var best *HubItem
+	var bestWeight uint32
+	for _, item := range hubs {
+		if item.IsClosing() {
+			continue
+		}
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		h.Write([]byte(strconv.Itoa(item.tunnel)))
+		if weight := h.Sum32(); best == nil || weight > bestWeight {
+			best, bestWeight = item, weight
+		}
+	}
+	return best
+}
+
+// throughput is sampled at most once per interval, and smoothed by ewma
+const throughputInterval = time.Second
+
+// bytes per second read and written recently
+func (self *Hub) throughput() float64 {
+	self.load.Lock()
+	defer self.load.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(self.load.sampled)
+	if elapsed < throughputInterval {
+		return self.load.rate
+	}
+	bytes := atomic.LoadInt64(&self.tunnel.rbytes) + atomic.LoadInt64(&self.tunnel.wbytes)
+	if !self.load.sampled.IsZero() {
+		current := float64(bytes-self.load.bytes) / elapsed.Seconds()
+		self.load.rate = (self.load.rate + current) / 2
+	}
+	self.load.sampled = now
+	self.load.bytes = bytes
+	return self.load.rate
+}
+
+// smoothed rtt of heartbeats, or rtt of the last, 0 if heartbeat is disabled
+func (self *Hub) rtt() time.Duration {
+	if srtt, _ := self.pathQuality(); srtt != 0 {
+		return srtt
+	}
+	return time.Duration(atomic.LoadInt64(&self.lastRTT))
+}
@@ -0,0 +1,90 @@
+//
+//   date  : 2015-09-16
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPickHub(t *testing.T) {
+	hubs := []*HubItem{
+		{Hub: &Hub{lastRTT: int64(time.Millisecond * 5)}, priority: 2},
+		{Hub: &Hub{lastRTT: int64(time.Millisecond * 50)}, priority: 1},
+		{Hub: &Hub{lastRTT: int64(time.Millisecond * 30)}, priority: 0},
+	}
+	hubs[0].load.rate = 100
+	hubs[1].load.rate = 10
+	hubs[2].load.rate = 10
+	for _, h := range hubs {
+		h.load.sampled = time.Now()
+	}
+
+	cases := []struct {
+		strategy string
+		skip     *HubItem
+		want     *HubItem
+	}{
+		{BalanceLinks, nil, hubs[2]},
+		{BalanceLinks, hubs[2], hubs[1]},
+		{BalanceThroughput, nil, hubs[2]},
+		{BalanceThroughput, hubs[2], hubs[1]},
+		{BalanceRTT, nil, hubs[0]},
+		{BalanceRTT, hubs[0], hubs[2]},
+	}
+	for _, c := range cases {
+		if got := pickHub(hubs, balancers[c.strategy], c.skip); got != c.want {
+			t.Errorf("%s: unexpected hub %d", c.strategy, got.priority)
+		}
+	}
+	if pickHub(hubs[:1], balancers[BalanceLinks], hubs[0]) != nil {
+		t.Error("no hub should be picked")
+	}
+}
+
+func TestRoundRobinAffinity(t *testing.T) {
+	var hubs []*HubItem
+	for i := 0; i < 3; i++ {
+		hubs = append(hubs, &HubItem{Hub: &Hub{}, tunnel: 2 - i})
+	}
+
+	last := -1
+	for i := 0; i < 6; i++ {
+		item := roundRobinHub(hubs, last)
+		if item.tunnel != i%3 {
+			t.Fatalf("round %d: unexpected tunnel %d", i, item.tunnel)
+		}
+		last = item.tunnel
+	}
+	hubs[1].closing = true
+	if item := roundRobinHub(hubs, 0); item.tunnel != 2 {
+		t.Fatalf("closing hub should be skipped:%d", item.tunnel)
+	}
+	hubs[1].closing = false
+
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1000}
+	item := affinityHub(hubs, src)
+	src.Port = 2000
+	if affinityHub(hubs, src) != item {
+		t.Fatal("same source ip should use the same hub")
+	}
+	// only sources of the removed hub move
+	var rest []*HubItem
+	for _, h := range hubs {
+		if h != item {
+			rest = append(rest, h)
+		}
+	}
+	moved := affinityHub(rest, src)
+	other := rest[0]
+	if moved == other {
+		other = rest[1]
+	}
+	if affinityHub([]*HubItem{moved, other}, src) != moved {
+		t.Fatal("affinity should be stable")
+	}
+}
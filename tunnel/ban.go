@@ -0,0 +1,154 @@
+//
+//   date  : 2015-10-02
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// default window of counting failed handshakes and time of a ban, in seconds
+const (
+	DefaultBanWindow = 60
+	DefaultBanTime   = 600
+)
+
+type banEntry struct {
+	failures int       // failed handshakes in window
+	first    time.Time // first failure of window
+	until    time.Time // banned until, zero if not banned
+}
+
+type banStatus struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until,omitempty"` // zero if not banned yet
+}
+
+// failed handshakes of source ips on tunnel listener, an ip failing threshold
+// times in window is banned for a while, and its connections are closed
+// before handshake; nil disables it
+type banList struct {
+	sync.Mutex
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	entries   map[string]*banEntry
+	swept     time.Time
+}
+
+func newBanList(threshold int, window, duration time.Duration) *banList {
+	if threshold <= 0 {
+		return nil
+	}
+	return &banList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		entries:   make(map[string]*banEntry),
+	}
+}
+
+// ip of tcp address, or address itself such as pipe
+func sourceIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// should be called with lock held
+func (b *banList) expired(e *banEntry, now time.Time) bool {
+	if !e.until.IsZero() {
+		return now.After(e.until)
+	}
+	return now.Sub(e.first) > b.window
+}
+
+func (b *banList) banned(ip string, now time.Time) bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	e := b.entries[ip]
+	return e != nil && !e.until.IsZero() && now.Before(e.until)
+}
+
+// count a failed handshake, return true if ip is banned by it
+func (b *banList) fail(ip string, now time.Time) bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	if now.Sub(b.swept) > b.window {
+		for key, e := range b.entries {
+			if b.expired(e, now) {
+				delete(b.entries, key)
+			}
+		}
+		b.swept = now
+	}
+
+	e := b.entries[ip]
+	if e == nil || b.expired(e, now) {
+		e = &banEntry{first: now}
+		b.entries[ip] = e
+	}
+	e.failures++
+	if e.failures >= b.threshold && e.until.IsZero() {
+		e.until = now.Add(b.duration)
+		return true
+	}
+	return false
+}
+
+// forget failures of ip after it's authenticated, a ban is kept
+func (b *banList) succeed(ip string) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if e := b.entries[ip]; e != nil && e.until.IsZero() {
+		delete(b.entries, ip)
+	}
+}
+
+// lift ban and forget failures of ip, false if it's unknown
+func (b *banList) clear(ip string) bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.entries[ip]; !ok {
+		return false
+	}
+	delete(b.entries, ip)
+	return true
+}
+
+// ips banned or failed in window, sorted by ip
+func (b *banList) list(now time.Time) []banStatus {
+	bans := []banStatus{}
+	if b == nil {
+		return bans
+	}
+	b.Lock()
+	defer b.Unlock()
+	for ip, e := range b.entries {
+		if b.expired(e, now) {
+			continue
+		}
+		bans = append(bans, banStatus{IP: ip, Failures: e.failures, Until: e.until})
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
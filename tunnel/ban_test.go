@@ -0,0 +1,44 @@
+//
+//   date  : 2015-10-02
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	b := newBanList(2, time.Minute, time.Hour)
+	now := time.Now()
+	if b.fail("1.1.1.1", now) || b.banned("1.1.1.1", now) {
+		t.Fatal("one failure should not ban")
+	}
+	if !b.fail("1.1.1.1", now) || !b.banned("1.1.1.1", now) {
+		t.Fatal("ip should be banned at threshold")
+	}
+	if b.banned("1.1.1.1", now.Add(time.Hour*2)) {
+		t.Fatal("ban should expire")
+	}
+
+	// failures out of window are forgotten, and by success
+	b.fail("2.2.2.2", now)
+	if b.fail("2.2.2.2", now.Add(time.Minute*2)) {
+		t.Fatal("failures out of window should be forgotten")
+	}
+	b.succeed("2.2.2.2")
+	if bans := b.list(now); len(bans) != 1 || bans[0].IP != "1.1.1.1" || bans[0].Failures != 2 {
+		t.Fatalf("unexpected bans:%v", bans)
+	}
+
+	if !b.clear("1.1.1.1") || b.banned("1.1.1.1", now) || b.clear("1.1.1.1") {
+		t.Fatal("ban should be cleared once")
+	}
+
+	var disabled *banList
+	if disabled.fail("1.1.1.1", now) || disabled.banned("1.1.1.1", now) || len(disabled.list(now)) != 0 {
+		t.Fatal("nil ban list should be disabled")
+	}
+}
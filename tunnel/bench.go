@@ -0,0 +1,215 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// bench measures tunnels of a client against EchoService of server: rtt of
+// small messages on an idle link of each hub, then throughput of parallel
+// links spread over hubs
+
+const (
+	DefaultBenchLinks    = 4
+	DefaultBenchDuration = 10 * time.Second
+	DefaultBenchSize     = 16 * 1024
+	DefaultBenchPings    = 20
+
+	benchPingSize = 64
+)
+
+var errBenchEcho = errors.New("server doesn't serve echo, upgrade it")
+
+type BenchOptions struct {
+	Links    int           // parallel links sending data
+	Duration time.Duration // time of sending data
+	Size     int           // bytes of each write
+	Pings    int           // rtt samples of each hub
+}
+
+type BenchHub struct {
+	Id    uint32        `json:"id"`
+	Links int           `json:"links"`
+	Bytes int64         `json:"bytes"` // echoed
+	RTT   time.Duration `json:"rtt"`   // median
+}
+
+type BenchResult struct {
+	Duration   time.Duration   `json:"duration"`
+	Bytes      int64           `json:"bytes"`      // echoed by all links
+	Throughput float64         `json:"throughput"` // echoed bytes per second
+	RTT        []time.Duration `json:"rtt"`        // sorted samples of all hubs
+	Hubs       []BenchHub      `json:"hubs"`
+	Fairness   float64         `json:"fairness"` // jain's index of bytes per link of hubs, 1 is fair
+}
+
+// rtt at percentile p of 100
+func (r *BenchResult) Percentile(p int) time.Duration {
+	if len(r.RTT) == 0 {
+		return 0
+	}
+	i := (len(r.RTT)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return r.RTT[i]
+}
+
+func (r *BenchResult) WriteTo(w io.Writer) (int64, error) {
+	var b []byte
+	b = fmt.Appendf(b, "throughput: %.2f MB/s, %d bytes echoed in %v\n", r.Throughput/1e6, r.Bytes, r.Duration.Round(time.Millisecond))
+	b = fmt.Appendf(b, "rtt: min %v, p50 %v, p90 %v, p99 %v, max %v, %d samples\n",
+		r.Percentile(0), r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100), len(r.RTT))
+	for _, hub := range r.Hubs {
+		b = fmt.Appendf(b, "hub %d: %d links, %.2f MB/s, rtt %v\n", hub.Id, hub.Links, float64(hub.Bytes)/r.Duration.Seconds()/1e6, hub.RTT)
+	}
+	b = fmt.Appendf(b, "fairness: %.3f\n", r.Fairness)
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// rtt samples of an idle link
+func benchPing(hub *Hub, n int) ([]time.Duration, error) {
+	conn := hub.echoLink("bench")
+	defer conn.Close()
+	msg := make([]byte, benchPingSize)
+	reply := make([]byte, benchPingSize)
+	var rtts []time.Duration
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		if _, err := conn.Write(msg); err != nil {
+			return nil, errBenchEcho
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, errBenchEcho
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	return rtts, nil
+}
+
+// send data until deadline, return bytes echoed
+func benchSend(hub *Hub, size int, deadline time.Time) int64 {
+	conn := hub.echoLink("bench")
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, size)
+		for time.Now().Before(deadline) {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+		conn.CloseWrite()
+	}()
+	n, _ := io.Copy(io.Discard, conn)
+	return n
+}
+
+func jainIndex(xs []float64) float64 {
+	var sum, sq float64
+	for _, x := range xs {
+		sum += x
+		sq += x * x
+	}
+	if sq == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(xs)) * sq)
+}
+
+func (opts *BenchOptions) setDefaults() {
+	if opts.Links <= 0 {
+		opts.Links = DefaultBenchLinks
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = DefaultBenchDuration
+	}
+	if opts.Size <= 0 {
+		opts.Size = DefaultBenchSize
+	}
+	if opts.Pings <= 0 {
+		opts.Pings = DefaultBenchPings
+	}
+}
+
+// connect tunnels as client, measure them and stop. Rules aren't listened.
+func (app *App) Bench(ctx context.Context, opts BenchOptions) (*BenchResult, error) {
+	opts.setDefaults()
+	if app.Tunnels == 0 {
+		return nil, errors.New("bench runs as client, tunnels should be positive")
+	}
+	if err := app.init(); err != nil {
+		return nil, err
+	}
+	app.rules = nil
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cli := newClient(app)
+	app.service = cli
+	if err := cli.Start(ctx); err != nil {
+		return nil, err
+	}
+	defer cli.Wait()
+	defer cancel()
+
+	hubs := cli.activeHubs()
+	if len(hubs) == 0 {
+		return nil, errors.New("no active tunnel")
+	}
+	result := &BenchResult{}
+	for _, hub := range hubs {
+		if !hub.tunnel.has(capEcho) {
+			return nil, errBenchEcho
+		}
+		rtts, err := benchPing(hub, opts.Pings)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		result.Hubs = append(result.Hubs, BenchHub{Id: hub.id, RTT: rtts[len(rtts)/2]})
+		result.RTT = append(result.RTT, rtts...)
+	}
+	sort.Slice(result.RTT, func(i, j int) bool { return result.RTT[i] < result.RTT[j] })
+
+	// links are spread over hubs in turn
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	start := time.Now()
+	deadline := start.Add(opts.Duration)
+	for i := 0; i < opts.Links; i++ {
+		h := &result.Hubs[i%len(hubs)]
+		h.Links++
+		wg.Add(1)
+		go func(hub *Hub) {
+			defer wg.Done()
+			n := benchSend(hub, opts.Size, deadline)
+			lock.Lock()
+			h.Bytes += n
+			lock.Unlock()
+		}(hubs[i%len(hubs)])
+	}
+	wg.Wait()
+	result.Duration = time.Since(start)
+
+	var perLink []float64
+	for _, h := range result.Hubs {
+		result.Bytes += h.Bytes
+		if h.Links > 0 {
+			perLink = append(perLink, float64(h.Bytes)/float64(h.Links))
+		}
+	}
+	result.Throughput = float64(result.Bytes) / result.Duration.Seconds()
+	result.Fairness = jainIndex(perLink)
+	return result, nil
+}
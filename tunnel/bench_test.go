@@ -0,0 +1,42 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPairBench(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{})
+	app := newTestApp(t, p.network, Config{Backend: testTunnelAddr, Listen: "127.0.0.1:8007", Tunnels: 2, Secret: "test secret"})
+	result, err := app.Bench(context.Background(), BenchOptions{Links: 4, Duration: time.Millisecond * 100, Size: 1024, Pings: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Hubs) != 2 || result.Bytes == 0 || len(result.RTT) != 10 || result.Fairness <= 0 || result.Fairness > 1 {
+		t.Fatalf("unexpected result:%+v", result)
+	}
+	for _, hub := range result.Hubs {
+		if hub.Links != 2 || hub.Bytes == 0 {
+			t.Fatalf("unexpected hub:%+v", hub)
+		}
+	}
+	var b bytes.Buffer
+	result.WriteTo(&b)
+	if !strings.Contains(b.String(), "fairness") {
+		t.Fatalf("unexpected report:%s", b.String())
+	}
+}
+
+func TestJainIndex(t *testing.T) {
+	if jainIndex([]float64{1, 1, 1}) != 1 || jainIndex([]float64{1, 0}) != 0.5 {
+		t.Fatal("unexpected fairness")
+	}
+}
@@ -0,0 +1,107 @@
+//
+//   date  : 2015-09-30
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// capabilities exchanged in handshake since version 4, a feature is used
+// only if both ends support it. Unknown bits are ignored, so newer peers keep
+// working with older ones instead of sending frames they can't parse.
+const (
+	capFlowControl uint32 = 1 << iota // LINK_WINDOW
+	capHeartbeat                      // TUNNEL_PING and TUNNEL_PONG
+	capUDP                            // links relayed to udp backends
+	capResume                         // TUNNEL_ACK and resume message after key exchange
+	capLinkRelease                    // LINK_RELEASE
+	capCloseCode                      // LINK_CONNECTED and code of LINK_CLOSE
+	capLinkId32                       // 32 bit link ids with generation of slot
+	capPlainFrame                     // plain aead frames for data of nocrypt links
+	capEcho                           // server serves EchoService
+	capDrain                          // TUNNEL_DRAIN
+	capEarlyData                      // link data in LINK_CREATE args
+	capTicket                         // ticket message after key exchange
+	capRekey                          // TUNNEL_REKEY
+)
+
+// capabilities of this build
+const localCaps = capFlowControl | capHeartbeat | capUDP | capLinkRelease | capCloseCode | capLinkId32 | capPlainFrame | capEcho | capDrain | capEarlyData | capRekey
+
+// peers before handshake version 4 don't tell, they were built with all of
+// these
+const legacyCaps = capFlowControl | capHeartbeat | capUDP
+
+var capNames = []struct {
+	cap  uint32
+	name string
+}{
+	{capFlowControl, "flow-control"},
+	{capHeartbeat, "heartbeat"},
+	{capUDP, "udp"},
+	{capResume, "resume"},
+	{capLinkRelease, "link-release"},
+	{capCloseCode, "close-code"},
+	{capLinkId32, "linkid32"},
+	{capPlainFrame, "plain-frame"},
+	{capEcho, "echo"},
+	{capDrain, "drain"},
+	{capEarlyData, "early-data"},
+	{capTicket, "ticket"},
+	{capRekey, "rekey"},
+}
+
+// capabilities advertised in handshake, resumption and tickets are optional
+func (app *App) localCaps() uint32 {
+	caps := localCaps
+	if app.Resume > 0 {
+		caps |= capResume
+	}
+	if app.Ticket > 0 {
+		caps |= capTicket
+	}
+	return caps
+}
+
+func capsNames(caps uint32) []string {
+	names := []string{}
+	for _, c := range capNames {
+		if caps&c.cap != 0 {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+func capsString(caps uint32) string {
+	return strings.Join(capsNames(caps), ",")
+}
+
+// capabilities message: 1 byte length, bitmask in little endian; peers may
+// send a longer bitmask
+func capsMessage(caps uint32) []byte {
+	msg := make([]byte, 5)
+	msg[0] = 4
+	binary.LittleEndian.PutUint32(msg[1:], caps)
+	return msg
+}
+
+// read capabilities message of peer, return the message for transcript
+func readCaps(rd io.Reader) (uint32, []byte, error) {
+	msg, err := readMessage(rd)
+	if err != nil {
+		return 0, nil, err
+	}
+	var mask [4]byte
+	copy(mask[:], msg[1:])
+	return binary.LittleEndian.Uint32(mask[:]), msg, nil
+}
+
+func (t *Tunnel) has(cap uint32) bool {
+	return t.caps&cap != 0
+}
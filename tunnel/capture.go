@@ -0,0 +1,203 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// admin captures decrypted data of links matching a filter as pcapng, each
+// link is a synthetic tcp connection between its source and destination.
+// Links never wait for a capture, packets are dropped if admin client reads
+// slowly.
+
+const (
+	captureQueue    = 256
+	captureMaxBytes = 16 << 20 // default bounds of a capture
+	captureDuration = time.Minute
+)
+
+type captureFilter struct {
+	hub, link  uint32 // 0 for any
+	service    string
+	hasService bool   // default rule has empty name
+	source     string // ip or ip:port
+	dest       string // host or host:port
+}
+
+func addrMatch(pattern, addr string) bool {
+	if pattern == "" || pattern == addr {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && host == pattern
+}
+
+func (f *captureFilter) match(link *Link) bool {
+	return (f.hub == 0 || f.hub == link.hub.id) && (f.link == 0 || f.link == link.id) &&
+		(!f.hasService || f.service == link.service) &&
+		addrMatch(f.source, link.source) && addrMatch(f.dest, link.dest)
+}
+
+type capturedPacket struct {
+	t       time.Time
+	pkts    [][]byte
+	comment string
+}
+
+type linkCapture struct {
+	filter   captureFilter
+	maxBytes int64
+	duration time.Duration
+
+	packets chan capturedPacket
+	dropped int64 // atomic
+
+	lock    sync.Mutex
+	streams map[*Link]*tcpStream
+}
+
+// active captures, links skip capturing if there is none
+var captures struct {
+	sync.RWMutex
+	active int32 // atomic
+	list   []*linkCapture
+}
+
+// capture of query: hub, link, service, source, dest, max_bytes and duration
+func newLinkCapture(q url.Values) (*linkCapture, error) {
+	c := &linkCapture{
+		maxBytes: captureMaxBytes,
+		duration: captureDuration,
+		packets:  make(chan capturedPacket, captureQueue),
+		streams:  make(map[*Link]*tcpStream),
+	}
+	f := &c.filter
+	for key, ptr := range map[string]*uint32{"hub": &f.hub, "link": &f.link} {
+		if v := q.Get(key); v != "" {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s:%s", key, v)
+			}
+			*ptr = uint32(id)
+		}
+	}
+	f.service, f.source, f.dest = q.Get("service"), q.Get("source"), q.Get("dest")
+	_, f.hasService = q["service"]
+	if v := q.Get("max_bytes"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad max_bytes:%s", v)
+		}
+		c.maxBytes = n
+	}
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad duration:%s", v)
+		}
+		c.duration = d
+	}
+	return c, nil
+}
+
+// data of link, out if it's read from local conn. Local conn of the end
+// dialing backend is the server of the synthetic connection.
+func (self *Link) capture(out bool, data []byte) {
+	if atomic.LoadInt32(&captures.active) == 0 || len(data) == 0 {
+		return
+	}
+	captures.RLock()
+	defer captures.RUnlock()
+	for _, c := range captures.list {
+		if c.filter.match(self) {
+			c.add(self, out != self.backend, data)
+		}
+	}
+}
+
+func (c *linkCapture) add(link *Link, fromClient bool, data []byte) {
+	c.lock.Lock()
+	s := c.streams[link]
+	if s == nil {
+		s = newTCPStream(link.source, link.dest)
+		c.streams[link] = s
+	}
+	pkts := s.packets(fromClient, tcpPsh, data)
+	c.lock.Unlock()
+
+	p := capturedPacket{
+		t:       time.Now(),
+		pkts:    pkts,
+		comment: fmt.Sprintf("hub %d link %d service %s", link.hub.id, link.id, link.service),
+	}
+	select {
+	case c.packets <- p:
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+	}
+}
+
+// write captured packets to w as pcapng until max bytes or duration is
+// reached, or ctx is done
+func (c *linkCapture) serve(ctx context.Context, w io.Writer) error {
+	captures.Lock()
+	captures.list = append(captures.list, c)
+	atomic.AddInt32(&captures.active, 1)
+	captures.Unlock()
+	defer func() {
+		captures.Lock()
+		for i, o := range captures.list {
+			if o == c {
+				captures.list = append(captures.list[:i], captures.list[i+1:]...)
+				break
+			}
+		}
+		atomic.AddInt32(&captures.active, -1)
+		captures.Unlock()
+	}()
+
+	pw, err := newPcapngWriter(w)
+	if err != nil {
+		return err
+	}
+	flusher, _ := w.(http.Flusher)
+	timer := time.NewTimer(c.duration)
+	defer timer.Stop()
+	var written int64
+	defer func() {
+		Log("capture finished, %d bytes written, %d packets dropped", written, atomic.LoadInt64(&c.dropped))
+	}()
+	for written < c.maxBytes {
+		select {
+		case p := <-c.packets:
+			for _, pkt := range p.pkts {
+				n, err := pw.writePacket(p.t, pkt, p.comment)
+				if err != nil {
+					return err
+				}
+				written += int64(n)
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
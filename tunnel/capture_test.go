@@ -0,0 +1,82 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// read a pcapng block, return its type and body
+func readPcapngBlock(t *testing.T, r io.Reader) (uint32, []byte) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := binary.LittleEndian.Uint32(h[4:])
+	body := make([]byte, n-8)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(body[len(body)-4:]) != n {
+		t.Fatal("bad block length")
+	}
+	return binary.LittleEndian.Uint32(h[:]), body[:len(body)-4]
+}
+
+func TestPairCapture(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{})
+	if _, err := newLinkCapture(url.Values{"link": {"x"}}); err == nil {
+		t.Fatal("bad filter should be refused")
+	}
+
+	// only the server end of link dials backend
+	c, err := newLinkCapture(url.Values{"dest": {testBackendAddr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.serve(ctx, pw)
+		pw.Close()
+	}()
+	defer func() {
+		cancel()
+		go io.Copy(io.Discard, pr)
+		<-done
+	}()
+
+	if typ, _ := readPcapngBlock(t, pr); typ != pcapngSectionHeader {
+		t.Fatalf("unexpected block:%x", typ)
+	}
+	if typ, body := readPcapngBlock(t, pr); typ != pcapngInterface || binary.LittleEndian.Uint16(body) != pcapLinkTypeRaw {
+		t.Fatalf("unexpected block:%x", typ)
+	}
+	waitFor(t, "capture", func() bool { return atomic.LoadInt32(&captures.active) > 0 })
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+
+	// request and response, with comment of link
+	for i := 0; i < 2; i++ {
+		typ, body := readPcapngBlock(t, pr)
+		if typ != pcapngEnhancedPacket {
+			t.Fatalf("unexpected block:%x", typ)
+		}
+		n := int(binary.LittleEndian.Uint32(body[12:]))
+		pkt := body[20 : 20+n]
+		if string(pkt[40:]) != "hello" || !strings.Contains(string(body[20+n:]), "service default") {
+			t.Fatalf("unexpected packet:%q", body)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+//
+//   date  : 2015-06-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	CipherRC4       = "rc4"         // legacy stream cipher
+	CipherAES256GCM = "aes-256-gcm" // aead cipher
+	CipherNone      = "none"        // plain text, only on tls transport
+)
+
+const (
+	cipherRC4 uint8 = iota
+	cipherAES256GCM
+	cipherNone
+)
+
+// max plain text size of an aead frame
+const aeadChunkSize = PacketSize * 2
+
+// high bit of aead frame length marks a frame of plain text followed by
+// GMAC of length and plain text, it's authenticated but not encrypted
+const aeadPlain = 0x8000
+
+var errCipherFrame = errors.New("errCipherFrame")
+
+var cipherSuites = map[string]uint8{
+	CipherRC4:       cipherRC4,
+	CipherAES256GCM: cipherAES256GCM,
+	CipherNone:      cipherNone,
+}
+
+func cipherSuite(name string) (uint8, bool) {
+	suite, ok := cipherSuites[name]
+	return suite, ok
+}
+
+func cipherName(suite uint8) string {
+	for name, s := range cipherSuites {
+		if s == suite {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// aead nonce: 1 byte direction, 3 bytes zero, 8 bytes counter
+type aeadNonce []byte
+
+func (n aeadNonce) next() []byte {
+	counter := binary.BigEndian.Uint64(n[4:])
+	binary.BigEndian.PutUint64(n[4:], counter+1)
+	return n
+}
+
+func newAeadNonce(size int, dir uint8) aeadNonce {
+	n := make(aeadNonce, size)
+	n[0] = dir
+	return n
+}
+
+// frame: 2 bytes plain text length, sealed data
+type aeadReader struct {
+	rd    io.Reader
+	aead  cipher.AEAD
+	nonce aeadNonce
+	head  []byte
+	buf   []byte
+	left  []byte
+	plain bool // accept plain frames
+}
+
+func (r *aeadReader) Read(p []byte) (int, error) {
+	if len(r.left) == 0 {
+		if _, err := io.ReadFull(r.rd, r.head); err != nil {
+			return 0, err
+		}
+		sz := int(binary.BigEndian.Uint16(r.head))
+		if sz&aeadPlain != 0 && r.plain {
+			return r.readPlain(p, sz&^aeadPlain)
+		}
+		if sz > aeadChunkSize {
+			return 0, errCipherFrame
+		}
+		sealed := r.buf[:sz+r.aead.Overhead()]
+		if _, err := io.ReadFull(r.rd, sealed); err != nil {
+			return 0, err
+		}
+		plain, err := r.aead.Open(sealed[:0], r.nonce.next(), sealed, r.head)
+		if err != nil {
+			return 0, err
+		}
+		r.left = plain
+	}
+	n := copy(p, r.left)
+	r.left = r.left[n:]
+	return n, nil
+}
+
+// length and plain text are kept together in buf as additional data of GMAC
+func (r *aeadReader) readPlain(p []byte, sz int) (int, error) {
+	if sz > aeadChunkSize {
+		return 0, errCipherFrame
+	}
+	frame := r.buf[:2+sz+r.aead.Overhead()]
+	copy(frame, r.head)
+	if _, err := io.ReadFull(r.rd, frame[2:]); err != nil {
+		return 0, err
+	}
+	if _, err := r.aead.Open(nil, r.nonce.next(), frame[2+sz:], frame[:2+sz]); err != nil {
+		return 0, err
+	}
+	r.left = frame[2 : 2+sz]
+	n := copy(p, r.left)
+	r.left = r.left[n:]
+	return n, nil
+}
+
+type aeadWriter struct {
+	wr    io.Writer
+	aead  cipher.AEAD
+	nonce aeadNonce
+	buf   []byte
+	plain bool // write plain frames
+}
+
+func (w *aeadWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		sz := len(p)
+		if sz > aeadChunkSize {
+			sz = aeadChunkSize
+		}
+		head := w.buf[:2]
+		var frame []byte
+		if w.plain {
+			binary.BigEndian.PutUint16(head, uint16(sz|aeadPlain))
+			plain := append(head, p[:sz]...)
+			frame = w.aead.Seal(plain, w.nonce.next(), nil, plain)
+		} else {
+			binary.BigEndian.PutUint16(head, uint16(sz))
+			frame = w.aead.Seal(head, w.nonce.next(), p[:sz], head)
+		}
+		if _, err := w.wr.Write(frame); err != nil {
+			return written, err
+		}
+		written += sz
+		p = p[sz:]
+	}
+	return written, nil
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// create encrypted reader and writer on conn by session key, client and server use different nonce spaces
+func newCipherStream(suite uint8, conn io.ReadWriter, key []byte, client bool) (io.Reader, io.Writer, error) {
+	switch suite {
+	case cipherNone:
+		return conn, conn, nil
+	case cipherRC4:
+		return NewRC4Reader(conn, key), NewRC4Writer(conn, key), nil
+	case cipherAES256GCM:
+		raead, err := newAead(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		waead, err := newAead(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var rdir, wdir uint8 = 1, 0
+		if !client {
+			rdir, wdir = 0, 1
+		}
+		rd := &aeadReader{
+			rd:    conn,
+			aead:  raead,
+			nonce: newAeadNonce(raead.NonceSize(), rdir),
+			head:  make([]byte, 2),
+			buf:   make([]byte, 2+aeadChunkSize+raead.Overhead()),
+		}
+		wr := &aeadWriter{
+			wr:    conn,
+			aead:  waead,
+			nonce: newAeadNonce(waead.NonceSize(), wdir),
+			buf:   make([]byte, 2+aeadChunkSize+waead.Overhead()),
+		}
+		return rd, wr, nil
+	}
+	return nil, nil, errors.New("unknown cipher suite")
+}
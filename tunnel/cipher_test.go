@@ -0,0 +1,87 @@
+//
+//   date  : 2015-06-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestAeadStream(t *testing.T) {
+	key := "a test key"
+	a1 := NewTaa(key)
+	a2 := NewTaa(key)
+
+	a1.GenToken()
+	b2, ok := a2.ExchangeCipherBlock(a1.GenCipherBlock(nil))
+	if !ok || !a1.VerifyCipherBlock(b2) {
+		t.Fatal("exchange block failed")
+	}
+
+	var conn bytes.Buffer
+	_, wr, err := newCipherStream(cipherAES256GCM, &conn, a1.GetSessionKey(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, _, err := newCipherStream(cipherAES256GCM, &conn, a2.GetSessionKey(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := bytes.Repeat([]byte("hello, world"), aeadChunkSize/4)
+	if _, err := wr.Write(input); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(conn.Bytes(), []byte("hello, world")) {
+		t.Fatal("plain text found in stream")
+	}
+
+	output := make([]byte, len(input))
+	if _, err := io.ReadFull(rd, output); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(input, output) {
+		t.Fatal("unexpected output")
+	}
+}
+
+func TestAeadPlainFrame(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	var conn bytes.Buffer
+	_, wr, err := newCipherStream(cipherAES256GCM, &conn, key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, _, err := newCipherStream(cipherAES256GCM, &conn, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.(*aeadReader).plain = true
+
+	// plain frame between sealed ones keeps nonces in step
+	w := wr.(*aeadWriter)
+	io.WriteString(w, "sealed")
+	w.plain = true
+	io.WriteString(w, "hello, plain")
+	w.plain = false
+	io.WriteString(w, "sealed again")
+	if !bytes.Contains(conn.Bytes(), []byte("hello, plain")) || bytes.Contains(conn.Bytes(), []byte("sealed")) {
+		t.Fatal("only plain frame should be readable")
+	}
+	output := make([]byte, len("sealedhello, plainsealed again"))
+	if _, err := io.ReadFull(rd, output); err != nil || string(output) != "sealedhello, plainsealed again" {
+		t.Fatalf("unexpected output:%q, %v", output, err)
+	}
+
+	// plain frame is authenticated
+	w.plain = true
+	io.WriteString(w, "hello")
+	conn.Bytes()[2] = 'j'
+	if _, err := rd.Read(output); err == nil {
+		t.Fatal("altered plain frame should fail")
+	}
+}
@@ -7,80 +7,442 @@ package tunnel
 
 import (
 	"container/heap"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Client struct {
-	app  *App
-	cq   HubQueue
-	lock sync.Mutex
-	wg   sync.WaitGroup
+	app       *App
+	cq        HubQueue
+	lock      sync.Mutex
+	wg        sync.WaitGroup
+	listeners map[*Rule]io.Closer
+	httpLns   []net.Listener // listeners of admin and metrics
+	stopped   bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	started   time.Time
+	history   []reconnectEvent // recent reconnects
+	rrTunnel  int              // tunnel chosen by round robin
+	servers   []*endpoint      // tunnel servers, Backend and Servers
+
+	running    int // tunnels connecting or connected
+	nextTunnel int // index of next extra tunnel opened by autoscaling
+
+	standbys []*standbyHub
+
+	conns      int32         // active local connections, atomic
+	acceptRate *rateLimiter  // accepted connections per second, nil if unlimited
+	sources    *sourceLimits // connections per source ip, nil if unlimited
+
+	tickets map[string]*clientTicket // by server address
+
+	traffic    *clientUsage // link data of all hubs, up is received and down is sent
+	lastServer string       // address of server connected last
 }
 
-func (cli *Client) createHub() (hub *HubItem, err error) {
-	conn, err := net.DialTCP("tcp", nil, cli.app.baddr)
+// keep recent reconnect events for admin api
+const maxReconnectHistory = 64
+
+func (cli *Client) recordReconnect(index, attempt int, err error) {
+	event := reconnectEvent{Time: time.Now(), Tunnel: index, Attempt: attempt}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	cli.lock.Lock()
+	if len(cli.history) >= maxReconnectHistory {
+		cli.history = cli.history[1:]
+	}
+	cli.history = append(cli.history, event)
+	cli.lock.Unlock()
+}
+
+// create hub on the best server, fail over to other servers at once
+func (cli *Client) connectHub(ctx context.Context, index int) (hub *HubItem, err error) {
+	for i := 0; i < len(cli.servers); i++ {
+		if hub, err = cli.createHub(ctx, index, cli.pickServer()); err == nil || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+// dial and handshake are canceled if ctx is done, hub lives until ctx is done
+func (cli *Client) createHub(ctx context.Context, index int, server *endpoint) (hub *HubItem, err error) {
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			cli.serverFailed(server)
+		} else {
+			cli.serverConnected(server, time.Since(start))
+		}
+	}()
+	tunnel, log, err := cli.handshake(cli.app.withUplink(ctx, index), index, server.addr, nil)
 	if err != nil {
 		return
 	}
-	Info("create tunnel: %v <-> %v", conn.LocalAddr(), conn.RemoteAddr())
+	hub = &HubItem{
+		Hub:    newServerHub(ctx, tunnel, cli.app, true, log).Hub,
+		tunnel: index,
+		server: server,
+	}
+	hub.SetHeartbeat(cli.app.heartbeat())
+	hub.SetHealthCheck(time.Duration(cli.app.HealthCheck) * time.Second)
+	hub.SetRateLimit(cli.app.LinkRate, cli.app.HubRate)
+	hub.SetBulkRate(cli.app.BulkRate)
+	hub.SetIdleTimeout(time.Duration(cli.app.IdleTimeout) * time.Second)
+	hub.SetLinkMaxAge(time.Duration(cli.app.LinkMaxAge) * time.Second)
+	hub.SetLinkIdAudit(cli.app.linkIdAudit())
+	hub.SetAccessLog(cli.app.accessLog)
+	hub.SetTracer(cli.app.tracer)
+	hub.SetEventHandler(cli.app.events)
+	hub.usage = cli.traffic
+	if tunnel.sess != nil {
+		// resume tries the other uplinks in turn, the broken one may be down
+		redials := 0
+		tunnel.sess.redial = func(ctx context.Context) error {
+			redials++
+			_, _, err := cli.handshake(cli.app.withUplink(ctx, index+redials), index, server.addr, tunnel)
+			return err
+		}
+	}
+	return
+}
+
+// dial server and handshake, a broken tunnel is resumed over the new
+// connection if resume is set. If server rejects our ticket, the full
+// handshake is done over another connection at once.
+func (cli *Client) handshake(ctx context.Context, index int, addr string, resume *Tunnel) (tunnel *Tunnel, log *Logger, err error) {
+	tunnel, log, err = cli.dialHandshake(ctx, index, addr, resume)
+	if errors.Is(err, errTicketRejected) {
+		tunnel, log, err = cli.dialHandshake(ctx, index, addr, resume)
+	}
+	return
+}
+
+func (cli *Client) dialHandshake(ctx context.Context, index int, addr string, resume *Tunnel) (tunnel *Tunnel, log *Logger, err error) {
+	hctx, cancel := cli.app.handshakeContext(ctx)
+	defer cancel()
+
+	raw, err := cli.app.transport.Dial(hctx, addr)
+	if err != nil {
+		return
+	}
+	return cli.handshakeConn(hctx, raw, index, addr, resume)
+}
+
+// handshake over raw connection dialed to addr until hctx is done, raw is
+// closed if it fails
+func (cli *Client) handshakeConn(hctx context.Context, raw net.Conn, index int, addr string, resume *Tunnel) (tunnel *Tunnel, log *Logger, err error) {
+	release := bindConn(hctx, raw)
+	defer func() {
+		release()
+		if err == nil {
+			err = hctx.Err()
+		}
+		if err != nil {
+			raw.Close()
+		}
+	}()
+	defer func() {
+		if err != nil && !errors.Is(err, errTicketRejected) {
+			atomic.AddInt64(&stats.HandshakeFailed, 1)
+			cli.app.authFailed(addr, err)
+		}
+	}()
+	log = rootLogger.With("tunnel", index, "peer", raw.RemoteAddr().String())
+	log.Info("create tunnel: %v <-> %v", raw.LocalAddr(), raw.RemoteAddr())
+
+	conn, err := cli.app.transport.Handshake(raw, addr)
+	if err != nil {
+		log.Error("%s handshake failed:%s", cli.app.scheme, err)
+		return
+	}
+
+	var n *negotiated
+	if t := cli.ticket(addr); t != nil {
+		n, err = cli.ticketHandshake(conn, addr, t, resume, log)
+	} else {
+		n, err = cli.negotiate(conn, log)
+	}
+	if err != nil {
+		return
+	}
+
+	rd, wr := n.rd, n.wr
+	if rd == nil {
+		if rd, wr, err = newCipherStream(n.suite, conn, n.key, true); err != nil {
+			log.Error("create cipher stream failed:%s", err)
+			return
+		}
+	}
+
+	if n.caps&capTicket != 0 && !n.ticket {
+		if err = cli.readTicket(rd, addr, n); err != nil {
+			log.Error("read ticket failed:%s", err)
+			return
+		}
+	}
+
+	// session id of a new session is issued by server
+	var sess *session
+	if n.caps&capResume != 0 {
+		var id [sessionIDSize]byte
+		var received uint64
+		if resume != nil {
+			id, received = resume.sess.id, resume.receivedFrames()
+		}
+		// sent with ticket already
+		if n.rd == nil {
+			if _, err = wr.Write(resumeMessage(id, received)); err != nil {
+				log.Error("send resume failed:%s", err)
+				return
+			}
+		}
+		var peerReceived uint64
+		if id, peerReceived, err = readResume(rd); err != nil {
+			log.Error("read resume failed:%s", err)
+			return
+		}
+		if resume != nil {
+			if id != resume.sess.id {
+				err = errSessionLost
+				log.Error("resume failed:%s", err)
+				return
+			}
+			if _, err = resume.attach(conn, rd, wr, peerReceived); err != nil {
+				log.Error("resume failed:%s", err)
+				resume.Close()
+				return
+			}
+			return resume, log, nil
+		}
+		sess = newSession(id, time.Duration(cli.app.Resume)*time.Second, int(cli.app.ResumeBuffer))
+	} else if resume != nil {
+		err = errSessionLost
+		log.Error("resume failed:%s", err)
+		return
+	}
+
+	tunnel = newTunnel(conn, rd, wr)
+	tunnel.integrity = n.integrity
+	tunnel.identity = cli.app.ClientID
+	tunnel.caps = n.caps
+	tunnel.setCompress(n.compress, cli.app.CompressThreshold)
+	tunnel.setSendQueue(cli.app.SendQueue)
+	if sess != nil {
+		tunnel.setSession(sess)
+	}
+	tunnel.setPlain(rd, wr)
+	tunnel.setRekey(rd, wr, n.key, cli.app.RekeyBytes, time.Duration(cli.app.RekeyInterval)*time.Second)
+	return
+}
 
-	// auth
+// authenticate by token and negotiate the tunnel with server, ending with
+// key exchange. Failures are logged.
+func (cli *Client) negotiate(conn net.Conn, log *Logger) (n *negotiated, err error) {
 	challenge := make([]byte, TaaBlockSize)
 	if _, err = io.ReadFull(conn, challenge); err != nil {
-		Error("read challenge failed(%v):%s", conn.RemoteAddr(), err)
+		log.Error("read challenge failed:%s", err)
 		return
 	}
-	Debug("challenge(%v), len %d, %v", conn.RemoteAddr(), len(challenge), challenge)
+	log.Debug("challenge, len %d, %v", len(challenge), challenge)
 
-	a := NewTaa(cli.app.Secret)
-	token, ok := a.ExchangeCipherBlock(challenge)
-	if !ok {
-		err = errors.New("exchange chanllenge failed")
-		Error("exchange challenge failed(%v)", conn.RemoteAddr())
-		return
+	// challenge is signed by another secret if server is rotating secrets,
+	// then server is authenticated by key exchange
+	// challenge is never signed by secret of an identified client
+	a := NewTaa(cli.app.secret())
+	token, verified := a.ExchangeCipherBlock(challenge)
+	if !verified {
+		if cli.app.ClientID == "" {
+			log.Info("challenge is not signed by our secret")
+		}
+		token = a.ExchangeUnverifiedBlock(challenge)
 	}
 
-	Debug("token(%v), len %d, %v", conn.RemoteAddr(), len(token), token)
+	log.Debug("token, len %d, %v", len(token), token)
+	// token followed by proposed cipher suite, handshake version, compress
+	// method and integrity
+	compress := cli.app.compress
+	if cli.app.Integrity {
+		compress |= compressIntegrity
+	}
+	token = append(token, cli.app.cipher, packFlags(handshakeVersion, compress))
 	if _, err = conn.Write(token); err != nil {
-		Error("write token failed(%v):%s", conn.RemoteAddr(), err)
+		log.Error("write token failed:%s", err)
 		return
 	}
 
-	hub = &HubItem{
-		Hub: newHub(newTunnel(conn, a.GetRc4key()), true),
+	suite := make([]byte, 2)
+	if _, err = io.ReadFull(conn, suite); err != nil {
+		log.Error("read cipher suite failed:%s", err)
+		return
 	}
-	return
+	if suite[0] != cli.app.cipher {
+		err = fmt.Errorf("cipher mismatch, want %s, server choose %s", cipherName(cli.app.cipher), cipherName(suite[0]))
+		log.Error("negotiate cipher failed:%s", err)
+		return
+	}
+	version, compress := unpackFlags(suite[1])
+	integrity := compress&compressIntegrity != 0
+	compress &^= compressIntegrity
+	if cli.app.Integrity && !integrity {
+		log.Info("server doesn't support integrity check")
+	}
+
+	transcript := append(append(challenge, token...), suite...)
+	if version >= handshakeIdentity {
+		var msg []byte
+		if msg, err = identityMessage(cli.app.ClientID); err != nil {
+			log.Error("send identity failed:%s", err)
+			return
+		}
+		if _, err = conn.Write(msg); err != nil {
+			log.Error("send identity failed:%s", err)
+			return
+		}
+		transcript = append(transcript, msg...)
+	} else if cli.app.ClientID != "" {
+		err = errors.New("server doesn't support client identity")
+		log.Error("negotiate handshake failed:%s", err)
+		return
+	}
+
+	caps := legacyCaps
+	if version >= handshakeCaps {
+		local := cli.app.localCaps()
+		if _, err = conn.Write(capsMessage(local)); err != nil {
+			log.Error("send capabilities failed:%s", err)
+			return
+		}
+		var peerCaps uint32
+		var msg []byte
+		if peerCaps, msg, err = readCaps(conn); err != nil {
+			log.Error("read capabilities failed:%s", err)
+			return
+		}
+		transcript = append(append(transcript, capsMessage(local)...), msg...)
+		caps = local & peerCaps
+	}
+
+	var key []byte
+	if version >= handshakeECDH {
+		if key, err = keyExchange(conn, a, transcript, true); err != nil {
+			log.Error("key exchange failed:%s", err)
+			return
+		}
+	} else if !verified {
+		err = errors.New("exchange chanllenge failed")
+		log.Error("exchange challenge failed")
+		return
+	} else if cli.app.LegacyHandshake {
+		key = legacySessionKey(suite[0], a)
+	} else {
+		err = errors.New("server only supports legacy handshake")
+		log.Error("negotiate handshake failed:%s", err)
+		return
+	}
+
+	log.Info("use handshake v%d, cipher %s, compress %s, integrity %v, caps %s", version, cipherName(suite[0]), compressName(compress), integrity, capsString(caps))
+	return &negotiated{suite: suite[0], version: version, compress: compress, integrity: integrity, caps: caps, key: key}, nil
 }
 
-func (cli *Client) addHub(item *HubItem) {
+func (cli *Client) addHub(item *HubItem) bool {
 	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	if cli.stopped {
+		return false
+	}
 	heap.Push(&cli.cq, item)
-	cli.lock.Unlock()
+	if cli.app.events != nil {
+		cli.app.events.OnTunnelUp(cli.tunnelEvent(item))
+	}
+	return true
 }
 
 func (cli *Client) removeHub(item *HubItem) {
 	cli.lock.Lock()
 	heap.Remove(&cli.cq, item.index)
 	cli.lock.Unlock()
+	if cli.app.events != nil {
+		cli.app.events.OnTunnelDown(cli.tunnelEvent(item))
+	}
 }
 
-func (cli *Client) fetchHub() *HubItem {
+// choose a hub for connection from src by Balance
+func (cli *Client) fetchHub(src net.Addr) *HubItem {
 	defer cli.lock.Unlock()
 	cli.lock.Lock()
 
 	if len(cli.cq) == 0 {
 		return nil
 	}
-	item := cli.cq[0]
+	var item *HubItem
+	switch cli.app.Balance {
+	case BalanceRoundRobin:
+		if item = roundRobinHub(cli.cq, cli.rrTunnel); item != nil {
+			cli.rrTunnel = item.tunnel
+		}
+	case BalanceAffinity:
+		item = affinityHub(cli.cq, src)
+	default:
+		item = pickHub(cli.cq, cli.app.balancer, nil)
+	}
+	if item == nil {
+		item = cli.cq[0]
+	}
 	item.priority += 1
-	heap.Fix(&cli.cq, 0)
+	heap.Fix(&cli.cq, item.index)
 	return item
 }
 
+// like fetchHub, but skip items
+func (cli *Client) fetchOtherHub(items []*HubItem) *HubItem {
+	defer cli.lock.Unlock()
+	cli.lock.Lock()
+
+	best := pickHub(cli.cq, cli.app.balancer, items...)
+	if best != nil {
+		best.priority += 1
+		heap.Fix(&cli.cq, best.index)
+	}
+	return best
+}
+
+// acquire a link id from hub. If hub is exhausted, other hubs are tried from
+// the next best one, then LinkIdPolicy applies to hub. Hub is replaced if id
+// is acquired from another one, return 0 if no id is available
+func (cli *Client) acquireId(hub *HubItem) (*HubItem, uint32) {
+	if linkid := hub.AcquireId(); linkid != 0 {
+		return hub, linkid
+	}
+	tried := []*HubItem{hub}
+	for {
+		other := cli.fetchOtherHub(tried)
+		if other == nil {
+			break
+		}
+		if linkid := other.AcquireId(); linkid != 0 {
+			hub.log.Info("link ids exhausted, link %d created in tunnel %d", linkid, other.tunnel)
+			cli.dropHub(hub)
+			return other, linkid
+		}
+		cli.dropHub(other)
+		tried = append(tried, other)
+	}
+	if cli.app.LinkIdPolicy == LinkIdWait {
+		timeout := time.Duration(cli.app.LinkIdTimeout) * time.Millisecond
+		return hub, hub.WaitId(hub.ctx, timeout)
+	}
+	return hub, 0
+}
+
 func (cli *Client) dropHub(item *HubItem) {
 	cli.lock.Lock()
 	item.priority -= 1
@@ -88,108 +450,480 @@ func (cli *Client) dropHub(item *HubItem) {
 	cli.lock.Unlock()
 }
 
-func (cli *Client) handleConn(hub *HubItem, conn BiConn) {
+func (cli *Client) handleConn(hub *HubItem, conn BiConn, rule *Rule) {
 	defer conn.Close()
 	defer Recover()
-	defer cli.dropHub(hub)
+	// priority raised by fetchHub, hub may be replaced or dropped below
+	defer func() {
+		if hub != nil {
+			cli.dropHub(hub)
+		}
+	}()
+
+	source := conn.RemoteAddr()
+	conn, err := rule.acceptTLS(conn)
+	if err != nil {
+		Error("rule %s: accept tls from %v failed, err:%v", rule, source, err)
+		return
+	}
+	args := &LinkArgs{Service: rule.Name, Source: source.String()}
+	if rule.routing() {
+		c, service, dest, err := rule.route(conn)
+		if err != nil {
+			Error("rule %s: route connection from %v failed, err:%v", rule, source, err)
+			return
+		}
+		conn, args.Service, args.Dest = c, service, dest
+		Info("rule %s: route connection from %v to service %s, dest: %q", rule, source, service, dest)
+	}
+	if rule.Transparent {
+		if args.Dest, err = rule.originalDest(conn); err != nil {
+			Error("rule %s: connection from %v failed, err:%v", rule, source, err)
+			return
+		}
+	}
+
+	// all tunnels are draining or closing if the best one is
+	if hub != nil && rule.Direct && hub.IsClosing() {
+		cli.dropHub(hub)
+		hub = nil
+	}
+	if hub == nil {
+		cli.handleDirect(conn, rule, args)
+		return
+	}
+
+	hub, linkid := cli.acquireId(hub)
+	if linkid != 0 {
+		defer hub.ReleaseId(linkid)
+		// proxy request may take up to Timeout
+		hub.holdId(linkid)
+	} else {
+		hub.log.Error("alloc linkid failed, source: %v, policy: %s", conn.RemoteAddr(), cli.app.LinkIdPolicy)
+		if rule.Direct {
+			cli.handleDirect(conn, rule, args)
+			return
+		}
+		if cli.app.LinkIdPolicy != LinkIdBusy {
+			return
+		}
+	}
+	busy := linkid == 0
 
-	linkid := hub.AcquireId()
-	if linkid == 0 {
-		Error("alloc linkid failed, source: %v", conn.RemoteAddr())
+	// proxy request is answered after server connects its destination
+	var reply func(code uint8) error
+	if rule.Socks5 {
+		dest, err := socks5Handshake(conn, busy)
+		if err != nil {
+			hub.log.Error("socks5 handshake failed, source: %v, err:%v", conn.RemoteAddr(), err)
+			return
+		}
+		args.Dest = dest
+		reply = func(code uint8) error {
+			return socks5Reply(conn, socks5CloseReply(code))
+		}
+	} else if rule.HTTPProxy {
+		c, dest, err := httpConnectHandshake(conn, busy)
+		if err != nil {
+			hub.log.Error("http proxy handshake failed, source: %v, err:%v", conn.RemoteAddr(), err)
+			return
+		}
+		conn, args.Dest = c, dest
+		reply = func(code uint8) error {
+			return httpConnectReply(c, code)
+		}
+	} else if busy {
+		// reset, so peer sees a refused connection at once
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
 		return
 	}
-	defer hub.ReleaseId(linkid)
 
-	Info("link(%d) create link, source: %v", linkid, conn.RemoteAddr())
-	link := hub.NewLink(linkid)
-	defer hub.ReleaseLink(linkid)
+	// old server doesn't tell, success is replied before it connects
+	if reply != nil && !hub.Hub.tunnel.has(capCloseCode) {
+		if err := reply(closeNormal); err != nil {
+			hub.log.Error("reply proxy request failed, source: %v, err:%v", conn.RemoteAddr(), err)
+			return
+		}
+		reply = nil
+	}
+	hub.forwardLink(linkid, conn, rule, args, reply)
+}
 
-	link.SendCreate()
-	link.Pump(conn)
+func (cli *Client) isStopped() bool {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	return cli.stopped || cli.ctx.Err() != nil
 }
 
-func (cli *Client) listen() {
-	defer cli.wg.Done()
+// stop accepting new connections
+func (cli *Client) shutdown() {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	cli.stopped = true
+	for _, ln := range cli.listeners {
+		ln.Close()
+	}
+}
 
-	ln, err := net.ListenTCP("tcp", cli.app.laddr)
-	if err != nil {
-		Panic("listen failed:%v", err)
+// should be called with lock held
+func (cli *Client) startListener(rule *Rule) error {
+	if rule.UDP {
+		laddr := &net.UDPAddr{IP: rule.laddr.IP, Port: rule.laddr.Port, Zone: rule.laddr.Zone}
+		ln, err := listenUDP(laddr)
+		if err != nil {
+			return err
+		}
+		cli.listeners[rule] = ln
+		cli.wg.Add(1)
+		go cli.listenUDP(rule, ln)
+	} else {
+		ln, err := cli.app.listenLink(rule)
+		if err != nil {
+			return err
+		}
+		cli.listeners[rule] = ln
+		cli.wg.Add(1)
+		go cli.listen(rule, ln)
 	}
+	return nil
+}
 
-	for {
-		conn, err := ln.AcceptTCP()
+// close listeners of removed rules before listening on added ones, so a
+// changed rule could keep its address
+func (cli *Client) reloadRules(added, removed []*Rule) error {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	if cli.stopped {
+		return nil
+	}
+
+	for _, rule := range removed {
+		rule.stopBackends()
+		if ln, ok := cli.listeners[rule]; ok {
+			ln.Close()
+			delete(cli.listeners, rule)
+		}
+	}
+	for _, rule := range added {
+		rule.startBackends(cli.ctx, cli.app)
+		if rule.Reverse {
+			continue
+		}
+		if err := cli.startListener(rule); err != nil {
+			return fmt.Errorf("rule %s: %s", rule, err)
+		}
+	}
+	return nil
+}
+
+func (cli *Client) listen(rule *Rule, ln net.Listener) {
+	defer cli.wg.Done()
+
+	backoff := Backoff{Min: acceptDelayMin, Max: acceptDelayMax}
+	for cli.waitAccept() {
+		conn, err := ln.Accept()
 		if err != nil {
-			Log("acceept failed:%s", err.Error())
+			if cli.isStopped() || errors.Is(err, net.ErrClosed) {
+				break
+			}
 			if opErr, ok := err.(*net.OpError); ok {
 				if !opErr.Temporary() {
+					Log("accept failed:%s", err.Error())
 					break
 				}
 			}
+			if !cli.acceptBackoff(&backoff, err) {
+				break
+			}
 			continue
 		}
+		backoff.Reset()
 		Info("new connection from %v", conn.RemoteAddr())
-		hub := cli.fetchHub()
-		if hub == nil {
+		ip := sourceIP(conn.RemoteAddr())
+		if err := cli.acquireConn(ip); err != nil {
+			Error("%s, reject %v", err, conn.RemoteAddr())
+			rejectConn(conn)
+			continue
+		}
+		hub := cli.fetchHub(conn.RemoteAddr())
+		if hub == nil && !rule.Direct {
 			Error("no active hub")
 			conn.Close()
+			cli.releaseConn(ip)
 			continue
 		}
 
-		conn.SetKeepAlive(true)
-		conn.SetKeepAlivePeriod(time.Second * 60)
-		go cli.handleConn(hub, conn)
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(time.Second * 60)
+		}
+		go func() {
+			defer cli.releaseConn(ip)
+			cli.handleConn(hub, conn.(BiConn), rule)
+		}()
 	}
 }
 
-func (cli *Client) Start() error {
-	sz := cap(cli.cq)
-	done := make(chan error, sz)
-	for i := 0; i < sz; i++ {
-		go func(index int) {
-			Recover()
-
-			first := true
-			for {
-				hub, err := cli.createHub()
-				if first {
-					first = false
-					done <- err
-					if err != nil {
-						Error("tunnel %d connect failed", index)
-						break
-					}
-				} else if err != nil {
-					Error("tunnel %d reconnect failed", index)
-					time.Sleep(time.Second * 3)
-					continue
-				}
+// connect tunnel of index in background and reconnect it until client
+// stops, the result of first connect is sent to done
+func (cli *Client) startTunnel(index int, done chan<- error) {
+	cli.lock.Lock()
+	cli.running++
+	cli.lock.Unlock()
+	go cli.runTunnel(index, done)
+}
 
-				Error("tunnel %d connect succeed", index)
-				cli.addHub(hub)
-				hub.Start()
-				cli.removeHub(hub)
-				Error("tunnel %d disconnected", index)
+func (cli *Client) runTunnel(index int, done chan<- error) {
+	defer Recover()
+	defer func() {
+		cli.lock.Lock()
+		cli.running--
+		cli.lock.Unlock()
+	}()
+
+	first := true
+	backoff := cli.app.backoff()
+	for {
+		if !first {
+			atomic.AddInt64(&stats.Reconnects, 1)
+		}
+		var err error
+		hub := cli.takeStandby(index)
+		if hub != nil {
+			Error("tunnel %d takes standby hub", index)
+		} else {
+			hub, err = cli.connectHub(cli.ctx, index)
+		}
+		if first {
+			first = false
+			if err != nil {
+				done <- err
+				Error("tunnel %d connect failed", index)
+				break
+			}
+		} else if err != nil {
+			delay := backoff.Next()
+			cli.recordReconnect(index, backoff.Attempt(), err)
+			Error("tunnel %d reconnect failed(%d):%v, retry in %v", index, backoff.Attempt(), err, delay)
+			if cli.app.OnReconnectFailed != nil {
+				cli.app.OnReconnectFailed(index, backoff.Attempt(), err)
+			}
+			if cli.app.ReconnectRetries > 0 && backoff.Attempt() >= cli.app.ReconnectRetries {
+				Error("tunnel %d give up after %d retries", index, backoff.Attempt())
+				break
+			}
+			select {
+			case <-time.After(delay):
+			case <-cli.ctx.Done():
+			}
+			if cli.isStopped() {
+				break
+			}
+			continue
+		} else {
+			cli.recordReconnect(index, backoff.Attempt()+1, nil)
+		}
+		backoff.Reset()
+
+		Error("tunnel %d connect succeed", index)
+		added := cli.addHub(hub)
+		if done != nil {
+			// links could be scheduled to the hub once Start returns
+			done <- nil
+			done = nil
+		}
+		if !added {
+			hub.Close()
+			cli.serverReleased(hub.server)
+			break
+		}
+		if !cli.waitHub(hub) {
+			if cli.isStopped() {
+				break
 			}
-		}(i)
+			continue
+		}
+		cli.removeHub(hub)
+		cli.serverReleased(hub.server)
+		Error("tunnel %d disconnected", index)
+		if cli.isStopped() {
+			break
+		}
+		// extra tunnels are opened again by autoscaling if needed
+		if index >= int(cli.app.Tunnels) {
+			break
+		}
+	}
+}
+
+func (cli *Client) Start(ctx context.Context) error {
+	cli.ctx, cli.cancel = context.WithCancel(ctx)
+	cli.started = time.Now()
+	cli.app.keepState(cli.ctx, &cli.wg, cli.restoreState, cli.snapshotState)
+	cli.app.tracer.run(cli.ctx, &cli.wg)
+	sz := int(cli.app.Tunnels)
+	cli.nextTunnel = sz
+	done := make(chan error, sz)
+	for i := 0; i < sz; i++ {
+		cli.startTunnel(i, done)
 	}
 
 	for i := 0; i < sz; i++ {
 		err := <-done
 		if err != nil {
+			cli.cancel()
 			return err
 		}
 	}
 
+	cli.lock.Lock()
+	for _, rule := range cli.app.rules {
+		rule.startBackends(cli.ctx, cli.app)
+		if rule.Reverse {
+			continue
+		}
+		if err := cli.startListener(rule); err != nil {
+			cli.lock.Unlock()
+			cli.cancel()
+			cli.shutdown()
+			return err
+		}
+	}
+	cli.lock.Unlock()
+
+	if cli.app.Metrics != "" {
+		ln, err := serveMetrics(cli.ctx, cli.app.Metrics, cli.activeHubs)
+		if err != nil {
+			cli.cancel()
+			cli.shutdown()
+			return err
+		}
+		cli.httpLns = append(cli.httpLns, ln)
+	}
+	if cli.app.Admin != "" {
+		ln, err := serveAdmin(cli.ctx, cli.app.Admin, cli)
+		if err != nil {
+			cli.cancel()
+			cli.shutdown()
+			return err
+		}
+		cli.httpLns = append(cli.httpLns, ln)
+	}
+	if cli.app.Debug != "" {
+		ln, err := serveDebug(cli.ctx, cli.app.Debug, cli.activeHubs)
+		if err != nil {
+			cli.cancel()
+			cli.shutdown()
+			return err
+		}
+		cli.httpLns = append(cli.httpLns, ln)
+	}
+
+	for i := 0; i < cli.app.Standby; i++ {
+		go cli.runStandby()
+	}
+	if cli.app.TunnelsMax > int(cli.app.Tunnels) {
+		cli.wg.Add(1)
+		go cli.autoscale()
+	}
+
+	// tear down everything if parent ctx is done, client keeps running
+	// without listeners, such as only reverse rules are configured
 	cli.wg.Add(1)
-	go cli.listen()
+	go func() {
+		defer cli.wg.Done()
+		<-cli.ctx.Done()
+		cli.shutdown()
+	}()
 	return nil
 }
 
+func (cli *Client) Stop(ctx context.Context) error {
+	cli.wg.Add(1)
+	defer cli.wg.Done()
+
+	cli.shutdown()
+
+	err := drainHubs(ctx, cli.activeHubs())
+	if err != nil {
+		Error("drain hubs failed:%v", err)
+	}
+
+	cli.cancel()
+	Log("tunnel client stopped")
+	return err
+}
+
 func (cli *Client) Wait() {
 	cli.wg.Wait()
 	Log("tunnel client quit")
 }
 
+func (cli *Client) activeHubs() []*Hub {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	hubs := make([]*Hub, len(cli.cq))
+	for i, item := range cli.cq {
+		hubs[i] = item.Hub
+	}
+	return hubs
+}
+
+// client accepts no tunnels
+func (cli *Client) bans() *banList {
+	return nil
+}
+
+// client doesn't account traffic
+func (cli *Client) clientUsage() *usageTable {
+	return nil
+}
+
+func (cli *Client) openListeners() []io.Closer {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	if cli.stopped {
+		return nil
+	}
+	lns := make([]io.Closer, 0, len(cli.httpLns)+len(cli.listeners))
+	for _, ln := range cli.httpLns {
+		lns = append(lns, ln)
+	}
+	for _, ln := range cli.listeners {
+		lns = append(lns, ln)
+	}
+	return lns
+}
+
+func (cli *Client) status() *serviceStatus {
+	cli.lock.Lock()
+	items := make([]*HubItem, len(cli.cq))
+	copy(items, cli.cq)
+	priorities := make([]int, len(items))
+	for i, item := range items {
+		priorities[i] = item.priority
+	}
+	history := make([]reconnectEvent, len(cli.history))
+	copy(history, cli.history)
+	standby := len(cli.standbys)
+	cli.lock.Unlock()
+
+	status := &serviceStatus{
+		Role:       "client",
+		Uptime:     time.Since(cli.started).Seconds(),
+		Hubs:       []hubStatus{},
+		Reconnects: history,
+		Servers:    cli.serverStatus(),
+		Standby:    standby,
+	}
+	for i, item := range items {
+		status.Hubs = append(status.Hubs, item.snapshot(priorities[i]))
+	}
+	return status
+}
+
 func (cli *Client) Status() {
 	for _, hub := range cli.cq {
 		hub.Status()
@@ -197,8 +931,15 @@ func (cli *Client) Status() {
 }
 
 func newClient(app *App) *Client {
-	return &Client{
-		app: app,
-		cq:  make(HubQueue, app.Tunnels)[0:0],
+	cli := &Client{
+		app:       app,
+		cq:        make(HubQueue, app.Tunnels)[0:0],
+		listeners: make(map[*Rule]io.Closer),
+		rrTunnel:  -1,
+		servers:   newEndpoints(app.servers),
 	}
+	cli.acceptRate = newRateLimiter(int64(app.AcceptRate))
+	cli.sources = newSourceLimits(app.MaxConnsPerIP, app.AcceptRatePerIP)
+	cli.traffic = newUsageTable(func(string) *Quota { return nil }).get(app.ClientID)
+	return cli
 }
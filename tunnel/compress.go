@@ -0,0 +1,125 @@
+//
+//   date  : 2015-07-28
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+const (
+	CompressNone    = "none"
+	CompressDeflate = "deflate"
+)
+
+const (
+	compressNone uint8 = iota
+	compressDeflate
+)
+
+// payloads smaller than threshold are sent as is
+const DefaultCompressThreshold = 256
+
+// flag byte before link data when compression is negotiated
+const (
+	frameRaw uint8 = iota
+	frameCompressed
+)
+
+var errCompressFrame = errors.New("errCompressFrame")
+
+var compressMethods = map[string]uint8{
+	CompressNone:    compressNone,
+	CompressDeflate: compressDeflate,
+}
+
+func compressMethod(name string) (uint8, bool) {
+	method, ok := compressMethods[name]
+	return method, ok
+}
+
+func compressName(method uint8) string {
+	for name, m := range compressMethods {
+		if m == method {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// compress link payloads of a tunnel, every frame is compressed independently.
+// not safe for concurrent use, tunnel has one writer and one reader goroutine.
+type compressor struct {
+	threshold int
+	buf       bytes.Buffer
+	fw        *flate.Writer
+	fr        io.ReadCloser
+	src       bytes.Reader
+}
+
+func newCompressor(method uint8, threshold int) *compressor {
+	if method != compressDeflate {
+		return nil
+	}
+	fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &compressor{
+		threshold: threshold,
+		fw:        fw,
+		fr:        flate.NewReader(nil),
+	}
+}
+
+// return flag byte and encoded data, data is kept if compression doesn't help
+func (c *compressor) encode(data []byte) (uint8, []byte) {
+	if len(data) < c.threshold {
+		return frameRaw, data
+	}
+	c.buf.Reset()
+	c.fw.Reset(&c.buf)
+	if _, err := c.fw.Write(data); err != nil {
+		return frameRaw, data
+	}
+	if err := c.fw.Close(); err != nil {
+		return frameRaw, data
+	}
+	if c.buf.Len() >= len(data) {
+		return frameRaw, data
+	}
+	return frameCompressed, c.buf.Bytes()
+}
+
+// decode frame into dst, return size of data
+func (c *compressor) decode(dst []byte, frame []byte) (int, error) {
+	if len(frame) == 0 {
+		return 0, errCompressFrame
+	}
+	switch frame[0] {
+	case frameRaw:
+		if len(frame)-1 > len(dst) {
+			return 0, errCompressFrame
+		}
+		return copy(dst, frame[1:]), nil
+	case frameCompressed:
+		c.src.Reset(frame[1:])
+		c.fr.(flate.Resetter).Reset(&c.src, nil)
+		n, err := io.ReadFull(c.fr, dst)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		// more data than a packet
+		var b [1]byte
+		if m, _ := c.fr.Read(b[:]); m > 0 {
+			return 0, errCompressFrame
+		}
+		return n, nil
+	}
+	return 0, errCompressFrame
+}
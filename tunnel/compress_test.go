@@ -0,0 +1,46 @@
+//
+//   date  : 2015-07-28
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	enc := newCompressor(compressDeflate, 16)
+	dec := newCompressor(compressDeflate, 16)
+	dst := make([]byte, PacketSize)
+
+	cases := []struct {
+		data []byte
+		flag uint8
+	}{
+		{[]byte("short"), frameRaw},
+		{bytes.Repeat([]byte("GET / HTTP/1.1\r\n"), 100), frameCompressed},
+		{bytes.Repeat([]byte{'x'}, PacketSize), frameCompressed},
+	}
+	for _, c := range cases {
+		flag, data := enc.encode(c.data)
+		if flag != c.flag {
+			t.Fatalf("unexpected flag %d for %d bytes", flag, len(c.data))
+		}
+		frame := append([]byte{flag}, data...)
+		n, err := dec.decode(dst, frame)
+		if err != nil {
+			t.Fatal("decode failed:", err)
+		}
+		if !bytes.Equal(dst[:n], c.data) {
+			t.Fatal("data mismatch")
+		}
+	}
+
+	// decompressed data must fit in a packet
+	_, data := enc.encode(bytes.Repeat([]byte{'x'}, PacketSize+1))
+	if _, err := dec.decode(dst, append([]byte{frameCompressed}, data...)); err == nil {
+		t.Fatal("decode oversize frame should fail")
+	}
+}
@@ -0,0 +1,376 @@
+//
+//   date  : 2015-07-06
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// configuration of client and server
+type Config struct {
+	Listen    string `json:"listen"`
+	Backend   string `json:"backend"` // tunnel server or client
+	Secret    string `json:"secret"`
+	Tunnels   uint   `json:"tunnels"`    // low level tunnel count; 0 if work as server
+	Cipher    string `json:"cipher"`     // cipher suite, rc4 is legacy
+	TLS       bool   `json:"tls"`        // use tls transport
+	TLSCert   string `json:"tls_cert"`   // certificate file
+	TLSKey    string `json:"tls_key"`    // private key file
+	TLSCA     string `json:"tls_ca"`     // ca file to verify peer
+	UDP       bool   `json:"udp"`        // forward udp datagrams instead of tcp streams
+	Socks5    bool   `json:"socks5"`     // client listener speaks socks5, server dials requested destination
+	HTTPProxy bool   `json:"http_proxy"` // like Socks5, but client listener accepts http CONNECT requests
+	Metrics   string `json:"metrics"`    // prometheus metrics listen address, disabled if empty
+	Admin     string `json:"admin"`      // admin api listen address, disabled if empty
+	Debug     string `json:"debug"`      // pprof and expvar listen address, disabled if empty
+
+	StatusFile string `json:"status_file"` // Status writes full snapshot to it besides logging, if set
+	StateDir   string `json:"state_dir"`   // directory of state kept across restarts, disabled if empty
+
+	// mutual tls: server requires client certificates verified by TLSCA,
+	// Clients with Cert map them to identities
+	TLSClientAuth bool     `json:"tls_client_auth"`
+	TLSPins       []string `json:"tls_pins"` // hex sha256 of public keys, one must be in peer's verified chain
+
+	ProxyProtocol int `json:"proxy_protocol"` // server sends PROXY protocol header of version 1 or 2 to backend
+
+	Priority string `json:"priority"` // priority of default rule: interactive, normal or bulk
+
+	NoCrypt bool `json:"nocrypt"` // data of default rule's links is authenticated but not encrypted
+
+	EarlyData bool `json:"early_data"` // first bytes of default rule's connections are sent with link creation
+
+	// like Socks5, but client listener takes connections redirected by
+	// iptables REDIRECT or TPROXY, destination is the original one
+	Transparent bool `json:"transparent"`
+
+	// client connects destination of default rule directly when no tunnel
+	// could take a connection, DirectBackend for a static rule
+	Direct        bool   `json:"direct"`
+	DirectBackend string `json:"direct_backend"`
+
+	Compress          string `json:"compress"`           // compress link data: none or deflate, proposed by client
+	CompressThreshold int    `json:"compress_threshold"` // min payload size to compress, default 256
+
+	Integrity bool `json:"integrity"` // append crc32c to every tunnel frame, proposed by client
+
+	// obfuscate tunnel connections against dpi: none, padding or tls, both
+	// ends must match. ObfsKey masks the stream, Secret if empty
+	Obfs    string `json:"obfs"`
+	ObfsKey string `json:"obfs_key"`
+
+	// kcp transport of tunnel address kcp://host:port, reliable udp for
+	// lossy links. Fec is enabled by parity shards, both ends must match
+	KCPMtu          int `json:"kcp_mtu"`           // max bytes of udp packets, default 1350
+	KCPWindow       int `json:"kcp_window"`        // send and receive window in packets, default 512
+	KCPDataShards   int `json:"kcp_data_shards"`   // packets of a fec group, default 10
+	KCPParityShards int `json:"kcp_parity_shards"` // parity packets following a fec group, fec is disabled if 0
+
+	LegacyHandshake bool `json:"legacy_handshake"` // accept peers without key exchange, no forward secrecy
+
+	ReplayWindow int `json:"replay_window"` // seconds server remembers tokens, and max age of challenge of ticket hello, default 30
+
+	// server bans a source ip failing handshakes threshold times in window
+	BanThreshold int `json:"ban_threshold"` // disabled if 0
+	BanWindow    int `json:"ban_window"`    // seconds, default 60
+	BanTime      int `json:"ban_time"`      // seconds of a ban, default 600
+
+	// tunnel connections must finish handshake in time, server closes those
+	// beyond MaxHandshakes in progress at once
+	HandshakeTimeout int `json:"handshake_timeout"` // seconds, default Timeout
+	MaxHandshakes    int `json:"max_handshakes"`    // 0 means unlimited
+
+	ClientID string `json:"client_id"` // identity presented by client, Secret is its own secret if set
+
+	// more tunnel servers of client besides Backend, of the same scheme.
+	// Tunnels are spread over them and fail over to healthy ones
+	Servers []string `json:"servers"`
+
+	// local ips or interfaces of client, tunnels are spread over them
+	Uplinks []string `json:"uplinks"`
+
+	// options of connections dialed by client to server and by server to backends
+	DialTimeout int    `json:"dial_timeout"` // connect timeout in seconds, system default if 0
+	DialBind    string `json:"dial_bind"`    // local ip to dial from
+	Nagle       bool   `json:"nagle"`        // enable nagle's algorithm, TCP_NODELAY is set by default
+	TOS         int    `json:"tos"`          // ip tos/dscp byte, linux only
+	FastOpen    bool   `json:"fast_open"`    // tcp fast open, linux only
+
+	ResolveTTL int `json:"resolve_ttl"` // seconds to cache names of destinations resolved per link, default 30, negative to disable
+
+	Balance string `json:"balance"` // hub selection of client: links, throughput or rtt, default links
+
+	MaxLinks      int    `json:"max_links"`      // max links created by this end per tunnel, default 1023, at most 32767
+	LinkIdPolicy  string `json:"linkid_policy"`  // when link ids of a hub are exhausted: reject, wait, spill or busy
+	LinkIdTimeout int    `json:"linkid_timeout"` // max milliseconds to wait for a free link id, default 1000
+
+	// ids leaked by links never released are logged, and reclaimed if they
+	// leaked for linkid_reclaim
+	LinkIdAudit   int `json:"linkid_audit"`   // seconds between audits of link ids of each tunnel, disabled if 0
+	LinkIdReclaim int `json:"linkid_reclaim"` // seconds, disabled if 0
+
+	IdleTimeout int `json:"idle_timeout"` // close links without traffic in seconds, disabled if 0
+
+	// links and tunnels are closed gracefully at max age, a tunnel is
+	// replaced by a new one with fresh keys
+	LinkMaxAge   int `json:"link_max_age"`   // seconds, disabled if 0
+	TunnelMaxAge int `json:"tunnel_max_age"` // seconds, disabled if 0
+
+	// json record of every closed link: a file path, "syslog" or
+	// syslog://host:port, disabled if empty
+	AccessLog        string `json:"access_log"`
+	AccessLogSize    int64  `json:"access_log_size"`    // max bytes of file before it's rotated, default 100MB
+	AccessLogBackups int    `json:"access_log_backups"` // rotated files kept, default 5, none if negative
+
+	// links are traced as opentelemetry spans exported to an otlp/http
+	// collector, such as http://127.0.0.1:4318/v1/traces, disabled if empty
+	Tracing     string  `json:"tracing"`
+	TraceSample float64 `json:"trace_sample"` // ratio of new traces started, default 1, negative to follow peer only
+
+	// command deciding links created by peer before destinations are
+	// dialed, run without shell per link, see Policy. Disabled if empty.
+	PolicyExec    string `json:"policy_exec"`
+	PolicyTimeout int    `json:"policy_timeout"` // max milliseconds of a decision, default 1000
+
+	LinkRate int64 `json:"link_rate"` // bytes per second of each link in each direction, 0 means unlimited
+	HubRate  int64 `json:"hub_rate"`  // bytes per second of all links in a tunnel in each direction, 0 means unlimited
+	BulkRate int64 `json:"bulk_rate"` // bytes per second of bulk links in a tunnel in each direction, 0 means unlimited
+
+	// accept loop of client listeners, excess connections are reset at once
+	MaxConns   int `json:"max_conns"`   // concurrent local connections of all listeners, 0 means unlimited
+	AcceptRate int `json:"accept_rate"` // connections accepted per second, the rest wait in backlog, 0 means unlimited
+
+	// limits of each source ip of client listeners, excess connections are
+	// reset at once
+	MaxConnsPerIP   int `json:"max_conns_per_ip"`   // concurrent connections, 0 means unlimited
+	AcceptRatePerIP int `json:"accept_rate_per_ip"` // connections per second with one second of burst, 0 means unlimited
+
+	SendQueue int64 `json:"send_queue"` // max bytes of data frames queued to write to a tunnel, default 256KB
+
+	Heartbeat        int `json:"heartbeat"`         // ping interval in seconds, disabled if 0
+	HeartbeatTimeout int `json:"heartbeat_timeout"` // close tunnel if no frame received in seconds, default 3 intervals
+
+	HealthCheck int `json:"health_check"` // seconds between echo checks of client tunnels end to end, disabled if 0
+
+	Standby int `json:"standby"` // idle hubs kept connected by client, taken at once when a tunnel breaks
+
+	// broken tunnel keeps its links and replays frames over another
+	// connection if client reconnects in grace period
+	Resume       int   `json:"resume"`        // grace period in seconds, disabled if 0
+	ResumeBuffer int64 `json:"resume_buffer"` // max bytes of frames kept until peer acks, default 4MB
+
+	// server issues a ticket after full handshake, client reconnects in one
+	// round trip by presenting it
+	Ticket int `json:"ticket"` // seconds a ticket is valid, disabled if 0
+
+	// key of aes-256-gcm tunnel is ratcheted in place, for the direction
+	// written by this end
+	RekeyBytes    int64 `json:"rekey_bytes"`    // bytes written under a key, disabled if 0
+	RekeyInterval int   `json:"rekey_interval"` // seconds, disabled if 0
+
+	// client opens extra tunnels up to TunnelsMax when links or throughput
+	// per tunnel exceed thresholds, and closes idle ones when load drops
+	TunnelsMax int   `json:"tunnels_max"` // disabled if not above Tunnels
+	ScaleLinks int   `json:"scale_links"` // links per tunnel, default 256
+	ScaleRate  int64 `json:"scale_rate"`  // bytes per second per tunnel, ignored if 0
+
+	ReconnectMin     int `json:"reconnect_min"`     // min reconnect delay in seconds, default 1
+	ReconnectMax     int `json:"reconnect_max"`     // max reconnect delay in seconds, default 60
+	ReconnectRetries int `json:"reconnect_retries"` // give up a tunnel after retries, 0 means forever
+
+	// called after every failed reconnect of tunnel index
+	OnReconnectFailed func(index int, attempts int, err error) `json:"-"`
+
+	// could be reloaded by App.Reload
+	Secrets  []*Secret     `json:"secrets"` // previous secrets accepted by server
+	Clients  []*Credential `json:"clients"` // identified clients accepted by server
+	Rules    []*Rule       `json:"rules"`
+	ACL      ACL           `json:"acl"`       // destinations allowed to dial by server
+	Quotas   []*Quota      `json:"quotas"`    // byte quotas of client identities, server only
+	LogLevel *uint         `json:"log_level"` // overrides log level if set
+}
+
+// load config file, toml if its extension is .toml, json otherwise
+func LoadConfig(file string) (*Config, error) {
+	config := new(Config)
+	if err := LoadConfigInto(file, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// like LoadConfig, but options missing from file keep their values in config.
+// ${NAME} or ${NAME:-default} in strings is replaced by environment variable
+// NAME, it's an error if NAME is unset and there's no default. Unknown
+// options are errors too.
+func LoadConfigInto(file string, config *Config) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := parseConfig(data, strings.HasSuffix(file, ".toml"), config); err != nil {
+		return fmt.Errorf("parse %s failed: %s", file, err)
+	}
+	return nil
+}
+
+func parseConfig(data []byte, toml bool, config *Config) error {
+	var v interface{}
+	var err error
+	if toml {
+		v, err = parseTOML(data)
+	} else {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		err = d.Decode(&v)
+	}
+	if err != nil {
+		return err
+	}
+	if v, err = expandEnv(v); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(v); err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	return d.Decode(config)
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// replace environment variables in strings of decoded config
+func expandEnv(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		var err error
+		s := envPattern.ReplaceAllStringFunc(v, func(m string) string {
+			sub := envPattern.FindStringSubmatch(m)
+			if value, ok := os.LookupEnv(sub[1]); ok {
+				return value
+			}
+			if sub[2] != "" {
+				return sub[2][2:]
+			}
+			if err == nil {
+				err = fmt.Errorf("environment variable %s is not set", sub[1])
+			}
+			return m
+		})
+		return s, err
+	case []interface{}:
+		for i, e := range v {
+			var err error
+			if v[i], err = expandEnv(e); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			var err error
+			if v[k], err = expandEnv(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// check config as Start does, without listening or dialing. Files of tls
+// are read, access log is not opened.
+func (c *Config) Validate() error {
+	app := &App{Config: *c}
+	app.AccessLog = ""
+	return app.init()
+}
+
+// options out of range, all of them are reported
+func (c *Config) check() error {
+	var errs []error
+	for _, o := range []struct {
+		name  string
+		value int64
+	}{
+		{"ban_threshold", int64(c.BanThreshold)},
+		{"handshake_timeout", int64(c.HandshakeTimeout)},
+		{"max_handshakes", int64(c.MaxHandshakes)},
+		{"dial_timeout", int64(c.DialTimeout)},
+		{"kcp_mtu", int64(c.KCPMtu)},
+		{"kcp_window", int64(c.KCPWindow)},
+		{"kcp_data_shards", int64(c.KCPDataShards)},
+		{"kcp_parity_shards", int64(c.KCPParityShards)},
+		{"idle_timeout", int64(c.IdleTimeout)},
+		{"link_max_age", int64(c.LinkMaxAge)},
+		{"linkid_audit", int64(c.LinkIdAudit)},
+		{"linkid_reclaim", int64(c.LinkIdReclaim)},
+		{"tunnel_max_age", int64(c.TunnelMaxAge)},
+		{"access_log_size", c.AccessLogSize},
+		{"link_rate", c.LinkRate},
+		{"hub_rate", c.HubRate},
+		{"bulk_rate", c.BulkRate},
+		{"max_conns", int64(c.MaxConns)},
+		{"accept_rate", int64(c.AcceptRate)},
+		{"max_conns_per_ip", int64(c.MaxConnsPerIP)},
+		{"accept_rate_per_ip", int64(c.AcceptRatePerIP)},
+		{"send_queue", c.SendQueue},
+		{"heartbeat", int64(c.Heartbeat)},
+		{"heartbeat_timeout", int64(c.HeartbeatTimeout)},
+		{"health_check", int64(c.HealthCheck)},
+		{"standby", int64(c.Standby)},
+		{"resume", int64(c.Resume)},
+		{"resume_buffer", c.ResumeBuffer},
+		{"ticket", int64(c.Ticket)},
+		{"rekey_bytes", c.RekeyBytes},
+		{"rekey_interval", int64(c.RekeyInterval)},
+		{"tunnels_max", int64(c.TunnelsMax)},
+		{"policy_timeout", int64(c.PolicyTimeout)},
+		{"scale_rate", c.ScaleRate},
+		{"reconnect_min", int64(c.ReconnectMin)},
+		{"reconnect_max", int64(c.ReconnectMax)},
+		{"reconnect_retries", int64(c.ReconnectRetries)},
+	} {
+		if o.value < 0 {
+			errs = append(errs, fmt.Errorf("%s should not be negative: %d", o.name, o.value))
+		}
+	}
+	if c.ReconnectMin > 0 && c.ReconnectMax > 0 && c.ReconnectMin > c.ReconnectMax {
+		errs = append(errs, fmt.Errorf("reconnect_min %d is above reconnect_max %d", c.ReconnectMin, c.ReconnectMax))
+	}
+	return errors.Join(errs...)
+}
+
+// create a tunnel client, Tunnels defaults to 1
+func NewClient(config Config) (*Client, error) {
+	if config.Tunnels == 0 {
+		config.Tunnels = 1
+	}
+	app := &App{Config: config}
+	if err := app.init(); err != nil {
+		return nil, err
+	}
+	cli := newClient(app)
+	app.service = cli
+	return cli, nil
+}
+
+// create a tunnel server, Tunnels is ignored
+func NewServer(config Config) (*Server, error) {
+	config.Tunnels = 0
+	app := &App{Config: config}
+	if err := app.init(); err != nil {
+		return nil, err
+	}
+	server := newServer(app)
+	app.service = server
+	return server, nil
+}
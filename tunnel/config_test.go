@@ -0,0 +1,111 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("GOTUNNEL_TEST_SECRET", "from env")
+	dir := t.TempDir()
+	toml := filepath.Join(dir, "gotunnel.toml")
+	os.WriteFile(toml, []byte(`
+backend = "${GOTUNNEL_TEST_HOST:-127.0.0.1}:8001"
+secret = "${GOTUNNEL_TEST_SECRET}"
+tunnels = 2
+heartbeat = 5
+
+[[secrets]]
+secret = "old"
+expires = 2015-10-01T00:00:00Z
+
+[[rules]]
+name = "ssh"
+listen = "127.0.0.1:2222"
+backend = "127.0.0.1:22"
+`), 0600)
+	json := filepath.Join(dir, "gotunnel.json")
+	os.WriteFile(json, []byte(`{
+	"backend": "${GOTUNNEL_TEST_HOST:-127.0.0.1}:8001",
+	"secret": "${GOTUNNEL_TEST_SECRET}",
+	"tunnels": 2,
+	"heartbeat": 5,
+	"secrets": [{"secret": "old", "expires": "2015-10-01T00:00:00Z"}],
+	"rules": [{"name": "ssh", "listen": "127.0.0.1:2222", "backend": "127.0.0.1:22"}]
+}`), 0600)
+
+	for _, file := range []string{toml, json} {
+		// options missing from file are kept
+		c := Config{Listen: ":8001", Tunnels: 1, Cipher: CipherAES256GCM}
+		if err := LoadConfigInto(file, &c); err != nil {
+			t.Fatal(err)
+		}
+		if c.Listen != ":8001" || c.Backend != "127.0.0.1:8001" || c.Secret != "from env" || c.Tunnels != 2 ||
+			c.Heartbeat != 5 || c.Cipher != CipherAES256GCM {
+			t.Fatalf("%s: unexpected config:%+v", file, c)
+		}
+		if len(c.Secrets) != 1 || !c.Secrets[0].Expires.Equal(time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("%s: unexpected secrets:%+v", file, c.Secrets)
+		}
+		if len(c.Rules) != 1 || c.Rules[0].Name != "ssh" || c.Rules[0].Backend != "127.0.0.1:22" {
+			t.Fatalf("%s: unexpected rules:%+v", file, c.Rules)
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"unknown.toml", "tunels = 2", `unknown field "tunels"`},
+		{"nested.json", `{"rules": [{"name": "a", "listn": ":1"}]}`, `unknown field "listn"`},
+		{"type.toml", `tunnels = "2"`, "cannot unmarshal string"},
+		{"env.toml", `secret = "${GOTUNNEL_TEST_UNSET}"`, "GOTUNNEL_TEST_UNSET is not set"},
+		{"syntax.toml", "[rules", "line 1"},
+	} {
+		file := filepath.Join(dir, c.name)
+		os.WriteFile(file, []byte(c.data), 0600)
+		_, err := LoadConfig(file)
+		if err == nil || !strings.Contains(err.Error(), c.err) || !strings.Contains(err.Error(), file) {
+			t.Errorf("%s: unexpected error:%v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	c := Config{Listen: ":8001", Backend: "127.0.0.1:1234", Tunnels: 1, Heartbeat: -1, ReconnectMin: 10, ReconnectMax: 5}
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "heartbeat should not be negative") ||
+		!strings.Contains(err.Error(), "reconnect_min 10 is above reconnect_max 5") {
+		t.Fatalf("unexpected error:%v", err)
+	}
+
+	c = Config{Listen: ":8001", Backend: "127.0.0.1:1234", Tunnels: 1, Cipher: "des"}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "unknown cipher") {
+		t.Fatalf("unexpected error:%v", err)
+	}
+
+	// access log is not opened by validation
+	log := filepath.Join(t.TempDir(), "access.log")
+	c = Config{Listen: ":8001", Backend: "127.0.0.1:1234", Tunnels: 1, AccessLog: log}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(log); !os.IsNotExist(err) {
+		t.Fatalf("access log is created:%v", err)
+	}
+}
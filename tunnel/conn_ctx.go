@@ -0,0 +1,55 @@
+//
+//   date  : 2015-07-02
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// abort blocking io on conn when ctx is done, the returned func releases the binding
+func bindConn(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// handshake should finish in HandshakeTimeout seconds, or Timeout
+func (app *App) handshakeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(Timeout) * time.Second
+	if app.HandshakeTimeout > 0 {
+		timeout = time.Duration(app.HandshakeTimeout) * time.Second
+	}
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// deadline of handshake passed. io on a conn bound to ctx times out at the
+// deadline, which may be before ctx is done
+func handshakeExpired(ctx context.Context, now time.Time) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && !now.Before(deadline)
+}
@@ -0,0 +1,190 @@
+//
+//   date  : 2015-10-06
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// internals of a link for diagnosing stuck pumps
+type linkVars struct {
+	Id       uint32  `json:"id"`
+	Idle     float64 `json:"idle"`     // seconds since last transfer
+	Buffered int     `json:"buffered"` // frames received but not written to local conn
+	Sending  bool    `json:"sending"`  // peer still accepts data
+	Window   int64   `json:"window"`   // bytes allowed to send, -1 without flow control
+	Granted  int64   `json:"granted"`  // bytes peer is allowed to send but not consumed
+}
+
+type hubVars struct {
+	Id      uint32     `json:"id"`
+	Links   int        `json:"links"`
+	FreeIds int        `json:"free_ids"` // link ids this end could acquire
+	Queued  int64      `json:"queued"`
+	Idle    float64    `json:"idle"` // seconds since last frame received
+	RTT     float64    `json:"rtt"`  // seconds
+	Closing bool       `json:"closing"`
+	Details []linkVars `json:"details"`
+}
+
+type debugVars struct {
+	Goroutines int              `json:"goroutines"`
+	Pool       int32            `json:"pool"` // buffers allocated by pool
+	Counters   map[string]int64 `json:"counters"`
+	Hubs       []hubVars        `json:"hubs"`
+}
+
+func (self *Link) vars() linkVars {
+	self.flow.L.Lock()
+	defer self.flow.L.Unlock()
+	window := int64(-1)
+	if self.flowOn {
+		window = self.sendLimit - self.sent
+	}
+	return linkVars{
+		Id:       self.id,
+		Idle:     self.idle().Seconds(),
+		Buffered: self.rbuf.Len(),
+		Sending:  self.sflag,
+		Window:   window,
+		Granted:  self.granted - self.consumed,
+	}
+}
+
+func (self *Hub) vars() hubVars {
+	v := hubVars{
+		Id:      self.id,
+		Links:   self.LinkCount(),
+		FreeIds: self.idStatus().Free,
+		Queued:  self.tunnel.queue.size(),
+		Idle:    self.idle().Seconds(),
+		RTT:     time.Duration(atomic.LoadInt64(&self.lastRTT)).Seconds(),
+		Closing: self.IsClosing(),
+		Details: []linkVars{},
+	}
+	for _, link := range self.activeLinks() {
+		v.Details = append(v.Details, link.vars())
+	}
+	return v
+}
+
+func collectVars(hubs []*Hub) debugVars {
+	v := debugVars{
+		Goroutines: runtime.NumGoroutine(),
+		Pool:       mpool.Alloced(),
+		Counters: map[string]int64{
+			"links_created":       atomic.LoadInt64(&stats.LinkCreated),
+			"links_closed":        atomic.LoadInt64(&stats.LinkClosed),
+			"handshake_failed":    atomic.LoadInt64(&stats.HandshakeFailed),
+			"reconnects":          atomic.LoadInt64(&stats.Reconnects),
+			"frames_corrupted":    atomic.LoadInt64(&stats.FrameCorrupted),
+			"tokens_replayed":     atomic.LoadInt64(&stats.TokenReplayed),
+			"handshake_timeouts":  atomic.LoadInt64(&stats.HandshakeTimeouts),
+			"handshakes_rejected": atomic.LoadInt64(&stats.HandshakesRejected),
+			"ticket_resumed":      atomic.LoadInt64(&stats.TicketResumed),
+			"ticket_rejected":     atomic.LoadInt64(&stats.TicketRejected),
+			"banned_conns":        atomic.LoadInt64(&stats.BannedConns),
+			"accepts_rejected":    atomic.LoadInt64(&stats.AcceptRejected),
+			"panics":              atomic.LoadInt64(&stats.Panics),
+			"mirror_dropped":      atomic.LoadInt64(&stats.MirrorDropped),
+			"health_failed":       atomic.LoadInt64(&stats.HealthFailed),
+			"failovers":           atomic.LoadInt64(&stats.Failovers),
+			"backend_down":        atomic.LoadInt64(&stats.BackendDown),
+			"policy_denied":       atomic.LoadInt64(&stats.PolicyDenied),
+			"linkids_leaked":      atomic.LoadInt64(&stats.LinkIdsLeaked),
+			"linkids_reclaimed":   atomic.LoadInt64(&stats.LinkIdsReclaimed),
+			"spans_exported":      atomic.LoadInt64(&stats.SpansExported),
+			"spans_dropped":       atomic.LoadInt64(&stats.SpansDropped),
+		},
+		Hubs: []hubVars{},
+	}
+	for _, hub := range hubs {
+		v.Hubs = append(v.Hubs, hub.vars())
+	}
+	return v
+}
+
+// expvar page of process wide vars, such as memstats, and gotunnel vars of
+// this service, which are not published globally so embedders could run
+// several services
+func writeVars(w http.ResponseWriter, hubs []*Hub) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+	data, _ := json.Marshal(collectVars(hubs))
+	fmt.Fprintf(w, "%q: %s\n}\n", "gotunnel", data)
+}
+
+// stacks of all goroutines
+func goroutineDump() []byte {
+	var buf bytes.Buffer
+	rpprof.Lookup("goroutine").WriteTo(&buf, 2)
+	return buf.Bytes()
+}
+
+// serve diagnostics until ctx is done:
+//
+//	/debug/pprof/                           net/http/pprof profiles
+//	GET  /debug/vars                        expvar with hubs and links internals
+//	POST /debug/dump                        log stacks of all goroutines and return them
+func serveDebug(ctx context.Context, addr string, hubs func() []*Hub) (net.Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := listenTCP(tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		writeVars(w, hubs())
+	})
+	mux.HandleFunc("/debug/dump", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dump := goroutineDump()
+		Log("goroutine dump by debug api:\n%s", dump)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(dump)
+	})
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		server.Shutdown(sctx)
+		cancel()
+	}()
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			Error("debug server quit:%v", err)
+		}
+	}()
+	Info("serve debug on %v", ln.Addr())
+	return ln, nil
+}
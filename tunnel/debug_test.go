@@ -0,0 +1,39 @@
+//
+//   date  : 2015-10-06
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPairDebugVars(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{})
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+
+	w := httptest.NewRecorder()
+	writeVars(w, p.client.activeHubs())
+	var page struct {
+		Memstats json.RawMessage `json:"memstats"`
+		Gotunnel debugVars       `json:"gotunnel"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("bad vars page:%v\n%s", err, w.Body.Bytes())
+	}
+	if len(page.Memstats) == 0 {
+		t.Fatal("memstats should be published")
+	}
+	vars := page.Gotunnel
+	if len(vars.Hubs) != 1 || vars.Hubs[0].FreeIds <= 0 || vars.Counters["links_created"] == 0 {
+		t.Fatalf("unexpected vars:%+v", vars)
+	}
+	if len(goroutineDump()) == 0 {
+		t.Fatal("goroutine dump should not be empty")
+	}
+}
@@ -0,0 +1,250 @@
+//
+//   date  : 2015-09-18
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// dialer of tunnel connections by client and backend connections by server,
+// network is tcp or udp
+func (app *App) dialer(network string) *net.Dialer {
+	d := &net.Dialer{
+		Timeout: time.Duration(app.DialTimeout) * time.Second,
+	}
+	if app.bindIP != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: app.bindIP}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: app.bindIP}
+		}
+	}
+	if app.TOS == 0 && !app.FastOpen {
+		return d
+	}
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			if app.TOS != 0 {
+				err = setTOS(fd, network, app.TOS)
+			}
+			if err == nil && app.FastOpen && network[:3] == "tcp" {
+				err = setFastOpen(fd)
+			}
+		})
+		return err
+	}
+	return d
+}
+
+// TCP_NODELAY is set by go unless Nagle is enabled
+func (app *App) tuneConn(conn *net.TCPConn) {
+	if app.Nagle {
+		conn.SetNoDelay(false)
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(time.Second * 60)
+}
+
+// dial backend of link
+func (app *App) dialLink(ctx context.Context, network, addr string) (net.Conn, error) {
+	if app.network != nil {
+		return app.network.Dial(ctx, addr)
+	}
+	return app.dialer(network).DialContext(ctx, network, addr)
+}
+
+// listen on address of tcp rule
+func (app *App) listenLink(rule *Rule) (net.Listener, error) {
+	if rule.lpath != "" {
+		return listenUnix(rule.lpath)
+	}
+	if app.network != nil {
+		return app.network.Listen(rule.laddr.String())
+	}
+	if rule.Transparent {
+		return listenTransparent(rule.laddr)
+	}
+	return listenTCP(rule.laddr)
+}
+
+// prefix of unix socket address of rules, unix:///path
+const unixScheme = "unix://"
+
+// path of unix socket address, ok is false if addr isn't one
+func unixPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixScheme), true
+}
+
+// stale socket file left by a previous process is removed. The file is
+// kept when listener is closed, so an old process of graceful upgrade
+// doesn't remove the socket of the new one.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	return ln, nil
+}
+
+// dial unix socket backend, tcp options don't apply
+func (app *App) dialUnix(ctx context.Context, path string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: time.Duration(app.DialTimeout) * time.Second}
+	return d.DialContext(ctx, "unix", path)
+}
+
+// split host:port of tunnel server, port must be numeric or a known service
+func splitTunnelAddr(addr string) (host string, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return "", err
+	}
+	return host, nil
+}
+
+// delay before dialing the next address of tunnel server while previous
+// ones are still connecting, as happy eyeballs (rfc 8305)
+const happyEyeballsDelay = time.Millisecond * 300
+
+// addresses of the two families interleave, starting from the family of the
+// first address
+func interleaveFamilies(ips []net.IPAddr) []net.IPAddr {
+	if len(ips) == 0 {
+		return ips
+	}
+	var first, other []net.IPAddr
+	v4 := ips[0].IP.To4() != nil
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == v4 {
+			first = append(first, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	sorted := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(other); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(other) {
+			sorted = append(sorted, other[i])
+		}
+	}
+	return sorted
+}
+
+// resolve tunnel server of addr on every dial, so client follows a server
+// moved by dns. Its ipv4 and ipv6 addresses are raced as happy eyeballs:
+// starting from the one connected last time, the next address is dialed if
+// the previous fails or doesn't connect in 300ms, and the first connected
+// wins, so a broken ipv6 path doesn't hang dual stack servers
+func (app *App) dialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, err := splitTunnelAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	app.lock.RLock()
+	last := app.tunnelIPs[addr]
+	app.lock.RUnlock()
+	for i, ip := range ips {
+		if ip.IP.Equal(last) {
+			ips[0], ips[i] = ips[i], ips[0]
+			break
+		}
+	}
+	ips = interleaveFamilies(ips)
+
+	type result struct {
+		conn net.Conn
+		ip   net.IPAddr
+		err  error
+	}
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	var delay <-chan time.Time
+	dialNext := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			d, err := app.tunnelDialer(dctx, network, ip.IP)
+			var conn net.Conn
+			if err == nil {
+				conn, err = d.DialContext(dctx, network, net.JoinHostPort(ip.String(), port))
+			}
+			results <- result{conn: conn, ip: ip, err: err}
+		}()
+		delay = nil
+		if next < len(ips) {
+			delay = time.After(happyEyeballsDelay)
+		}
+	}
+
+	var firstErr error
+	dialNext()
+	for pending > 0 {
+		select {
+		case <-delay:
+			dialNext()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// close losers connected at the same time
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				if !r.ip.IP.Equal(last) {
+					Info("tunnel server %s resolved to %s", host, r.conn.RemoteAddr())
+					app.lock.Lock()
+					if app.tunnelIPs == nil {
+						app.tunnelIPs = make(map[string]net.IP)
+					}
+					app.tunnelIPs[addr] = r.ip.IP
+					app.lock.Unlock()
+				}
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if len(ips) > 1 {
+				Info("dial tunnel server %s at %s failed:%s", host, r.ip.String(), r.err)
+			}
+			if next < len(ips) && ctx.Err() == nil {
+				dialNext()
+			}
+		}
+	}
+	return nil, firstErr
+}
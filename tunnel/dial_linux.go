@@ -0,0 +1,77 @@
+//
+//   date  : 2015-09-18
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// connect returns at once and syn carries the first write
+const tcpFastOpenConnect = 30
+
+func setTOS(fd uintptr, network string, tos int) error {
+	if network == "tcp6" || network == "udp6" {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
+
+func setFastOpen(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+}
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST of netfilter, the same for ipv6
+	ipv6Transparent = 75
+)
+
+// listening socket accepts connections to any address routed to it by
+// TPROXY, it needs CAP_NET_ADMIN
+func setTransparent(fd uintptr, network string) error {
+	if network == "tcp6" {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TRANSPARENT, 1)
+}
+
+// destination of a connection before REDIRECT of iptables, from conntrack.
+// Sockaddr is read by getsockopt of the same size, its port is big endian
+func getOriginalDst(fd uintptr, ipv6 bool) (*net.TCPAddr, error) {
+	if ipv6 {
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			return nil, err
+		}
+		port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+		return &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(port)}, nil
+	}
+	mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	b := mreq.Multiaddr
+	return &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}, nil
+}
+
+// it needs CAP_NET_RAW
+func setBindDevice(fd uintptr, dev string) error {
+	return syscall.BindToDevice(int(fd), dev)
+}
+
+// total retransmits and mss of tcp connection
+func getTCPRetrans(fd uintptr) (retrans, mss uint32, err error) {
+	var info syscall.TCPInfo
+	size := uint32(unsafe.Sizeof(info))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+		uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return info.Total_retrans, info.Snd_mss, nil
+}
@@ -0,0 +1,40 @@
+//
+//   date  : 2015-09-18
+//   author: xjdrew
+//
+
+//go:build !linux
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+)
+
+var errDialOption = errors.New("dial option is not supported on this platform")
+
+func setTOS(fd uintptr, network string, tos int) error {
+	return errDialOption
+}
+
+func setFastOpen(fd uintptr) error {
+	return errDialOption
+}
+
+func setTransparent(fd uintptr, network string) error {
+	return errDialOption
+}
+
+func getOriginalDst(fd uintptr, ipv6 bool) (*net.TCPAddr, error) {
+	return nil, errDialOption
+}
+
+// only source ip is bound
+func setBindDevice(fd uintptr, dev string) error {
+	return nil
+}
+
+func getTCPRetrans(fd uintptr) (retrans, mss uint32, err error) {
+	return 0, 0, errDialOption
+}
@@ -0,0 +1,115 @@
+//
+//   date  : 2015-09-29
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDialTunnel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// localhost may resolve to ::1 first, which refuses
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+	app := &App{}
+	for i := 0; i < 2; i++ {
+		conn, err := app.dialTunnel(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("dial tunnel failed:%v", err)
+		}
+		conn.Close()
+		if ip := app.tunnelIPs[addr]; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("unexpected tunnel ip:%v", ip)
+		}
+	}
+
+	if _, err := app.dialTunnel(context.Background(), "tcp", "localhost:http-unknown"); err == nil {
+		t.Fatal("unknown port should fail")
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := []net.IPAddr{
+		{IP: net.ParseIP("::1")}, {IP: net.ParseIP("::2")}, {IP: net.ParseIP("::3")},
+		{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")},
+	}
+	var got []string
+	for _, ip := range interleaveFamilies(ips) {
+		got = append(got, ip.String())
+	}
+	if s := strings.Join(got, ","); s != "::1,10.0.0.1,::2,10.0.0.2,::3" {
+		t.Fatalf("unexpected order:%s", s)
+	}
+}
+
+func TestPairUnix(t *testing.T) {
+	dir := t.TempDir()
+	backend := filepath.Join(dir, "backend.sock")
+	listen := filepath.Join(dir, "listen.sock")
+	ln, err := net.Listen("unix", backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	server := Config{Rules: []*Rule{{Name: "db", Backend: unixScheme + backend}}}
+	client := Config{Rules: []*Rule{{Name: "db", Listen: unixScheme + listen}}}
+	newTestPair(t, server, client)
+	conn, err := net.Dial("unix", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		io.WriteString(conn, "hello")
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+	if echoed, err := io.ReadAll(conn); err != nil || string(echoed) != "hello" {
+		t.Fatalf("unexpected echo:%q, %v", echoed, err)
+	}
+
+	app := &App{Config: Config{Listen: "127.0.0.1:0", Backend: "127.0.0.1:1"}}
+	for _, rule := range []*Rule{
+		{Name: "a", Backend: unixScheme + backend, UDP: true},
+		{Name: "b", Backend: unixScheme + backend, BackendTLS: true},
+		{Name: "c", Backend: unixScheme},
+	} {
+		if _, err := app.buildRules([]*Rule{rule}); err == nil {
+			t.Fatalf("rule %s should be rejected", rule)
+		}
+	}
+}
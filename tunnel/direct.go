@@ -0,0 +1,91 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// a rule with Direct falls back to connecting destination directly when
+// the tunnel can't take a connection: no tunnel is active, all are
+// draining or closing, or no link id is available. The destination is the
+// one requested by proxy client, or DirectBackend of a static rule. It's
+// decided for each connection, so new connections go through tunnels again
+// as soon as one recovers.
+
+// connect destination of conn directly, and relay until both ends close
+func (cli *Client) handleDirect(conn BiConn, rule *Rule, args *LinkArgs) {
+	var err error
+	var reply func(code uint8) error
+	dest := args.Dest
+	if rule.Socks5 {
+		if dest, err = socks5Handshake(conn, false); err != nil {
+			Error("rule %s: socks5 handshake failed, source: %v, err:%v", rule, args.Source, err)
+			return
+		}
+		reply = func(code uint8) error {
+			return socks5Reply(conn, socks5CloseReply(code))
+		}
+	} else if rule.HTTPProxy {
+		var c BiConn
+		if c, dest, err = httpConnectHandshake(conn, false); err != nil {
+			Error("rule %s: http proxy handshake failed, source: %v, err:%v", rule, args.Source, err)
+			return
+		}
+		conn = c
+		reply = func(code uint8) error {
+			return httpConnectReply(c, code)
+		}
+	} else if dest == "" {
+		dest = rule.DirectBackend
+	}
+	atomic.AddInt64(&stats.DirectConns, 1)
+	Info("rule %s: no tunnel available, connect %s directly, source: %v", rule, dest, args.Source)
+
+	ctx := cli.ctx
+	if rule.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(rule.ConnectTimeout)*time.Second)
+		defer cancel()
+	}
+	var c net.Conn
+	if path, ok := unixPath(dest); ok {
+		c, err = cli.app.dialUnix(ctx, path)
+	} else {
+		c, err = cli.app.dialLink(ctx, "tcp", dest)
+	}
+	if reply != nil {
+		if rerr := reply(closeCode(err)); rerr != nil && err == nil {
+			Error("rule %s: reply proxy request failed, source: %v, err:%v", rule, args.Source, rerr)
+			c.Close()
+			return
+		}
+	}
+	if err != nil {
+		Error("rule %s: connect %s directly failed, err:%v", rule, dest, err)
+		return
+	}
+	defer c.Close()
+	relay(conn, c.(BiConn))
+}
+
+// copy data both ways, shutting down writing of one end when the other
+// end's reading is done
+func relay(a, b BiConn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(b, a)
+		b.CloseWrite()
+	}()
+	io.Copy(a, b)
+	a.CloseWrite()
+	<-done
+}
@@ -0,0 +1,63 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestPairDirect(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{Direct: true, DirectBackend: testBackendAddr})
+	direct := atomic.LoadInt64(&stats.DirectConns)
+	if got := p.roundTrip(t, "hello"); got != "hello" {
+		t.Fatalf("unexpected echo:%q", got)
+	}
+	if atomic.LoadInt64(&stats.DirectConns) != direct {
+		t.Fatal("connection shouldn't be direct while tunnel is active")
+	}
+
+	// all tunnels are closing, connections go to backend directly
+	setClosing := func(closing bool) {
+		for _, hub := range p.client.activeHubs() {
+			hub.lock.Lock()
+			hub.closing = closing
+			hub.lock.Unlock()
+		}
+	}
+	setClosing(true)
+	if got := p.roundTrip(t, "direct"); got != "direct" {
+		t.Fatalf("unexpected echo:%q", got)
+	}
+	if atomic.LoadInt64(&stats.DirectConns) != direct+1 {
+		t.Fatal("connection should be direct")
+	}
+
+	// and back to tunnel once it recovers
+	setClosing(false)
+	if got := p.roundTrip(t, "again"); got != "again" {
+		t.Fatalf("unexpected echo:%q", got)
+	}
+	if atomic.LoadInt64(&stats.DirectConns) != direct+1 {
+		t.Fatal("connection should go through tunnel again")
+	}
+}
+
+func TestDirectConfig(t *testing.T) {
+	app := &App{Config: Config{Listen: "127.0.0.1:0", Backend: "127.0.0.1:1", Tunnels: 1}}
+	for _, rule := range []*Rule{
+		{Name: "a", Listen: "127.0.0.1:0", Direct: true},
+		{Name: "b", Listen: "127.0.0.1:0", Direct: true, DirectBackend: "127.0.0.1:80", UDP: true},
+		{Name: "c", Listen: "127.0.0.1:0", DirectBackend: "127.0.0.1:80"},
+	} {
+		if _, err := app.buildRules([]*Rule{rule}); err == nil {
+			t.Fatalf("rule %s should be rejected", rule)
+		}
+	}
+	if _, err := app.buildRules([]*Rule{{Name: "a", Listen: "127.0.0.1:0", Direct: true, Socks5: true}}); err != nil {
+		t.Fatal(err)
+	}
+}
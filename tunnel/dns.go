@@ -0,0 +1,122 @@
+//
+//   date  : 2015-10-11
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// destinations of links are resolved when links are created, so backends
+// behind dynamic dns are followed. Go's resolver doesn't expose ttl of
+// records, lookups are cached for ResolveTTL seconds instead; failures are
+// not cached, and concurrent lookups of a name share one query.
+
+const (
+	DefaultResolveTTL = 30
+	dnsCacheSize      = 4096 // names cached at most
+)
+
+type lookupFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+type dnsEntry struct {
+	done   chan struct{} // closed when lookup finishes
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+type dnsCache struct {
+	ttl    time.Duration // disabled if not positive
+	lookup lookupFunc
+
+	lock sync.Mutex
+	m    map[string]*dnsEntry
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{ttl: ttl, lookup: lookupIP, m: make(map[string]*dnsEntry)}
+}
+
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// ips of host, ip literal is returned as is
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if c.ttl <= 0 {
+		return c.lookup(ctx, host)
+	}
+
+	c.lock.Lock()
+	e := c.m[host]
+	if e == nil || isDone(e.done) && time.Now().After(e.expire) {
+		if len(c.m) >= dnsCacheSize {
+			c.evict()
+		}
+		e = &dnsEntry{done: make(chan struct{})}
+		c.m[host] = e
+		go c.query(host, e)
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-e.done:
+		return e.ips, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// query outlives ctx of links, others may be waiting for it
+func (c *dnsCache) query(host string, e *dnsEntry) {
+	defer close(e.done)
+	e.ips, e.err = c.lookup(context.Background(), host)
+	e.expire = time.Now().Add(c.ttl)
+	if e.err != nil {
+		c.lock.Lock()
+		if c.m[host] == e {
+			delete(c.m, host)
+		}
+		c.lock.Unlock()
+	}
+}
+
+// drop expired names, or all if none expired. It should be called with
+// lock held.
+func (c *dnsCache) evict() {
+	now := time.Now()
+	for host, e := range c.m {
+		if isDone(e.done) && now.After(e.expire) {
+			delete(c.m, host)
+		}
+	}
+	if len(c.m) >= dnsCacheSize {
+		c.m = make(map[string]*dnsEntry)
+	}
+}
+
+func isDone(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,95 @@
+//
+//   date  : 2015-10-11
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	var queries int32
+	var fail atomic.Bool
+	c := newDNSCache(time.Hour)
+	c.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(time.Millisecond * 10)
+		if fail.Load() {
+			return nil, errors.New("no such host")
+		}
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+
+	// concurrent lookups share a query
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ips, err := c.resolve(context.Background(), "backend.test"); err != nil || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+				t.Errorf("unexpected lookup:%v, %v", ips, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("unexpected queries:%d", n)
+	}
+	if ips, _ := c.resolve(context.Background(), "10.0.0.2"); atomic.LoadInt32(&queries) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatal("ip literal shouldn't be looked up")
+	}
+
+	// expired names are looked up again, failures aren't cached
+	c.lock.Lock()
+	c.m["backend.test"].expire = time.Now()
+	c.lock.Unlock()
+	fail.Store(true)
+	for i := 0; i < 2; i++ {
+		if _, err := c.resolve(context.Background(), "backend.test"); err == nil {
+			t.Fatal("lookup should fail")
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 3 {
+		t.Fatalf("unexpected queries:%d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.resolve(ctx, "other.test"); err != context.Canceled {
+		t.Fatalf("unexpected err:%v", err)
+	}
+}
+
+func TestPairBackendName(t *testing.T) {
+	server := Config{Rules: []*Rule{{Name: "web", Backend: "backend.test:8002"}}}
+	client := Config{Rules: []*Rule{{Name: "web", Listen: testListenAddr}}}
+	p := newTestPair(t, server, client)
+	var ip atomic.Value
+	ip.Store("10.0.0.1")
+	p.server.app.dns.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		if host != "backend.test" {
+			return nil, errors.New("no such host")
+		}
+		return []net.IP{net.ParseIP(ip.Load().(string))}, nil
+	}
+
+	// name is resolved when link is created, not when rule is built
+	if echoed := p.roundTrip(t, "hello"); echoed != "" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	ip.Store("127.0.0.1")
+	p.server.app.dns.lock.Lock()
+	p.server.app.dns.m = make(map[string]*dnsEntry)
+	p.server.app.dns.lock.Unlock()
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+}
@@ -0,0 +1,40 @@
+//
+//   date  : 2015-07-06
+//   author: xjdrew
+//
+
+/*
+Package tunnel implements gotunnel client and server, it could be embedded
+in other programs:
+
+	cli, err := tunnel.NewClient(tunnel.Config{
+		Listen:  "127.0.0.1:8080",
+		Backend: "server:8001",
+		Secret:  "your secret",
+		Tunnels: 4,
+	})
+	if err != nil {
+		return err
+	}
+	if err := cli.Start(ctx); err != nil {
+		return err
+	}
+	defer cli.Stop(ctx)
+
+Server is created by NewServer in the same way, Listen is the tunnel address
+and Backend is the service to forward to.
+
+Tunnels and links are reported to an EventHandler set by SetEventHandler
+before Start:
+
+	type alerts struct {
+		tunnel.NopEventHandler
+	}
+
+	func (alerts) OnAuthFailure(e tunnel.AuthFailureEvent) {
+		log.Printf("%s failed auth: %v", e.Remote, e.Err)
+	}
+
+	cli.SetEventHandler(alerts{})
+*/
+package tunnel
@@ -0,0 +1,79 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// draining for maintenance: a draining hub refuses new links and tells its
+// peer by TUNNEL_DRAIN if it's supported, so client schedules new links to
+// other hubs instead of having them refused. The hub is closed when its
+// links finish or timeout passes, and client reconnects it; when the whole
+// server drains, it stops accepting tunnels first, so clients reconnect to
+// other servers. Admin api drains a hub, or the whole process which exits
+// when it's done.
+
+const DefaultDrainTimeout = 300 // seconds
+
+// refuse new links, peer is told at the first time
+func (self *Hub) startDrain() {
+	self.lock.Lock()
+	closing := self.closing
+	self.closing = true
+	self.lock.Unlock()
+	if !closing && self.tunnel.has(capDrain) {
+		self.Send(TUNNEL_DRAIN, 0, nil)
+	}
+}
+
+// peer drains the hub, no new link is scheduled to it
+func (self *Hub) onDrain() {
+	self.log.Log("drained by peer, %d links left", self.LinkCount())
+	self.lock.Lock()
+	self.closing = true
+	self.lock.Unlock()
+}
+
+// drain hub, and close it when links finish or timeout passes
+func (self *Hub) drainClose(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(self.ctx, timeout)
+	defer cancel()
+	if err := self.Drain(ctx); err != nil {
+		self.log.Error("drain timeout, close %d links", self.LinkCount())
+	}
+	self.Close()
+}
+
+// drain all hubs at once, then wait for them in turn
+func drainHubs(ctx context.Context, hubs []*Hub) error {
+	for _, hub := range hubs {
+		hub.startDrain()
+	}
+	for _, hub := range hubs {
+		if err := hub.Drain(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeout query of drain request, DefaultDrainTimeout if it's absent
+func drainTimeout(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("timeout")
+	if s == "" {
+		return DefaultDrainTimeout * time.Second, nil
+	}
+	secs, err := strconv.Atoi(s)
+	if err != nil || secs <= 0 {
+		return 0, fmt.Errorf("bad timeout: %s", s)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
@@ -0,0 +1,110 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPairDrain(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{Tunnels: 2})
+	waitFor(t, "tunnels", func() bool { return len(p.server.activeHubs()) == 2 })
+
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	io.WriteString(conn, "hello")
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var drained *Hub
+	for _, hub := range p.server.activeHubs() {
+		if hub.LinkCount() == 1 {
+			drained = hub
+		}
+	}
+	if drained == nil {
+		t.Fatal("no hub has the link")
+	}
+	go drained.drainClose(time.Minute)
+
+	// client moves new links to the other hub
+	waitFor(t, "drain of client hub", func() bool {
+		for _, hub := range p.client.activeHubs() {
+			if hub.IsClosing() {
+				return true
+			}
+		}
+		return false
+	})
+	for i := 0; i < 4; i++ {
+		if got := p.roundTrip(t, "world"); got != "world" {
+			t.Fatalf("unexpected echo:%q", got)
+		}
+	}
+	if drained.LinkCount() != 1 {
+		t.Fatalf("drained hub has %d links", drained.LinkCount())
+	}
+
+	// existing link goes on, hub is closed when it's done
+	io.WriteString(conn, "again")
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "again" {
+		t.Fatalf("link of drained hub failed:%q, %v", buf, err)
+	}
+	conn.Close()
+	select {
+	case <-drained.ctx.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("drained hub isn't closed")
+	}
+	waitFor(t, "reconnect", func() bool {
+		hubs := p.client.activeHubs()
+		for _, hub := range hubs {
+			if hub.IsClosing() {
+				return false
+			}
+		}
+		return len(hubs) == 2
+	})
+}
+
+func TestDrainTimeout(t *testing.T) {
+	cases := []struct {
+		url  string
+		want time.Duration
+		ok   bool
+	}{
+		{"/drain", DefaultDrainTimeout * time.Second, true},
+		{"/drain?timeout=10", time.Second * 10, true},
+		{"/drain?timeout=0", 0, false},
+		{"/drain?timeout=x", 0, false},
+	}
+	for _, c := range cases {
+		got, err := drainTimeout(httptest.NewRequest("POST", c.url, nil))
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("%s: unexpected timeout %v, err:%v", c.url, got, err)
+		}
+	}
+
+	// draining hub is picked only if all are
+	hubs := []*HubItem{{Hub: &Hub{}, priority: 0}, {Hub: &Hub{}, priority: 1}}
+	hubs[0].closing = true
+	hubs[1].path.loss = 0.5
+	if got := pickHub(hubs, balancers[BalanceLinks]); got != hubs[1] {
+		t.Fatalf("unexpected hub %d", got.priority)
+	}
+	if got := pickHub(hubs, balancers[BalanceLinks], hubs[1]); got != hubs[0] {
+		t.Fatal("draining hub should be picked as the last resort")
+	}
+}
@@ -0,0 +1,52 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"time"
+)
+
+// links of a rule with EarlyData carry the first bytes of the local
+// connection in LINK_CREATE, so the other end writes them to backend as soon
+// as it's connected, and request/response protocols save a round trip of
+// tunnel. The creator waits earlyDataWait at most for them, so protocols in
+// which the server speaks first are only delayed that much. Proxy rules
+// answer their clients before data comes, they don't use it.
+
+const (
+	earlyDataMax  = 4096
+	earlyDataWait = 20 * time.Millisecond
+)
+
+// first bytes of conn sent within earlyDataWait, nil if none. Errors are
+// left to pump, which meets them again.
+func readEarlyData(conn BiConn) []byte {
+	buf := make([]byte, earlyDataMax)
+	conn.SetReadDeadline(time.Now().Add(earlyDataWait))
+	n, _ := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if n == 0 {
+		return nil
+	}
+	return buf[:n]
+}
+
+// early data is read from local conn and sent
+func (self *Link) onEarlyData(data []byte) {
+	self.tap.onRead(data)
+	self.capture(true, data)
+	self.touch()
+	self.onSent(len(data))
+}
+
+// early data of peer is received like data frames
+func (self *Link) putEarlyData(data string) {
+	buf := mpool.GetSize(len(data))
+	copy(buf, data)
+	if !self.putData(buf) {
+		mpool.Put(buf)
+	}
+}
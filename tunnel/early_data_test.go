@@ -0,0 +1,60 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReadEarlyData(t *testing.T) {
+	local, remote := memPipe("a", pipeAddr("b"))
+	defer local.Close()
+	defer remote.Close()
+
+	go io.WriteString(remote, "hello")
+	if data := readEarlyData(local); string(data) != "hello" {
+		t.Fatalf("unexpected early data:%q", data)
+	}
+
+	// server speaks first, nothing comes
+	start := time.Now()
+	if data := readEarlyData(local); data != nil {
+		t.Fatalf("unexpected early data:%q", data)
+	}
+	if time.Since(start) > earlyDataWait*10 {
+		t.Fatal("early data should be waited shortly")
+	}
+	go io.WriteString(remote, "world")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(local, buf); err != nil || string(buf) != "world" {
+		t.Fatalf("conn should be readable after waiting, got %q, err:%v", buf, err)
+	}
+}
+
+func TestPairEarlyData(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{EarlyData: true})
+	for i := 0; i < 4; i++ {
+		if got := p.roundTrip(t, "hello"); got != "hello" {
+			t.Fatalf("unexpected echo:%q", got)
+		}
+	}
+
+	// nothing is sent before the first reply
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(earlyDataWait * 2)
+	io.WriteString(conn, "late")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "late" {
+		t.Fatalf("unexpected echo:%q, err:%v", buf, err)
+	}
+}
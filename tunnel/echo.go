@@ -0,0 +1,49 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"io"
+)
+
+// EchoService is a built-in service of server echoing data of its links
+// back, without backend. Client opens links to it to measure or check a
+// tunnel end to end. Old servers refuse it as an unknown service.
+const EchoService = "@echo"
+
+var echoRule = &Rule{Name: EchoService, echo: true, priority: priorityNormal}
+
+// rule of service name, the built-in echo rule if it's not configured
+func (app *App) serviceRule(name string) *Rule {
+	if rule := app.findRule(name); rule != nil || name != EchoService {
+		return rule
+	}
+	return echoRule
+}
+
+// open a link of hub to echo service, return local end of it
+func (self *Hub) echoLink(source string) BiConn {
+	local, remote := memPipe(pipeAddr(source), EchoService)
+	go func() {
+		defer remote.Close()
+		self.forward(remote, echoRule, &LinkArgs{Service: EchoService})
+	}()
+	return local
+}
+
+// pump link with a conn echoing what it receives
+func (self *ServerHub) handleEchoLink(link *Link) {
+	conn, peer := memPipe("echo", "echo")
+	go func() {
+		defer peer.Close()
+		io.Copy(peer, peer)
+		peer.CloseWrite()
+	}()
+	defer conn.Close()
+	link.dest = EchoService
+	link.SendConnected()
+	link.Pump(conn)
+}
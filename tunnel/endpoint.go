@@ -0,0 +1,137 @@
+//
+//   date  : 2015-09-29
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"time"
+)
+
+// longest time a failing server is skipped
+const maxServerDown = time.Second * 60
+
+// tunnel server of client, tunnels are spread over Backend and Servers.
+// Protected by client lock
+type endpoint struct {
+	addr      string        // host:port
+	tunnels   int           // tunnels connected or connecting to it
+	failures  int           // consecutive failed connects
+	downUntil time.Time     // skipped until then, unless all servers are down
+	rtt       time.Duration // smoothed time of dial and handshake
+	last      bool          // connected last before restart, preferred until a tunnel connects
+}
+
+type endpointStatus struct {
+	Addr     string  `json:"addr"`
+	Tunnels  int     `json:"tunnels"`
+	Failures int     `json:"failures"`
+	Down     bool    `json:"down"`
+	RTT      float64 `json:"rtt"` // milliseconds
+}
+
+func newEndpoints(addrs []string) []*endpoint {
+	eps := make([]*endpoint, len(addrs))
+	for i, addr := range addrs {
+		eps[i] = &endpoint{addr: addr}
+	}
+	return eps
+}
+
+func (ep *endpoint) isDown(now time.Time) bool {
+	return now.Before(ep.downUntil)
+}
+
+// servers up are preferred, then the one with fewest tunnels, then the
+// fastest. If all are down, the one recovering first
+func (ep *endpoint) better(other *endpoint, now time.Time) bool {
+	down, otherDown := ep.isDown(now), other.isDown(now)
+	if down != otherDown {
+		return !down
+	}
+	if down {
+		return ep.downUntil.Before(other.downUntil)
+	}
+	if ep.tunnels != other.tunnels {
+		return ep.tunnels < other.tunnels
+	}
+	if ep.last != other.last {
+		return ep.last
+	}
+	return ep.rtt < other.rtt
+}
+
+// choose server of a new tunnel, it's released by connected, failed or
+// released
+func (cli *Client) pickServer() *endpoint {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+
+	now := time.Now()
+	best := cli.servers[0]
+	for _, ep := range cli.servers[1:] {
+		if ep.better(best, now) {
+			best = ep
+		}
+	}
+	best.tunnels++
+	return best
+}
+
+func (cli *Client) serverConnected(ep *endpoint, rtt time.Duration) {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	ep.failures = 0
+	ep.downUntil = time.Time{}
+	cli.lastServer = ep.addr
+	for _, other := range cli.servers {
+		other.last = false
+	}
+	if ep.rtt == 0 {
+		ep.rtt = rtt
+	} else {
+		ep.rtt = (ep.rtt*7 + rtt) / 8
+	}
+}
+
+// server is skipped for a while doubling with failures
+func (cli *Client) serverFailed(ep *endpoint) {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	ep.tunnels--
+	ep.failures++
+	down := maxServerDown
+	if ep.failures < 7 {
+		down = time.Second << uint(ep.failures-1)
+	}
+	ep.downUntil = time.Now().Add(down)
+	if len(cli.servers) > 1 {
+		Error("tunnel server %s failed %d times, skip it for %v", ep.addr, ep.failures, down)
+	}
+}
+
+// tunnel to server is closed
+func (cli *Client) serverReleased(ep *endpoint) {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	ep.tunnels--
+}
+
+func (cli *Client) serverStatus() []endpointStatus {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+
+	now := time.Now()
+	status := make([]endpointStatus, len(cli.servers))
+	for i, ep := range cli.servers {
+		status[i] = endpointStatus{
+			Addr:     ep.addr,
+			Tunnels:  ep.tunnels,
+			Failures: ep.failures,
+			Down:     ep.isDown(now),
+			RTT:      float64(ep.rtt) / float64(time.Millisecond),
+		}
+	}
+	return status
+}
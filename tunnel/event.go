@@ -0,0 +1,151 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+)
+
+// EventHandler is told about tunnels and links by Client and Server, so a
+// program embedding them could drive its own alerting, UI or policy without
+// parsing logs. Methods are called synchronously by goroutines of tunnels
+// and links, they should return quickly and be safe for concurrent use.
+type EventHandler interface {
+	OnTunnelUp(e TunnelEvent)
+	OnTunnelDown(e TunnelEvent)
+	OnLinkOpen(e LinkEvent)
+	OnLinkClose(e LinkEvent)
+	OnAuthFailure(e AuthFailureEvent)
+}
+
+// NopEventHandler ignores all events, embed it to handle some of them
+type NopEventHandler struct{}
+
+func (NopEventHandler) OnTunnelUp(TunnelEvent)         {}
+func (NopEventHandler) OnTunnelDown(TunnelEvent)       {}
+func (NopEventHandler) OnLinkOpen(LinkEvent)           {}
+func (NopEventHandler) OnLinkClose(LinkEvent)          {}
+func (NopEventHandler) OnAuthFailure(AuthFailureEvent) {}
+
+type TunnelEvent struct {
+	Side   string    // client or server
+	Index  int       // index of tunnel of client, 0 for server
+	Server string    // tunnel server dialed by client
+	Client string    // identity of client, empty if anonymous
+	Local  string    // address of tunnel connection
+	Remote string    // address of peer
+	Start  time.Time // when tunnel was up
+}
+
+type LinkEvent struct {
+	Side    string // client or server
+	ID      uint32 // in its tunnel
+	Client  string // identity of client, empty if anonymous
+	Service string // rule name
+	Source  string // ip:port of original client, empty if unknown
+	Dest    string // destination requested or dialed, empty if unknown
+	Start   time.Time
+
+	// known when link closes, up is bytes from the end accepting connection
+	// to the end dialing destination
+	Up     int64
+	Down   int64
+	Reason string
+}
+
+// a peer failed to prove secret or certificate, errors of network or of
+// other negotiation are not reported
+type AuthFailureEvent struct {
+	Side   string // end reporting it, client or server
+	Remote string // address of peer
+	Err    error
+}
+
+// failures of secret or certificate
+func isAuthFailure(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	return errors.Is(err, errVerifyToken) || errors.Is(err, errReplayed) || errors.Is(err, errKexMac) ||
+		errors.As(err, &certErr)
+}
+
+// events of links in hub, disabled if nil
+func (self *Hub) SetEventHandler(events EventHandler) {
+	self.events = events
+}
+
+func (self *Hub) tunnelEvent() TunnelEvent {
+	conn := self.tunnel.netConn()
+	return TunnelEvent{
+		Side:   self.side(),
+		Client: self.tunnel.identity,
+		Local:  conn.LocalAddr().String(),
+		Remote: conn.RemoteAddr().String(),
+		Start:  self.created,
+	}
+}
+
+func (self *Hub) linkEvent(link *Link) LinkEvent {
+	return LinkEvent{
+		Side:    self.side(),
+		ID:      link.id,
+		Client:  self.tunnel.identity,
+		Service: link.service,
+		Source:  link.source,
+		Dest:    link.dest,
+		Start:   link.created,
+	}
+}
+
+func (self *Hub) onLinkOpen(link *Link) {
+	if self.events != nil {
+		self.events.OnLinkOpen(self.linkEvent(link))
+	}
+}
+
+func (self *Hub) onLinkClose(link *Link) {
+	if self.events == nil {
+		return
+	}
+	e := self.linkEvent(link)
+	e.Up, e.Down = self.linkTraffic(link)
+	e.Reason = link.closeReason()
+	self.events.OnLinkClose(e)
+}
+
+// handler is called on events of tunnels and links, it should be set before
+// Start
+func (cli *Client) SetEventHandler(events EventHandler) {
+	cli.app.events = events
+}
+
+func (cli *Client) tunnelEvent(item *HubItem) TunnelEvent {
+	e := item.tunnelEvent()
+	e.Index = item.tunnel
+	if item.server != nil {
+		e.Server = item.server.addr
+	}
+	return e
+}
+
+// handler is called on events of tunnels and links, it should be set before
+// Start
+func (self *Server) SetEventHandler(events EventHandler) {
+	self.app.events = events
+}
+
+// report err of handshake with remote if it's an auth failure
+func (app *App) authFailed(remote string, err error) {
+	if app.events == nil || !isAuthFailure(err) {
+		return
+	}
+	side := "server"
+	if app.Tunnels > 0 {
+		side = "client"
+	}
+	app.events.OnAuthFailure(AuthFailureEvent{Side: side, Remote: remote, Err: err})
+}
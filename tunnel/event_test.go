@@ -0,0 +1,150 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+)
+
+// events recorded by name
+type testEvents struct {
+	NopEventHandler
+	lock    sync.Mutex
+	tunnels map[string][]TunnelEvent
+	links   map[string][]LinkEvent
+	auths   []AuthFailureEvent
+}
+
+func newTestEvents() *testEvents {
+	return &testEvents{tunnels: make(map[string][]TunnelEvent), links: make(map[string][]LinkEvent)}
+}
+
+func (h *testEvents) OnTunnelUp(e TunnelEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.tunnels["up"] = append(h.tunnels["up"], e)
+}
+
+func (h *testEvents) OnTunnelDown(e TunnelEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.tunnels["down"] = append(h.tunnels["down"], e)
+}
+
+func (h *testEvents) OnLinkOpen(e LinkEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.links["open"] = append(h.links["open"], e)
+}
+
+func (h *testEvents) OnLinkClose(e LinkEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.links["close"] = append(h.links["close"], e)
+}
+
+func (h *testEvents) OnAuthFailure(e AuthFailureEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.auths = append(h.auths, e)
+}
+
+func (h *testEvents) count() (tunnels, links, auths int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.tunnels["up"]) + len(h.tunnels["down"]), len(h.links["open"]) + len(h.links["close"]), len(h.auths)
+}
+
+func TestPairEvents(t *testing.T) {
+	network := newPipeNetwork()
+	echo, err := network.Listen(testBackendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(BiConn).CloseWrite()
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := newServer(newTestApp(t, network, Config{Listen: testTunnelAddr, Backend: testBackendAddr, Secret: "a"}))
+	serverEvents := newTestEvents()
+	server.SetEventHandler(serverEvents)
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client := newClient(newTestApp(t, network, Config{Listen: testListenAddr, Backend: testTunnelAddr, Secret: "a", Tunnels: 1}))
+	clientEvents := newTestEvents()
+	client.SetEventHandler(clientEvents)
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testPair{network: network, server: server, client: client}
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	waitFor(t, "link events", func() bool {
+		_, c, _ := clientEvents.count()
+		_, s, _ := serverEvents.count()
+		return c == 2 && s == 2
+	})
+
+	up := clientEvents.tunnels["up"][0]
+	if up.Side != "client" || up.Server != testTunnelAddr || up.Index != 0 || up.Remote == "" || up.Start.IsZero() {
+		t.Fatalf("unexpected tunnel event:%+v", up)
+	}
+	if up := serverEvents.tunnels["up"][0]; up.Side != "server" || up.Server != "" || up.Remote == "" {
+		t.Fatalf("unexpected tunnel event:%+v", up)
+	}
+	for _, h := range []*testEvents{clientEvents, serverEvents} {
+		open, closed := h.links["open"][0], h.links["close"][0]
+		if open.ID != closed.ID || open.Service == "" || open.Source == "" {
+			t.Fatalf("unexpected link events:%+v %+v", open, closed)
+		}
+		if closed.Up != 5 || closed.Down != 5 || closed.Reason != "closed" {
+			t.Fatalf("unexpected link close:%+v", closed)
+		}
+	}
+	if dest := serverEvents.links["close"][0].Dest; dest != testBackendAddr {
+		t.Fatalf("unexpected dest:%s", dest)
+	}
+
+	bad := newClient(newTestApp(t, network, Config{Listen: "127.0.0.1:8007", Backend: testTunnelAddr, Secret: "b", Tunnels: 1}))
+	if err := bad.Start(ctx); err == nil {
+		t.Fatal("handshake should fail")
+	}
+	waitFor(t, "auth failure", func() bool {
+		_, _, n := serverEvents.count()
+		return n == 1
+	})
+	if e := serverEvents.auths[0]; e.Side != "server" || e.Remote == "" || e.Err != errVerifyToken {
+		t.Fatalf("unexpected auth failure:%+v", e)
+	}
+
+	cancel()
+	client.Wait()
+	server.Wait()
+	waitFor(t, "tunnels down", func() bool {
+		c, _, _ := clientEvents.count()
+		s, _, _ := serverEvents.count()
+		return c == 2 && s == 2
+	})
+}
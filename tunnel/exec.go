@@ -0,0 +1,71 @@
+//
+//   date  : 2015-10-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// links of a rule with Exec are served by running the command, like inetd:
+// data of link is written to stdin of the process, and its stdout is sent
+// back. Stderr goes to our own. The process is killed if it doesn't exit
+// execExitDelay after the link is done, or at once if hub is closed.
+
+const execExitDelay = 5 * time.Second
+
+// run command of rule and pump link with its stdio
+func (self *ServerHub) handleExecLink(link *Link, rule *Rule) {
+	cmd := exec.CommandContext(link.ctx, rule.Exec[0], rule.Exec[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GOTUNNEL_SERVICE="+rule.String(),
+		"GOTUNNEL_SOURCE="+link.source,
+		"GOTUNNEL_CLIENT="+self.tunnel.identity)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		link.SendReject(err)
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		link.SendReject(err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		link.log.Error("exec %s failed, err:%v", rule.Exec[0], err)
+		link.SendReject(err)
+		return
+	}
+	link.log.Info("new process %d of %s", cmd.Process.Pid, rule.Exec[0])
+
+	conn, peer := memPipe("exec", pipeAddr(rule.Exec[0]))
+	go func() {
+		io.Copy(stdin, peer)
+		stdin.Close()
+	}()
+	go func() {
+		io.Copy(peer, stdout)
+		peer.CloseWrite()
+	}()
+	link.dest = rule.Exec[0]
+	link.SendConnected()
+	link.Pump(conn)
+	conn.Close()
+
+	// stdout is closed by Wait, it's drained or link is gone by now
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(execExitDelay):
+		cmd.Process.Kill()
+		err = <-done
+	}
+	link.log.Info("process %d exited, err:%v", cmd.Process.Pid, err)
+}
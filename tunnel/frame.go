@@ -0,0 +1,75 @@
+//
+//   date  : 2015-10-08
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// frames come from an authenticated peer, but a buggy or malicious one must
+// not panic or exhaust memory of this end: bodies are bounded by the 16 bit
+// size field, and every field is checked before it's used
+
+var (
+	errCmdSize    = errors.New("control message too short")
+	errUnknownCmd = errors.New("unknown cmd")
+	errCmdArg     = errors.New("cmd arg too short")
+)
+
+// min size of arg of cmd, others have optional or variable args
+var cmdArgSize = map[uint8]int{
+	TUNNEL_PING: 8,
+	TUNNEL_PONG: 8,
+	LINK_WINDOW: 8,
+	TUNNEL_ACK:  8,
+}
+
+// parse frame head of link id in idSize bytes and body size, return size of
+// body without checksum
+func parseHead(head []byte, idSize int, integrity bool) (uint32, int, error) {
+	var linkid uint32
+	if idSize == 4 {
+		linkid = binary.LittleEndian.Uint32(head)
+	} else {
+		linkid = uint32(binary.LittleEndian.Uint16(head))
+	}
+	n := int(binary.LittleEndian.Uint16(head[idSize:]))
+	if integrity {
+		if n < frameSumSize {
+			return 0, 0, errFrameChecksum
+		}
+		n -= frameSumSize
+	}
+	return linkid, n, nil
+}
+
+// decode control message in body of frame of link id 0: cmd, link id in
+// idSize bytes and arg. arg is copied, so data could be reused.
+func decodeCmd(data []byte, idSize int) (Cmd, []byte, error) {
+	var cmd Cmd
+	if len(data) < 1+idSize {
+		return cmd, nil, errCmdSize
+	}
+	cmd.Cmd = data[0]
+	if cmd.Cmd == LINK_DATA || cmd.Cmd > TUNNEL_REKEY {
+		return cmd, nil, errUnknownCmd
+	}
+	if idSize == 4 {
+		cmd.Linkid = binary.LittleEndian.Uint32(data[1:])
+	} else {
+		cmd.Linkid = uint32(binary.LittleEndian.Uint16(data[1:]))
+	}
+	data = data[1+idSize:]
+	if len(data) < cmdArgSize[cmd.Cmd] {
+		return cmd, nil, errCmdArg
+	}
+	var arg []byte
+	if len(data) > 0 {
+		arg = append(arg, data...)
+	}
+	return cmd, arg, nil
+}
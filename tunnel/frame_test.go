@@ -0,0 +1,82 @@
+//
+//   date  : 2015-10-08
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecodeCmd(f *testing.F) {
+	f.Add([]byte{LINK_CREATE, 1, 0}, false)
+	f.Add([]byte{LINK_WINDOW, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0}, false)
+	f.Add([]byte{TUNNEL_PING, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}, true)
+	f.Add([]byte{LINK_CLOSE, 2, 0, 0, 0, closeRefused, 'x'}, true)
+	f.Fuzz(func(t *testing.T, data []byte, wide bool) {
+		idSize := 2
+		if wide {
+			idSize = 4
+		}
+		cmd, arg, err := decodeCmd(data, idSize)
+		if err != nil {
+			return
+		}
+		if len(arg) < cmdArgSize[cmd.Cmd] || len(data) != 1+idSize+len(arg) {
+			t.Fatalf("unexpected cmd:%+v, arg:%v", cmd, arg)
+		}
+	})
+}
+
+func FuzzLinkArgs(f *testing.F) {
+	args := &LinkArgs{Service: "ssh", Window: uint32(LinkWindow), Dest: "example.com:22", Source: "127.0.0.1:1", Priority: "bulk"}
+	f.Add(args.encode())
+	f.Add([]byte{argWindow, 4, 0, 1, 2})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var args LinkArgs
+		if args.decode(data) != nil {
+			return
+		}
+		var again LinkArgs
+		if err := again.decode(args.encode()); err != nil || again != args {
+			t.Fatalf("unexpected args:%+v, %+v, %v", args, again, err)
+		}
+	})
+}
+
+// frames read by tunnel, flags are bit 0 integrity, bit 1 32 bit ids and
+// bit 2 compression
+func FuzzTunnelRead(f *testing.F) {
+	f.Add(uint8(0), []byte{1, 0, 5, 0, 'h', 'e', 'l', 'l', 'o'})
+	f.Add(uint8(1), []byte{1, 0, 2, 0})
+	f.Add(uint8(2), []byte{0, 0, 0, 0, 3, 0, LINK_CREATE, 1, 0})
+	f.Add(uint8(4), []byte{1, 0, 3, 0, frameRaw, 'h', 'i'})
+	f.Add(uint8(4), []byte{1, 0, 3, 0, frameCompressed, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, flags uint8, data []byte) {
+		c1, _ := memPipe("a", "b")
+		tun := newTunnel(c1, bytes.NewReader(data), c1)
+		defer tun.Close()
+		tun.integrity = flags&1 != 0
+		if flags&2 != 0 {
+			tun.caps |= capLinkId32
+		}
+		if flags&4 != 0 {
+			tun.setCompress(compressDeflate, DefaultCompressThreshold)
+		}
+		for {
+			payload, err := tun.Read()
+			if err != nil {
+				return
+			}
+			if len(payload.data) > PacketSize && payload.linkid != 0 && tun.rcomp != nil {
+				t.Fatalf("decompressed frame too large:%d", len(payload.data))
+			}
+			if payload.linkid == 0 {
+				decodeCmd(payload.data, tun.idSize())
+			}
+			mpool.Put(payload.data)
+		}
+	})
+}
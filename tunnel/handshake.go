@@ -0,0 +1,171 @@
+//
+//   date  : 2015-09-01
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// Handshake versions, carried in high 4 bits of the compress byte of client
+// token and server answer. Legacy peers treat it as an unknown compress
+// method, and answer with version 0.
+//
+// version 0: session key derives from the Taa token, no forward secrecy.
+// version 2: after negotiation, server and client exchange x25519 keys and
+// hmac of the transcript by secret, session key derives from the shared key
+// by hkdf.
+// version 3: client sends its identity after negotiation, server verifies the
+// token by secrets of the identity, then exchanges keys like version 2.
+// version 4: client sends its capabilities after identity, server answers
+// with its own before key exchange, both are covered by the transcript.
+const (
+	handshakeLegacy   uint8 = 0
+	handshakeECDH     uint8 = 2
+	handshakeIdentity uint8 = 3
+	handshakeCaps     uint8 = 4
+
+	handshakeVersion = handshakeCaps
+
+	// client resumes by a ticket of an earlier handshake instead, see ticket.go
+	handshakeTicket uint8 = 5
+)
+
+const kexKeySize = 32
+
+var (
+	errKexMac          = errors.New("key exchange mac mismatch")
+	errVerifyToken     = errors.New("verify token failed")
+	errCipherMismatch  = errors.New("cipher mismatch")
+	errReplayed        = errors.New("stale or replayed token")
+	errLegacyHandshake = errors.New("legacy handshake is rejected")
+)
+
+// result of handshake before cipher stream
+type negotiated struct {
+	suite     uint8
+	version   uint8
+	compress  uint8
+	integrity bool
+	caps      uint32
+	key       []byte // session key
+	identity  string // of client, known by server only
+	log       *Logger
+
+	// resumed by ticket; client creates cipher stream to send resume message
+	// along with its ticket
+	ticket bool
+	rd     io.Reader
+	wr     io.Writer
+}
+
+// identity message: 1 byte length, client id; empty id for anonymous client
+func identityMessage(id string) ([]byte, error) {
+	if len(id) > 255 {
+		return nil, errors.New("client id too long")
+	}
+	return append([]byte{byte(len(id))}, id...), nil
+}
+
+// read a message led by 1 byte length, such as identity and capabilities
+func readMessage(rd io.Reader) ([]byte, error) {
+	msg := make([]byte, 1)
+	if _, err := io.ReadFull(rd, msg); err != nil {
+		return nil, err
+	}
+	msg = append(msg, make([]byte, msg[0])...)
+	if _, err := io.ReadFull(rd, msg[1:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func packFlags(version, compress uint8) uint8 {
+	return version<<4 | compress&0x0f
+}
+
+func unpackFlags(flags uint8) (version, compress uint8) {
+	return flags >> 4, flags & 0x0f
+}
+
+// key of legacy handshake
+func legacySessionKey(suite uint8, a *Taa) []byte {
+	if suite == cipherRC4 {
+		return a.GetRc4key()
+	}
+	return a.GetSessionKey()
+}
+
+func kexMac(a *Taa, transcript []byte, label string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(transcript)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// exchange ephemeral keys after negotiation, transcript is all bytes sent and
+// received in handshake. server sends its public key first, client answers
+// with its public key and mac, then server confirms with its mac.
+func keyExchange(conn io.ReadWriter, a *Taa, transcript []byte, client bool) ([]byte, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pub := priv.PublicKey().Bytes()
+
+	var peer []byte
+	if client {
+		peer = make([]byte, kexKeySize)
+		if _, err := io.ReadFull(conn, peer); err != nil {
+			return nil, err
+		}
+		transcript = append(append(transcript, peer...), pub...)
+		if _, err := conn.Write(append(pub, kexMac(a, transcript, "client")...)); err != nil {
+			return nil, err
+		}
+		mac := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(conn, mac); err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(mac, kexMac(a, transcript, "server")) {
+			return nil, errKexMac
+		}
+	} else {
+		if _, err := conn.Write(pub); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, kexKeySize+sha256.Size)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		peer = buf[:kexKeySize]
+		transcript = append(append(transcript, pub...), peer...)
+		if !hmac.Equal(buf[kexKeySize:], kexMac(a, transcript, "client")) {
+			return nil, errKexMac
+		}
+		if _, err := conn.Write(kexMac(a, transcript, "server")); err != nil {
+			return nil, err
+		}
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// secret is mixed in, so the key is safe even if x25519 is broken
+	salt := sha256.Sum256(transcript)
+	return hkdf.Key(sha256.New, append(shared, a.key...), salt[:], "gotunnel session key", 32)
+}
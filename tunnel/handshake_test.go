@@ -0,0 +1,152 @@
+//
+//   date  : 2015-09-01
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func exchange(t *testing.T, ckey, skey string) ([]byte, []byte, error, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	transcript := []byte("transcript")
+	type result struct {
+		key []byte
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		key, err := keyExchange(s, NewTaa(skey), transcript, false)
+		if err != nil {
+			s.Close()
+		}
+		done <- result{key, err}
+	}()
+	key, err := keyExchange(c, NewTaa(ckey), transcript, true)
+	if err != nil {
+		c.Close()
+	}
+	r := <-done
+	return key, r.key, err, r.err
+}
+
+func TestKeyExchange(t *testing.T) {
+	k1, k2, err1, err2 := exchange(t, "secret", "secret")
+	if err1 != nil || err2 != nil {
+		t.Fatal("exchange failed:", err1, err2)
+	}
+	if len(k1) != 32 || !bytes.Equal(k1, k2) {
+		t.Fatal("session key mismatch")
+	}
+
+	// fresh key every session
+	k3, _, _, _ := exchange(t, "secret", "secret")
+	if bytes.Equal(k1, k3) {
+		t.Fatal("session key reused")
+	}
+
+	if _, _, err1, err2 := exchange(t, "secret", "other"); err1 == nil || err2 != errKexMac {
+		t.Fatal("exchange with wrong secret should fail:", err1, err2)
+	}
+}
+
+func TestHandshakeFlags(t *testing.T) {
+	version, compress := unpackFlags(packFlags(handshakeECDH, compressDeflate))
+	if version != handshakeECDH || compress != compressDeflate {
+		t.Fatal("unexpected flags:", version, compress)
+	}
+	// legacy server treats flags as unknown compress method
+	if compressName(packFlags(handshakeECDH, compressNone)) != "unknown" {
+		t.Fatal("flags should be unknown to legacy peers")
+	}
+}
+
+func TestCapsMessage(t *testing.T) {
+	caps, msg, err := readCaps(bytes.NewReader(capsMessage(localCaps)))
+	if err != nil || caps != localCaps || !bytes.Equal(msg, capsMessage(localCaps)) {
+		t.Fatal("unexpected caps:", caps, msg, err)
+	}
+	// bits of newer peers are ignored, a short mask is padded
+	for _, msg := range [][]byte{{8, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}, {1, 1}} {
+		if caps, _, err := readCaps(bytes.NewReader(msg)); err != nil || caps&localCaps != capFlowControl {
+			t.Fatal("unexpected caps:", caps, err)
+		}
+	}
+	if capsString(capFlowControl|capUDP) != "flow-control,udp" {
+		t.Fatal("unexpected caps string:", capsString(capFlowControl|capUDP))
+	}
+}
+
+// ctx whose deadline passed, but its timer hasn't fired yet
+type expiringCtx struct {
+	context.Context
+	deadline time.Time
+}
+
+func (c expiringCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func TestHandshakeExpired(t *testing.T) {
+	now := time.Now()
+	ctx := expiringCtx{Context: context.Background(), deadline: now}
+	if ctx.Err() != nil || !handshakeExpired(ctx, now) {
+		t.Fatal("handshake should expire at deadline before ctx is done")
+	}
+	if handshakeExpired(ctx, now.Add(-time.Millisecond)) {
+		t.Fatal("handshake shouldn't expire before deadline")
+	}
+	if handshakeExpired(context.Background(), now) {
+		t.Fatal("handshake without deadline shouldn't expire")
+	}
+}
+
+func TestPairHandshakeTimeout(t *testing.T) {
+	p := newTestPair(t, Config{HandshakeTimeout: 1, MaxHandshakes: 1}, Config{})
+	waitFor(t, "tunnel", func() bool { return len(p.server.activeHubs()) == 1 })
+
+	timeouts := atomic.LoadInt64(&stats.HandshakeTimeouts)
+	rejected := atomic.LoadInt64(&stats.HandshakesRejected)
+	// a connection sending nothing holds the only handshake slot
+	slow, err := p.network.Dial(context.Background(), testTunnelAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	waitFor(t, "handshake", func() bool { return atomic.LoadInt32(&p.server.handshaking) == 1 })
+
+	conn, err := p.network.Dial(context.Background(), testTunnelAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection beyond max handshakes isn't closed:%v", err)
+	}
+	if n := atomic.LoadInt64(&stats.HandshakesRejected); n != rejected+1 {
+		t.Fatalf("unexpected rejected handshakes:%d", n-rejected)
+	}
+
+	// challenge is sent, then nothing until timeout
+	slow.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadAll(slow); err != nil {
+		t.Fatalf("slow connection isn't closed:%v", err)
+	}
+	waitFor(t, "timeout", func() bool { return atomic.LoadInt64(&stats.HandshakeTimeouts) == timeouts+1 })
+	waitFor(t, "release", func() bool { return atomic.LoadInt32(&p.server.handshaking) == 0 })
+	if got := p.roundTrip(t, "hello"); got != "hello" {
+		t.Fatalf("unexpected echo:%q", got)
+	}
+}
@@ -0,0 +1,423 @@
+//
+//   date  : 2015-09-22
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addresses on pipe network of test pair
+const (
+	testTunnelAddr  = "127.0.0.1:8001"
+	testBackendAddr = "127.0.0.1:8002"
+	testListenAddr  = "127.0.0.1:8003"
+)
+
+// client and server connected by pipe network in process
+type testPair struct {
+	network *pipeNetwork
+	server  *Server
+	client  *Client
+}
+
+func newTestApp(t testing.TB, network *pipeNetwork, config Config) *App {
+	app := &App{Config: config}
+	app.network = network
+	app.transport = &pipeTransport{network: network, addr: config.Listen}
+	if err := app.init(); err != nil {
+		t.Fatalf("init app failed:%v", err)
+	}
+	return app
+}
+
+// server forwards default rule to an echo backend, Listen, Backend and
+// Tunnels of configs are filled if empty
+// setup is called before server and client start
+func newTestPair(t testing.TB, server, client Config, setup ...func(p *testPair)) *testPair {
+	if server.Listen == "" {
+		server.Listen = testTunnelAddr
+	}
+	if server.Backend == "" {
+		server.Backend = testBackendAddr
+	}
+	if client.Listen == "" {
+		client.Listen = testListenAddr
+	}
+	if client.Backend == "" {
+		client.Backend = testTunnelAddr
+	}
+	if client.Tunnels == 0 {
+		client.Tunnels = 1
+	}
+	if server.Secret == "" {
+		server.Secret = "test secret"
+	}
+	if client.Secret == "" {
+		client.Secret = server.Secret
+	}
+
+	p := &testPair{network: newPipeNetwork()}
+	echo, err := p.network.Listen(server.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(BiConn).CloseWrite()
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.server = newServer(newTestApp(t, p.network, server))
+	p.client = newClient(newTestApp(t, p.network, client))
+	for _, f := range setup {
+		f(p)
+	}
+	if err := p.server.Start(ctx); err != nil {
+		t.Fatalf("start server failed:%v", err)
+	}
+	if err := p.client.Start(ctx); err != nil {
+		t.Fatalf("start client failed:%v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		echo.Close()
+		p.client.Wait()
+		p.server.Wait()
+	})
+	return p
+}
+
+// send data through a link of client listener, return data echoed
+func (p *testPair) roundTrip(t *testing.T, data string) string {
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatalf("dial client failed:%v", err)
+	}
+	defer conn.Close()
+	go func() {
+		io.WriteString(conn, data)
+		conn.(BiConn).CloseWrite()
+	}()
+	echoed, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read echo failed:%v", err)
+	}
+	return string(echoed)
+}
+
+// poll cond, tunnels are created and torn down in background
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("wait %s timeout", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// priorities raised by connections of client are all dropped once they
+// are handled
+func waitHubsReleased(t *testing.T, cli *Client) {
+	waitFor(t, "hub priorities dropped", func() bool {
+		cli.lock.Lock()
+		defer cli.lock.Unlock()
+		for _, item := range cli.cq {
+			if item.priority != 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestPairLink(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{})
+	for _, data := range []string{"hello", "", string(make([]byte, PacketSize*3))} {
+		if echoed := p.roundTrip(t, data); echoed != data {
+			t.Fatalf("unexpected echo, len %d, want %d", len(echoed), len(data))
+		}
+	}
+
+	hubs := p.server.activeHubs()
+	if len(hubs) != 1 {
+		t.Fatalf("unexpected server hubs:%d", len(hubs))
+	}
+	if hubs[0].tunnel.caps != localCaps {
+		t.Fatalf("unexpected caps:%s", capsString(hubs[0].tunnel.caps))
+	}
+	waitFor(t, "links released", func() bool {
+		return hubs[0].LinkCount() == 0 && p.client.activeHubs()[0].LinkCount() == 0
+	})
+}
+
+func TestPairIdentity(t *testing.T) {
+	p := newTestPair(t,
+		Config{Clients: []*Credential{{ID: "alice", Secret: Secret{Secret: "alice secret"}}}},
+		Config{ClientID: "alice", Secret: "alice secret"})
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	if identity := p.server.activeHubs()[0].tunnel.identity; identity != "alice" {
+		t.Fatalf("unexpected identity:%q", identity)
+	}
+}
+
+func TestPairIntegrity(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{Integrity: true, Compress: CompressDeflate})
+	data := strings.Repeat("hello", PacketSize)
+	if echoed := p.roundTrip(t, data); echoed != data {
+		t.Fatalf("unexpected echo, len %d, want %d", len(echoed), len(data))
+	}
+	if !p.server.activeHubs()[0].tunnel.integrity || !p.client.activeHubs()[0].tunnel.integrity {
+		t.Fatal("integrity should be negotiated")
+	}
+}
+
+func TestPairBadSecret(t *testing.T) {
+	network := newPipeNetwork()
+	server := newServer(newTestApp(t, network, Config{Listen: testTunnelAddr, Backend: testBackendAddr, Secret: "a"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client := newClient(newTestApp(t, network, Config{Listen: testListenAddr, Backend: testTunnelAddr, Secret: "b", Tunnels: 1}))
+	if err := client.Start(ctx); err == nil {
+		t.Fatal("handshake should fail")
+	}
+}
+
+func TestPairBan(t *testing.T) {
+	network := newPipeNetwork()
+	server := newServer(newTestApp(t, network, Config{Listen: testTunnelAddr, Backend: testBackendAddr, Secret: "a", BanThreshold: 1}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client := newClient(newTestApp(t, network, Config{Listen: testListenAddr, Backend: testTunnelAddr, Secret: "b", Tunnels: 1}))
+	if err := client.Start(ctx); err == nil {
+		t.Fatal("handshake should fail")
+	}
+	// all pipe conns come from ip "pipe"
+	waitFor(t, "ban", func() bool {
+		return server.banned.banned("pipe", time.Now())
+	})
+	if bans := server.bans().list(time.Now()); len(bans) != 1 || bans[0].IP != "pipe" {
+		t.Fatalf("unexpected bans:%v", bans)
+	}
+	if !server.bans().clear("pipe") || len(server.bans().list(time.Now())) != 0 {
+		t.Fatal("ban should be cleared")
+	}
+}
+
+func TestPairLinkIdExhausted(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{Tunnels: 2, MaxLinks: 1, Balance: BalanceRoundRobin})
+	waitFor(t, "tunnels connected", func() bool {
+		return len(p.client.activeHubs()) == 2
+	})
+	dial := func() net.Conn {
+		conn, err := p.network.Dial(context.Background(), testListenAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		io.WriteString(conn, "hello")
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("link should be created:%v", err)
+		}
+		return conn
+	}
+
+	// round robin chooses the first tunnel again, whose only id is in use
+	first := dial()
+	defer first.Close()
+	dial().Close()
+	waitFor(t, "link released", func() bool {
+		links := 0
+		for _, hub := range p.client.activeHubs() {
+			links += hub.LinkCount()
+		}
+		return links == 1
+	})
+	third := dial()
+	defer third.Close()
+	for _, hub := range p.client.activeHubs() {
+		if hub.LinkCount() != 1 {
+			t.Fatalf("links should spread over tunnels, got %d", hub.LinkCount())
+		}
+	}
+}
+
+func TestPairServers(t *testing.T) {
+	const testTunnelAddr2 = "127.0.0.1:8011"
+	network := newPipeNetwork()
+	startServer := func(addr string) (*Server, context.CancelFunc) {
+		server := newServer(newTestApp(t, network, Config{Listen: addr, Backend: testBackendAddr, Secret: "a"}))
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := server.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(server.Wait)
+		t.Cleanup(cancel)
+		return server, cancel
+	}
+	server1, _ := startServer(testTunnelAddr)
+	server2, stop2 := startServer(testTunnelAddr2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := newClient(newTestApp(t, network, Config{Listen: testListenAddr, Backend: testTunnelAddr, Secret: "a", Tunnels: 2,
+		Servers: []string{testTunnelAddr2}}))
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Wait()
+	defer cancel()
+	waitFor(t, "tunnels spread", func() bool {
+		return len(server1.activeHubs()) == 1 && len(server2.activeHubs()) == 1
+	})
+
+	// tunnel of stopped server fails over to the other one
+	stop2()
+	waitFor(t, "fail over", func() bool {
+		return len(server1.activeHubs()) == 2 && len(client.activeHubs()) == 2
+	})
+	status := client.status().Servers
+	if status[0].Tunnels != 2 || status[1].Tunnels != 0 || !status[1].Down {
+		t.Fatalf("unexpected server status:%+v", status)
+	}
+}
+
+func TestPairReconnect(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{})
+	old := p.client.activeHubs()[0]
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+
+	for _, hub := range p.server.activeHubs() {
+		hub.Close()
+	}
+	waitFor(t, "reconnect", func() bool {
+		hubs := p.client.activeHubs()
+		return len(hubs) == 1 && hubs[0] != old
+	})
+	if echoed := p.roundTrip(t, "again"); echoed != "again" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+}
+
+func TestPairStandby(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{Standby: 1})
+	waitFor(t, "standby", func() bool {
+		return p.client.status().Standby == 1 && len(p.server.activeHubs()) == 2
+	})
+	old := p.client.activeHubs()[0]
+	closed := time.Now()
+	old.Close()
+	// standby is taken at once, and replaced
+	waitFor(t, "standby taken", func() bool {
+		hubs := p.client.activeHubs()
+		return len(hubs) == 1 && hubs[0] != old && p.client.status().Standby == 1
+	})
+	if !p.client.activeHubs()[0].created.Before(closed) {
+		t.Fatal("standby hub should be taken")
+	}
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	if reconnects := p.client.status().Reconnects; len(reconnects) != 1 || reconnects[0].Error != "" {
+		t.Fatalf("unexpected reconnects:%v", reconnects)
+	}
+}
+
+func TestPairSocks5Refused(t *testing.T) {
+	p := newTestPair(t, Config{Socks5: true}, Config{Socks5: true})
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatalf("dial client failed:%v", err)
+	}
+	defer conn.Close()
+
+	// nothing listens on port 9
+	go conn.Write([]byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0, 9})
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read reply failed:%v", err)
+	}
+	if reply[3] != socks5Refused {
+		t.Fatalf("unexpected reply:%v", reply)
+	}
+}
+
+func TestPairResume(t *testing.T) {
+	p := newTestPair(t, Config{Resume: 5}, Config{Resume: 5})
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatalf("dial client failed:%v", err)
+	}
+	defer conn.Close()
+	echo := func(data string) {
+		if _, err := io.WriteString(conn, data); err != nil {
+			t.Fatalf("write failed:%v", err)
+		}
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != data {
+			t.Fatalf("unexpected echo:%q, %v", buf, err)
+		}
+	}
+	echo("hello")
+
+	// connection breaks, but the link survives
+	hub := p.client.activeHubs()[0]
+	hub.tunnel.netConn().Close()
+	echo(strings.Repeat("again", PacketSize))
+	if hubs := p.client.activeHubs(); len(hubs) != 1 || hubs[0] != hub {
+		t.Fatal("tunnel should be resumed")
+	}
+	if resumed := p.server.activeHubs()[0].tunnel.resumedCount(); resumed != 1 {
+		t.Fatalf("unexpected resumed:%d", resumed)
+	}
+}
+
+// bulk data through a link, client listener to echo backend and back
+func BenchmarkPairLink(b *testing.B) {
+	p := newTestPair(b, Config{}, Config{})
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	b.ReportAllocs()
+	b.SetBytes(PacketSize)
+	go func() {
+		data := make([]byte, PacketSize)
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := io.CopyN(io.Discard, conn, int64(b.N)*PacketSize); err != nil {
+		b.Fatal(err)
+	}
+}
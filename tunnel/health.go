@@ -0,0 +1,122 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// health check of client opens a link to EchoService of server every
+// interval and checks a probe comes back in time. Unlike heartbeat, it covers
+// link creation, flow control and pumps of both ends. A hub failing
+// healthFailures checks in a row is closed, so client reconnects it.
+const (
+	healthFailures  = 3
+	healthProbeSize = 16
+)
+
+var errHealthEcho = errors.New("echo mismatch")
+
+type hubHealth struct {
+	interval time.Duration
+	checked  int64 // unix nano of last check, atomic
+	ok       int32 // last check passed, atomic
+	rtt      int64 // nano seconds of last passed check, atomic
+	failures int32 // failed checks in a row, atomic
+}
+
+type healthStatus struct {
+	OK       bool      `json:"ok"`
+	Checked  time.Time `json:"checked"`
+	RTT      float64   `json:"rtt"` // seconds of last passed check
+	Failures int       `json:"failures"`
+}
+
+// health check is disabled if interval is 0
+func (self *Hub) SetHealthCheck(interval time.Duration) {
+	self.health.interval = interval
+}
+
+// hub has been checked at least once
+func (self *Hub) healthChecked() bool {
+	return atomic.LoadInt64(&self.health.checked) != 0
+}
+
+func (self *Hub) healthy() bool {
+	return atomic.LoadInt32(&self.health.ok) == 1
+}
+
+func (self *Hub) healthStatus() *healthStatus {
+	if !self.healthChecked() {
+		return nil
+	}
+	return &healthStatus{
+		OK:       self.healthy(),
+		Checked:  time.Unix(0, atomic.LoadInt64(&self.health.checked)),
+		RTT:      time.Duration(atomic.LoadInt64(&self.health.rtt)).Seconds(),
+		Failures: int(atomic.LoadInt32(&self.health.failures)),
+	}
+}
+
+// send a probe through an echo link, return time it takes to come back
+func (self *Hub) checkHealth(timeout time.Duration) (time.Duration, error) {
+	conn := self.echoLink("health")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	probe := make([]byte, healthProbeSize)
+	rand.Read(probe)
+	start := time.Now()
+	if _, err := conn.Write(probe); err != nil {
+		return 0, err
+	}
+	reply := make([]byte, len(probe))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(probe, reply) {
+		return 0, errHealthEcho
+	}
+	return time.Since(start), nil
+}
+
+func (self *Hub) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rtt, err := self.checkHealth(interval)
+			if self.ctx.Err() != nil {
+				return
+			}
+			atomic.StoreInt64(&self.health.checked, time.Now().UnixNano())
+			if err == nil {
+				atomic.StoreInt32(&self.health.ok, 1)
+				atomic.StoreInt64(&self.health.rtt, int64(rtt))
+				atomic.StoreInt32(&self.health.failures, 0)
+				continue
+			}
+			atomic.StoreInt32(&self.health.ok, 0)
+			atomic.AddInt64(&stats.HealthFailed, 1)
+			failures := atomic.AddInt32(&self.health.failures, 1)
+			self.log.Error("health check failed %d times, err:%v", failures, err)
+			if failures >= healthFailures {
+				self.log.Error("unhealthy, close")
+				self.Close()
+				return
+			}
+		case <-self.ctx.Done():
+			return
+		}
+	}
+}
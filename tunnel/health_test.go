@@ -0,0 +1,36 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPairHealthCheck(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{})
+	hub := p.client.activeHubs()[0]
+	if rtt, err := hub.checkHealth(time.Second); err != nil || rtt <= 0 {
+		t.Fatalf("unexpected check:%v, %v", rtt, err)
+	}
+	go hub.healthCheck(time.Millisecond * 10)
+	waitFor(t, "healthy", func() bool { return hub.healthChecked() && hub.healthy() })
+	if h := hub.healthStatus(); !h.OK || h.Failures != 0 || h.RTT <= 0 {
+		t.Fatalf("unexpected status:%+v", h)
+	}
+}
+
+func TestPairHealthCheckFailed(t *testing.T) {
+	// a configured echo rule whose backend is down
+	server := Config{Rules: []*Rule{{Name: EchoService, Backend: "127.0.0.1:8009"}}}
+	p := newTestPair(t, server, Config{})
+	hub := p.client.activeHubs()[0]
+	go hub.healthCheck(time.Millisecond * 10)
+	waitFor(t, "unhealthy hub closed", func() bool { return hub.ctx.Err() != nil })
+	if hub.healthy() || hub.healthStatus().Failures != healthFailures {
+		t.Fatalf("unexpected status:%+v", hub.healthStatus())
+	}
+}
@@ -0,0 +1,85 @@
+//
+//   date  : 2015-07-16
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var errHeartbeatTimeout = errors.New("heartbeat timeout")
+
+// ping carries send time which is echoed by pong
+func (self *Hub) sendPing(now time.Time) bool {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(now.UnixNano()))
+	return self.Send(TUNNEL_PING, 0, buf[:])
+}
+
+// any frame from peer proves tunnel is alive
+func (self *Hub) touch() {
+	atomic.StoreInt64(&self.lastRecv, time.Now().UnixNano())
+}
+
+func (self *Hub) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&self.lastRecv))
+}
+
+func (self *Hub) onHeartbeat(cmd *Cmd, arg []byte) {
+	switch cmd.Cmd {
+	case TUNNEL_PING:
+		self.Send(TUNNEL_PONG, 0, arg)
+	case TUNNEL_PONG:
+		if len(arg) >= 8 {
+			sent := int64(binary.LittleEndian.Uint64(arg))
+			now := time.Now()
+			rtt := now.UnixNano() - sent
+			atomic.StoreInt64(&self.lastRTT, rtt)
+			self.pathPong(sent, now)
+			self.log.Debug("heartbeat rtt %v", time.Duration(rtt))
+		}
+	}
+}
+
+// send ping every interval, close tunnel if nothing received in timeout
+func (self *Hub) heartbeat(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if self.tunnel.resuming(timeout) {
+				continue
+			}
+			if idle := self.idle(); idle > timeout {
+				self.log.Error("heartbeat timeout, idle %v", idle)
+				if self.tunnel.interrupt(errHeartbeatTimeout) {
+					continue
+				}
+				self.tunnel.Close()
+				return
+			}
+			now := time.Now()
+			self.pathPing(now)
+			self.sampleRetrans()
+			self.sendPing(now)
+		case <-self.ctx.Done():
+			return
+		}
+	}
+}
+
+// heartbeat is disabled if interval is 0, timeout defaults to 3 intervals
+func (self *Hub) SetHeartbeat(interval, timeout time.Duration) {
+	if timeout == 0 {
+		timeout = interval * 3
+	}
+	self.hbInterval = interval
+	self.hbTimeout = timeout
+}
@@ -0,0 +1,73 @@
+//
+//   date  : 2015-08-05
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errHTTPMethod = errors.New("errHTTPMethod")
+
+// conn with data buffered while reading request head
+type bufferedConn struct {
+	BiConn
+	rd *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.rd.Read(p)
+}
+
+// read a CONNECT request from local client, return destination as host:port.
+// like socks5, caller replies by httpConnectReply, and the request is
+// answered with 503 if busy
+func httpConnectHandshake(conn BiConn, busy bool) (BiConn, string, error) {
+	if Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(Timeout) * time.Second))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	rd := bufio.NewReader(conn)
+	req, err := http.ReadRequest(rd)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n")
+		return nil, "", errHTTPMethod
+	}
+
+	if busy {
+		io.WriteString(conn, "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\n\r\n")
+		return nil, "", errLinkIdBusy
+	}
+
+	dest := req.URL.Host
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		// ipv6 literal without port is bracketed too
+		dest = net.JoinHostPort(strings.Trim(dest, "[]"), "443")
+	}
+	if rd.Buffered() > 0 {
+		conn = &bufferedConn{BiConn: conn, rd: rd}
+	}
+	return conn, dest, nil
+}
+
+// answer CONNECT request by code of link close
+func httpConnectReply(conn io.Writer, code uint8) error {
+	head := "HTTP/1.1 " + httpCloseReply(code) + "\r\n"
+	if code != closeNormal {
+		head += "Connection: close\r\n"
+	}
+	_, err := io.WriteString(conn, head+"\r\n")
+	return err
+}
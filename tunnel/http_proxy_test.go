@@ -0,0 +1,68 @@
+//
+//   date  : 2015-08-05
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) CloseRead() error  { return nil }
+func (pipeConn) CloseWrite() error { return nil }
+
+func TestHTTPConnectHandshake(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go func() {
+		// early data after request head should not be lost
+		io.WriteString(local, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\nhello")
+	}()
+	reply := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(local).ReadString('\n')
+		reply <- line
+	}()
+
+	conn, dest, err := httpConnectHandshake(pipeConn{remote}, false)
+	if err != nil {
+		t.Fatal("handshake failed:", err)
+	}
+	if dest != "example.com:443" {
+		t.Fatalf("unexpected dest:%s", dest)
+	}
+	httpConnectReply(conn, closeNormal)
+	if line := <-reply; !strings.HasPrefix(line, "HTTP/1.1 200") {
+		t.Fatalf("unexpected reply:%q", line)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("early data lost:%q, %v", buf, err)
+	}
+}
+
+func TestHTTPConnectIPv6(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go func() {
+		io.WriteString(local, "CONNECT [::1] HTTP/1.1\r\nHost: [::1]\r\n\r\n")
+		io.Copy(io.Discard, local)
+	}()
+	_, dest, err := httpConnectHandshake(pipeConn{remote}, false)
+	if err != nil || dest != "[::1]:443" {
+		t.Fatalf("unexpected dest:%s, %v", dest, err)
+	}
+}
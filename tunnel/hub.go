@@ -6,8 +6,10 @@
 package tunnel
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -16,86 +18,186 @@ const (
 	LINK_CLOSE
 	LINK_CLOSE_RECV
 	LINK_CLOSE_SEND
+	TUNNEL_PING
+	TUNNEL_PONG
+	LINK_WINDOW
+	TUNNEL_ACK     // frames received, handled by resumable tunnel
+	LINK_RELEASE   // link is released by peer, its id could be reused
+	LINK_CONNECTED // destination of link is connected by peer
+	TUNNEL_DRAIN   // peer drains the tunnel, new links should go elsewhere
+	TUNNEL_REKEY   // frames after it are sealed by next key, handled by tunnel
 )
 
 type Cmd struct {
 	Cmd    uint8
-	Linkid uint16
+	Linkid uint32
 }
 
+// arg is the extra data after cmd, such as link create args
 type CtrlDelegate interface {
-	Ctrl(cmd *Cmd) bool
+	Ctrl(cmd *Cmd, arg []byte) bool
 }
 
+// sequence of hub id, atomic
+var hubSeq uint32
+
 type Hub struct {
 	*LinkSet
-	tunnel *Tunnel
+	id      uint32
+	tunnel  *Tunnel
+	created time.Time
 
 	delegate CtrlDelegate
+
+	active  sync.WaitGroup // active links
+	nlinks  int32          // active link count, atomic
+	lock    sync.Mutex
+	closing bool // refuse new link if closing
+	ctx     context.Context
+	cancel  context.CancelFunc
+	log     *Logger
+
+	lastRecv   int64 // unix nano of last received frame, atomic
+	hbInterval time.Duration
+	hbTimeout  time.Duration
+	lastRTT    int64 // nano seconds, atomic
+	path       hubPath
+
+	// sample of throughput
+	load struct {
+		sync.Mutex
+		sampled time.Time
+		bytes   int64
+		rate    float64
+	}
+
+	linkRate int64        // rate limit of each link
+	rate     rateLimiters // shared by all links
+	bulkRate rateLimiters // shared by bulk links
+
+	linkIdle time.Duration // idle timeout of links if rule doesn't set
+
+	linkMaxAge time.Duration // links are closed after it, disabled if 0
+
+	health hubHealth // echo checks of client
+
+	audit struct {
+		interval time.Duration // between audits of link ids, disabled if 0
+		reclaim  time.Duration // leaked ids are reclaimed after it, disabled if 0
+	}
+
+	client bool         // hub of client
+	access *accessLog   // records released links, disabled if nil
+	tracer *tracer      // spans of links, disabled if nil
+	events EventHandler // told about links, disabled if nil
+
+	usage *clientUsage // traffic of client identity, server only
 }
 
 func (self *Hub) SetCtrlDelegate(delegate CtrlDelegate) {
 	self.delegate = delegate
 }
 
-func (self *Hub) Send(cmd uint8, linkid uint16, data []byte) bool {
-	var payload Payload
-	switch cmd {
-	case LINK_DATA:
-		payload.linkid = linkid
-		payload.data = data
-		Info("link(%d) send %d bytes data", linkid, len(data))
-	default:
-		buf := bytes.NewBuffer(mpool.Get()[0:0])
-		var body Cmd
-		body.Cmd = cmd
-		body.Linkid = linkid
-		binary.Write(buf, binary.LittleEndian, &body)
-
-		payload.linkid = 0
-		payload.data = buf.Bytes()
-		Info("link(%d) send cmd:%d", linkid, cmd)
+func (self *Hub) Send(cmd uint8, linkid uint32, data []byte) bool {
+	if cmd == LINK_DATA {
+		return self.sendData(linkid, data, priorityNormal, false)
 	}
+	return self.sendCtrl(cmd, linkid, data, priorityInteractive)
+}
 
-	return self.tunnel.Write(payload)
+// frames of the same class keep their order, so a link sends close in the
+// class of its data
+func (self *Hub) sendCtrl(cmd uint8, linkid uint32, data []byte, prio uint8) bool {
+	n := self.tunnel.cmdSize()
+	buf := mpool.GetSize(n + len(data))
+	buf[0] = cmd
+	self.tunnel.putId(buf[1:], linkid)
+	copy(buf[n:], data)
+	self.log.Info("link(%d) send cmd:%d", linkid, cmd)
+	return self.tunnel.Write(Payload{linkid: 0, data: buf, prio: prio})
 }
 
-func (self *Hub) onCtrl(cmd *Cmd) {
-	if self.delegate != nil && self.delegate.Ctrl(cmd) {
+// data frames are written in order of priority class
+func (self *Hub) sendData(linkid uint32, data []byte, prio uint8, plain bool) bool {
+	// boxing args allocates on every frame even if info is off
+	if GetLogLevel() > 1 {
+		self.log.Info("link(%d) send %d bytes data", linkid, len(data))
+	}
+	self.usage.add(0, len(data))
+	return self.tunnel.Write(Payload{linkid: linkid, data: data, prio: prio, plain: plain})
+}
+
+func (self *Hub) onCtrl(cmd *Cmd, arg []byte) {
+	defer self.recoverFrame(cmd.Linkid)
+
+	switch cmd.Cmd {
+	case TUNNEL_PING, TUNNEL_PONG:
+		self.onHeartbeat(cmd, arg)
+		return
+	case LINK_RELEASE:
+		self.peerReleased(cmd.Linkid)
+		return
+	case TUNNEL_DRAIN:
+		self.onDrain()
+		return
+	}
+
+	if self.delegate != nil && self.delegate.Ctrl(cmd, arg) {
 		return
 	}
 
 	linkid := cmd.Linkid
 	link := self.getLink(linkid)
 	if link == nil {
-		Error("link(%d) recv cmd:%d, no link", linkid, cmd.Cmd)
+		self.log.Error("link(%d) recv cmd:%d, no link", linkid, cmd.Cmd)
 		return
 	}
 
 	switch cmd.Cmd {
 	case LINK_CLOSE:
+		code := closeFailed
+		if self.tunnel.has(capCloseCode) && len(arg) > 0 {
+			var reason string
+			code, reason = parseCloseArg(arg)
+			link.log.Error("closed by peer: %s, %s", closeName(code), reason)
+			link.setReason(closeName(code))
+		} else if len(arg) > 0 {
+			link.log.Error("closed by peer: %s", arg)
+		}
+		link.setReason("peer closed")
+		if code == closeNormal {
+			code = closeFailed
+		}
+		link.onConnected(code)
 		link.resetRSflag()
+	case LINK_CONNECTED:
+		link.onConnected(closeNormal)
 	case LINK_CLOSE_RECV:
 		link.resetSflag()
 	case LINK_CLOSE_SEND:
 		link.resetRflag()
+	case LINK_WINDOW:
+		link.onWindow(arg)
 	default:
-		Error("link(%d) receive unknown cmd:%v", linkid, cmd)
+		link.log.Error("receive unknown cmd:%v", cmd)
 	}
 }
 
-func (self *Hub) onData(linkid uint16, data []byte) {
+func (self *Hub) onData(linkid uint32, data []byte) {
+	defer self.recoverFrame(linkid)
+
 	link := self.getLink(linkid)
 
 	if link == nil {
 		mpool.Put(data)
-		Error("link(%d) no link", linkid)
+		self.log.Error("link(%d) no link", linkid)
 		return
 	}
 
+	self.usage.add(len(data), 0)
 	if !link.putData(data) {
 		mpool.Put(data)
-		Error("link(%d) put data failed", linkid)
+		link.log.Error("put data failed")
 		return
 	}
 	return
@@ -103,80 +205,270 @@ func (self *Hub) onData(linkid uint16, data []byte) {
 
 func (self *Hub) dispatch() {
 	defer self.tunnel.Close()
+	defer self.tunnel.recoverPanic("read")
 
-	var cmd Cmd
+	idSize := self.tunnel.idSize()
 	for {
 		payload, err := self.tunnel.Read()
 		if err != nil {
-			Error("%s read failed:%v", self.tunnel.String(), err)
+			self.log.Error("%s read failed:%v", self.tunnel.String(), err)
 			break
 		}
 
+		self.touch()
 		linkid, data := payload.linkid, payload.data
 		if linkid == 0 {
-			buf := bytes.NewBuffer(data)
-			err := binary.Read(buf, binary.LittleEndian, &cmd)
+			cmd, arg, err := decodeCmd(data, idSize)
 			mpool.Put(data)
-			if err != nil {
-				Error("parse message failed:%s, break dispatch", err.Error())
+			if err == errCmdSize {
+				self.log.Error("parse message failed:%d bytes, break dispatch", len(data))
 				break
 			}
-			Info("link(%d) recv cmd:%d", cmd.Linkid, cmd.Cmd)
-			self.onCtrl(&cmd)
+			if err != nil {
+				self.log.Error("link(%d) drop cmd:%d, %v", cmd.Linkid, cmd.Cmd, err)
+				continue
+			}
+			self.log.Info("link(%d) recv cmd:%d", cmd.Linkid, cmd.Cmd)
+			self.onCtrl(&cmd, arg)
 		} else {
-			Info("link(%d) recv %d bytes data", linkid, len(data))
+			if GetLogLevel() > 1 {
+				self.log.Info("link(%d) recv %d bytes data", linkid, len(data))
+			}
 			self.onData(linkid, data)
 		}
 	}
 }
 
 func (self *Hub) Start() {
+	defer self.cancel()
+	go func() {
+		<-self.ctx.Done()
+		self.tunnel.Close()
+	}()
+
+	self.touch()
+	if self.hbInterval > 0 && !self.tunnel.has(capHeartbeat) {
+		self.log.Info("peer doesn't support heartbeat, disabled")
+	} else if self.hbInterval > 0 {
+		go self.heartbeat(self.hbInterval, self.hbTimeout)
+	}
+	if self.health.interval > 0 && !self.tunnel.has(capEcho) {
+		self.log.Info("peer doesn't serve echo, health check disabled")
+	} else if self.health.interval > 0 {
+		go self.healthCheck(self.health.interval)
+	}
+	if self.audit.interval > 0 {
+		go self.auditLoop(self.audit.interval, self.audit.reclaim)
+	}
+
 	self.dispatch()
 
 	// tunnel disconnect, so reset all link
-	Error("reset all link")
-	for i := uint16(1); i < MaxLinkPerTunnel; i++ {
-		link := self.getLink(i)
-		if link != nil {
-			link.resetRSflag()
-			Error("link(%d) reset", i)
-		}
+	self.log.Error("reset all link")
+	for _, link := range self.activeLinks() {
+		link.setReason("tunnel broken")
+		link.resetRSflag()
+		link.log.Error("reset")
 	}
-	Log("hub(%s) quit", self.tunnel.String())
+	self.log.Log("hub(%s) quit", self.tunnel.String())
 }
 
 func (self *Hub) Status() {
-	total := 0
-	links := make([]uint16, 100)
-	for i := uint16(0); i < MaxLinkPerTunnel; i++ {
-		if self.links[i] != nil {
-			if total < cap(links) {
-				links[total] = i
-			}
-			total += 1
+	active := self.activeLinks()
+	total := len(active)
+	links := make([]uint32, 0, 100)
+	for _, link := range active {
+		if len(links) == cap(links) {
+			break
 		}
+		links = append(links, link.id)
 	}
-	if total <= cap(links) {
-		links = links[:total]
-	}
-	Log("<status> %s, %d links(%v)", self.tunnel.String(), total, links)
+	self.log.Log("<status> %s, %d links(%v)", self.tunnel.String(), total, links)
 }
 
-func (self *Hub) NewLink(linkid uint16) *Link {
+func (self *Hub) NewLink(linkid uint32) *Link {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closing {
+		return nil
+	}
+
 	link := newLink(linkid, self)
+	link.maxAge = self.linkMaxAge
 	if self.setLink(linkid, link) {
+		self.active.Add(1)
+		atomic.AddInt32(&self.nlinks, 1)
+		atomic.AddInt64(&stats.LinkCreated, 1)
 		return link
 	}
 	return nil
 }
 
-func (self *Hub) ReleaseLink(linkid uint16) bool {
-	return self.resetLink(linkid)
+// link created by peer is released after both directions are closed, peer
+// reuses its id then
+func (self *Hub) ReleaseLink(linkid uint32) bool {
+	if link := self.getLink(linkid); link != nil {
+		return self.releaseLink(link)
+	}
+	return false
+}
+
+// link reclaimed by audit is released already, it's not released again
+func (self *Hub) releaseLink(link *Link) bool {
+	if self.removeLink(link) {
+		if !self.owns(link.id) && self.tunnel.has(capLinkRelease) {
+			self.sendCtrl(LINK_RELEASE, link.id, nil, link.priority)
+		}
+		link.cancel()
+		if self.access != nil {
+			self.logAccess(link)
+		}
+		self.endSpan(link)
+		self.onLinkClose(link)
+		self.active.Done()
+		atomic.AddInt32(&self.nlinks, -1)
+		atomic.AddInt64(&stats.LinkClosed, 1)
+		return true
+	}
+	return false
+}
+
+// create a link for conn, and pump data until link is closed
+func (self *Hub) forward(conn BiConn, rule *Rule, args *LinkArgs) {
+	linkid := self.AcquireId()
+	if linkid == 0 {
+		self.log.Error("alloc linkid failed, source: %v", conn.RemoteAddr())
+		return
+	}
+	defer self.ReleaseId(linkid)
+	self.forwardLink(linkid, conn, rule, args, nil)
+}
+
+// like forward, but linkid is acquired by caller. If reply is set, it's
+// called with result of peer connecting destination before pumping data
+func (self *Hub) forwardLink(linkid uint32, conn BiConn, rule *Rule, args *LinkArgs, reply func(code uint8) error) {
+	self.stampId(linkid)
+	link := self.NewLink(linkid)
+	if link == nil {
+		self.log.Error("link(%d) create failed, source: %v", linkid, conn.RemoteAddr())
+		return
+	}
+	defer self.releaseLink(link)
+	link.service = rule.String()
+	link.source = args.Source
+	link.dest = args.Dest
+	link.idleTimeout = self.idleTimeout(rule)
+	link.setPriority(rule.priority)
+	link.setNoCrypt(rule.NoCrypt)
+	args.Priority = rule.Priority
+	args.NoCrypt = rule.NoCrypt
+	link.log.Info("create link, source: %v, service: %s, dest: %s", conn.RemoteAddr(), rule, args.Dest)
+
+	if reply == nil && rule.EarlyData && self.tunnel.has(capEarlyData) {
+		if data := readEarlyData(conn); data != nil {
+			link.onEarlyData(data)
+			args.EarlyData = string(data)
+		}
+	}
+	link.span = self.tracer.startRoot("link "+link.service, spanKindClient)
+	self.startSpan(link)
+	self.onLinkOpen(link)
+	args.TraceParent = link.span.traceParent()
+	link.SendCreate(args)
+	if reply != nil {
+		code := link.waitConnected()
+		err := reply(code)
+		if code != closeNormal {
+			link.log.Error("peer failed to connect %s: %s", args.Dest, closeName(code))
+			link.setReason(closeName(code))
+		} else if err != nil {
+			link.log.Error("reply proxy request failed:%v", err)
+			link.setReason("reply failed")
+		}
+		if code != closeNormal || err != nil {
+			link.SendClose()
+			return
+		}
+	}
+	link.Pump(conn)
+}
+
+func (self *Hub) LinkCount() int {
+	return int(atomic.LoadInt32(&self.nlinks))
+}
+
+func (self *Hub) IsClosing() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closing
+}
+
+// refuse new links and wait active links finish
+func (self *Hub) Drain(ctx context.Context) error {
+	self.startDrain()
+
+	done := make(chan struct{})
+	go func() {
+		self.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (self *Hub) Close() {
+	self.cancel()
+	self.tunnel.Close()
 }
 
-func newHub(tunnel *Tunnel, client bool) *Hub {
+// links without traffic in timeout are closed, disabled if 0
+func (self *Hub) SetIdleTimeout(timeout time.Duration) {
+	self.linkIdle = timeout
+}
+
+// rule overrides timeout of hub, negative means disabled
+func (self *Hub) idleTimeout(rule *Rule) time.Duration {
+	switch {
+	case rule.IdleTimeout > 0:
+		return time.Duration(rule.IdleTimeout) * time.Second
+	case rule.IdleTimeout < 0:
+		return 0
+	}
+	return self.linkIdle
+}
+
+// write a record of every released link, disabled if nil
+func (self *Hub) SetAccessLog(access *accessLog) {
+	self.access = access
+}
+
+// trace links as spans, disabled if nil
+func (self *Hub) SetTracer(tracer *tracer) {
+	self.tracer = tracer
+}
+
+// hub is closed when ctx is done
+// at most maxLinks links are created by this end
+func newHub(ctx context.Context, tunnel *Tunnel, client bool, maxLinks int, log *Logger) *Hub {
 	hub := new(Hub)
-	hub.LinkSet = newLinkSet(client)
+	if tunnel.has(capLinkId32) {
+		hub.LinkSet = newWideLinkSet(client, maxLinks)
+	} else {
+		hub.LinkSet = newLinkSet(client, maxLinks)
+	}
+	if tunnel.has(capLinkRelease) {
+		hub.holdIds()
+	}
+	hub.id = atomic.AddUint32(&hubSeq, 1)
+	hub.client = client
 	hub.tunnel = tunnel
+	hub.created = time.Now()
+	hub.log = log
+	hub.ctx, hub.cancel = context.WithCancel(ctx)
 	return hub
 }
@@ -9,6 +9,9 @@ type HubItem struct {
 	*Hub
 	priority int // cocurrent link
 	index    int // index in the heap
+	tunnel   int // index of tunnel
+	server   *endpoint
+	quit     <-chan struct{} // closed when hub started as standby quits, nil otherwise
 }
 
 func (h *HubItem) Status() {
@@ -0,0 +1,48 @@
+//
+//   date  : 2015-09-29
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+)
+
+// bit of compress nibble in handshake, set if client proposes per-frame
+// checksum and server accepts it. Old servers take it as an unknown compress
+// method and answer without it.
+const compressIntegrity uint8 = 0x08
+
+// size of crc32c appended to every frame when integrity is enabled
+const frameSumSize = 4
+
+var errFrameChecksum = errors.New("frame checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum of frame head and body, the body is compressed form on wire
+func frameSum(head, body []byte) uint32 {
+	return crc32.Update(crc32.Update(0, castagnoli, head), castagnoli, body)
+}
+
+// read and verify checksum after frame body if integrity is enabled. A
+// mismatch is counted and breaks the tunnel, since frames after it can't be
+// trusted either.
+func (t *Tunnel) readSum(body []byte) error {
+	if !t.integrity {
+		return nil
+	}
+	if _, err := io.ReadFull(t.reader, t.rsum[:]); err != nil {
+		return err
+	}
+	if frameSum(t.rhead[:t.headSize()], body) != binary.LittleEndian.Uint32(t.rsum[:]) {
+		atomic.AddInt64(&stats.FrameCorrupted, 1)
+		return errFrameChecksum
+	}
+	return nil
+}
@@ -0,0 +1,598 @@
+//
+//   date  : 2015-10-20
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// kcp arq over datagrams, as ikcp of skywind3000/kcp, in stream mode: a
+// write is merged into segments of mss, so reads see a byte stream. It isn't
+// safe for concurrent use, kcpConn serializes calls.
+//
+// segment header, little endian:
+//
+//	conv(4) cmd(1) frg(1) wnd(2) ts(4) sn(4) una(4) len(4)
+const (
+	kcpOverhead = 24
+
+	kcpCmdPush = 81 // data
+	kcpCmdAck  = 82 // ack of a push
+	kcpCmdWask = 83 // ask window size of peer
+	kcpCmdWins = 84 // tell window size
+
+	kcpAskSend = 1 // send wask
+	kcpAskTell = 2 // send wins
+
+	kcpRtoNdl     = 30 // min rto of nodelay, ms
+	kcpRtoMin     = 100
+	kcpRtoDef     = 200
+	kcpRtoMax     = 60000
+	kcpThreshInit = 2
+	kcpThreshMin  = 2
+	kcpProbeInit  = 7000   // ms to probe window of peer after it's zero
+	kcpProbeLimit = 120000 // max ms between probes
+	kcpDeadLink   = 20     // transmissions of a segment before link is dead
+	kcpFastLimit  = 5      // max fast retransmissions of a segment
+)
+
+var (
+	errKCPConv   = errors.New("kcp: conv mismatch")
+	errKCPPacket = errors.New("kcp: bad packet")
+)
+
+// modular difference of sequence numbers and timestamps
+func kcpDiff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+type kcpSegment struct {
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	resendts uint32
+	rto      uint32
+	fastack  uint32
+	xmit     uint32
+	data     []byte
+}
+
+func (seg *kcpSegment) encode(p []byte) []byte {
+	binary.LittleEndian.PutUint32(p, seg.conv)
+	p[4] = seg.cmd
+	p[5] = seg.frg
+	binary.LittleEndian.PutUint16(p[6:], seg.wnd)
+	binary.LittleEndian.PutUint32(p[8:], seg.ts)
+	binary.LittleEndian.PutUint32(p[12:], seg.sn)
+	binary.LittleEndian.PutUint32(p[16:], seg.una)
+	binary.LittleEndian.PutUint32(p[20:], uint32(len(seg.data)))
+	return p[kcpOverhead:]
+}
+
+type kcpAck struct {
+	sn uint32
+	ts uint32
+}
+
+type kcp struct {
+	conv, mtu, mss uint32
+	dead           bool
+
+	sndUna, sndNxt, rcvNxt uint32
+	ssthresh               uint32
+	rxRttval, rxSrtt       int32
+	rxRto, rxMinrto        uint32
+
+	sndWnd, rcvWnd, rmtWnd, cwnd uint32
+	probe                        uint32
+	interval, tsFlush            uint32
+	current                      uint32
+	updated                      bool
+	tsProbe, probeWait           uint32
+	incr                         uint32
+
+	nodelay    int
+	fastresend uint32
+	nocwnd     bool
+
+	sndQueue []kcpSegment
+	rcvQueue []kcpSegment
+	sndBuf   []kcpSegment
+	rcvBuf   []kcpSegment
+	acklist  []kcpAck
+
+	buffer []byte
+	output func(p []byte) // packets of at most mtu bytes, p is reused after return
+
+	xmit uint64 // retransmissions by timeout
+}
+
+func newKCP(conv uint32, output func(p []byte)) *kcp {
+	k := &kcp{
+		conv:     conv,
+		sndWnd:   32,
+		rcvWnd:   128,
+		rmtWnd:   128,
+		rxRto:    kcpRtoDef,
+		rxMinrto: kcpRtoMin,
+		interval: 100,
+		tsFlush:  100,
+		ssthresh: kcpThreshInit,
+		output:   output,
+	}
+	k.setMtu(1400)
+	return k
+}
+
+func (k *kcp) setMtu(mtu int) {
+	k.mtu = uint32(mtu)
+	k.mss = k.mtu - kcpOverhead
+	k.buffer = make([]byte, mtu)
+}
+
+// rcv is at least 128, the max fragments of a message of ikcp
+func (k *kcp) setWindow(snd, rcv int) {
+	if snd > 0 {
+		k.sndWnd = uint32(snd)
+	}
+	if rcv > 0 {
+		k.rcvWnd = uint32(rcv)
+		if k.rcvWnd < 128 {
+			k.rcvWnd = 128
+		}
+	}
+}
+
+// nodelay: 0 normal, 1 lower min rto and slower rto growth, 2 rto grows by
+// half of current rto. resend: fast retransmit after acks skipping a segment
+// that many times, 0 to disable. nc disables congestion control
+func (k *kcp) setNoDelay(nodelay, interval, resend int, nc bool) {
+	k.nodelay = nodelay
+	if nodelay > 0 {
+		k.rxMinrto = kcpRtoNdl
+	} else {
+		k.rxMinrto = kcpRtoMin
+	}
+	if interval < 10 {
+		interval = 10
+	} else if interval > 5000 {
+		interval = 5000
+	}
+	k.interval = uint32(interval)
+	k.fastresend = uint32(resend)
+	k.nocwnd = nc
+}
+
+// queue data to send, flushed by update
+func (k *kcp) send(data []byte) {
+	// stream mode, fill last segment first
+	if n := len(k.sndQueue); n > 0 {
+		seg := &k.sndQueue[n-1]
+		if room := int(k.mss) - len(seg.data); room > 0 {
+			if room > len(data) {
+				room = len(data)
+			}
+			seg.data = append(seg.data, data[:room]...)
+			data = data[room:]
+		}
+	}
+	for len(data) > 0 {
+		size := len(data)
+		if size > int(k.mss) {
+			size = int(k.mss)
+		}
+		seg := kcpSegment{data: make([]byte, size, k.mss)}
+		copy(seg.data, data)
+		k.sndQueue = append(k.sndQueue, seg)
+		data = data[size:]
+	}
+}
+
+// bytes ready to read
+func (k *kcp) readable() bool {
+	return len(k.rcvQueue) > 0
+}
+
+// read received bytes in order, 0 if none
+func (k *kcp) recv(p []byte) int {
+	full := len(k.rcvQueue) >= int(k.rcvWnd)
+	n := 0
+	for n < len(p) && len(k.rcvQueue) > 0 {
+		seg := &k.rcvQueue[0]
+		c := copy(p[n:], seg.data)
+		n += c
+		if c < len(seg.data) {
+			seg.data = seg.data[c:]
+			break
+		}
+		k.rcvQueue = removeSegments(k.rcvQueue, 1)
+	}
+	k.moveRcvBuf()
+	// tell peer window is open again
+	if full && len(k.rcvQueue) < int(k.rcvWnd) {
+		k.probe |= kcpAskTell
+	}
+	return n
+}
+
+// segments waiting to be sent or acked
+func (k *kcp) waitSnd() int {
+	return len(k.sndBuf) + len(k.sndQueue)
+}
+
+// remove first n segments, keeping capacity
+func removeSegments(segs []kcpSegment, n int) []kcpSegment {
+	m := copy(segs, segs[n:])
+	for i := m; i < len(segs); i++ {
+		segs[i] = kcpSegment{}
+	}
+	return segs[:m]
+}
+
+// move segments in order from rcvBuf to rcvQueue
+func (k *kcp) moveRcvBuf() {
+	count := 0
+	for _, seg := range k.rcvBuf {
+		if seg.sn != k.rcvNxt || len(k.rcvQueue)+count >= int(k.rcvWnd) {
+			break
+		}
+		k.rcvNxt++
+		count++
+	}
+	if count > 0 {
+		k.rcvQueue = append(k.rcvQueue, k.rcvBuf[:count]...)
+		k.rcvBuf = removeSegments(k.rcvBuf, count)
+	}
+}
+
+func (k *kcp) updateAck(rtt int32) {
+	if k.rxSrtt == 0 {
+		k.rxSrtt = rtt
+		k.rxRttval = rtt / 2
+	} else {
+		delta := rtt - k.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rxRttval = (3*k.rxRttval + delta) / 4
+		k.rxSrtt = (7*k.rxSrtt + rtt) / 8
+		if k.rxSrtt < 1 {
+			k.rxSrtt = 1
+		}
+	}
+	rto := uint32(k.rxSrtt) + max(k.interval, uint32(4*k.rxRttval))
+	k.rxRto = min(max(k.rxMinrto, rto), kcpRtoMax)
+}
+
+func (k *kcp) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+func (k *kcp) parseAck(sn uint32) {
+	if kcpDiff(sn, k.sndUna) < 0 || kcpDiff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i := range k.sndBuf {
+		seg := &k.sndBuf[i]
+		if sn == seg.sn {
+			k.sndBuf = append(k.sndBuf[:i], k.sndBuf[i+1:]...)
+			break
+		}
+		if kcpDiff(sn, seg.sn) < 0 {
+			break
+		}
+	}
+}
+
+func (k *kcp) parseUna(una uint32) {
+	count := 0
+	for _, seg := range k.sndBuf {
+		if kcpDiff(una, seg.sn) <= 0 {
+			break
+		}
+		count++
+	}
+	if count > 0 {
+		k.sndBuf = removeSegments(k.sndBuf, count)
+	}
+}
+
+// segments before the max acked one are skipped once more
+func (k *kcp) parseFastack(sn uint32) {
+	if kcpDiff(sn, k.sndUna) < 0 || kcpDiff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i := range k.sndBuf {
+		seg := &k.sndBuf[i]
+		if kcpDiff(sn, seg.sn) < 0 {
+			break
+		}
+		if sn != seg.sn {
+			seg.fastack++
+		}
+	}
+}
+
+// insert pushed segment into rcvBuf by sn, duplicated ones are dropped
+func (k *kcp) parseData(newseg kcpSegment) {
+	sn := newseg.sn
+	if kcpDiff(sn, k.rcvNxt+k.rcvWnd) >= 0 || kcpDiff(sn, k.rcvNxt) < 0 {
+		return
+	}
+	i := len(k.rcvBuf) - 1
+	for ; i >= 0; i-- {
+		seg := &k.rcvBuf[i]
+		if seg.sn == sn {
+			return
+		}
+		if kcpDiff(sn, seg.sn) > 0 {
+			break
+		}
+	}
+	k.rcvBuf = append(k.rcvBuf, kcpSegment{})
+	copy(k.rcvBuf[i+2:], k.rcvBuf[i+1:])
+	k.rcvBuf[i+1] = newseg
+	k.moveRcvBuf()
+}
+
+// input a packet of peer, may hold several segments
+func (k *kcp) input(data []byte) error {
+	if len(data) < kcpOverhead {
+		return errKCPPacket
+	}
+	prevUna := k.sndUna
+	var maxack uint32
+	acked := false
+	for len(data) >= kcpOverhead {
+		conv := binary.LittleEndian.Uint32(data)
+		if conv != k.conv {
+			return errKCPConv
+		}
+		cmd := data[4]
+		frg := data[5]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[kcpOverhead:]
+		if uint32(len(data)) < length {
+			return errKCPPacket
+		}
+		if cmd != kcpCmdPush && cmd != kcpCmdAck && cmd != kcpCmdWask && cmd != kcpCmdWins {
+			return errKCPPacket
+		}
+
+		k.rmtWnd = uint32(wnd)
+		k.parseUna(una)
+		k.shrinkBuf()
+		switch cmd {
+		case kcpCmdAck:
+			if rtt := kcpDiff(k.current, ts); rtt >= 0 {
+				k.updateAck(rtt)
+			}
+			k.parseAck(sn)
+			k.shrinkBuf()
+			if !acked || kcpDiff(sn, maxack) > 0 {
+				acked = true
+				maxack = sn
+			}
+		case kcpCmdPush:
+			if kcpDiff(sn, k.rcvNxt+k.rcvWnd) < 0 {
+				k.acklist = append(k.acklist, kcpAck{sn: sn, ts: ts})
+				if kcpDiff(sn, k.rcvNxt) >= 0 {
+					seg := kcpSegment{conv: conv, cmd: cmd, frg: frg, wnd: wnd, ts: ts, sn: sn, una: una}
+					seg.data = append([]byte(nil), data[:length]...)
+					k.parseData(seg)
+				}
+			}
+		case kcpCmdWask:
+			k.probe |= kcpAskTell
+		case kcpCmdWins:
+			// window of peer is taken above
+		}
+		data = data[length:]
+	}
+	if acked {
+		k.parseFastack(maxack)
+	}
+
+	// grow congestion window as peer acks
+	if kcpDiff(k.sndUna, prevUna) > 0 && k.cwnd < k.rmtWnd {
+		mss := k.mss
+		if k.cwnd < k.ssthresh {
+			k.cwnd++
+			k.incr += mss
+		} else {
+			if k.incr < mss {
+				k.incr = mss
+			}
+			k.incr += (mss*mss)/k.incr + mss/16
+			if (k.cwnd+1)*mss <= k.incr {
+				k.cwnd = (k.incr + mss - 1) / mss
+			}
+		}
+		if k.cwnd > k.rmtWnd {
+			k.cwnd = k.rmtWnd
+			k.incr = k.rmtWnd * mss
+		}
+	}
+	return nil
+}
+
+func (k *kcp) wndUnused() uint16 {
+	if n := len(k.rcvQueue); n < int(k.rcvWnd) {
+		return uint16(k.rcvWnd - uint32(n))
+	}
+	return 0
+}
+
+// send acks, probes and segments due at current
+func (k *kcp) flush() {
+	if !k.updated {
+		return
+	}
+	current := k.current
+	buf := k.buffer
+	ptr := 0
+	write := func(seg *kcpSegment) {
+		if ptr+kcpOverhead+len(seg.data) > int(k.mtu) {
+			k.output(buf[:ptr])
+			ptr = 0
+		}
+		seg.encode(buf[ptr:])
+		ptr += kcpOverhead
+		ptr += copy(buf[ptr:], seg.data)
+	}
+
+	seg := kcpSegment{conv: k.conv, cmd: kcpCmdAck, wnd: k.wndUnused(), una: k.rcvNxt}
+	for _, ack := range k.acklist {
+		seg.sn, seg.ts = ack.sn, ack.ts
+		write(&seg)
+	}
+	k.acklist = k.acklist[:0]
+
+	// probe window of peer while it's zero
+	if k.rmtWnd == 0 {
+		if k.probeWait == 0 {
+			k.probeWait = kcpProbeInit
+			k.tsProbe = current + k.probeWait
+		} else if kcpDiff(current, k.tsProbe) >= 0 {
+			k.probeWait = max(k.probeWait, kcpProbeInit)
+			k.probeWait = min(k.probeWait+k.probeWait/2, kcpProbeLimit)
+			k.tsProbe = current + k.probeWait
+			k.probe |= kcpAskSend
+		}
+	} else {
+		k.tsProbe = 0
+		k.probeWait = 0
+	}
+	seg.sn, seg.ts = 0, 0
+	if k.probe&kcpAskSend != 0 {
+		seg.cmd = kcpCmdWask
+		write(&seg)
+	}
+	if k.probe&kcpAskTell != 0 {
+		seg.cmd = kcpCmdWins
+		write(&seg)
+	}
+	k.probe = 0
+
+	cwnd := min(k.sndWnd, k.rmtWnd)
+	if !k.nocwnd {
+		cwnd = min(k.cwnd, cwnd)
+	}
+	count := 0
+	for _, newseg := range k.sndQueue {
+		if kcpDiff(k.sndNxt, k.sndUna+cwnd) >= 0 {
+			break
+		}
+		newseg.conv = k.conv
+		newseg.cmd = kcpCmdPush
+		newseg.sn = k.sndNxt
+		k.sndNxt++
+		k.sndBuf = append(k.sndBuf, newseg)
+		count++
+	}
+	if count > 0 {
+		k.sndQueue = removeSegments(k.sndQueue, count)
+	}
+
+	resent := k.fastresend
+	if resent == 0 {
+		resent = 0xffffffff
+	}
+	var rtomin uint32
+	if k.nodelay == 0 {
+		rtomin = k.rxRto >> 3
+	}
+	lost, change := false, false
+	for i := range k.sndBuf {
+		s := &k.sndBuf[i]
+		needsend := false
+		if s.xmit == 0 {
+			needsend = true
+			s.rto = k.rxRto
+			s.resendts = current + s.rto + rtomin
+		} else if kcpDiff(current, s.resendts) >= 0 {
+			needsend = true
+			k.xmit++
+			if k.nodelay == 0 {
+				s.rto += max(s.rto, k.rxRto)
+			} else if k.nodelay < 2 {
+				s.rto += s.rto / 2
+			} else {
+				s.rto += k.rxRto / 2
+			}
+			s.resendts = current + s.rto
+			lost = true
+		} else if s.fastack >= resent && s.xmit <= kcpFastLimit {
+			needsend = true
+			s.fastack = 0
+			s.resendts = current + s.rto
+			change = true
+		}
+		if needsend {
+			s.xmit++
+			s.ts = current
+			s.wnd = seg.wnd
+			s.una = k.rcvNxt
+			write(s)
+			if s.xmit >= kcpDeadLink {
+				k.dead = true
+			}
+		}
+	}
+	if ptr > 0 {
+		k.output(buf[:ptr])
+	}
+
+	if change {
+		inflight := k.sndNxt - k.sndUna
+		k.ssthresh = max(inflight/2, kcpThreshMin)
+		k.cwnd = k.ssthresh + resent
+		k.incr = k.cwnd * k.mss
+	}
+	if lost {
+		k.ssthresh = max(cwnd/2, kcpThreshMin)
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+	if k.cwnd < 1 {
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+}
+
+// advance clock of kcp to current ms, and flush every interval
+func (k *kcp) update(current uint32) {
+	k.current = current
+	if !k.updated {
+		k.updated = true
+		k.tsFlush = current
+	}
+	slap := kcpDiff(current, k.tsFlush)
+	if slap >= 10000 || slap < -10000 {
+		k.tsFlush = current
+		slap = 0
+	}
+	if slap >= 0 {
+		k.tsFlush += k.interval
+		if kcpDiff(current, k.tsFlush) >= 0 {
+			k.tsFlush = current + k.interval
+		}
+		k.flush()
+	}
+}
@@ -0,0 +1,561 @@
+//
+//   date  : 2015-10-20
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaults of kcp transport
+const (
+	DefaultKCPMtu    = 1350
+	DefaultKCPWindow = 512
+	// data shards of a fec group if parity shards are set
+	DefaultKCPDataShards = 10
+)
+
+const (
+	kcpMinMtu = 256
+	kcpMaxMtu = 9000
+
+	// tuned for lossy links as fast mode of kcptun: nodelay, 10ms interval,
+	// fast retransmit after 2 skips and no congestion window
+	kcpNoDelay  = 1
+	kcpInterval = 10
+	kcpResend   = 2
+
+	kcpOpening   = 100 * time.Millisecond // client asks window of server until it answers
+	kcpKeepalive = 5 * time.Second        // a window update is sent if idle
+	kcpIdle      = 30 * time.Second       // session dies without packets of peer
+	kcpLinger    = 10 * time.Second       // max time closed session flushes data
+
+	// sent as a bare segment by a closing end, not a kcp command
+	kcpCmdClose = 90
+)
+
+var (
+	errKCPUnreachable = errors.New("kcp: peer is unreachable")
+	errKCPReset       = errors.New("kcp: closed by peer")
+)
+
+var kcpEpoch = time.Now()
+
+// clock of kcp in ms
+func kcpNow() uint32 {
+	return uint32(time.Since(kcpEpoch) / time.Millisecond)
+}
+
+// check and default options of kcp transport
+func (app *App) initKCP() error {
+	if app.KCPMtu == 0 {
+		app.KCPMtu = DefaultKCPMtu
+	}
+	if app.KCPMtu < kcpMinMtu || app.KCPMtu > kcpMaxMtu {
+		return fmt.Errorf("kcp mtu should be in [%d, %d]", kcpMinMtu, kcpMaxMtu)
+	}
+	if app.KCPWindow == 0 {
+		app.KCPWindow = DefaultKCPWindow
+	}
+	if app.KCPParityShards > 0 && app.KCPDataShards == 0 {
+		app.KCPDataShards = DefaultKCPDataShards
+	}
+	if app.KCPParityShards > 0 && app.KCPDataShards+app.KCPParityShards > 256 {
+		return fmt.Errorf("kcp data and parity shards should be at most 256 in total")
+	}
+	return nil
+}
+
+// reliable udp by kcp arq and optional fec, wrapped by tls, websocket and
+// obfuscation as tcp
+type kcpTransport struct {
+	app *App
+}
+
+func newKCPTransport(app *App) Transport {
+	return &kcpTransport{app: app}
+}
+
+func (t *kcpTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := t.app.dialTunnel(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := newKCPConn(t.app, rand.Uint32(), conn.(*net.UDPConn), conn.RemoteAddr())
+	// server speaks first in tunnel handshake, client opens the session
+	c.opening = true
+	go c.readLoop()
+	return c, nil
+}
+
+func (t *kcpTransport) Listen() (net.Listener, error) {
+	laddr := t.app.laddr
+	conn, err := listenUDP(&net.UDPAddr{IP: laddr.IP, Port: laddr.Port, Zone: laddr.Zone})
+	if err != nil {
+		return nil, err
+	}
+	ln := &kcpListener{
+		app:      t.app,
+		conn:     conn,
+		sessions: make(map[kcpKey]*kcpConn),
+		accepted: make(chan *kcpConn, 128),
+		done:     make(chan struct{}),
+	}
+	go ln.serve()
+	return ln, nil
+}
+
+func (t *kcpTransport) Handshake(conn net.Conn, server string) (net.Conn, error) {
+	return t.app.wrapConn(conn, server)
+}
+
+// a kcp session over udp, as a net.Conn. Client owns its connected socket,
+// sessions of server share the listener's
+type kcpConn struct {
+	mu     sync.Mutex
+	kcp    *kcp
+	conv   uint32
+	conn   *net.UDPConn
+	raddr  net.Addr
+	ln     *kcpListener // nil of client
+	window int
+	enc    *fecEncoder // nil if fec is disabled
+	dec    *fecDecoder
+
+	readable chan struct{} // notified when data arrives, state or deadline changes
+	writable chan struct{} // notified when send window drains, state or deadline changes
+	released chan struct{} // closed when session is gone
+
+	rdeadline, wdeadline time.Time
+	rerr, werr           error     // set once session is broken or closed
+	closed               bool      // Close is called
+	opening              bool      // client hasn't heard from server
+	lingerUntil          time.Time // closed session is released then at latest
+	lastRecv, lastSend   time.Time
+}
+
+func newKCPConn(app *App, conv uint32, conn *net.UDPConn, raddr net.Addr) *kcpConn {
+	c := &kcpConn{
+		conv:     conv,
+		conn:     conn,
+		raddr:    raddr,
+		window:   app.KCPWindow,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		released: make(chan struct{}),
+		lastRecv: time.Now(),
+		lastSend: time.Now(),
+	}
+	mtu := app.KCPMtu
+	if app.KCPParityShards > 0 {
+		c.enc = newFECEncoder(conv, app.KCPDataShards, app.KCPParityShards, mtu)
+		c.dec = newFECDecoder(app.KCPDataShards, app.KCPParityShards)
+		mtu -= fecOverhead
+	}
+	c.kcp = newKCP(conv, c.output)
+	c.kcp.setMtu(mtu)
+	c.kcp.setWindow(app.KCPWindow, app.KCPWindow)
+	c.kcp.setNoDelay(kcpNoDelay, kcpInterval, kcpResend, true)
+	go c.run()
+	return c
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// packet of kcp to peer, called with lock held
+func (c *kcpConn) output(p []byte) {
+	c.lastSend = time.Now()
+	if c.enc != nil {
+		c.enc.encode(p, c.write)
+	} else {
+		c.write(p)
+	}
+}
+
+// losses are recovered by kcp, errors are ignored
+func (c *kcpConn) write(p []byte) {
+	if c.ln == nil {
+		c.conn.Write(p)
+	} else {
+		c.conn.WriteTo(p, c.raddr)
+	}
+}
+
+// packet of peer
+func (c *kcpConn) input(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// closed session still takes acks of data it flushes
+	if c.werr != nil && c.werr != net.ErrClosed {
+		return
+	}
+	// packets of other sessions from the same address, forged or stale
+	if len(p) < 4 || binary.LittleEndian.Uint32(p) != c.conv {
+		return
+	}
+	pkts := [][]byte{p}
+	if c.dec != nil {
+		var err error
+		if pkts, err = c.dec.decode(p); err != nil {
+			return
+		}
+	}
+	for _, pkt := range pkts {
+		if len(pkt) == kcpOverhead && pkt[4] == kcpCmdClose && binary.LittleEndian.Uint32(pkt) == c.conv {
+			c.fail(io.EOF, errKCPReset)
+			return
+		}
+		if c.kcp.input(pkt) == nil {
+			c.lastRecv = time.Now()
+			c.opening = false
+		}
+	}
+	if c.kcp.readable() {
+		notify(c.readable)
+	}
+	notify(c.writable)
+}
+
+// session is broken, called with lock held
+func (c *kcpConn) fail(rerr, werr error) {
+	if c.rerr == nil {
+		c.rerr = rerr
+	}
+	if c.werr == nil {
+		c.werr = werr
+	}
+	notify(c.readable)
+	notify(c.writable)
+}
+
+// drive kcp by its interval until the session is released
+func (c *kcpConn) run() {
+	ticker := time.NewTicker(kcpInterval * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !c.tick() {
+			c.release()
+			return
+		}
+	}
+}
+
+// false if session should be released
+func (c *kcpConn) tick() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	broken := c.rerr != nil && !c.closed
+	if c.closed {
+		if c.werr != net.ErrClosed || c.kcp.waitSnd() == 0 || now.After(c.lingerUntil) {
+			if c.werr == net.ErrClosed {
+				c.sendClose()
+			}
+			return false
+		}
+	} else if broken {
+		// wait for Close
+		return true
+	}
+
+	if c.opening && now.Sub(c.lastSend) >= kcpOpening {
+		c.kcp.probe |= kcpAskSend
+	} else if now.Sub(c.lastSend) >= kcpKeepalive {
+		c.kcp.probe |= kcpAskTell
+	}
+	waiting := c.kcp.waitSnd()
+	c.kcp.update(kcpNow())
+	if c.kcp.dead || now.Sub(c.lastRecv) >= kcpIdle {
+		c.fail(errKCPUnreachable, errKCPUnreachable)
+		return !c.closed
+	}
+	if c.kcp.waitSnd() < waiting {
+		notify(c.writable)
+	}
+	return true
+}
+
+// tell peer to release the session at once, lost if the packet is lost
+func (c *kcpConn) sendClose() {
+	seg := kcpSegment{conv: c.conv, cmd: kcpCmdClose}
+	p := make([]byte, kcpOverhead)
+	seg.encode(p)
+	c.output(p)
+}
+
+func (c *kcpConn) release() {
+	close(c.released)
+	if c.ln != nil {
+		c.ln.remove(c)
+	} else {
+		c.conn.Close()
+	}
+}
+
+// client reads its own socket until it's closed
+func (c *kcpConn) readLoop() {
+	buf := make([]byte, kcpMaxMtu)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-c.released:
+				return
+			default:
+			}
+			// such as icmp port unreachable, peer may come back
+			continue
+		}
+		c.input(buf[:n])
+	}
+}
+
+// wait for ch until deadline, false on timeout
+func waitDeadline(ch, released chan struct{}, deadline time.Time) bool {
+	if deadline.IsZero() {
+		select {
+		case <-ch:
+		case <-released:
+		}
+		return true
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-released:
+	case <-timer.C:
+	}
+	return true
+}
+
+func (c *kcpConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if c.kcp.readable() {
+			n := c.kcp.recv(p)
+			c.mu.Unlock()
+			return n, nil
+		}
+		if err := c.rerr; err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.rdeadline
+		c.mu.Unlock()
+		if !waitDeadline(c.readable, c.released, deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *kcpConn) Write(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if err := c.werr; err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		// at most a write beyond twice of window is queued
+		if c.kcp.waitSnd() < 2*c.window {
+			c.kcp.send(p)
+			c.kcp.current = kcpNow()
+			c.kcp.flush()
+			c.mu.Unlock()
+			return len(p), nil
+		}
+		deadline := c.wdeadline
+		c.mu.Unlock()
+		if !waitDeadline(c.writable, c.released, deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// queued data is still sent in kcpLinger, then peer is told
+func (c *kcpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.lingerUntil = time.Now().Add(kcpLinger)
+	c.fail(net.ErrClosed, net.ErrClosed)
+	return nil
+}
+
+func (c *kcpConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *kcpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *kcpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *kcpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *kcpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
+
+// sessions of server by address and conv of peer on one udp socket. A
+// packet of a new conv opens another session and leaves those of the
+// address alone, which die of idle if peer restarted, so a forged one
+// can't reset a tunnel. The socket is kept after Close until its sessions
+// are released, so tunnels survive the listener as those of tcp
+type kcpListener struct {
+	app      *App
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	sessions map[kcpKey]*kcpConn
+	accepted chan *kcpConn
+	done     chan struct{}
+	closed   bool
+}
+
+func (l *kcpListener) serve() {
+	buf := make([]byte, kcpMaxMtu)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				Error("kcp listener %s read failed:%s", l.conn.LocalAddr(), err)
+				l.Close()
+			}
+			return
+		}
+		if c := l.session(buf[:n], addr); c != nil {
+			c.input(buf[:n])
+		}
+	}
+}
+
+type kcpKey struct {
+	addr string
+	conv uint32
+}
+
+// packet p may open a session
+func (l *kcpListener) opens(p []byte) bool {
+	if l.app.KCPParityShards > 0 {
+		if len(p) < fecHeaderSize || binary.LittleEndian.Uint16(p[8:]) != fecFlagData {
+			return false
+		}
+		var ok bool
+		if p, ok = fecPacket(p[fecHeaderSize:]); !ok {
+			return false
+		}
+	}
+	return len(p) >= kcpOverhead && (p[4] == kcpCmdPush || p[4] == kcpCmdWask)
+}
+
+// session of packet from addr, a new one is accepted if it opens one
+func (l *kcpListener) session(p []byte, addr *net.UDPAddr) *kcpConn {
+	if len(p) < 4 {
+		return nil
+	}
+	key := kcpKey{addr: addr.String(), conv: binary.LittleEndian.Uint32(p)}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c := l.sessions[key]; c != nil {
+		return c
+	}
+	if l.closed || !l.opens(p) {
+		return nil
+	}
+	c := newKCPConn(l.app, key.conv, l.conn, addr)
+	c.ln = l
+	select {
+	case l.accepted <- c:
+	default:
+		// backlog is full
+		c.Close()
+		return nil
+	}
+	l.sessions[key] = c
+	return c
+}
+
+func (l *kcpListener) remove(c *kcpConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := kcpKey{addr: c.raddr.String(), conv: c.conv}
+	if l.sessions[key] == c {
+		delete(l.sessions, key)
+	}
+	if l.closed && len(l.sessions) == 0 {
+		l.conn.Close()
+	}
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "kcp", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// sessions accepted keep running
+func (l *kcpListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	l.closed = true
+	close(l.done)
+	// sessions are queued with lock held
+	for len(l.accepted) > 0 {
+		(<-l.accepted).Close()
+	}
+	if len(l.sessions) == 0 {
+		l.conn.Close()
+	}
+	return nil
+}
+
+func (l *kcpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
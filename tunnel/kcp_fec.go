@@ -0,0 +1,380 @@
+//
+//   date  : 2015-10-20
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// forward error correction of kcp packets. Every data shards packets of a
+// group are followed by parity shards packets of reed-solomon code over
+// GF(2^8), so lost ones of a group are rebuilt without retransmission if no
+// more than parity shards are lost. Packet header, little endian:
+//
+//	conv(4) seq(4) flag(2), then size(2) and kcp packet if flag is data
+//
+// conv leads as in kcp packets, so every packet tells its session
+const (
+	fecHeaderSize = 10
+	fecSizeSize   = 2
+	fecOverhead   = fecHeaderSize + fecSizeSize
+
+	fecFlagData   = 0xf1
+	fecFlagParity = 0xf2
+
+	fecKeepGroups = 64 // groups kept by decoder for lost shards
+)
+
+var errFECPacket = errors.New("fec: bad packet")
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+// polynomial x^8+x^4+x^3+x^2+1 with generator 2
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// dst ^= c * src
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMul[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// systematic reed-solomon code, parity rows form a cauchy matrix, so any
+// data shards of a group rebuild the others
+type reedSolomon struct {
+	data, parity int
+	matrix       [][]byte // parity rows, matrix[i][j] = 1 / (x_i + y_j)
+}
+
+func newReedSolomon(data, parity int) *reedSolomon {
+	rs := &reedSolomon{data: data, parity: parity}
+	rs.matrix = make([][]byte, parity)
+	for i := range rs.matrix {
+		row := make([]byte, data)
+		for j := range row {
+			row[j] = gfInv(byte(data+i) ^ byte(j))
+		}
+		rs.matrix[i] = row
+	}
+	return rs
+}
+
+// parity shards of data shards of the same size
+func (rs *reedSolomon) encode(shards, parity [][]byte) {
+	for i, row := range rs.matrix {
+		p := parity[i]
+		clear(p)
+		for j, shard := range shards {
+			gfMulAdd(p, shard, row[j])
+		}
+	}
+}
+
+// row of shard i of group in encoding matrix
+func (rs *reedSolomon) row(i int) []byte {
+	if i >= rs.data {
+		return rs.matrix[i-rs.data]
+	}
+	row := make([]byte, rs.data)
+	row[i] = 1
+	return row
+}
+
+// rebuild missing data shards of group in place, shards are nil if lost and
+// those present are of the same size. It needs data shards present
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	var present []int
+	for i, shard := range shards {
+		if shard != nil && len(present) < rs.data {
+			present = append(present, i)
+		}
+	}
+	if len(present) < rs.data {
+		return errFECPacket
+	}
+	m := make([][]byte, rs.data)
+	for k, i := range present {
+		m[k] = rs.row(i)
+	}
+	inv, err := gfInvert(m)
+	if err != nil {
+		return err
+	}
+	size := len(shards[present[0]])
+	for j := 0; j < rs.data; j++ {
+		if shards[j] != nil {
+			continue
+		}
+		shard := make([]byte, size)
+		for k, i := range present {
+			gfMulAdd(shard, shards[i], inv[j][k])
+		}
+		shards[j] = shard
+	}
+	return nil
+}
+
+// inverse of square matrix by gauss-jordan elimination
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i, row := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], row)
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("fec: singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		if c := work[col][col]; c != 1 {
+			scale := gfInv(c)
+			for k := range work[col] {
+				work[col][k] = gfMul[scale][work[col][k]]
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r != col && work[r][col] != 0 {
+				gfMulAdd(work[r], work[col], work[r][col])
+			}
+		}
+	}
+	inv := make([][]byte, n)
+	for i := range work {
+		inv[i] = work[i][n:]
+	}
+	return inv, nil
+}
+
+// shards of a group are numbered by seq, which wraps at a multiple of group
+// size so a group never straddles it
+func fecSeqLimit(shards int) uint64 {
+	return (1 << 32) / uint64(shards) * uint64(shards)
+}
+
+type fecEncoder struct {
+	conv   uint32
+	rs     *reedSolomon
+	seq    uint64
+	limit  uint64
+	shards [][]byte // size and packet of data shards of current group
+	parity [][]byte
+	buf    []byte
+}
+
+func newFECEncoder(conv uint32, data, parity, mtu int) *fecEncoder {
+	e := &fecEncoder{
+		conv:   conv,
+		rs:     newReedSolomon(data, parity),
+		limit:  fecSeqLimit(data + parity),
+		parity: make([][]byte, parity),
+		buf:    make([]byte, mtu),
+	}
+	for j := range e.parity {
+		e.parity[j] = make([]byte, mtu)
+	}
+	for i := 0; i < data; i++ {
+		e.shards = append(e.shards, make([]byte, 0, mtu-fecHeaderSize))
+	}
+	return e
+}
+
+func (e *fecEncoder) header(p []byte, flag uint16) {
+	binary.LittleEndian.PutUint32(p, e.conv)
+	binary.LittleEndian.PutUint32(p[4:], uint32(e.seq))
+	binary.LittleEndian.PutUint16(p[8:], flag)
+	if e.seq++; e.seq == e.limit {
+		e.seq = 0
+	}
+}
+
+// packet of pkt is passed to output, parity packets follow the last data
+// shard of a group. Packets passed are reused after output returns
+func (e *fecEncoder) encode(pkt []byte, output func(p []byte)) {
+	i := int(e.seq % uint64(e.rs.data+e.rs.parity))
+	p := e.buf[:fecOverhead+len(pkt)]
+	e.header(p, fecFlagData)
+	binary.LittleEndian.PutUint16(p[fecHeaderSize:], uint16(fecSizeSize+len(pkt)))
+	copy(p[fecOverhead:], pkt)
+	e.shards[i] = append(e.shards[i][:0], p[fecHeaderSize:]...)
+	output(p)
+	if i < e.rs.data-1 {
+		return
+	}
+
+	size := 0
+	for _, shard := range e.shards {
+		size = max(size, len(shard))
+	}
+	for j, shard := range e.shards {
+		n := len(shard)
+		e.shards[j] = shard[:size]
+		clear(e.shards[j][n:])
+	}
+	parity := make([][]byte, len(e.parity))
+	for j := range e.parity {
+		parity[j] = e.parity[j][fecHeaderSize : fecHeaderSize+size]
+	}
+	e.rs.encode(e.shards, parity)
+	for j := range e.parity {
+		p := e.parity[j][:fecHeaderSize+size]
+		e.header(p, fecFlagParity)
+		output(p)
+	}
+}
+
+type fecGroup struct {
+	shards [][]byte
+	count  int
+	done   bool
+}
+
+type fecDecoder struct {
+	rs     *reedSolomon
+	groups map[uint32]*fecGroup // by seq of first shard
+	order  []uint32             // seq of groups, oldest first
+}
+
+func newFECDecoder(data, parity int) *fecDecoder {
+	return &fecDecoder{
+		rs:     newReedSolomon(data, parity),
+		groups: make(map[uint32]*fecGroup),
+	}
+}
+
+// kcp packet of data shard, followed by those rebuilt from its group if
+// possible. Returned packets are valid until next decode
+func (d *fecDecoder) decode(p []byte) ([][]byte, error) {
+	if len(p) < fecHeaderSize {
+		return nil, errFECPacket
+	}
+	seq := binary.LittleEndian.Uint32(p[4:])
+	flag := binary.LittleEndian.Uint16(p[8:])
+	shard := p[fecHeaderSize:]
+
+	var pkts [][]byte
+	switch flag {
+	case fecFlagData:
+		pkt, ok := fecPacket(shard)
+		if !ok {
+			return nil, errFECPacket
+		}
+		pkts = append(pkts, pkt)
+	case fecFlagParity:
+	default:
+		return nil, errFECPacket
+	}
+
+	n := uint32(d.rs.data + d.rs.parity)
+	i := seq % n
+	g := d.group(seq - i)
+	if g.done || g.shards[i] != nil {
+		return pkts, nil
+	}
+	g.shards[i] = append([]byte(nil), shard...)
+	g.count++
+	if g.count < d.rs.data {
+		return pkts, nil
+	}
+	g.done = true
+
+	lost := false
+	for _, s := range g.shards[:d.rs.data] {
+		lost = lost || s == nil
+	}
+	if !lost {
+		return pkts, nil
+	}
+	// data shards are shorter than parity ones, zero padded by encoder
+	size := 0
+	for _, s := range g.shards {
+		size = max(size, len(s))
+	}
+	for j, s := range g.shards {
+		if s != nil && len(s) < size {
+			g.shards[j] = append(s, make([]byte, size-len(s))...)
+		}
+	}
+	missing := make([]bool, d.rs.data)
+	for j := range missing {
+		missing[j] = g.shards[j] == nil
+	}
+	if err := d.rs.reconstruct(g.shards); err != nil {
+		return pkts, err
+	}
+	for j, m := range missing {
+		if !m {
+			continue
+		}
+		if pkt, ok := fecPacket(g.shards[j]); ok {
+			pkts = append(pkts, pkt)
+		}
+	}
+	return pkts, nil
+}
+
+// kcp packet in shard after its size
+func fecPacket(shard []byte) ([]byte, bool) {
+	if len(shard) < fecSizeSize {
+		return nil, false
+	}
+	size := int(binary.LittleEndian.Uint16(shard))
+	if size < fecSizeSize || size > len(shard) {
+		return nil, false
+	}
+	return shard[fecSizeSize:size], true
+}
+
+// group of first seq, the oldest is dropped beyond fecKeepGroups
+func (d *fecDecoder) group(seq uint32) *fecGroup {
+	if g, ok := d.groups[seq]; ok {
+		return g
+	}
+	if len(d.order) >= fecKeepGroups {
+		delete(d.groups, d.order[0])
+		d.order = append(d.order[:0], d.order[1:]...)
+	}
+	g := &fecGroup{shards: make([][]byte, d.rs.data+d.rs.parity)}
+	d.groups[seq] = g
+	d.order = append(d.order, seq)
+	return g
+}
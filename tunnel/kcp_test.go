@@ -0,0 +1,192 @@
+//
+//   date  : 2015-10-20
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+)
+
+// two kcp ends over a link losing packets, driven by a fake clock
+func TestKCPLossy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var toB, toA [][]byte
+	lossy := func(queue *[][]byte) func(p []byte) {
+		return func(p []byte) {
+			if rnd.Intn(100) < 30 {
+				return
+			}
+			*queue = append(*queue, append([]byte(nil), p...))
+		}
+	}
+	a := newKCP(7, lossy(&toB))
+	b := newKCP(7, lossy(&toA))
+	for _, k := range []*kcp{a, b} {
+		k.setWindow(128, 128)
+		k.setNoDelay(kcpNoDelay, kcpInterval, kcpResend, true)
+	}
+
+	data := make([]byte, 256*1024)
+	rnd.Read(data)
+	a.send(data)
+	var got []byte
+	buf := make([]byte, 4096)
+	for now := uint32(0); now < 120000 && len(got) < len(data); now += kcpInterval {
+		a.update(now)
+		b.update(now)
+		for _, p := range toB {
+			if err := b.input(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, p := range toA {
+			if err := a.input(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		toA, toB = toA[:0], toB[:0]
+		for b.readable() {
+			got = append(got, buf[:b.recv(buf)]...)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d of %d bytes, or corrupted", len(got), len(data))
+	}
+	if a.xmit == 0 {
+		t.Fatal("lost segments should be retransmitted")
+	}
+	if err := b.input([]byte("short")); err != errKCPPacket {
+		t.Fatalf("unexpected err:%v", err)
+	}
+	p := make([]byte, kcpOverhead)
+	(&kcpSegment{conv: 8, cmd: kcpCmdWins}).encode(p)
+	if err := b.input(p); err != errKCPConv {
+		t.Fatalf("unexpected err:%v", err)
+	}
+}
+
+func TestKCPFEC(t *testing.T) {
+	const data, parity = 4, 2
+	rnd := rand.New(rand.NewSource(1))
+	enc := newFECEncoder(7, data, parity, 1400)
+	dec := newFECDecoder(data, parity)
+
+	var sent [][]byte
+	got := make(map[string]bool)
+	n := 0
+	for i := 0; i < 10*data; i++ {
+		pkt := make([]byte, 1+rnd.Intn(1400-fecOverhead))
+		rnd.Read(pkt)
+		sent = append(sent, pkt)
+		enc.encode(pkt, func(p []byte) {
+			// two of every group are lost, data or parity
+			if n++; n%3 == 0 {
+				return
+			}
+			pkts, err := dec.decode(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pkt := range pkts {
+				got[string(pkt)] = true
+			}
+		})
+	}
+	for i, pkt := range sent {
+		if !got[string(pkt)] {
+			t.Fatalf("packet %d isn't recovered", i)
+		}
+	}
+	if _, err := dec.decode([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9}); err != errFECPacket {
+		t.Fatalf("unexpected err:%v", err)
+	}
+}
+
+func TestPairKCP(t *testing.T) {
+	for _, shards := range []int{0, 2} {
+		// sessions keep socket of server a while after it stops
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := "kcp://" + conn.LocalAddr().String()
+		conn.Close()
+
+		server := Config{Listen: addr, KCPParityShards: shards}
+		client := Config{Backend: addr, KCPParityShards: shards}
+		p := newTestPair(t, server, client, func(p *testPair) {
+			for _, app := range []*App{p.server.app, p.client.app} {
+				app.transport = newKCPTransport(app)
+			}
+		})
+		data := strings.Repeat("hello", 10000)
+		if echoed := p.roundTrip(t, data); echoed != data {
+			t.Fatalf("fec %d: unexpected echo of %d bytes", shards, len(echoed))
+		}
+		hub := p.client.activeHubs()[0]
+		c, ok := hub.tunnel.netConn().(*kcpConn)
+		if !ok {
+			t.Fatalf("tunnel isn't over kcp: %T", hub.tunnel.netConn())
+		}
+
+		// packets of a foreign conv from address of the tunnel open another
+		// session, the tunnel survives
+		for _, cmd := range []uint8{kcpCmdPush, kcpCmdWask} {
+			kcpForge(c, c.conv+1, cmd)
+		}
+		waitFor(t, "foreign session", func() bool {
+			ln := p.server.ln.(*kcpListener)
+			ln.mu.Lock()
+			defer ln.mu.Unlock()
+			return len(ln.sessions) == 2
+		})
+		hubs := p.server.activeHubs()
+		if len(hubs) != 1 {
+			t.Fatalf("fec %d: tunnel of server is reset", shards)
+		}
+		old := hubs[0].tunnel.netConn().(*kcpConn)
+		old.mu.Lock()
+		err = old.rerr
+		old.mu.Unlock()
+		if err != nil {
+			t.Fatalf("fec %d: session is broken by forged packets:%v", shards, err)
+		}
+		if echoed := p.roundTrip(t, data); echoed != data {
+			t.Fatalf("fec %d: unexpected echo of %d bytes after forged packets", shards, len(echoed))
+		}
+		if hubs := p.client.activeHubs(); len(hubs) != 1 || hubs[0] != hub {
+			t.Fatalf("fec %d: tunnel is reset", shards)
+		}
+		p.server.Stop(t.Context())
+		p.client.Stop(t.Context())
+	}
+
+	for _, c := range []Config{
+		{Listen: "kcp://127.0.0.1:8001", KCPMtu: 100},
+		{Listen: "kcp://127.0.0.1:8001", KCPDataShards: 250, KCPParityShards: 10},
+		{Listen: "kcp://127.0.0.1:8001", KCPWindow: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("config %+v should be rejected", c)
+		}
+	}
+}
+
+// send a bare segment of conv from socket of client session c, as an
+// attacker spoofing its address would
+func kcpForge(c *kcpConn, conv uint32, cmd uint8) {
+	p := make([]byte, kcpOverhead)
+	(&kcpSegment{conv: conv, cmd: cmd, wnd: 128}).encode(p)
+	if c.enc == nil {
+		c.conn.Write(p)
+		return
+	}
+	enc := newFECEncoder(conv, c.enc.rs.data, c.enc.rs.parity, len(c.enc.buf))
+	enc.encode(p, func(p []byte) { c.conn.Write(p) })
+}
@@ -6,33 +6,73 @@
 package tunnel
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var errPeerClosed = errors.New("errPeerClosed")
 
 type Link struct {
-	id    uint16
+	id    uint32
 	conn  BiConn
 	hub   *Hub
 	rbuf  *LinkBuffer // 接收缓存
 	sflag bool        // 对端是否可以收数据
 	wg    sync.WaitGroup
+
+	ctx     context.Context // canceled when link is released or hub is closed
+	cancel  context.CancelFunc
+	log     *Logger
+	created time.Time
+	service string // rule name
+	source  string // ip:port of original client, empty if unknown
+	dest    string // destination requested or dialed
+	rate    rateLimiters
+
+	connected chan uint8 // result of LINK_CONNECTED or LINK_CLOSE
+
+	reason string // why link is closed, the first one is kept, protected by flow.L
+
+	priority uint8        // class of frames sent
+	plain    bool         // data is sent in plain frames, nocrypt
+	bulk     rateLimiters // shared by bulk links of hub, unlimited for others
+	tap      *linkTap     // mirror or capture of data of local conn, nil if none
+	backend  bool         // local conn is backend dialed by this end
+	span     *span        // trace of link, nil if not sampled
+
+	idleTimeout time.Duration // close link if no data is transferred, disabled if 0
+	lastActive  int64         // unix nano of last transfer, atomic
+	maxAge      time.Duration // close link after it since created, disabled if 0
+
+	// flow control, protected by flow.L
+	flow      *sync.Cond
+	flowOn    bool  // peer supports flow control
+	sendLimit int64 // peer allows sending up to
+	window    int64 // receive window of peer, its first limit
+	sent      int64
+	consumed  int64 // bytes written to local conn
+	granted   int64 // peer is allowed sending up to
 }
 
 // stop write data to remote
 func (self *Link) resetSflag() bool {
-	if self.sflag {
-		self.sflag = false
-		// close read
-		if self.conn != nil {
-			self.conn.CloseRead()
-		}
-		return true
+	self.flow.L.Lock()
+	if !self.sflag {
+		self.flow.L.Unlock()
+		return false
 	}
-	return false
+	self.sflag = false
+	self.flow.Broadcast()
+	self.flow.L.Unlock()
+
+	// close read
+	if self.conn != nil {
+		self.conn.CloseRead()
+	}
+	return true
 }
 
 // stop recv data from remote
@@ -47,16 +87,93 @@ func (self *Link) resetRSflag() bool {
 	return ok1 || ok2
 }
 
-func (self *Link) SendCreate() {
-	self.hub.Send(LINK_CREATE, self.id, nil)
+func (self *Link) SendCreate(args *LinkArgs) {
+	if self.hub.tunnel.has(capFlowControl) {
+		args.Window = uint32(LinkWindow)
+		self.flow.L.Lock()
+		self.granted = int64(LinkWindow)
+		self.flow.L.Unlock()
+	}
+	self.hub.peerHolds(self.id)
+	self.hub.sendCtrl(LINK_CREATE, self.id, args.encode(), self.priority)
 }
 
 func (self *Link) SendClose() {
 	if self.resetRSflag() {
-		self.hub.Send(LINK_CLOSE, self.id, nil)
+		self.hub.sendCtrl(LINK_CLOSE, self.id, nil, self.priority)
+	}
+}
+
+// close link and tell peer why, old peers ignore the reason
+func (self *Link) SendReject(err error) {
+	if self.resetRSflag() {
+		self.setReason(closeName(closeCode(err)))
+		arg := []byte(err.Error())
+		if self.hub.tunnel.has(capCloseCode) {
+			arg = closeArg(closeCode(err), err.Error())
+		}
+		self.hub.sendCtrl(LINK_CLOSE, self.id, arg, self.priority)
 	}
 }
 
+// destination is connected, sent before any data
+func (self *Link) SendConnected() {
+	if self.hub.tunnel.has(capCloseCode) {
+		self.hub.sendCtrl(LINK_CONNECTED, self.id, nil, self.priority)
+	}
+}
+
+// first result of connecting destination by peer, later ones are dropped
+func (self *Link) onConnected(code uint8) {
+	select {
+	case self.connected <- code:
+	default:
+	}
+}
+
+// wait peer to connect destination, closeFailed if hub is closed
+func (self *Link) waitConnected() uint8 {
+	select {
+	case code := <-self.connected:
+		return code
+	case <-self.ctx.Done():
+		return closeFailed
+	}
+}
+
+// keep the first reason of closing link, for access log
+func (self *Link) setReason(reason string) {
+	self.flow.L.Lock()
+	if self.reason == "" {
+		self.reason = reason
+	}
+	self.flow.L.Unlock()
+}
+
+func (self *Link) closeReason() string {
+	self.flow.L.Lock()
+	defer self.flow.L.Unlock()
+	if self.reason == "" {
+		return "closed"
+	}
+	return self.reason
+}
+
+// peer still accepts data
+func (self *Link) sending() bool {
+	self.flow.L.Lock()
+	defer self.flow.L.Unlock()
+	return self.sflag
+}
+
+func (self *Link) touch() {
+	atomic.StoreInt64(&self.lastActive, time.Now().UnixNano())
+}
+
+func (self *Link) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&self.lastActive))
+}
+
 func (self *Link) putData(data []byte) bool {
 	return self.rbuf.Put(data)
 }
@@ -65,30 +182,51 @@ func (self *Link) putData(data []byte) bool {
 func (self *Link) pumpIn() {
 	defer self.wg.Done()
 	defer self.conn.CloseRead()
+	defer self.recoverPanic("read")
 
-	bufsize := PacketSize * 2
-	rd := bufio.NewReaderSize(self.conn, bufsize)
+	// read straight into pooled buffers, a buffered reader costs a copy of
+	// every byte. A datagram is cut to the buffer, so it's read only if
+	// window takes a whole packet.
+	_, whole := self.conn.(datagramConn)
 	for {
+		allowed := self.waitSendWindow(whole)
+		if allowed == 0 {
+			break
+		}
 		buffer := mpool.Get()
-		n, err := rd.Read(buffer)
+		n, err := self.conn.Read(buffer[:allowed])
 		if err != nil {
 			if self.resetSflag() {
-				self.hub.Send(LINK_CLOSE_SEND, self.id, nil)
+				self.hub.sendCtrl(LINK_CLOSE_SEND, self.id, nil, self.priority)
 			}
 			mpool.Put(buffer)
-			Debug("link(%d) read failed:%v", self.id, err)
+			self.log.Debug("read failed:%v", err)
+			break
+		}
+		// converting payload to string costs a copy even if trace is off
+		if GetLogLevel() > 3 {
+			self.log.Trace("read %d bytes:%s", n, string(buffer[:n]))
+		}
+		self.tap.onRead(buffer[:n])
+		self.capture(true, buffer[:n])
+		self.touch()
+		if !self.throttle(self.rate.send, self.hub.rate.send, self.bulk.send, self.hub.usage.limiters().send, n) {
+			mpool.Put(buffer)
 			break
 		}
-		Trace("link(%d) read %d bytes:%s", self.id, n, string(buffer[:n]))
 
-		if !self.sflag {
+		self.flow.L.Lock()
+		sflag := self.sflag
+		self.flow.L.Unlock()
+		if !sflag {
 			// receive LINK_CLOSE_WRITE
 			mpool.Put(buffer)
 			break
 		}
-		if !self.hub.Send(LINK_DATA, self.id, buffer[:n]) {
+		if !self.hub.sendData(self.id, buffer[:n], self.priority, self.plain) {
 			break
 		}
+		self.onSent(n)
 	}
 }
 
@@ -96,6 +234,7 @@ func (self *Link) pumpIn() {
 func (self *Link) pumpOut() {
 	defer self.wg.Done()
 	defer self.conn.CloseWrite()
+	defer self.recoverPanic("write")
 
 	for {
 		data, ok := self.rbuf.Pop()
@@ -103,23 +242,83 @@ func (self *Link) pumpOut() {
 			break
 		}
 
-		_, err := self.conn.Write(data)
+		if !self.throttle(self.rate.recv, self.hub.rate.recv, self.bulk.recv, self.hub.usage.limiters().recv, len(data)) {
+			mpool.Put(data)
+			break
+		}
+
+		n, err := self.conn.Write(data)
+		if err == nil && GetLogLevel() > 3 {
+			self.log.Trace("write %d bytes:%s", len(data), string(data))
+		}
+		self.tap.onWrite(data[:n])
+		self.capture(false, data[:n])
+		// data is reused by tunnel reader once it's put back
 		mpool.Put(data)
+		self.onConsumed(n)
 
 		if err != nil {
 			if self.resetRflag() {
-				self.hub.Send(LINK_CLOSE_RECV, self.id, nil)
+				self.hub.sendCtrl(LINK_CLOSE_RECV, self.id, nil, self.priority)
 			}
-			Debug("link(%d) write failed:%v", self.id, err)
+			self.log.Debug("write failed:%v", err)
 			break
 		}
-		Trace("link(%d) write %d bytes:%s", self.id, len(data), string(data))
+		self.touch()
 	}
 }
 
 func (self *Link) Pump(conn BiConn) {
 	self.conn = conn
 
+	// watcher quits before Pump returns, so it never outlives the link
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer func() {
+		close(done)
+		<-quit
+	}()
+	self.touch()
+	go func() {
+		defer close(quit)
+		defer self.recoverPanic("watch")
+		var idle <-chan time.Time
+		if self.idleTimeout > 0 {
+			ticker := time.NewTicker(self.idleTimeout / 4)
+			defer ticker.Stop()
+			idle = ticker.C
+		}
+		var expire <-chan time.Time
+		if left := self.ageLeft(); left > 0 {
+			timer := time.NewTimer(left)
+			defer timer.Stop()
+			expire = timer.C
+		}
+		for {
+			select {
+			case <-self.ctx.Done():
+				self.log.Info("canceled")
+				self.setReason("canceled")
+				self.SendClose()
+				return
+			case <-idle:
+				if self.idle() > self.idleTimeout {
+					self.log.Info("idle timeout")
+					self.setReason("idle timeout")
+					self.SendClose()
+					return
+				}
+			case <-expire:
+				self.log.Info("max age")
+				self.setReason("max age")
+				self.SendClose()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
 	self.wg.Add(1)
 	go self.pumpIn()
 
@@ -127,13 +326,22 @@ func (self *Link) Pump(conn BiConn) {
 	go self.pumpOut()
 
 	self.wg.Wait()
-	Info("link(%d) closed", self.id)
+	self.log.Info("closed")
 }
 
-func newLink(id uint16, hub *Hub) *Link {
-	return &Link{
-		id:    id,
-		hub:   hub,
-		rbuf:  NewLinkBuffer(16),
-		sflag: true}
+func newLink(id uint32, hub *Hub) *Link {
+	ctx, cancel := context.WithCancel(hub.ctx)
+	link := &Link{
+		id:      id,
+		hub:     hub,
+		rbuf:    NewLinkBuffer(16),
+		sflag:   true,
+		ctx:     ctx,
+		cancel:  cancel,
+		log:     hub.log.With("link", id),
+		created: time.Now(),
+		rate:    newRateLimiters(hub.linkRate),
+		flow:    sync.NewCond(new(sync.Mutex))}
+	link.connected = make(chan uint8, 1)
+	return link
 }
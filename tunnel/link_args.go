@@ -0,0 +1,119 @@
+//
+//   date  : 2015-06-26
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// link create arguments, appended to LINK_CREATE cmd as type-length-value
+// items, unknown types are skipped so old peers keep working
+const (
+	argService uint8 = iota + 1
+	argWindow
+	argDest
+	argSource
+	argPriority
+	argNoCrypt
+	argEarlyData
+	argTraceParent
+)
+
+var errLinkArgs = errors.New("errLinkArgs")
+
+type LinkArgs struct {
+	Service string // forwarding rule name
+	Window  uint32 // receive window of creator, 0 if flow control is not supported
+	Dest    string // host:port requested by proxy client, overrides rule backend
+	Source  string // ip:port of the connection accepted by creator
+
+	Priority string // priority of creator's rule, empty if default
+
+	NoCrypt bool // creator's rule is nocrypt, so peer sends data in plain too
+
+	EarlyData string // first bytes of link data, peer supports capEarlyData
+
+	TraceParent string // w3c trace context of creator's span, empty if not traced
+}
+
+func appendArg(buf []byte, typ uint8, value []byte) []byte {
+	var head [3]byte
+	head[0] = typ
+	binary.LittleEndian.PutUint16(head[1:], uint16(len(value)))
+	buf = append(buf, head[:]...)
+	return append(buf, value...)
+}
+
+func (args *LinkArgs) encode() []byte {
+	var buf []byte
+	if args.Service != "" {
+		buf = appendArg(buf, argService, []byte(args.Service))
+	}
+	if args.Window > 0 {
+		var value [4]byte
+		binary.LittleEndian.PutUint32(value[:], args.Window)
+		buf = appendArg(buf, argWindow, value[:])
+	}
+	if args.Dest != "" {
+		buf = appendArg(buf, argDest, []byte(args.Dest))
+	}
+	if args.Source != "" {
+		buf = appendArg(buf, argSource, []byte(args.Source))
+	}
+	if args.Priority != "" {
+		buf = appendArg(buf, argPriority, []byte(args.Priority))
+	}
+	if args.NoCrypt {
+		buf = appendArg(buf, argNoCrypt, nil)
+	}
+	if args.EarlyData != "" {
+		buf = appendArg(buf, argEarlyData, []byte(args.EarlyData))
+	}
+	if args.TraceParent != "" {
+		buf = appendArg(buf, argTraceParent, []byte(args.TraceParent))
+	}
+	return buf
+}
+
+func (args *LinkArgs) decode(buf []byte) error {
+	for len(buf) > 0 {
+		if len(buf) < 3 {
+			return errLinkArgs
+		}
+		typ := buf[0]
+		sz := int(binary.LittleEndian.Uint16(buf[1:]))
+		buf = buf[3:]
+		if len(buf) < sz {
+			return errLinkArgs
+		}
+		value := buf[:sz]
+		buf = buf[sz:]
+
+		switch typ {
+		case argService:
+			args.Service = string(value)
+		case argWindow:
+			if sz != 4 {
+				return errLinkArgs
+			}
+			args.Window = binary.LittleEndian.Uint32(value)
+		case argDest:
+			args.Dest = string(value)
+		case argSource:
+			args.Source = string(value)
+		case argPriority:
+			args.Priority = string(value)
+		case argNoCrypt:
+			args.NoCrypt = true
+		case argEarlyData:
+			args.EarlyData = string(value)
+		case argTraceParent:
+			args.TraceParent = string(value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+//
+//   date  : 2015-06-26
+//   author: xjdrew
+//
+
+package tunnel
+
+import "testing"
+
+func TestLinkArgs(t *testing.T) {
+	args := LinkArgs{Service: "ssh", Window: 65536, Dest: "example.com:80", Source: "10.0.0.1:5000", Priority: PriorityBulk, EarlyData: "GET / HTTP/1.1\r\n",
+		TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	buf := args.encode()
+
+	// unknown args should be skipped
+	buf = appendArg(buf, 0xff, []byte("unknown"))
+
+	var args2 LinkArgs
+	if err := args2.decode(buf); err != nil {
+		t.Fatal("decode failed:", err)
+	}
+	if args2 != args {
+		t.Fatalf("unexpected args:%+v", args2)
+	}
+
+	if err := args2.decode(buf[:len(buf)-1]); err == nil {
+		t.Fatal("decode truncated args should fail")
+	}
+}
@@ -0,0 +1,168 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// link id audit: an id acquired by this end should be released after its
+// link, and a link after both directions are closed. If a release is missed
+// by a bug or a goroutine is wedged, the id leaks until restart. So every
+// LinkIdAudit seconds a hub cross-checks ids acquired against its links:
+// ids without link and links closed both ways but not released, for an
+// audit interval at least, are logged and counted as leaked. With
+// LinkIdReclaim, those leaked for it are reclaimed: the link is canceled
+// and released, and its id is freed; a late release by the holder is
+// ignored. An id held by a handler before its link, such as one waiting
+// for a socks5 request, isn't audited until the link is forwarded.
+
+// an id without link, or held by a dead link
+type idLeak struct {
+	linkid uint32
+	link   *Link         // nil if id has no link
+	age    time.Duration // since id is acquired, or since last transfer of link
+}
+
+// audit link ids every interval, leaked ones are reclaimed after reclaim,
+// disabled if interval is 0. It should be set before Start.
+func (self *Hub) SetLinkIdAudit(interval, reclaim time.Duration) {
+	self.audit.interval = interval
+	self.audit.reclaim = reclaim
+	if interval > 0 {
+		self.trackIds()
+	}
+}
+
+func (app *App) linkIdAudit() (interval, reclaim time.Duration) {
+	return time.Duration(app.LinkIdAudit) * time.Second, time.Duration(app.LinkIdReclaim) * time.Second
+}
+
+// remember ids acquired from now on
+func (self *LinkSet) trackIds() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.acquired == nil {
+		self.acquired = make(map[uint32]time.Time)
+		self.reclaimed = make(map[uint32]int)
+	}
+}
+
+// id is held by a handler routing its conn, which may wait for the client
+// up to Timeout, so it isn't audited until stampId
+func (self *LinkSet) holdId(linkid uint32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.acquired[linkid]; ok {
+		self.acquired[linkid] = time.Time{}
+	}
+}
+
+// link of id is forwarded, audit it from now on
+func (self *LinkSet) stampId(linkid uint32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.acquired[linkid]; ok {
+		self.acquired[linkid] = time.Now()
+	}
+}
+
+// ids acquired before now-age without link, held ones are skipped
+func (self *LinkSet) unlinkedIds(now time.Time, age time.Duration) []idLeak {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var leaks []idLeak
+	for linkid, acquired := range self.acquired {
+		if acquired.IsZero() {
+			continue
+		}
+		if self.links[linkid] == nil && now.Sub(acquired) >= age {
+			leaks = append(leaks, idLeak{linkid: linkid, age: now.Sub(acquired)})
+		}
+	}
+	return leaks
+}
+
+// free id acquired by this end whose holder doesn't release it
+func (self *LinkSet) reclaimId(linkid uint32) {
+	self.lock.Lock()
+	if _, ok := self.acquired[linkid]; !ok {
+		self.lock.Unlock()
+		return
+	}
+	self.reclaimed[linkid]++
+	freed := self.freeId(linkid)
+	self.lock.Unlock()
+	if freed {
+		self.notifyReleased()
+	}
+}
+
+// both directions are closed
+func (self *Link) dead() bool {
+	return !self.sending() && self.rbuf.Closed()
+}
+
+// links dead without transfer in age
+func (self *Hub) deadLinks(age time.Duration) []idLeak {
+	var leaks []idLeak
+	for _, link := range self.activeLinks() {
+		if idle := link.idle(); idle >= age && link.dead() {
+			leaks = append(leaks, idLeak{linkid: link.id, link: link, age: idle})
+		}
+	}
+	return leaks
+}
+
+func (self *Hub) auditLoop(interval, reclaim time.Duration) {
+	defer Recover()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var reported map[uint32]bool
+	for {
+		select {
+		case <-ticker.C:
+			reported = self.auditIds(reported, interval, reclaim)
+		case <-self.ctx.Done():
+			return
+		}
+	}
+}
+
+// ids leaked for interval are reported unless they are in reported, and
+// reclaimed if they leaked for reclaim. Return ids still leaked.
+func (self *Hub) auditIds(reported map[uint32]bool, interval, reclaim time.Duration) map[uint32]bool {
+	leaks := append(self.unlinkedIds(time.Now(), interval), self.deadLinks(interval)...)
+	leaked := make(map[uint32]bool, len(leaks))
+	for _, leak := range leaks {
+		if !reported[leak.linkid] {
+			atomic.AddInt64(&stats.LinkIdsLeaked, 1)
+			if leak.link == nil {
+				self.log.Error("link(%d) id leaked, acquired %v ago without link", leak.linkid, leak.age)
+			} else {
+				self.log.Error("link(%d) id leaked, link is closed but not released for %v", leak.linkid, leak.age)
+			}
+		}
+		if reclaim > 0 && leak.age >= reclaim {
+			self.reclaim(leak)
+			continue
+		}
+		leaked[leak.linkid] = true
+	}
+	return leaked
+}
+
+func (self *Hub) reclaim(leak idLeak) {
+	self.log.Error("link(%d) reclaim leaked id", leak.linkid)
+	atomic.AddInt64(&stats.LinkIdsReclaimed, 1)
+	if link := leak.link; link != nil {
+		link.setReason("reclaimed")
+		self.releaseLink(link)
+	}
+	self.reclaimId(leak.linkid)
+}
@@ -0,0 +1,102 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPairLinkIdAudit(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{LinkIdAudit: 3600})
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	p.client.lock.Lock()
+	hub := p.client.cq[0]
+	p.client.lock.Unlock()
+	waitFor(t, "link released", func() bool {
+		return len(hub.unlinkedIds(time.Now(), 0)) == 0 && len(hub.deadLinks(0)) == 0
+	})
+
+	leakedBefore := atomic.LoadInt64(&stats.LinkIdsLeaked)
+	reclaimedBefore := atomic.LoadInt64(&stats.LinkIdsReclaimed)
+	free := hub.idStatus().Free
+
+	// id acquired without link is reported once
+	unlinked := hub.AcquireId()
+	leaked := hub.auditIds(nil, 0, 0)
+	leaked = hub.auditIds(leaked, 0, 0)
+	if !leaked[unlinked] || atomic.LoadInt64(&stats.LinkIdsLeaked) != leakedBefore+1 {
+		t.Fatalf("unexpected leaks:%v", leaked)
+	}
+
+	// dead link
+	id := hub.AcquireId()
+	link := hub.NewLink(id)
+	link.resetRSflag()
+	if leaked := hub.auditIds(leaked, time.Hour, time.Hour); len(leaked) != 0 {
+		t.Fatalf("fresh ids are leaked:%v", leaked)
+	}
+	if leaked := hub.auditIds(nil, 0, time.Nanosecond); len(leaked) != 0 {
+		t.Fatalf("leaked ids aren't reclaimed:%v", leaked)
+	}
+	if n := atomic.LoadInt64(&stats.LinkIdsReclaimed); n != reclaimedBefore+2 {
+		t.Fatalf("unexpected reclaimed:%d", n)
+	}
+	if hub.getLink(id) != nil || hub.LinkCount() != 0 || link.ctx.Err() == nil || link.closeReason() != "reclaimed" {
+		t.Fatal("dead link isn't released")
+	}
+	if got := hub.idStatus().Free; got != free {
+		t.Fatalf("ids aren't freed:%d, want %d", got, free)
+	}
+
+	// late releases are harmless
+	if hub.releaseLink(link) {
+		t.Fatal("reclaimed link is released again")
+	}
+	hub.ReleaseId(unlinked)
+	hub.ReleaseId(id)
+	if got := hub.idStatus().Free; got != free {
+		t.Fatalf("ids are freed twice:%d, want %d", got, free)
+	}
+	if echoed := p.roundTrip(t, "again"); echoed != "again" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+}
+
+// id of a client slow to send its socks5 request isn't reclaimed
+func TestPairLinkIdAuditSlowClient(t *testing.T) {
+	p := newTestPair(t, Config{Socks5: true}, Config{Socks5: true, LinkIdAudit: 3600})
+	p.client.lock.Lock()
+	hub := p.client.cq[0]
+	p.client.lock.Unlock()
+	free := hub.idStatus().Free
+
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, "id acquired", func() bool { return hub.idStatus().Free == free-1 })
+	if leaked := hub.auditIds(nil, 0, time.Nanosecond); len(leaked) != 0 || hub.idStatus().Free != free-1 {
+		t.Fatalf("held id is reclaimed:%v", leaked)
+	}
+
+	go conn.Write([]byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0x1f, 0x42})
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != socks5Succeeded {
+		t.Fatalf("unexpected reply:%v, err:%v", reply, err)
+	}
+	buf := make([]byte, 5)
+	io.WriteString(conn, "hello")
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected echo:%q, err:%v", buf, err)
+	}
+}
@@ -38,6 +38,12 @@ func (b *LinkBuffer) Close() bool {
 	return true
 }
 
+func (b *LinkBuffer) Closed() bool {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	return b.closed
+}
+
 func (b *LinkBuffer) Put(data []byte) bool {
 	b.cond.L.Lock()
 	defer b.cond.L.Unlock()
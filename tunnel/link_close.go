@@ -0,0 +1,99 @@
+//
+//   date  : 2015-10-03
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// why server failed to connect destination of a link, sent as the first
+// byte of LINK_CLOSE if peers negotiate capCloseCode
+const (
+	closeNormal uint8 = iota
+	closeFailed
+	closeRefused
+	closeTimeout
+	closeDenied
+	closeUnreachable
+	closeUnavailable // backend of rule is down by health check
+)
+
+var closeNames = []string{"normal", "failed", "refused", "timeout", "denied", "unreachable", "unavailable"}
+
+func closeName(code uint8) string {
+	if int(code) < len(closeNames) {
+		return closeNames[code]
+	}
+	return closeNames[closeFailed]
+}
+
+// classify error of resolving or dialing destination
+func closeCode(err error) uint8 {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return closeNormal
+	case errors.Is(err, errACLDenied), errors.Is(err, errQuotaExceeded), errors.Is(err, errPolicyDenied):
+		return closeDenied
+	case errors.Is(err, errBackendDown):
+		return closeUnavailable
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, errPipeRefused):
+		return closeRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return closeTimeout
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return closeUnreachable
+	}
+	return closeFailed
+}
+
+// LINK_CLOSE arg: code followed by reason, old peers take it all as reason
+func closeArg(code uint8, reason string) []byte {
+	return append([]byte{code}, reason...)
+}
+
+func parseCloseArg(arg []byte) (uint8, string) {
+	if len(arg) == 0 {
+		return closeFailed, ""
+	}
+	return arg[0], string(arg[1:])
+}
+
+// reply of socks5 CONNECT when server failed to connect
+func socks5CloseReply(code uint8) uint8 {
+	switch code {
+	case closeNormal:
+		return socks5Succeeded
+	case closeDenied:
+		return socks5NotAllowed
+	case closeRefused:
+		return socks5Refused
+	case closeTimeout:
+		return socks5HostUnreachable
+	case closeUnreachable:
+		return socks5NetUnreachable
+	}
+	return socks5GeneralFailure
+}
+
+// status line of http CONNECT when server failed to connect
+func httpCloseReply(code uint8) string {
+	switch code {
+	case closeNormal:
+		return "200 Connection established"
+	case closeDenied:
+		return "403 Forbidden"
+	case closeTimeout:
+		return "504 Gateway Timeout"
+	case closeUnavailable:
+		return "503 Service Unavailable"
+	}
+	return "502 Bad Gateway"
+}
@@ -0,0 +1,44 @@
+//
+//   date  : 2015-10-03
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestCloseCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		code uint8
+	}{
+		{nil, closeNormal},
+		{errACLDenied, closeDenied},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, closeRefused},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), closeTimeout},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, closeUnreachable},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, closeUnreachable},
+		{fmt.Errorf("rule web: %w", errBackendDown), closeUnavailable},
+		{errLinkArgs, closeFailed},
+	}
+	for _, c := range cases {
+		if code := closeCode(c.err); code != c.code {
+			t.Fatalf("unexpected code of %v:%s, want %s", c.err, closeName(code), closeName(c.code))
+		}
+	}
+
+	code, reason := parseCloseArg(closeArg(closeRefused, "connection refused"))
+	if code != closeRefused || reason != "connection refused" {
+		t.Fatalf("unexpected close arg:%d, %q", code, reason)
+	}
+	if socks5CloseReply(closeTimeout) != socks5HostUnreachable || httpCloseReply(closeDenied) != "403 Forbidden" {
+		t.Fatal("unexpected proxy reply")
+	}
+}
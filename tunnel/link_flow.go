@@ -0,0 +1,116 @@
+//
+//   date  : 2015-07-23
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+)
+
+// receive window of a link in bytes. The creator advertises its window in
+// LINK_CREATE args; a peer supporting flow control answers with LINK_WINDOW,
+// which carries the absolute offset the sender may send up to.
+var LinkWindow = 256 * 1024
+
+// sender is unlimited until peer advertise a window
+func (self *Link) setSendLimit(limit int64) {
+	self.flow.L.Lock()
+	self.flowOn = true
+	if self.window == 0 {
+		self.window = limit
+	}
+	if limit > self.sendLimit {
+		self.sendLimit = limit
+	}
+	self.flow.Broadcast()
+	self.flow.L.Unlock()
+}
+
+// wait until peer's window is open, for a whole packet if whole is set, return
+// bytes could be sent, 0 if link is closed. A whole packet is at most the
+// window of peer, or it never opens
+func (self *Link) waitSendWindow(whole bool) int {
+	self.flow.L.Lock()
+	defer self.flow.L.Unlock()
+
+	need := int64(1)
+	if whole {
+		need = min(PacketSize, self.window)
+	}
+	for self.sflag && self.flowOn && self.sendLimit-self.sent < need {
+		self.flow.Wait()
+	}
+	if !self.sflag {
+		return 0
+	}
+	if !self.flowOn || self.sendLimit-self.sent > PacketSize {
+		return PacketSize
+	}
+	return int(self.sendLimit - self.sent)
+}
+
+// bytes sent to peer and written to local conn
+func (self *Link) transferred() (int64, int64) {
+	self.flow.L.Lock()
+	defer self.flow.L.Unlock()
+	return self.sent, self.consumed
+}
+
+func (self *Link) onSent(n int) {
+	self.flow.L.Lock()
+	first := self.sent == 0 && n > 0
+	self.sent += int64(n)
+	self.flow.L.Unlock()
+	if first {
+		self.span.addEvent("first byte sent")
+	}
+}
+
+// data written to local conn, grant more window to peer if half is consumed
+func (self *Link) onConsumed(n int) {
+	self.flow.L.Lock()
+	if self.consumed == 0 && n > 0 {
+		self.span.addEvent("first byte received")
+	}
+	self.consumed += int64(n)
+	if !self.flowOn {
+		self.flow.L.Unlock()
+		return
+	}
+	var limit int64
+	if self.granted-self.consumed <= int64(LinkWindow/2) {
+		self.granted = self.consumed + int64(LinkWindow)
+		limit = self.granted
+	}
+	self.flow.L.Unlock()
+
+	if limit > 0 {
+		self.sendWindow(limit)
+	}
+}
+
+func (self *Link) sendWindow(limit int64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(limit))
+	self.hub.Send(LINK_WINDOW, self.id, buf[:])
+}
+
+func (self *Link) onWindow(arg []byte) {
+	if len(arg) < 8 {
+		self.log.Error("invalid window:%v", arg)
+		return
+	}
+	self.setSendLimit(int64(binary.LittleEndian.Uint64(arg)))
+}
+
+// server side: peer advertised its window in create args, grant ours
+func (self *Link) acceptWindow(window uint32) {
+	self.flow.L.Lock()
+	self.granted = int64(LinkWindow)
+	self.flow.L.Unlock()
+
+	self.setSendLimit(int64(window))
+	self.sendWindow(int64(LinkWindow))
+}
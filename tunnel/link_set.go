@@ -4,55 +4,278 @@
 //
 package tunnel
 
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// behavior of client when all link ids of all hubs are in use
+const (
+	LinkIdReject = "reject" // close the connection
+	LinkIdWait   = "wait"   // wait for a free id of the chosen hub up to LinkIdTimeout milliseconds
+	LinkIdSpill  = "spill"  // same as reject, other hubs are always tried before the policy applies
+	LinkIdBusy   = "busy"   // answer proxy requests with a busy reply, reset other connections
+)
+
+const DefaultLinkIdTimeout = 1000
+
+var errLinkIdBusy = errors.New("no free link id")
+
+// client creates links with id in [1, reverseLinkid), server creates reverse
+// links with id from reverseLinkid, so both ends could raise their limits
+// independently
+const (
+	reverseLinkid = 0x8000
+	maxLinkLimit  = reverseLinkid - 1 // with peers not supporting 32 bit ids
+)
+
+// 32 bit ids split the same way in low 24 bits of slot, high 8 bits are
+// generation of the slot, bumped every time it's reused, so frames of a
+// closed link are dropped instead of reaching a new link of the same slot
+const (
+	reverseLinkid32 = 0x800000
+	MaxLinkLimit    = reverseLinkid32 - 1
+	linkSlotMask    = 0xffffff
+	linkGenShift    = 24
+)
+
+// links are kept in a map, ids are allocated on demand up to limit, and
+// released ids are reused in fifo order
 type LinkSet struct {
-	freeLinkid chan uint16
-	links      []*Link
+	lock     sync.Mutex
+	links    map[uint32]*Link
+	free     []uint32 // released ids
+	first    uint32   // first id of this end
+	next     uint32   // first never used id
+	last     uint32   // ids are less than last
+	released chan struct{}
+
+	wide bool // 32 bit ids, first, next and last are slots
+
+	// ids of links created by this end are reused only after peer releases
+	// them, nil if peer doesn't tell
+	peerHeld map[uint32]bool // peer may still use it
+	parked   map[uint32]bool // released here, waiting for peer
+
+	// ids acquired by this end and when, nil if ids aren't audited
+	acquired  map[uint32]time.Time
+	reclaimed map[uint32]int // ids freed by audit, so many releases of them are ignored
 }
 
-func (self *LinkSet) AcquireId() uint16 {
-	var linkid uint16 = 0
-	select {
-	case linkid = <-self.freeLinkid:
-	default:
+func (self *LinkSet) AcquireId() uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var linkid uint32
+	if len(self.free) > 0 {
+		linkid = self.free[0]
+		self.free = self.free[1:]
+		if self.wide {
+			linkid = linkid&linkSlotMask | (linkid>>linkGenShift+1)<<linkGenShift
+		}
+	} else if self.next < self.last {
+		linkid = self.next
+		self.next++
+	} else {
 		Error("allocate linkid failed")
 	}
+	if linkid != 0 && self.acquired != nil {
+		self.acquired[linkid] = time.Now()
+	}
 	return linkid
 }
 
-func (self *LinkSet) ReleaseId(linkid uint16) {
-	self.freeLinkid <- linkid
+// wait up to timeout for a free id, return 0 if timeout or ctx is done
+func (self *LinkSet) WaitId(ctx context.Context, timeout time.Duration) uint32 {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		if linkid := self.AcquireId(); linkid != 0 {
+			return linkid
+		}
+		select {
+		case <-self.released:
+		case <-t.C:
+			return 0
+		case <-ctx.Done():
+			return 0
+		}
+	}
+}
+
+func (self *LinkSet) ReleaseId(linkid uint32) {
+	self.lock.Lock()
+	freed := false
+	if n := self.reclaimed[linkid]; n > 0 {
+		// audit has freed it, holder releases it late
+		if n == 1 {
+			delete(self.reclaimed, linkid)
+		} else {
+			self.reclaimed[linkid] = n - 1
+		}
+	} else {
+		freed = self.freeId(linkid)
+	}
+	self.lock.Unlock()
+	if freed {
+		self.notifyReleased()
+	}
 }
 
-func (self *LinkSet) setLink(id uint16, link *Link) bool {
-	if self.links[id] != nil {
+// id is reused unless peer still holds it, called with lock held
+func (self *LinkSet) freeId(linkid uint32) bool {
+	delete(self.acquired, linkid)
+	if self.peerHeld[linkid] {
+		self.parked[linkid] = true
+		return false
+	}
+	self.free = append(self.free, linkid)
+	return true
+}
+
+func (self *LinkSet) notifyReleased() {
+	select {
+	case self.released <- struct{}{}:
+	default:
+	}
+}
+
+// wait for peer to release ids of links created by this end
+func (self *LinkSet) holdIds() {
+	self.peerHeld = make(map[uint32]bool)
+	self.parked = make(map[uint32]bool)
+}
+
+// link of id is created at peer
+func (self *LinkSet) peerHolds(linkid uint32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.peerHeld != nil {
+		self.peerHeld[linkid] = true
+	}
+}
+
+// peer released link of id, it's reused if released here too
+func (self *LinkSet) peerReleased(linkid uint32) {
+	self.lock.Lock()
+	if !self.peerHeld[linkid] {
+		self.lock.Unlock()
+		return
+	}
+	delete(self.peerHeld, linkid)
+	parked := self.parked[linkid]
+	if parked {
+		delete(self.parked, linkid)
+		self.free = append(self.free, linkid)
+	}
+	self.lock.Unlock()
+	if parked {
+		self.notifyReleased()
+	}
+}
+
+// id is allocated by this end
+func (self *LinkSet) idStatus() linkIdStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return linkIdStatus{
+		Limit:  int(self.last - self.first),
+		Free:   len(self.free) + int(self.last-self.next),
+		Parked: len(self.parked),
+	}
+}
+
+func (self *LinkSet) owns(linkid uint32) bool {
+	if self.wide {
+		linkid &= linkSlotMask
+	}
+	return linkid >= self.first && linkid < self.last
+}
+
+func (self *LinkSet) setLink(id uint32, link *Link) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if id == 0 || self.links[id] != nil {
 		return false
 	}
 	self.links[id] = link
 	return true
 }
 
-func (self *LinkSet) getLink(id uint16) *Link {
+func (self *LinkSet) getLink(id uint32) *Link {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	return self.links[id]
 }
 
-func (self *LinkSet) resetLink(id uint16) bool {
+// remove link unless its id is taken by another one
+func (self *LinkSet) removeLink(link *Link) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.links[link.id] != link {
+		return false
+	}
+	delete(self.links, link.id)
+	return true
+}
+
+func (self *LinkSet) resetLink(id uint32) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	if self.links[id] != nil {
-		self.links[id] = nil
+		delete(self.links, id)
 		return true
 	}
 	return false
 }
 
-func newLinkSet(client bool) *LinkSet {
-	linkset := new(LinkSet)
-	linkset.links = make([]*Link, MaxLinkPerTunnel)
-	if client {
-		freeLinkid := make(chan uint16, MaxLinkPerTunnel)
-		for i := uint16(1); i < MaxLinkPerTunnel; i++ {
-			freeLinkid <- i
-		}
-		linkset.freeLinkid = freeLinkid
+// snapshot of active links, sorted by id
+func (self *LinkSet) activeLinks() []*Link {
+	self.lock.Lock()
+	links := make([]*Link, 0, len(self.links))
+	for _, link := range self.links {
+		links = append(links, link)
 	}
+	self.lock.Unlock()
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].id < links[j].id
+	})
+	return links
+}
+
+// at most limit links are created by this end, limit is capped by
+// maxLinkLimit, MaxLinkPerTunnel-1 if not positive
+func newLinkSet(client bool, limit int) *LinkSet {
+	return makeLinkSet(client, limit, reverseLinkid)
+}
 
+// link set of 32 bit ids, limit is capped by MaxLinkLimit
+func newWideLinkSet(client bool, limit int) *LinkSet {
+	linkset := makeLinkSet(client, limit, reverseLinkid32)
+	linkset.wide = true
+	return linkset
+}
+
+func makeLinkSet(client bool, limit int, reverse uint32) *LinkSet {
+	if limit <= 0 {
+		limit = MaxLinkPerTunnel - 1
+	}
+	if limit > int(reverse-1) {
+		limit = int(reverse - 1)
+	}
+
+	linkset := new(LinkSet)
+	linkset.links = make(map[uint32]*Link)
+	linkset.next = 1
+	if !client {
+		linkset.next = reverse
+	}
+	linkset.first = linkset.next
+	linkset.last = linkset.next + uint32(limit)
+	linkset.released = make(chan struct{}, 1)
 	return linkset
 }
@@ -0,0 +1,160 @@
+//
+//   date  : 2015-09-15
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLinkSet(t *testing.T) {
+	set := newLinkSet(true, 3)
+	for i := uint32(1); i <= 3; i++ {
+		if id := set.AcquireId(); id != i {
+			t.Fatalf("unexpected id:%d, want %d", id, i)
+		}
+	}
+	if id := set.AcquireId(); id != 0 {
+		t.Fatalf("ids should be exhausted:%d", id)
+	}
+
+	// released ids are reused in order
+	set.ReleaseId(2)
+	set.ReleaseId(1)
+	if id := set.AcquireId(); id != 2 {
+		t.Fatalf("unexpected id:%d", id)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		set.ReleaseId(3)
+	}()
+	if id := set.WaitId(context.Background(), time.Second); id != 1 {
+		t.Fatalf("unexpected id:%d", id)
+	}
+	if id := set.WaitId(context.Background(), time.Second); id != 3 {
+		t.Fatalf("unexpected id:%d", id)
+	}
+	if id := set.WaitId(context.Background(), time.Millisecond*10); id != 0 {
+		t.Fatalf("wait should time out:%d", id)
+	}
+
+	server := newLinkSet(false, MaxLinkLimit+1)
+	if id := server.AcquireId(); id != reverseLinkid {
+		t.Fatalf("unexpected reverse id:%d", id)
+	}
+	if server.last != 0xffff {
+		t.Fatalf("limit should be capped:%d", server.last)
+	}
+
+	link := &Link{id: 5}
+	if !set.setLink(5, link) || set.setLink(5, link) || set.setLink(0, link) {
+		t.Fatal("unexpected setLink result")
+	}
+	if links := set.activeLinks(); len(links) != 1 || set.getLink(5) != link {
+		t.Fatal("link should be active")
+	}
+	if !set.resetLink(5) || set.resetLink(5) {
+		t.Fatal("unexpected resetLink result")
+	}
+}
+
+func TestLinkSetPeerRelease(t *testing.T) {
+	set := newLinkSet(true, 2)
+	set.holdIds()
+	id1, id2 := set.AcquireId(), set.AcquireId()
+	set.peerHolds(id1)
+	set.peerHolds(id2)
+
+	// id is reused only after both ends release it
+	set.ReleaseId(id1)
+	if id := set.AcquireId(); id != 0 {
+		t.Fatalf("id held by peer is reused:%d", id)
+	}
+	set.peerReleased(id2)
+	set.peerReleased(id1)
+	if id := set.AcquireId(); id != id1 {
+		t.Fatalf("unexpected id:%d", id)
+	}
+	set.ReleaseId(id2)
+	if id := set.AcquireId(); id != id2 {
+		t.Fatalf("unexpected id:%d", id)
+	}
+	if set.owns(reverseLinkid) || !set.owns(id2) {
+		t.Fatal("unexpected owner of ids")
+	}
+}
+
+func TestWideLinkSet(t *testing.T) {
+	set := newWideLinkSet(true, MaxLinkLimit+1)
+	if set.last != reverseLinkid32 {
+		t.Fatalf("limit should be capped:%d", set.last)
+	}
+	id := set.AcquireId()
+	if id != 1 {
+		t.Fatalf("unexpected id:%d", id)
+	}
+
+	// a reused slot has a new generation, so a stale frame misses the link
+	set.ReleaseId(id)
+	reused := set.AcquireId()
+	if reused&linkSlotMask != 1 || reused>>linkGenShift != 1 {
+		t.Fatalf("unexpected reused id:%x", reused)
+	}
+	set.setLink(reused, &Link{id: reused})
+	if set.getLink(id) != nil || !set.owns(reused) {
+		t.Fatal("stale id should not reach new link")
+	}
+
+	// generation wraps around
+	set.ReleaseId(0xff<<linkGenShift | 5)
+	if id := set.AcquireId(); id != 5 {
+		t.Fatalf("unexpected id:%x", id)
+	}
+
+	server := newWideLinkSet(false, 0)
+	if id := server.AcquireId(); id != reverseLinkid32 || set.owns(id) || !server.owns(id) {
+		t.Fatalf("unexpected reverse id:%x", id)
+	}
+}
+
+func TestLinkSetReclaim(t *testing.T) {
+	set := newLinkSet(true, 2)
+	set.trackIds()
+	id1, id2 := set.AcquireId(), set.AcquireId()
+	link := &Link{id: id2}
+	set.setLink(id2, link)
+	if leaks := set.unlinkedIds(time.Now(), 0); len(leaks) != 1 || leaks[0].linkid != id1 {
+		t.Fatalf("unexpected leaks:%+v", leaks)
+	}
+	if leaks := set.unlinkedIds(time.Now(), time.Hour); len(leaks) != 0 {
+		t.Fatalf("fresh id is leaked:%+v", leaks)
+	}
+
+	// late release of reclaimed id is ignored once
+	set.reclaimId(id1)
+	set.reclaimId(id1)
+	if id := set.AcquireId(); id != id1 {
+		t.Fatalf("reclaimed id isn't reused:%d", id)
+	}
+	set.ReleaseId(id1)
+	if id := set.AcquireId(); id != 0 {
+		t.Fatalf("late release frees id:%d", id)
+	}
+	set.ReleaseId(id1)
+	if id := set.AcquireId(); id != id1 {
+		t.Fatalf("unexpected id:%d", id)
+	}
+
+	if !set.removeLink(link) || set.removeLink(link) {
+		t.Fatal("unexpected removeLink result")
+	}
+	set.ReleaseId(id2)
+	if leaks := set.unlinkedIds(time.Now(), 0); len(leaks) != 1 || leaks[0].linkid != id1 {
+		t.Fatalf("unexpected leaks:%+v", leaks)
+	}
+}
@@ -6,68 +6,154 @@
 package tunnel
 
 import (
+	"context"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"runtime"
+	"sync/atomic"
 )
 
-var logger *log.Logger
-var LogLevel uint = 1
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const levelTrace = slog.LevelDebug - 4
+
+var logger *slog.Logger
+
+// read by every log call while a reload may set it
+var logLevel atomic.Uint32
 
 func init() {
-	//logger = log.New(io.Writer(os.Stderr), "", log.Ldate | log.Lmicroseconds | log.Lshortfile)
-	logger = log.New(io.Writer(os.Stderr), "", log.Ldate|log.Lmicroseconds)
+	logger = newSlogger(os.Stderr, LogFormatText)
+	logLevel.Store(1)
+}
+
+func GetLogLevel() uint {
+	return uint(logLevel.Load())
+}
+
+func SetLogLevel(level uint) {
+	logLevel.Store(uint32(level))
+}
+
+func newSlogger(w io.Writer, format string) *slog.Logger {
+	// level is filtered by log level
+	opts := &slog.HandlerOptions{Level: levelTrace}
+	if format == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
 }
 
-func _print(format string, a ...interface{}) {
-	logger.Printf(format, a...)
+// replace the default logger, such as a json logger to ELK
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// text or json output to stderr
+func SetLogFormat(format string) error {
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	logger = newSlogger(os.Stderr, format)
+	return nil
+}
+
+func _print(level slog.Level, args []interface{}, format string, a ...interface{}) {
+	logger.Log(context.Background(), level, fmt.Sprintf(format, a...), args...)
 }
 
 func Trace(format string, a ...interface{}) {
-	if LogLevel > 3 {
-		_print(format, a...)
+	if GetLogLevel() > 3 {
+		_print(levelTrace, nil, format, a...)
 	}
 }
 
 func Debug(format string, a ...interface{}) {
-	if LogLevel > 2 {
-		_print(format, a...)
+	if GetLogLevel() > 2 {
+		_print(slog.LevelDebug, nil, format, a...)
 	}
 }
 
 func Info(format string, a ...interface{}) {
-	if LogLevel > 1 {
-		_print(format, a...)
+	if GetLogLevel() > 1 {
+		_print(slog.LevelInfo, nil, format, a...)
 	}
 }
 
 func Error(format string, a ...interface{}) {
-	if LogLevel > 0 {
-		_print(format, a...)
+	if GetLogLevel() > 0 {
+		_print(slog.LevelError, nil, format, a...)
 	}
 }
 
 func Log(format string, a ...interface{}) {
-	_print(format, a...)
+	_print(slog.LevelWarn, nil, format, a...)
 }
 
 func LogStack(format string, a ...interface{}) {
-	_print(format, a...)
+	Log(format, a...)
 
 	buf := make([]byte, 32768)
 	runtime.Stack(buf, true)
-	_print("!!!!!stack!!!!!: %s", buf)
+	Log("!!!!!stack!!!!!: %s", buf)
 }
 
 func LogCurStack(format string, a ...interface{}) {
-	_print(format, a...)
+	Log(format, a...)
 	buf := make([]byte, 8192)
 	runtime.Stack(buf, false)
-	_print("!!!!!stack!!!!!: %s", buf)
+	Log("!!!!!stack!!!!!: %s", buf)
 }
 
 func Panic(format string, a ...interface{}) {
 	LogStack(format, a...)
 	panic("!!")
 }
+
+// logger tags every message with fields, such as tunnel index, link id and peer address
+type Logger struct {
+	args []interface{}
+}
+
+var rootLogger = &Logger{}
+
+// args are key-value pairs
+func (l *Logger) With(args ...interface{}) *Logger {
+	n := &Logger{args: make([]interface{}, 0, len(l.args)+len(args))}
+	n.args = append(n.args, l.args...)
+	n.args = append(n.args, args...)
+	return n
+}
+
+func (l *Logger) Trace(format string, a ...interface{}) {
+	if GetLogLevel() > 3 {
+		_print(levelTrace, l.args, format, a...)
+	}
+}
+
+func (l *Logger) Debug(format string, a ...interface{}) {
+	if GetLogLevel() > 2 {
+		_print(slog.LevelDebug, l.args, format, a...)
+	}
+}
+
+func (l *Logger) Info(format string, a ...interface{}) {
+	if GetLogLevel() > 1 {
+		_print(slog.LevelInfo, l.args, format, a...)
+	}
+}
+
+func (l *Logger) Error(format string, a ...interface{}) {
+	if GetLogLevel() > 0 {
+		_print(slog.LevelError, l.args, format, a...)
+	}
+}
+
+func (l *Logger) Log(format string, a ...interface{}) {
+	_print(slog.LevelWarn, l.args, format, a...)
+}
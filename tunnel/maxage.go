@@ -0,0 +1,90 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"math/rand"
+	"time"
+)
+
+// max age: a link older than LinkMaxAge is closed like an idle one, and
+// applications reconnect. A tunnel older than TunnelMaxAge is replaced, so
+// keys of a long lived tunnel are renewed: client connects a new hub for the
+// tunnel first, then drains the old one, which is closed when its links
+// finish or DefaultDrainTimeout passes. Server drains hubs older than it
+// too, in case client doesn't; client replaces its tunnels a bit earlier,
+// by up to a tenth of the age, so they don't reconnect at once.
+
+// links are closed after timeout, disabled if 0
+func (self *Hub) SetLinkMaxAge(timeout time.Duration) {
+	self.linkMaxAge = timeout
+}
+
+// time left for link of max age, 0 if it's disabled
+func (self *Link) ageLeft() time.Duration {
+	if self.maxAge <= 0 {
+		return 0
+	}
+	if left := self.maxAge - time.Since(self.created); left > 0 {
+		return left
+	}
+	return time.Nanosecond
+}
+
+func (app *App) tunnelMaxAge() time.Duration {
+	return time.Duration(app.TunnelMaxAge) * time.Second
+}
+
+// drain and close hub when it's older than age, for server
+func (self *Hub) expire(age time.Duration) {
+	defer Recover()
+	timer := time.NewTimer(age)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		self.log.Info("max age, drain tunnel of %d links", self.LinkCount())
+		self.drainClose(DefaultDrainTimeout * time.Second)
+	case <-self.ctx.Done():
+	}
+}
+
+// run hub of tunnel until it quits and return true, or until it reaches
+// max age and return false. An aged hub drains in background, while tunnel
+// connects another hub.
+func (cli *Client) waitHub(hub *HubItem) bool {
+	quit := hub.quit
+	if quit == nil {
+		q := make(chan struct{})
+		go func() {
+			defer close(q)
+			defer Recover()
+			hub.Start()
+		}()
+		quit = q
+	}
+
+	var expire <-chan time.Time
+	if age := cli.app.tunnelMaxAge(); age > 0 {
+		age -= time.Duration(rand.Int63n(int64(age)/10 + 1))
+		timer := time.NewTimer(age)
+		defer timer.Stop()
+		expire = timer.C
+	}
+	select {
+	case <-quit:
+		return true
+	case <-expire:
+	}
+
+	hub.log.Info("max age, replace tunnel of %d links", hub.LinkCount())
+	go func() {
+		hub.drainClose(DefaultDrainTimeout * time.Second)
+		<-quit
+		cli.removeHub(hub)
+		cli.serverReleased(hub.server)
+	}()
+	return false
+}
@@ -0,0 +1,75 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPairLinkMaxAge(t *testing.T) {
+	p := newTestPair(t, Config{LinkMaxAge: 1}, Config{})
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	buf := make([]byte, 5)
+	io.WriteString(conn, "hello")
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// server closes the link gracefully
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("link isn't closed:%v", err)
+	}
+	if age := time.Since(start); age < time.Second*9/10 {
+		t.Fatalf("link is closed early:%v", age)
+	}
+}
+
+func TestPairTunnelMaxAge(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{TunnelMaxAge: 1})
+	old := p.client.activeHubs()[0]
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo := func(data string) {
+		buf := make([]byte, len(data))
+		io.WriteString(conn, data)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != data {
+			t.Fatalf("unexpected echo:%q, %v", buf, err)
+		}
+	}
+	echo("hello")
+
+	// a new tunnel is connected, the old one drains
+	waitFor(t, "new tunnel", func() bool {
+		hubs := p.client.activeHubs()
+		return len(hubs) == 2 && old.IsClosing()
+	})
+	echo("again")
+	if got := p.roundTrip(t, "world"); got != "world" {
+		t.Fatalf("unexpected echo:%q", got)
+	}
+	if old.LinkCount() != 1 {
+		t.Fatalf("old tunnel has %d links", old.LinkCount())
+	}
+
+	conn.Close()
+	select {
+	case <-old.ctx.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("old tunnel isn't closed")
+	}
+}
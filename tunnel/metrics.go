@@ -0,0 +1,204 @@
+//
+//   date  : 2015-07-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// process wide counters, atomic
+var stats struct {
+	LinkCreated     int64
+	LinkClosed      int64
+	HandshakeFailed int64
+	Reconnects      int64
+	FrameCorrupted  int64
+	TokenReplayed   int64
+	BannedConns     int64
+	AcceptRejected  int64
+	Panics          int64
+	MirrorDropped   int64
+	HealthFailed    int64
+	Failovers       int64
+	BackendDown     int64
+	DirectConns     int64
+	TicketResumed   int64
+	TicketRejected  int64
+
+	HandshakeTimeouts  int64
+	HandshakesRejected int64
+
+	Rekeys int64
+
+	SpansExported int64
+	SpansDropped  int64
+
+	PolicyDenied int64
+
+	LinkIdsLeaked    int64
+	LinkIdsReclaimed int64
+}
+
+// serve prometheus metrics on /metrics until ctx is done
+func serveMetrics(ctx context.Context, addr string, hubs func() []*Hub) (net.Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := listenTCP(tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, hubs())
+	})
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		server.Shutdown(sctx)
+		cancel()
+	}()
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			Error("metrics server quit:%v", err)
+		}
+	}()
+	Info("serve metrics on %v", ln.Addr())
+	return ln, nil
+}
+
+func writeMetric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeMetrics(w io.Writer, hubs []*Hub) {
+	writeMetric(w, "gotunnel_hubs", "gauge", "Active hubs.")
+	fmt.Fprintf(w, "gotunnel_hubs %d\n", len(hubs))
+
+	writeMetric(w, "gotunnel_hub_links", "gauge", "Active links per hub.")
+	for _, hub := range hubs {
+		fmt.Fprintf(w, "gotunnel_hub_links{%s} %d\n", hub.tunnel.labels(), hub.LinkCount())
+	}
+
+	writeMetric(w, "gotunnel_tunnel_read_bytes_total", "counter", "Bytes read from tunnel.")
+	for _, hub := range hubs {
+		fmt.Fprintf(w, "gotunnel_tunnel_read_bytes_total{%s} %d\n", hub.tunnel.labels(), atomic.LoadInt64(&hub.tunnel.rbytes))
+	}
+
+	writeMetric(w, "gotunnel_tunnel_write_bytes_total", "counter", "Bytes written to tunnel.")
+	for _, hub := range hubs {
+		fmt.Fprintf(w, "gotunnel_tunnel_write_bytes_total{%s} %d\n", hub.tunnel.labels(), atomic.LoadInt64(&hub.tunnel.wbytes))
+	}
+
+	writeMetric(w, "gotunnel_tunnel_send_queue_bytes", "gauge", "Bytes of data frames waiting to be written to tunnel.")
+	for _, hub := range hubs {
+		fmt.Fprintf(w, "gotunnel_tunnel_send_queue_bytes{%s} %d\n", hub.tunnel.labels(), hub.tunnel.queue.size())
+	}
+
+	writeMetric(w, "gotunnel_hub_rtt_seconds", "gauge", "Smoothed round trip time of heartbeats, hubs with heartbeat only.")
+	for _, hub := range hubs {
+		if srtt, _ := hub.pathQuality(); srtt != 0 {
+			fmt.Fprintf(w, "gotunnel_hub_rtt_seconds{%s} %g\n", hub.tunnel.labels(), srtt.Seconds())
+		}
+	}
+
+	writeMetric(w, "gotunnel_hub_loss_ratio", "gauge", "Smoothed ratio of heartbeats lost or tcp segments retransmitted, hubs with heartbeat only.")
+	for _, hub := range hubs {
+		if srtt, loss := hub.pathQuality(); srtt != 0 {
+			fmt.Fprintf(w, "gotunnel_hub_loss_ratio{%s} %g\n", hub.tunnel.labels(), loss)
+		}
+	}
+
+	writeMetric(w, "gotunnel_hub_healthy", "gauge", "Hub passed its last echo health check, checked hubs only.")
+	for _, hub := range hubs {
+		if hub.healthChecked() {
+			healthy := 0
+			if hub.healthy() {
+				healthy = 1
+			}
+			fmt.Fprintf(w, "gotunnel_hub_healthy{%s} %d\n", hub.tunnel.labels(), healthy)
+		}
+	}
+
+	writeMetric(w, "gotunnel_hub_health_rtt_seconds", "gauge", "Round trip time of last passed echo health check.")
+	for _, hub := range hubs {
+		if hub.healthChecked() {
+			fmt.Fprintf(w, "gotunnel_hub_health_rtt_seconds{%s} %g\n", hub.tunnel.labels(), time.Duration(atomic.LoadInt64(&hub.health.rtt)).Seconds())
+		}
+	}
+
+	// by ip of original clients, only active links are counted to bound cardinality
+	writeMetric(w, "gotunnel_source_links", "gauge", "Active links per source ip of original client.")
+	sources := make(map[string]int)
+	for _, hub := range hubs {
+		for _, link := range hub.activeLinks() {
+			if host, _, err := net.SplitHostPort(link.source); err == nil {
+				sources[host]++
+			}
+		}
+	}
+	keys := make([]string, 0, len(sources))
+	for source := range sources {
+		keys = append(keys, source)
+	}
+	sort.Strings(keys)
+	for _, source := range keys {
+		fmt.Fprintf(w, "gotunnel_source_links{source=%q} %d\n", source, sources[source])
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value *int64
+	}{
+		{"gotunnel_links_created_total", "Links created.", &stats.LinkCreated},
+		{"gotunnel_links_closed_total", "Links closed.", &stats.LinkClosed},
+		{"gotunnel_handshake_failures_total", "Failed tunnel handshakes.", &stats.HandshakeFailed},
+		{"gotunnel_reconnects_total", "Tunnel reconnect attempts.", &stats.Reconnects},
+		{"gotunnel_handshake_timeouts_total", "Tunnel handshakes not finished in handshake timeout.", &stats.HandshakeTimeouts},
+		{"gotunnel_handshakes_rejected_total", "Tunnel connections closed for max handshakes in progress.", &stats.HandshakesRejected},
+		{"gotunnel_handshake_replays_total", "Handshakes rejected for stale or replayed token.", &stats.TokenReplayed},
+		{"gotunnel_banned_connections_total", "Tunnel connections closed for banned source.", &stats.BannedConns},
+		{"gotunnel_accepts_rejected_total", "Local connections reset for max conns.", &stats.AcceptRejected},
+		{"gotunnel_panics_total", "Panics recovered, their links are closed.", &stats.Panics},
+		{"gotunnel_mirror_dropped_bytes_total", "Bytes not copied to mirror as it's slow or unreachable.", &stats.MirrorDropped},
+		{"gotunnel_health_checks_failed_total", "Echo health checks of tunnels failed.", &stats.HealthFailed},
+		{"gotunnel_backend_failovers_total", "Links dialed to failover as backend is down.", &stats.Failovers},
+		{"gotunnel_backend_down_rejects_total", "Links rejected as backend and failover are down.", &stats.BackendDown},
+		{"gotunnel_direct_conns_total", "Connections of client connected directly as no tunnel could take them.", &stats.DirectConns},
+		{"gotunnel_ticket_resumes_total", "Tunnels established by session ticket in one round trip.", &stats.TicketResumed},
+		{"gotunnel_ticket_rejects_total", "Session tickets rejected, clients fall back to full handshake.", &stats.TicketRejected},
+		{"gotunnel_rekeys_total", "Keys of tunnel directions ratcheted by this end.", &stats.Rekeys},
+		{"gotunnel_policy_denied_total", "Links denied by policy or as it failed.", &stats.PolicyDenied},
+		{"gotunnel_linkids_leaked_total", "Link ids found leaked by audit.", &stats.LinkIdsLeaked},
+		{"gotunnel_linkids_reclaimed_total", "Leaked link ids reclaimed by audit.", &stats.LinkIdsReclaimed},
+		{"gotunnel_spans_exported_total", "Trace spans of links exported to collector.", &stats.SpansExported},
+		{"gotunnel_spans_dropped_total", "Trace spans dropped as collector is slow or unreachable.", &stats.SpansDropped},
+		{"gotunnel_frames_corrupted_total", "Frames failed integrity check.", &stats.FrameCorrupted},
+	}
+	for _, c := range counters {
+		writeMetric(w, c.name, "counter", c.help)
+		fmt.Fprintf(w, "%s %d\n", c.name, atomic.LoadInt64(c.value))
+	}
+
+	writeMetric(w, "gotunnel_goroutines", "gauge", "Number of goroutines.")
+	fmt.Fprintf(w, "gotunnel_goroutines %d\n", runtime.NumGoroutine())
+	writeMetric(w, "gotunnel_pool_alloced", "gauge", "Buffers allocated by pool.")
+	fmt.Fprintf(w, "gotunnel_pool_alloced %d\n", mpool.Alloced())
+}
@@ -6,50 +6,75 @@
 package tunnel
 
 import (
+	"sort"
 	"sync"
 	"sync/atomic"
+	"unsafe"
 )
 
+// pool of buffers in size classes, so small frames don't hold a full packet
 type MPool struct {
-	pool    *sync.Pool
+	pools   []*sync.Pool
+	sizes   []int // ascending
 	alloced int32
 	used    int32
 	freed   int32
-	sz      int
 }
 
+// buffer of largest class
 func (p *MPool) Get() []byte {
+	return p.get(len(p.sizes) - 1)
+}
+
+// buffer of smallest class fits n, sliced to n. It's allocated out of pool
+// if n exceeds the largest class
+func (p *MPool) GetSize(n int) []byte {
+	i := sort.SearchInts(p.sizes, n)
+	if i == len(p.sizes) {
+		return make([]byte, n)
+	}
+	return p.get(i)[:n]
+}
+
+// pools keep pointer to first byte, putting a slice header into interface
+// allocates on every Put
+func (p *MPool) get(i int) []byte {
 	atomic.AddInt32(&p.used, 1)
-	return p.pool.Get().([]byte)
+	return unsafe.Slice(p.pools[i].Get().(*byte), p.sizes[i])
 }
 
+// buffer not from pool is dropped
 func (p *MPool) Put(x []byte) {
-	if cap(x) == p.sz {
+	i := sort.SearchInts(p.sizes, cap(x))
+	if i < len(p.sizes) && p.sizes[i] == cap(x) {
 		atomic.AddInt32(&p.freed, 1)
-		p.pool.Put(x[0:p.sz])
+		p.pools[i].Put(&x[:1][0])
 	}
 }
 
 func (p *MPool) Alloced() int32 {
-	return p.alloced
+	return atomic.LoadInt32(&p.alloced)
 }
 
 func (p *MPool) Freed() int32 {
-	return p.freed
+	return atomic.LoadInt32(&p.freed)
 }
 
 func (p *MPool) Used() int32 {
-	return p.used
+	return atomic.LoadInt32(&p.used)
 }
 
-func NewMPool(sz int) *MPool {
-	p := &MPool{sz: sz}
-	pool := new(sync.Pool)
-	pool.New = func() interface{} {
-		buf := make([]byte, p.sz)
-		atomic.AddInt32(&p.alloced, 1)
-		return buf
+func NewMPool(sizes ...int) *MPool {
+	p := &MPool{sizes: append([]int{}, sizes...)}
+	sort.Ints(p.sizes)
+	for _, sz := range p.sizes {
+		sz := sz
+		p.pools = append(p.pools, &sync.Pool{
+			New: func() interface{} {
+				atomic.AddInt32(&p.alloced, 1)
+				return &make([]byte, sz)[0]
+			},
+		})
 	}
-	p.pool = pool
 	return p
 }
@@ -0,0 +1,60 @@
+//
+//   date  : 2015-10-09
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"io"
+)
+
+// Data of links of a nocrypt rule is sent in plain aead frames: it's
+// authenticated by GMAC of the session key, so it can't be forged or
+// altered, but not encrypted. It saves encrypting traffic twice, such as tls
+// over a trusted private network. Control frames and other links are always
+// encrypted. Plain frames are written only if both ends support
+// capPlainFrame, cipher is aes-256-gcm and the tunnel isn't resumable.
+
+// enable plain frames of rd and wr, should be called after caps and session
+// are set
+func (t *Tunnel) setPlain(rd io.Reader, wr io.Writer) {
+	if !t.has(capPlainFrame) || t.sess != nil {
+		return
+	}
+	r, ok := rd.(*aeadReader)
+	w, ok2 := wr.(*aeadWriter)
+	if ok && ok2 {
+		r.plain = true
+		t.plain = w
+	}
+}
+
+// tunnel could send data of nocrypt links in plain
+func (t *Tunnel) plainSupported() bool {
+	return t.plain != nil
+}
+
+// write frame of nocrypt link in plain frames, frame is flushed before
+// switching back
+func (t *Tunnel) writePlain(payload Payload) error {
+	t.plain.plain = true
+	defer func() {
+		t.plain.plain = false
+	}()
+	return t.writeFrame(payload)
+}
+
+// data of link is sent in plain if rule of either end is nocrypt, the creator
+// tells peer by link args
+func (self *Link) setNoCrypt(nocrypt bool) {
+	if !nocrypt {
+		return
+	}
+	if !self.hub.tunnel.plainSupported() {
+		self.log.Error("nocrypt isn't supported by peer or cipher, data is encrypted")
+		return
+	}
+	self.plain = true
+	self.log.Info("nocrypt, data is authenticated but not encrypted")
+}
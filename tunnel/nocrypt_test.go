@@ -0,0 +1,37 @@
+//
+//   date  : 2015-10-09
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestPairNoCrypt(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{NoCrypt: true})
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	io.WriteString(conn, "hello")
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected echo:%q, %v", buf, err)
+	}
+
+	// creator's rule makes both ends send data in plain
+	for _, hub := range []*Hub{p.client.activeHubs()[0], p.server.activeHubs()[0]} {
+		if !hub.tunnel.plainSupported() {
+			t.Fatal("plain frames should be negotiated")
+		}
+		links := hub.activeLinks()
+		if len(links) != 1 || !links[0].plain {
+			t.Fatalf("link should be nocrypt:%v", links)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+//
+//   date  : 2015-10-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+)
+
+// obfuscation wraps tunnel connections under tls and websocket, so dpi
+// doesn't see the tunnel protocol. Both ends must use the same mode and key:
+//
+//   - padding: bytes on the wire are masked by a keystream of aes-ctr, with
+//     a random iv sent first by each end. Writes are cut into frames with
+//     random padding, so lengths of packets don't follow tunnel frames.
+//   - tls: padding frames carried by tls application data records, after
+//     a client hello and a server hello made of random bytes.
+//
+// It hides the protocol from passive inspection, not from active probes.
+const (
+	ObfsNone    = "none"
+	ObfsPadding = "padding"
+	ObfsTLS     = "tls"
+)
+
+const (
+	obfsIVSize   = aes.BlockSize
+	obfsHeadSize = 4 // data and padding length
+	obfsMaxData  = 16000
+	obfsMaxPad   = 255
+)
+
+const (
+	tlsRecordData  = 0x17
+	tlsServerHello = 0x02
+)
+
+var errObfsFrame = errors.New("bad obfuscated frame")
+
+func obfsMode(mode string) bool {
+	switch mode {
+	case ObfsNone, ObfsPadding, ObfsTLS:
+		return true
+	}
+	return false
+}
+
+// aes key of keystream
+func obfsKey(key string) []byte {
+	sum := sha256.Sum256([]byte("gotunnel obfs:" + key))
+	return sum[:]
+}
+
+type obfsConn struct {
+	net.Conn
+	mode   string
+	client bool
+	key    []byte
+
+	rd   *bufio.Reader
+	dec  cipher.Stream // nil until hello of peer is read
+	left int           // unread data of current frame
+	pad  int           // padding after it
+	head [obfsHeadSize]byte
+
+	wlock sync.Mutex
+	enc   cipher.Stream // nil until our hello is sent
+	wbuf  []byte
+}
+
+func newObfsConn(conn net.Conn, mode string, key []byte, client bool) *obfsConn {
+	return &obfsConn{Conn: conn, mode: mode, client: client, key: key, rd: bufio.NewReader(conn)}
+}
+
+func (c *obfsConn) stream(iv []byte) cipher.Stream {
+	block, _ := aes.NewCipher(c.key)
+	return cipher.NewCTR(block, iv)
+}
+
+// iv of our stream, in random of a hello record in tls mode
+func (c *obfsConn) appendHello(buf []byte) ([]byte, error) {
+	var random [64]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	c.enc = c.stream(random[:obfsIVSize])
+	if c.mode != ObfsTLS {
+		return append(buf, random[:obfsIVSize]...), nil
+	}
+
+	// version, random and session id, then a few tls 1.3 suites and null
+	// compression of client hello, or the chosen ones of server hello
+	body := []byte{0x03, 0x03}
+	body = append(body, random[:32]...)
+	body = append(body, 32)
+	body = append(body, random[32:]...)
+	msgType, version := byte(tlsClientHello), byte(1)
+	if c.client {
+		body = append(body, 0x00, 0x06, 0x13, 0x01, 0x13, 0x02, 0x13, 0x03, 0x01, 0x00, 0x00, 0x00)
+	} else {
+		body = append(body, 0x13, 0x01, 0x00, 0x00, 0x00)
+		msgType, version = tlsServerHello, 3
+	}
+	n := len(body) + 4
+	buf = append(buf, tlsRecordHandshake, 0x03, version, byte(n>>8), byte(n))
+	buf = append(buf, msgType, 0, byte(len(body)>>8), byte(len(body)))
+	return append(buf, body...), nil
+}
+
+func (c *obfsConn) readHello() error {
+	if c.mode != ObfsTLS {
+		var iv [obfsIVSize]byte
+		if _, err := io.ReadFull(c.rd, iv[:]); err != nil {
+			return err
+		}
+		c.dec = c.stream(iv[:])
+		return nil
+	}
+	body, err := c.readRecord(tlsRecordHandshake)
+	if err != nil {
+		return err
+	}
+	// type, length and version are followed by random
+	if len(body) < 6+obfsIVSize || body[0] != tlsClientHello && body[0] != tlsServerHello {
+		return errObfsFrame
+	}
+	c.dec = c.stream(body[6 : 6+obfsIVSize])
+	return nil
+}
+
+// body of a whole tls record
+func (c *obfsConn) readRecord(typ byte) ([]byte, error) {
+	var head [tlsRecordHeadSize]byte
+	if _, err := io.ReadFull(c.rd, head[:]); err != nil {
+		return nil, err
+	}
+	n := int(head[3])<<8 | int(head[4])
+	if head[0] != typ || head[1] != 0x03 || n > tlsRecordSize-tlsRecordHeadSize {
+		return nil, errObfsFrame
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.rd, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (c *obfsConn) Read(p []byte) (int, error) {
+	if c.dec == nil {
+		if err := c.readHello(); err != nil {
+			return 0, err
+		}
+	}
+	for c.left == 0 {
+		if err := c.readHead(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.rd.Read(p)
+	c.dec.XORKeyStream(p[:n], p[:n])
+	c.left -= n
+	return n, err
+}
+
+// skip padding of last frame, and read head of next one
+func (c *obfsConn) readHead() error {
+	var pad [obfsMaxPad]byte
+	if _, err := io.ReadFull(c.rd, pad[:c.pad]); err != nil {
+		return err
+	}
+	c.dec.XORKeyStream(pad[:c.pad], pad[:c.pad])
+	if c.mode == ObfsTLS {
+		var head [tlsRecordHeadSize]byte
+		if _, err := io.ReadFull(c.rd, head[:]); err != nil {
+			return err
+		}
+		if head[0] != tlsRecordData || head[1] != 0x03 {
+			return errObfsFrame
+		}
+	}
+	if _, err := io.ReadFull(c.rd, c.head[:]); err != nil {
+		return err
+	}
+	c.dec.XORKeyStream(c.head[:], c.head[:])
+	c.left = int(c.head[0])<<8 | int(c.head[1])
+	c.pad = int(c.head[2])<<8 | int(c.head[3])
+	if c.left > obfsMaxData || c.pad > obfsMaxPad {
+		return errObfsFrame
+	}
+	return nil
+}
+
+func (c *obfsConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	buf := c.wbuf[:0]
+	if c.enc == nil {
+		var err error
+		if buf, err = c.appendHello(buf); err != nil {
+			return 0, err
+		}
+	}
+	for data := p; len(data) > 0; {
+		n := len(data)
+		if n > obfsMaxData {
+			n = obfsMaxData
+		}
+		buf = c.appendFrame(buf, data[:n])
+		data = data[n:]
+	}
+	c.wbuf = buf
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *obfsConn) appendFrame(buf []byte, data []byte) []byte {
+	pad := mrand.Intn(obfsMaxPad + 1)
+	if c.mode == ObfsTLS {
+		n := obfsHeadSize + len(data) + pad
+		buf = append(buf, tlsRecordData, 0x03, 0x03, byte(n>>8), byte(n))
+	}
+	start := len(buf)
+	buf = append(buf, byte(len(data)>>8), byte(len(data)), byte(pad>>8), byte(pad))
+	buf = append(buf, data...)
+	buf = append(buf, make([]byte, pad)...)
+	c.enc.XORKeyStream(buf[start:], buf[start:])
+	return buf
+}
@@ -0,0 +1,68 @@
+//
+//   date  : 2015-10-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestObfsConn(t *testing.T) {
+	key := obfsKey("test secret")
+	data := make([]byte, 100000)
+	rand.Read(data)
+	for _, mode := range []string{ObfsPadding, ObfsTLS} {
+		a, b := memPipe("client", "server")
+		c := newObfsConn(a, mode, key, true)
+		s := newObfsConn(b, mode, key, false)
+		go func() {
+			c.Write(data[:10])
+			c.Write(data[10:])
+		}()
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: unexpected read, err:%v", mode, err)
+		}
+		go s.Write([]byte("pong"))
+		if _, err := io.ReadFull(c, got[:4]); err != nil || string(got[:4]) != "pong" {
+			t.Fatalf("%s: unexpected reply:%q, %v", mode, got[:4], err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestObfsWire(t *testing.T) {
+	a, b := memPipe("client", "server")
+	c := newObfsConn(a, ObfsTLS, obfsKey("test secret"), true)
+	go func() {
+		c.Write([]byte("hello tunnel"))
+		a.CloseWrite()
+	}()
+	wire, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// client hello, then application data
+	if !bytes.HasPrefix(wire, []byte{tlsRecordHandshake, 3, 1}) || wire[5] != tlsClientHello || bytes.Contains(wire, []byte("hello tunnel")) {
+		t.Fatalf("unexpected wire:%x", wire)
+	}
+	hello := tlsRecordHeadSize + (int(wire[3])<<8 | int(wire[4]))
+	if wire[hello] != tlsRecordData {
+		t.Fatalf("unexpected record:%x", wire[hello:])
+	}
+
+	// peer with another key doesn't read it
+	a, b = memPipe("client", "server")
+	s := newObfsConn(b, ObfsTLS, obfsKey("other secret"), false)
+	go a.Write(wire)
+	buf := make([]byte, 64)
+	if n, err := s.Read(buf); err == nil && string(buf[:n]) == "hello tunnel" {
+		t.Fatal("wrong key shouldn't read data")
+	}
+}
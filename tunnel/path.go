@@ -0,0 +1,150 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// quality of the path of a hub, measured by heartbeats: rtt of pongs is
+// smoothed like srtt of tcp, and a ping without pong when the next is sent
+// is lost. On linux, tcp retransmits of tunnel connection per segment
+// written count as loss too. Client schedules new links to hubs losing
+// less than degradedLoss first, so they avoid degraded paths.
+
+const (
+	degradedLoss  = 0.05
+	pathMinSegs   = 16 // segments written between samples of retransmits
+	pathSmoothing = 8  // weight of old value in ewma is 1 - 1/8
+)
+
+type hubPath struct {
+	sync.Mutex
+	srtt   time.Duration // 0 until the first pong
+	rttvar time.Duration
+	ping   int64   // unix nano of ping waiting for pong, 0 if answered
+	loss   float64 // smoothed ratio of pings lost
+	lost   int64   // pings lost
+
+	retrans      float64 // smoothed ratio of segments retransmitted
+	totalRetrans uint32  // retransmits of tunnel connection at last sample
+	written      int64   // bytes written to tunnel at last sample
+}
+
+func ewma(old, sample float64) float64 {
+	return old + (sample-old)/pathSmoothing
+}
+
+// heartbeat sends ping
+func (self *Hub) pathPing(now time.Time) {
+	p := &self.path
+	p.Lock()
+	if p.ping != 0 {
+		p.loss = ewma(p.loss, 1)
+		p.lost++
+	}
+	p.ping = now.UnixNano()
+	p.Unlock()
+}
+
+// pong of ping sent at unix nano sent
+func (self *Hub) pathPong(sent int64, now time.Time) {
+	rtt := time.Duration(now.UnixNano() - sent)
+	p := &self.path
+	p.Lock()
+	defer p.Unlock()
+	if p.srtt == 0 {
+		p.srtt, p.rttvar = rtt, rtt/2
+	} else {
+		delta := p.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		p.rttvar += (delta - p.rttvar) / 4
+		p.srtt += (rtt - p.srtt) / pathSmoothing
+	}
+	if sent == p.ping {
+		p.ping = 0
+		p.loss = ewma(p.loss, 0)
+	}
+}
+
+// sample retransmits of tunnel connection if enough data is written since
+// last sample
+func (self *Hub) sampleRetrans() {
+	tc := tcpConnOf(self.tunnel.netConn())
+	if tc == nil {
+		return
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+	var retrans, mss uint32
+	raw.Control(func(fd uintptr) {
+		retrans, mss, err = getTCPRetrans(fd)
+	})
+	if err != nil || mss == 0 {
+		return
+	}
+	written := atomic.LoadInt64(&self.tunnel.wbytes)
+
+	p := &self.path
+	p.Lock()
+	defer p.Unlock()
+	segs := (written - p.written) / int64(mss)
+	if p.written != 0 && segs < pathMinSegs && retrans >= p.totalRetrans {
+		return
+	}
+	// a resumed tunnel has a new connection, its counter starts over
+	if p.written != 0 && retrans >= p.totalRetrans {
+		ratio := float64(retrans-p.totalRetrans) / float64(segs)
+		if ratio > 1 {
+			ratio = 1
+		}
+		p.retrans = ewma(p.retrans, ratio)
+	}
+	p.totalRetrans, p.written = retrans, written
+}
+
+// rtt and loss of path, 0 if heartbeat is disabled
+func (self *Hub) pathQuality() (srtt time.Duration, loss float64) {
+	p := &self.path
+	p.Lock()
+	defer p.Unlock()
+	loss = p.loss
+	if p.retrans > loss {
+		loss = p.retrans
+	}
+	return p.srtt, loss
+}
+
+func (self *Hub) degraded() bool {
+	_, loss := self.pathQuality()
+	return loss >= degradedLoss
+}
+
+// tcp connection under tls, websocket and obfuscation, nil if it isn't tcp
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *wsConn:
+			conn = c.Conn
+		case *obfsConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
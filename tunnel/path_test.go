@@ -0,0 +1,75 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHubPath(t *testing.T) {
+	hub := &Hub{}
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		hub.pathPing(now)
+		now = now.Add(time.Second)
+		hub.pathPong(now.Add(-time.Second).UnixNano(), now.Add(-time.Second+time.Millisecond*20))
+	}
+	if srtt, loss := hub.pathQuality(); srtt != time.Millisecond*20 || loss != 0 {
+		t.Fatalf("unexpected path:%v, %v", srtt, loss)
+	}
+
+	// pings without pong are lost, path recovers with pongs
+	for i := 0; i < 2; i++ {
+		hub.pathPing(now)
+		now = now.Add(time.Second)
+	}
+	if _, loss := hub.pathQuality(); loss == 0 || !hub.degraded() || hub.path.lost != 1 {
+		t.Fatalf("unexpected loss:%v, lost:%d", loss, hub.path.lost)
+	}
+	for i := 0; i < 32; i++ {
+		hub.pathPing(now)
+		hub.pathPong(now.UnixNano(), now.Add(time.Millisecond*20))
+		now = now.Add(time.Second)
+	}
+	if hub.degraded() {
+		t.Fatal("path should recover")
+	}
+
+	// degraded hub is picked only if all are
+	hubs := []*HubItem{{Hub: &Hub{}, priority: 0}, {Hub: &Hub{}, priority: 1}}
+	hubs[0].path.loss = 0.5
+	if got := pickHub(hubs, balancers[BalanceLinks]); got != hubs[1] {
+		t.Fatalf("unexpected hub %d", got.priority)
+	}
+	if got := pickHub(hubs, balancers[BalanceLinks], hubs[1]); got != hubs[0] {
+		t.Fatal("degraded hub should be picked as the last resort")
+	}
+}
+
+func TestTCPConnOf(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	wrapped := tls.Client(newObfsConn(conn, ObfsPadding, obfsKey(""), true), &tls.Config{})
+	if tcpConnOf(wrapped) != conn {
+		t.Fatal("tcp conn should be found under tls and obfuscation")
+	}
+	a, _ := memPipe("a", "b")
+	if tcpConnOf(a) != nil {
+		t.Fatal("pipe isn't tcp")
+	}
+}
@@ -0,0 +1,313 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// link data is captured as a synthetic tcp connection between source and
+// destination of the link, so tools like wireshark could follow its streams.
+// Packets are raw ip, with valid checksums.
+
+const (
+	pcapMagic       = 0xa1b2c3d4
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 65535
+
+	// payload of a segment, fits both ipv4 and ipv6 length fields
+	tcpMaxSegment = 65535 - 60 - 20
+
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpPsh = 0x08
+	tcpAck = 0x10
+)
+
+// addresses of link whose source or destination is unknown
+var (
+	tapClientAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4()}
+	tapServerAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2).To4()}
+)
+
+// synthetic tcp connection, not safe for concurrent use
+type tcpStream struct {
+	client, server *net.TCPAddr
+	seq            [2]uint32 // next sequence number of client and server
+}
+
+// ip:port without resolving, ok is false if it isn't an ip literal
+func parseTapAddr(addr string) (*net.TCPAddr, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, false
+	}
+	p, _ := net.LookupPort("tcp", port)
+	return &net.TCPAddr{IP: ip, Port: p}, true
+}
+
+func newTCPStream(source, dest string) *tcpStream {
+	client, ok := parseTapAddr(source)
+	if !ok {
+		client = tapClientAddr
+	}
+	server, ok := parseTapAddr(dest)
+	if !ok {
+		server = tapServerAddr
+	}
+	// both ends are in one family
+	if ip := client.IP.To4(); ip != nil && server.IP.To4() != nil {
+		client = &net.TCPAddr{IP: ip, Port: client.Port}
+		server = &net.TCPAddr{IP: server.IP.To4(), Port: server.Port}
+	} else {
+		client = &net.TCPAddr{IP: client.IP.To16(), Port: client.Port}
+		server = &net.TCPAddr{IP: server.IP.To16(), Port: server.Port}
+	}
+	return &tcpStream{client: client, server: server, seq: [2]uint32{1, 1}}
+}
+
+// packets of data sent by client or server, data is split into segments.
+// SYN and FIN take a sequence number.
+func (s *tcpStream) packets(fromClient bool, flags uint8, data []byte) [][]byte {
+	var pkts [][]byte
+	for {
+		n := len(data)
+		if n > tcpMaxSegment {
+			n = tcpMaxSegment
+		}
+		pkts = append(pkts, s.packet(fromClient, flags, data[:n]))
+		data = data[n:]
+		if len(data) == 0 {
+			return pkts
+		}
+	}
+}
+
+func (s *tcpStream) packet(fromClient bool, flags uint8, data []byte) []byte {
+	src, dst, me := s.client, s.server, 0
+	if !fromClient {
+		src, dst, me = s.server, s.client, 1
+	}
+	seq, ack := s.seq[me], s.seq[1-me]
+	s.seq[me] += uint32(len(data))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		s.seq[me]++
+	}
+	if flags&tcpSyn != 0 && fromClient {
+		ack = 0
+	} else {
+		flags |= tcpAck
+	}
+
+	ipLen := 20
+	if src.IP.To4() == nil {
+		ipLen = 40
+	}
+	pkt := make([]byte, ipLen+20+len(data))
+	tcp := pkt[ipLen:]
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	copy(tcp[20:], data)
+
+	// checksum of pseudo header and tcp segment
+	var pseudo []byte
+	if ipLen == 20 {
+		ip := pkt[:20]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src.IP.To4())
+		copy(ip[16:], dst.IP.To4())
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+		pseudo = append(append([]byte{}, ip[12:20]...), 0, 6, 0, 0)
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	} else {
+		ip := pkt[:40]
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], src.IP)
+		copy(ip[24:], dst.IP)
+		pseudo = append(append([]byte{}, ip[8:40]...), 0, 0, 0, 0, 0, 0, 0, 6)
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo), tcp))
+	return pkt
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		s += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+// internet checksum of b, s is partial sum of other data
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return ^uint16(s)
+}
+
+// writer of libpcap file of raw ip packets, safe for concurrent use
+type pcapWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// header is written if the file is new
+func newPcapWriter(w io.Writer, header bool) (*pcapWriter, error) {
+	if header {
+		var h [24]byte
+		binary.LittleEndian.PutUint32(h[0:], pcapMagic)
+		binary.LittleEndian.PutUint16(h[4:], 2)
+		binary.LittleEndian.PutUint16(h[6:], 4)
+		binary.LittleEndian.PutUint32(h[16:], pcapSnapLen)
+		binary.LittleEndian.PutUint32(h[20:], pcapLinkTypeRaw)
+		if _, err := w.Write(h[:]); err != nil {
+			return nil, err
+		}
+	}
+	return &pcapWriter{w: w}, nil
+}
+
+// packets are written together, so packets of links don't interleave
+func (p *pcapWriter) writePackets(t time.Time, pkts [][]byte) error {
+	var buf []byte
+	for _, pkt := range pkts {
+		var h [16]byte
+		binary.LittleEndian.PutUint32(h[0:], uint32(t.Unix()))
+		binary.LittleEndian.PutUint32(h[4:], uint32(t.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(h[8:], uint32(len(pkt)))
+		binary.LittleEndian.PutUint32(h[12:], uint32(len(pkt)))
+		buf = append(append(buf, h[:]...), pkt...)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, err := p.w.Write(buf)
+	return err
+}
+
+// pcapng blocks
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngOptComment     = 1
+)
+
+// writer of pcapng stream of raw ip packets, with a section and an
+// interface, not safe for concurrent use
+type pcapngWriter struct {
+	w io.Writer
+}
+
+func pcapngBlock(typ uint32, body []byte) []byte {
+	n := 12 + len(body)
+	b := make([]byte, n)
+	binary.LittleEndian.PutUint32(b[0:], typ)
+	binary.LittleEndian.PutUint32(b[4:], uint32(n))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[n-4:], uint32(n))
+	return b
+}
+
+// option padded to 32 bits
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	var h [4]byte
+	binary.LittleEndian.PutUint16(h[0:], code)
+	binary.LittleEndian.PutUint16(h[2:], uint16(len(value)))
+	b = append(append(b, h[:]...), value...)
+	return append(b, make([]byte, -len(value)&3)...)
+}
+
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	var shb [16]byte
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0)) // section length unknown
+	var idb [8]byte
+	binary.LittleEndian.PutUint16(idb[0:], pcapLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], pcapSnapLen)
+	b := append(pcapngBlock(pcapngSectionHeader, shb[:]), pcapngBlock(pcapngInterface, idb[:])...)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	return &pcapngWriter{w: w}, nil
+}
+
+// write packet with time in microseconds and comment, return bytes written
+func (p *pcapngWriter) writePacket(t time.Time, pkt []byte, comment string) (int, error) {
+	body := make([]byte, 20, 20+len(pkt)+len(comment)+16)
+	ts := uint64(t.UnixNano() / 1000)
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(pkt)))
+	body = append(body, pkt...)
+	body = append(body, make([]byte, -len(pkt)&3)...)
+	if comment != "" {
+		body = pcapngOption(body, pcapngOptComment, []byte(comment))
+		body = pcapngOption(body, 0, nil)
+	}
+	return p.w.Write(pcapngBlock(pcapngEnhancedPacket, body))
+}
+
+// capture files are shared by rules of the same path and kept open, rules
+// are rebuilt on reload
+var tapFiles struct {
+	sync.Mutex
+	m map[string]*pcapWriter
+}
+
+func openTapFile(path string) (*pcapWriter, error) {
+	tapFiles.Lock()
+	defer tapFiles.Unlock()
+	if w, ok := tapFiles.m[path]; ok {
+		return w, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w, err := newPcapWriter(f, fi.Size() == 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if tapFiles.m == nil {
+		tapFiles.m = make(map[string]*pcapWriter)
+	}
+	tapFiles.m[path] = w
+	return w, nil
+}
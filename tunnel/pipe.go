@@ -0,0 +1,155 @@
+//
+//   date  : 2015-09-22
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var errPipeRefused = errors.New("connection refused")
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// in-memory duplex conn made of two net.Pipe, one for each direction, so it
+// could be half closed like tcp
+type memConn struct {
+	rd    net.Conn
+	wr    net.Conn
+	laddr pipeAddr
+	raddr pipeAddr
+}
+
+func memPipe(a, b pipeAddr) (*memConn, *memConn) {
+	ra, wb := net.Pipe()
+	rb, wa := net.Pipe()
+	return &memConn{rd: ra, wr: wa, laddr: a, raddr: b}, &memConn{rd: rb, wr: wb, laddr: b, raddr: a}
+}
+
+func (c *memConn) Read(b []byte) (int, error)  { return c.rd.Read(b) }
+func (c *memConn) Write(b []byte) (int, error) { return c.wr.Write(b) }
+func (c *memConn) CloseRead() error            { return c.rd.Close() }
+func (c *memConn) CloseWrite() error           { return c.wr.Close() }
+func (c *memConn) LocalAddr() net.Addr         { return c.laddr }
+func (c *memConn) RemoteAddr() net.Addr        { return c.raddr }
+
+func (c *memConn) Close() error {
+	c.rd.Close()
+	return c.wr.Close()
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.rd.SetDeadline(t)
+	return c.wr.SetDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error  { return c.rd.SetReadDeadline(t) }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return c.wr.SetWriteDeadline(t) }
+
+// in-memory network, tunnels and links run over it without real sockets
+type pipeNetwork struct {
+	sync.Mutex
+	listeners map[string]*pipeListener
+	seq       int
+}
+
+func newPipeNetwork() *pipeNetwork {
+	return &pipeNetwork{listeners: make(map[string]*pipeListener)}
+}
+
+func (n *pipeNetwork) Listen(addr string) (net.Listener, error) {
+	n.Lock()
+	defer n.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("listen %s: address already in use", addr)
+	}
+	ln := &pipeListener{
+		network: n,
+		addr:    pipeAddr(addr),
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addr] = ln
+	return ln, nil
+}
+
+// block until conn is accepted, or ctx is done
+func (n *pipeNetwork) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	n.Lock()
+	ln := n.listeners[addr]
+	n.seq++
+	laddr := pipeAddr(fmt.Sprintf("pipe:%d", n.seq))
+	n.Unlock()
+	if ln == nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, errPipeRefused)
+	}
+
+	local, remote := memPipe(laddr, ln.addr)
+	select {
+	case ln.conns <- remote:
+		return local, nil
+	case <-ln.done:
+		return nil, fmt.Errorf("dial %s: %w", addr, errPipeRefused)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type pipeListener struct {
+	network *pipeNetwork
+	addr    pipeAddr
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (ln *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *pipeListener) Close() error {
+	ln.once.Do(func() {
+		close(ln.done)
+		ln.network.Lock()
+		delete(ln.network.listeners, string(ln.addr))
+		ln.network.Unlock()
+	})
+	return nil
+}
+
+func (ln *pipeListener) Addr() net.Addr {
+	return ln.addr
+}
+
+// tunnels over pipe network, there is no transport level handshake
+type pipeTransport struct {
+	network *pipeNetwork
+	addr    string // listen address of server
+}
+
+func (t *pipeTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return t.network.Dial(ctx, addr)
+}
+
+func (t *pipeTransport) Listen() (net.Listener, error) {
+	return t.network.Listen(t.addr)
+}
+
+func (t *pipeTransport) Handshake(conn net.Conn, server string) (net.Conn, error) {
+	return conn, nil
+}
@@ -0,0 +1,155 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// default max milliseconds of a decision of policy command
+const DefaultPolicyTimeout = 1000
+
+var errPolicyDenied = errors.New("link denied by policy")
+
+// Policy decides links created by peer before the end dials their
+// destinations, that's server for rules forwarded by client, so custom
+// policy needn't a fork. It's called by a goroutine of each link, and should
+// be safe for concurrent use. An error denies the link.
+type Policy interface {
+	Decide(ctx context.Context, req PolicyRequest) (PolicyDecision, error)
+}
+
+type PolicyRequest struct {
+	Client  string `json:"client,omitempty"` // identity of client, empty if anonymous
+	Peer    string `json:"peer"`             // address of tunnel peer
+	Service string `json:"service"`          // rule name
+	Source  string `json:"source,omitempty"` // ip:port of original client, empty if unknown
+	Dest    string `json:"dest,omitempty"`   // requested by peer, empty for backend of rule
+}
+
+// zero decision allows the link as it is
+type PolicyDecision struct {
+	Deny   bool   `json:"deny"`
+	Reason string `json:"reason,omitempty"` // why it's denied, sent to peer
+
+	// destination dialed instead of backend of rule or the one requested,
+	// acl still applies. Ignored by echo and exec rules.
+	Dest string `json:"dest,omitempty"`
+
+	Priority string `json:"priority,omitempty"` // class of frames sent by this end: interactive, normal or bulk
+	Rate     int64  `json:"rate,omitempty"`     // bytes per second of link in each direction, overrides link_rate
+}
+
+// decide by an external command: request is written to its stdin in json,
+// decision is read from its stdout in json. Command exits non-zero or not in
+// timeout denies the link.
+type execPolicy struct {
+	args    []string
+	timeout time.Duration
+}
+
+func newExecPolicy(command string, timeout time.Duration) (*execPolicy, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("policy exec: no command")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, fmt.Errorf("policy exec: %v", err)
+	}
+	return &execPolicy{args: args, timeout: timeout}, nil
+}
+
+func (p *execPolicy) Decide(ctx context.Context, req PolicyRequest) (PolicyDecision, error) {
+	var d PolicyDecision
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return d, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.args[0], p.args[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	// children of command may hold its output open after it's killed
+	cmd.WaitDelay = 100 * time.Millisecond
+	out, err := cmd.Output()
+	if err != nil {
+		return d, fmt.Errorf("policy %s failed: %v %s", p.args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if err := json.Unmarshal(out, &d); err != nil {
+		return d, fmt.Errorf("policy %s answers bad decision: %v", p.args[0], err)
+	}
+	return d, nil
+}
+
+// policy decides links created by server, set it before Start. It overrides
+// PolicyExec.
+func (self *Server) SetPolicy(policy Policy) {
+	self.app.policy = policy
+}
+
+// policy decides links of reverse rules created by server, set it before
+// Start. It overrides PolicyExec.
+func (cli *Client) SetPolicy(policy Policy) {
+	cli.app.policy = policy
+}
+
+// ask policy about link, dest is rewritten if it decides so
+func (self *ServerHub) applyPolicy(link *Link, dest *string) error {
+	policy := self.app.policy
+	if policy == nil {
+		return nil
+	}
+	req := PolicyRequest{
+		Client:  self.tunnel.identity,
+		Peer:    self.tunnel.netConn().RemoteAddr().String(),
+		Service: link.service,
+		Source:  link.source,
+		Dest:    *dest,
+	}
+	d, err := policy.Decide(link.ctx, req)
+	if err == nil && d.Deny {
+		err = errPolicyDenied
+		if d.Reason != "" {
+			err = fmt.Errorf("%w: %s", errPolicyDenied, d.Reason)
+		}
+	}
+	if err == nil && d.Priority != "" {
+		if _, ok := priorities[d.Priority]; !ok {
+			err = fmt.Errorf("policy answers unknown priority %s", d.Priority)
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&stats.PolicyDenied, 1)
+		link.log.Error("policy denies link to %q: %v", req.Dest, err)
+		// failures of policy aren't told to peer
+		if !errors.Is(err, errPolicyDenied) {
+			err = errPolicyDenied
+		}
+		return err
+	}
+
+	if d.Dest != "" && d.Dest != *dest {
+		link.log.Info("policy rewrites destination %q to %s", *dest, d.Dest)
+		*dest = d.Dest
+	}
+	if d.Priority != "" {
+		link.setPriority(priorities[d.Priority])
+	}
+	if d.Rate > 0 {
+		link.rate = newRateLimiters(d.Rate)
+	}
+	return nil
+}
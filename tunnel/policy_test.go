@@ -0,0 +1,131 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+type policyFunc func(ctx context.Context, req PolicyRequest) (PolicyDecision, error)
+
+func (f policyFunc) Decide(ctx context.Context, req PolicyRequest) (PolicyDecision, error) {
+	return f(ctx, req)
+}
+
+func TestPairPolicy(t *testing.T) {
+	var lock sync.Mutex
+	var requests []PolicyRequest
+	var decision PolicyDecision
+	var failure error
+	policy := policyFunc(func(ctx context.Context, req PolicyRequest) (PolicyDecision, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, req)
+		return decision, failure
+	})
+	decide := func(d PolicyDecision, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		decision, failure = d, err
+	}
+
+	p := newTestPair(t, Config{}, Config{}, func(p *testPair) {
+		p.server.SetPolicy(policy)
+	})
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	lock.Lock()
+	req := requests[0]
+	lock.Unlock()
+	if req.Service == "" || req.Source == "" || req.Peer == "" || req.Dest != "" {
+		t.Fatalf("unexpected request:%+v", req)
+	}
+
+	decide(PolicyDecision{Deny: true, Reason: "no way"}, nil)
+	if echoed := p.roundTrip(t, "hello"); echoed != "" {
+		t.Fatalf("denied link echoes:%q", echoed)
+	}
+	decide(PolicyDecision{}, errors.New("policy is down"))
+	if echoed := p.roundTrip(t, "hello"); echoed != "" {
+		t.Fatalf("link echoes while policy fails:%q", echoed)
+	}
+	decide(PolicyDecision{Priority: "unknown"}, nil)
+	if echoed := p.roundTrip(t, "hello"); echoed != "" {
+		t.Fatalf("link echoes with unknown priority:%q", echoed)
+	}
+
+	// destination rewritten to another backend
+	other, err := p.network.Listen("127.0.0.1:8004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	go func() {
+		for {
+			conn, err := other.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "rewritten")
+			conn.Close()
+		}
+	}()
+	decide(PolicyDecision{Dest: "127.0.0.1:8004", Priority: PriorityBulk, Rate: 1 << 20}, nil)
+	if echoed := p.roundTrip(t, "hello"); echoed != "rewritten" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+}
+
+func TestExecPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("policy script needs sh")
+	}
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// request is on stdin
+	saved := filepath.Join(dir, "request")
+	p, err := newExecPolicy(script("deny", `cat > `+saved+`; echo '{"deny": true, "reason": "no way"}'`), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := p.Decide(context.Background(), PolicyRequest{Service: "ssh"})
+	if err != nil || !d.Deny || d.Reason != "no way" {
+		t.Fatalf("unexpected decision:%+v, %v", d, err)
+	}
+	if req, _ := os.ReadFile(saved); string(req) != `{"peer":"","service":"ssh"}` {
+		t.Fatalf("unexpected request:%s", req)
+	}
+
+	for _, body := range []string{"exit 1", "echo bad", "sleep 5"} {
+		p, err := newExecPolicy(script("fail", body), 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Decide(context.Background(), PolicyRequest{}); err == nil {
+			t.Fatalf("policy %q should fail", body)
+		}
+	}
+
+	if _, err := newExecPolicy(filepath.Join(dir, "missing"), time.Second); err == nil {
+		t.Fatal("missing policy command is accepted")
+	}
+}
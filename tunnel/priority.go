@@ -0,0 +1,56 @@
+//
+//   date  : 2015-09-24
+//   author: xjdrew
+//
+
+package tunnel
+
+// priority of links set by rule, frames of a higher class are written to
+// tunnel first, so interactive links stay responsive behind bulk transfers
+const (
+	PriorityInteractive = "interactive"
+	PriorityNormal      = "normal"
+	PriorityBulk        = "bulk"
+)
+
+// classes of frames, control frames are interactive
+const (
+	priorityNormal uint8 = iota
+	priorityInteractive
+	priorityBulk
+	priorityClasses
+)
+
+// classes in write order
+var priorityOrder = [priorityClasses]uint8{priorityInteractive, priorityNormal, priorityBulk}
+
+// write chan of each class
+type priorityChans [priorityClasses]chan Payload
+
+var priorities = map[string]uint8{
+	"":                  priorityNormal,
+	PriorityInteractive: priorityInteractive,
+	PriorityNormal:      priorityNormal,
+	PriorityBulk:        priorityBulk,
+}
+
+var priorityNames = [priorityClasses]string{
+	priorityNormal:      PriorityNormal,
+	priorityInteractive: PriorityInteractive,
+	priorityBulk:        PriorityBulk,
+}
+
+// rate limit of all bulk links of the hub in bytes per second, for each
+// direction; 0 means unlimited
+func (self *Hub) SetBulkRate(rate int64) {
+	self.bulkRate = newRateLimiters(rate)
+}
+
+// set priority of link, bulk links are also limited by hub bulk rate
+func (self *Link) setPriority(prio uint8) {
+	self.priority = prio
+	self.bulk = rateLimiters{}
+	if prio == priorityBulk {
+		self.bulk = self.hub.bulkRate
+	}
+}
@@ -0,0 +1,72 @@
+//
+//   date  : 2015-09-20
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// haproxy PROXY protocol, written to backend before link data, so backend
+// sees address of the original client instead of gotunnel server
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// src is ip:port of original client, dst is the backend. Both families are
+// mapped to ipv6 if they differ. An unknown source or backend is sent as
+// UNKNOWN in v1 and LOCAL in v2, so backend uses the real connection address.
+func proxyHeader(version int, src string, dst *net.TCPAddr) []byte {
+	var srcIP, dstIP net.IP
+	var srcPort int
+	if host, port, err := net.SplitHostPort(src); err == nil && dst != nil {
+		srcIP = net.ParseIP(host)
+		srcPort, _ = strconv.Atoi(port)
+		dstIP = dst.IP
+	}
+	v4 := srcIP.To4() != nil && dstIP.To4() != nil
+	if v4 {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else if srcIP != nil {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	if version == ProxyProtocolV1 {
+		if srcIP == nil {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		if v4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, srcPort, dst.Port))
+		}
+		// keep mapped ipv4 in ipv6 form
+		srcAddr := netip.AddrFrom16([16]byte(srcIP))
+		dstAddr := netip.AddrFrom16([16]byte(dstIP))
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", srcAddr, dstAddr, srcPort, dst.Port))
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	if srcIP == nil {
+		// LOCAL command, unspecified family
+		return append(header, 0x20, 0x00, 0, 0)
+	}
+	family := byte(0x21) // tcp over ipv6
+	if v4 {
+		family = 0x11 // tcp over ipv4
+	}
+	header = append(header, 0x21, family, 0, 0)
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(srcPort))
+	header = binary.BigEndian.AppendUint16(header, uint16(dst.Port))
+	binary.BigEndian.PutUint16(header[14:], uint16(len(header)-16))
+	return header
+}
@@ -0,0 +1,49 @@
+//
+//   date  : 2015-09-20
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}
+	cases := []struct {
+		src    string
+		header string
+	}{
+		{"192.168.1.1:5000", "PROXY TCP4 192.168.1.1 10.0.0.2 5000 80\r\n"},
+		{"[2001:db8::1]:5000", "PROXY TCP6 2001:db8::1 ::ffff:10.0.0.2 5000 80\r\n"},
+		{"", "PROXY UNKNOWN\r\n"},
+	}
+	for _, c := range cases {
+		if header := string(proxyHeader(ProxyProtocolV1, c.src, dst)); header != c.header {
+			t.Errorf("unexpected header:%q, want %q", header, c.header)
+		}
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}
+	header := proxyHeader(ProxyProtocolV2, "192.168.1.1:5000", dst)
+	expected := append([]byte{}, proxyV2Signature...)
+	expected = append(expected, 0x21, 0x11, 0, 12, 192, 168, 1, 1, 10, 0, 0, 2, 0x13, 0x88, 0, 80)
+	if !bytes.Equal(header, expected) {
+		t.Fatalf("unexpected header:%v", header)
+	}
+
+	header = proxyHeader(ProxyProtocolV2, "[2001:db8::1]:5000", dst)
+	if len(header) != 16+36 || header[13] != 0x21 || header[15] != 36 {
+		t.Fatalf("unexpected ipv6 header:%v", header)
+	}
+
+	header = proxyHeader(ProxyProtocolV2, "", dst)
+	if !bytes.Equal(header[12:], []byte{0x20, 0, 0, 0}) {
+		t.Fatalf("unexpected local header:%v", header)
+	}
+}
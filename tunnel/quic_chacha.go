@@ -0,0 +1,206 @@
+//
+//   date  : 2015-09-21
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// chacha20-poly1305 of rfc 8439, tls 1.3 may pick it for quic packets on
+// machines without aes instructions, and stdlib doesn't export one
+
+var errChaChaOpen = errors.New("chacha20poly1305: message authentication failed")
+
+// block of key stream at counter
+func chachaBlock(out *[64]byte, key *[8]uint32, counter uint32, nonce []byte) {
+	var s [16]uint32
+	s[0], s[1], s[2], s[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	copy(s[4:12], key[:])
+	s[12] = counter
+	s[13] = binary.LittleEndian.Uint32(nonce)
+	s[14] = binary.LittleEndian.Uint32(nonce[4:])
+	s[15] = binary.LittleEndian.Uint32(nonce[8:])
+	x := s
+	qr := func(a, b, c, d int) {
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+	}
+	for i := 0; i < 10; i++ {
+		qr(0, 4, 8, 12)
+		qr(1, 5, 9, 13)
+		qr(2, 6, 10, 14)
+		qr(3, 7, 11, 15)
+		qr(0, 5, 10, 15)
+		qr(1, 6, 11, 12)
+		qr(2, 7, 8, 13)
+		qr(3, 4, 9, 14)
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[i*4:], x[i]+s[i])
+	}
+}
+
+func chachaKey(key []byte) *[8]uint32 {
+	var k [8]uint32
+	for i := range k {
+		k[i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	return &k
+}
+
+// dst = src ^ key stream from counter, dst and src may overlap entirely
+func chachaXOR(dst, src []byte, key *[8]uint32, counter uint32, nonce []byte) {
+	var block [64]byte
+	for len(src) > 0 {
+		chachaBlock(&block, key, counter, nonce)
+		counter++
+		n := subtle.XORBytes(dst, src, block[:])
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+// poly1305 one-time authenticator, h is kept below 2^130 partially reduced
+type poly1305 struct {
+	h0, h1, h2 uint64
+	r0, r1     uint64
+	s0, s1     uint64
+}
+
+func newPoly1305(key []byte) *poly1305 {
+	return &poly1305{
+		r0: binary.LittleEndian.Uint64(key) & 0x0ffffffc0fffffff,
+		r1: binary.LittleEndian.Uint64(key[8:]) & 0x0ffffffc0ffffffc,
+		s0: binary.LittleEndian.Uint64(key[16:]),
+		s1: binary.LittleEndian.Uint64(key[24:]),
+	}
+}
+
+// blocks of msg, the last one is padded by zeros as aead does
+func (p *poly1305) update(msg []byte) {
+	h0, h1, h2 := p.h0, p.h1, p.h2
+	for len(msg) > 0 {
+		var block [16]byte
+		n := copy(block[:], msg)
+		msg = msg[n:]
+		var c uint64
+		h0, c = bits.Add64(h0, binary.LittleEndian.Uint64(block[:]), 0)
+		h1, c = bits.Add64(h1, binary.LittleEndian.Uint64(block[8:]), c)
+		h2 += c + 1
+
+		// h * r, h2 is small and top bits of r are clear, so no product of
+		// them overflows 128 bits
+		m0h, m0l := bits.Mul64(h0, p.r0)
+		a1h, a1l := bits.Mul64(h1, p.r0)
+		b1h, b1l := bits.Mul64(h0, p.r1)
+		m1l, c := bits.Add64(a1l, b1l, 0)
+		m1h, _ := bits.Add64(a1h, b1h, c)
+		a2h, a2l := bits.Mul64(h2, p.r0)
+		b2h, b2l := bits.Mul64(h1, p.r1)
+		m2l, c := bits.Add64(a2l, b2l, 0)
+		m2h, _ := bits.Add64(a2h, b2h, c)
+		_, m3l := bits.Mul64(h2, p.r1)
+
+		t0 := m0l
+		t1, c := bits.Add64(m1l, m0h, 0)
+		t2, c := bits.Add64(m2l, m1h, c)
+		t3, _ := bits.Add64(m3l, m2h, c)
+
+		// bits above 130 times 5 are folded in, 2^130 = 5 mod p
+		h0, h1, h2 = t0, t1, t2&3
+		cl, ch := t2&^3, t3
+		h0, c = bits.Add64(h0, cl, 0)
+		h1, c = bits.Add64(h1, ch, c)
+		h2 += c
+		cl, ch = cl>>2|ch<<62, ch>>2
+		h0, c = bits.Add64(h0, cl, 0)
+		h1, c = bits.Add64(h1, ch, c)
+		h2 += c
+	}
+	p.h0, p.h1, p.h2 = h0, h1, h2
+}
+
+func (p *poly1305) sum(out []byte) {
+	h0, h1, h2 := p.h0, p.h1, p.h2
+	// h - p, kept if it doesn't borrow
+	t0, b := bits.Sub64(h0, 0xfffffffffffffffb, 0)
+	t1, b := bits.Sub64(h1, 0xffffffffffffffff, b)
+	_, b = bits.Sub64(h2, 3, b)
+	if b == 0 {
+		h0, h1 = t0, t1
+	}
+	h0, c := bits.Add64(h0, p.s0, 0)
+	h1, _ = bits.Add64(h1, p.s1, c)
+	binary.LittleEndian.PutUint64(out, h0)
+	binary.LittleEndian.PutUint64(out[8:], h1)
+}
+
+type chacha20poly1305 struct {
+	key *[8]uint32
+}
+
+func newChaCha20Poly1305(key []byte) cipher.AEAD {
+	return &chacha20poly1305{key: chachaKey(key)}
+}
+
+func (c *chacha20poly1305) NonceSize() int { return 12 }
+func (c *chacha20poly1305) Overhead() int  { return 16 }
+
+func (c *chacha20poly1305) tag(out, nonce, ciphertext, aad []byte) {
+	var block [64]byte
+	chachaBlock(&block, c.key, 0, nonce)
+	p := newPoly1305(block[:32])
+	p.update(aad)
+	p.update(ciphertext)
+	var lens [16]byte
+	binary.LittleEndian.PutUint64(lens[:], uint64(len(aad)))
+	binary.LittleEndian.PutUint64(lens[8:], uint64(len(ciphertext)))
+	p.update(lens[:])
+	p.sum(out)
+}
+
+func (c *chacha20poly1305) Seal(dst, nonce, plaintext, aad []byte) []byte {
+	ret, out := sliceForAppend(dst, len(plaintext)+16)
+	chachaXOR(out, plaintext, c.key, 1, nonce)
+	c.tag(out[len(plaintext):], nonce, out[:len(plaintext)], aad)
+	return ret
+}
+
+func (c *chacha20poly1305) Open(dst, nonce, ciphertext, aad []byte) ([]byte, error) {
+	if len(ciphertext) < 16 {
+		return nil, errChaChaOpen
+	}
+	tag := ciphertext[len(ciphertext)-16:]
+	ciphertext = ciphertext[:len(ciphertext)-16]
+	var want [16]byte
+	c.tag(want[:], nonce, ciphertext, aad)
+	if subtle.ConstantTimeCompare(want[:], tag) != 1 {
+		return nil, errChaChaOpen
+	}
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	chachaXOR(out, ciphertext, c.key, 1, nonce)
+	return ret, nil
+}
+
+// dst extended by n bytes, and the extension
+func sliceForAppend(dst []byte, n int) (ret, tail []byte) {
+	if total := len(dst) + n; cap(dst) >= total {
+		ret = dst[:total]
+	} else {
+		ret = make([]byte, total)
+		copy(ret, dst)
+	}
+	return ret, ret[len(dst):]
+}
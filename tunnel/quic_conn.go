@@ -0,0 +1,1593 @@
+//
+//   date  : 2015-09-21
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	quicALPN       = "gotunnel"
+	quicWindow     = 4 << 20          // receive window of stream and conn
+	quicSendBuffer = 4 << 20          // bytes written but not acked, Write waits beyond it
+	quicKeepalive  = 5 * time.Second  // a ping is sent if nothing is sent
+	quicIdle       = 30 * time.Second // session dies without packets of peer
+	quicLinger     = 10 * time.Second // max time closed session flushes data
+
+	quicAckDelay     = 25 * time.Millisecond // max delay of acks of 1-rtt packets
+	quicInitialRTT   = 333 * time.Millisecond
+	quicMinWindow    = 2 * quicMaxSize
+	quicInitWindow   = 10 * quicMaxSize
+	quicPacketThresh = 3
+)
+
+var (
+	errQUICUnreachable = errors.New("quic: peer is unreachable")
+	errQUICReset       = errors.New("quic: closed by peer")
+)
+
+// error of CONNECTION_CLOSE of peer, or one sent for a violation of peer
+type quicError struct {
+	code   uint64
+	reason string
+}
+
+func (e *quicError) Error() string {
+	return fmt.Sprintf("quic: error %#x: %s", e.code, e.reason)
+}
+
+// quic carries a tunnel by a bidirectional stream of a quic connection, tls
+// 1.3 of the connection replaces tls of the tunnel
+type quicTransport struct {
+	app *App
+}
+
+func newQUICTransport(app *App) Transport {
+	return &quicTransport{app: app}
+}
+
+// tls config of tunnel for quic, server is address dialed by client
+func (t *quicTransport) tlsConfig(server string) (*tls.Config, error) {
+	config := t.app.tlsConfig.Clone()
+	config.MinVersion = tls.VersionTLS13
+	config.NextProtos = []string{quicALPN}
+	if server != "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	return config, nil
+}
+
+func (t *quicTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	config, err := t.tlsConfig(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.app.dialTunnel(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := newQUICConn(conn.(*net.UDPConn), conn.RemoteAddr().(*net.UDPAddr), nil, quicCID())
+	c.mu.Lock()
+	c.startTLS(tls.QUICClient(&tls.QUICConfig{TLSConfig: config}))
+	c.mu.Unlock()
+	go c.readLoop()
+	return c, nil
+}
+
+func (t *quicTransport) Listen() (net.Listener, error) {
+	config, err := t.tlsConfig("")
+	if err != nil {
+		return nil, err
+	}
+	laddr := t.app.laddr
+	conn, err := listenUDP(&net.UDPAddr{IP: laddr.IP, Port: laddr.Port, Zone: laddr.Zone})
+	if err != nil {
+		return nil, err
+	}
+	ln := &quicListener{
+		conn:     conn,
+		config:   config,
+		conns:    make(map[string]*quicConn),
+		accepted: make(chan *quicConn, 128),
+		done:     make(chan struct{}),
+	}
+	go ln.serve()
+	return ln, nil
+}
+
+// wait for quic handshake, which started when conn is dialed or accepted
+func (t *quicTransport) Handshake(conn net.Conn, server string) (net.Conn, error) {
+	c := conn.(*quicConn)
+	for {
+		c.mu.Lock()
+		if c.werr != nil {
+			c.mu.Unlock()
+			return nil, c.werr
+		}
+		if c.established {
+			c.mu.Unlock()
+			return c, nil
+		}
+		deadline := c.rdeadline
+		c.mu.Unlock()
+		if !waitDeadline(c.readable, c.released, deadline) {
+			return nil, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func quicCID() []byte {
+	cid := make([]byte, quicCIDLen)
+	rand.Read(cid)
+	return cid
+}
+
+// an ack-eliciting packet sent and not acked or lost yet, counted in flight
+type quicSent struct {
+	pn     uint64
+	time   time.Time
+	size   int
+	frames []quicFrame
+}
+
+// frame of a sent packet, to resend if the packet is lost
+type quicFrame struct {
+	kind uint8 // quicFrameCrypto, quicFrameStream, quicFrameMaxData or quicFrameHandshakeDone
+	off  uint64
+	n    int
+	fin  bool
+}
+
+// chunk of crypto or stream data received out of order
+type quicChunk struct {
+	off  uint64
+	data []byte
+}
+
+// packet number space
+type quicSpace struct {
+	seal, open *quicKeys
+	discarded  bool
+
+	next          uint64      // packet number to send
+	sent          []*quicSent // by pn
+	largestAcked  int64
+	lossTime      time.Time // time to declare a packet lost, zero if none
+	lastEliciting time.Time // last ack-eliciting packet sent
+
+	recv        quicRanges // packet numbers received
+	largestRecv int64
+	recvTime    time.Time // when largestRecv is received
+	ackPending  bool      // ack-eliciting packets received since last ack
+	ackDeadline time.Time
+
+	cryptoOut  []byte      // crypto data written by tls, from offset 0
+	cryptoSent uint64      // next new offset to send
+	cryptoLost []quicFrame // to resend
+	cryptoNext uint64      // next offset to pass to tls
+	cryptoIn   []quicChunk
+}
+
+func newQUICSpace() *quicSpace {
+	return &quicSpace{largestAcked: -1, largestRecv: -1}
+}
+
+// a quic connection of one bidirectional stream, as a net.Conn. Client owns
+// its connected socket, conns of server share the listener's
+type quicConn struct {
+	mu       sync.Mutex
+	conn     *net.UDPConn
+	raddr    *net.UDPAddr
+	ln       *quicListener // nil of client
+	server   bool
+	tls      *tls.QUICConn
+	scid     []byte // chosen by this end
+	dcid     []byte // chosen by peer
+	odcid    []byte // first destination id of client, keys of initial packets
+	spaces   [quicSpaces]*quicSpace
+	peer     *quicParams
+	resolved bool // dcid is chosen by peer
+
+	established bool // tls handshake is done
+	confirmed   bool // handshake is confirmed, handshake keys are dropped
+	validated   bool // address of client is validated, server only
+	recvBytes   int  // bytes received before validated
+	sentBytes   int  // bytes sent before validated
+	handshakeOK bool // server sends HANDSHAKE_DONE
+	pathResp    []byte
+
+	// key update is started by peer only
+	keyPhase   bool
+	phaseStart uint64    // first packet number of key phase
+	prevOpen   *quicKeys // keys of previous phase, nil if none
+
+	// loss recovery and congestion control of rfc 9002, new reno
+	srtt, rttvar, minRTT time.Duration
+	hasRTT               bool
+	ptoCount             int
+	probe                [quicSpaces]bool
+	cwnd, ssthresh       int
+	inFlight             int
+	recovery             time.Time // packets sent before it don't reduce cwnd again
+
+	// stream 0, opened by client
+	streamOpen bool   // server: client opened the stream, client: opening is acked
+	openSent   bool   // client: an empty frame opening the stream is in flight
+	sbuf       []byte // bytes from sbase not acked
+	sbase      uint64
+	snext      uint64 // next new offset to send
+	slost      []quicFrame
+	sacked     []quicRange // acked ranges above sbase, hi exclusive
+	maxData    uint64      // flow control limits of peer, of conn and stream
+	maxStream  uint64
+	finQueued  bool
+	finSent    bool
+	finAcked   bool
+
+	rbuf      []byte // bytes ready to read
+	rnext     uint64 // next offset expected
+	rpend     []quicChunk
+	rfin      int64  // final size, -1 if unknown
+	rmax      uint64 // flow control limit advertised
+	rconsumed uint64 // bytes read
+	maxSent   bool   // MAX_DATA is pending
+
+	readable chan struct{} // notified when data arrives, state or deadline changes
+	writable chan struct{} // notified when send buffer drains, state or deadline changes
+	wake     chan struct{} // notified to send and rearm timer
+	released chan struct{} // closed when session is gone
+
+	rdeadline, wdeadline time.Time
+	rerr, werr           error      // set once session is broken or closed
+	closed               bool       // Close is called
+	closing              *quicError // CONNECTION_CLOSE to send
+	closeSent            bool
+	draining             bool      // peer closed the connection
+	lingerUntil          time.Time // closed session is released then at latest
+	lastRecv, lastSend   time.Time
+}
+
+func newQUICConn(conn *net.UDPConn, raddr *net.UDPAddr, ln *quicListener, dcid []byte) *quicConn {
+	c := &quicConn{
+		conn:     conn,
+		raddr:    raddr,
+		ln:       ln,
+		server:   ln != nil,
+		scid:     quicCID(),
+		dcid:     dcid,
+		odcid:    dcid,
+		cwnd:     quicInitWindow,
+		ssthresh: 1 << 62,
+		rfin:     -1,
+		rmax:     quicWindow,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		wake:     make(chan struct{}, 1),
+		released: make(chan struct{}),
+		lastRecv: time.Now(),
+		lastSend: time.Now(),
+	}
+	for i := range c.spaces {
+		c.spaces[i] = newQUICSpace()
+	}
+	initial := c.spaces[quicSpaceInitial]
+	initial.seal, initial.open = quicInitialKeys(dcid, c.server)
+	// client's address is validated once it answers in handshake packets
+	c.validated = !c.server
+	go c.run()
+	return c
+}
+
+// start tls handshake, called with lock held
+func (c *quicConn) startTLS(t *tls.QUICConn) {
+	c.tls = t
+	params := &quicParams{
+		srcCID:      c.scid,
+		idleTimeout: uint64(quicIdle / time.Millisecond),
+		maxData:     quicWindow,
+		streamLocal: quicWindow,
+		streamPeer:  quicWindow,
+	}
+	if c.server {
+		params.originalCID = c.odcid
+		params.streamsBidi = 1
+	}
+	t.SetTransportParameters(params.encode())
+	if err := t.Start(context.Background()); err != nil {
+		c.closeWith(quicTLSError(err))
+		return
+	}
+	c.tlsEvents()
+	c.flush(time.Now())
+}
+
+func quicTLSError(err error) *quicError {
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		return &quicError{code: quicCryptoError + uint64(alert), reason: err.Error()}
+	}
+	return &quicError{code: quicInternalError, reason: err.Error()}
+}
+
+func quicLevelSpace(level tls.QUICEncryptionLevel) int {
+	switch level {
+	case tls.QUICEncryptionLevelInitial:
+		return quicSpaceInitial
+	case tls.QUICEncryptionLevelHandshake:
+		return quicSpaceHandshake
+	}
+	return quicSpaceApp
+}
+
+// events of tls, called with lock held
+func (c *quicConn) tlsEvents() {
+	for c.closing == nil {
+		e := c.tls.NextEvent()
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			if e.Level == tls.QUICEncryptionLevelEarly {
+				continue
+			}
+			keys, err := newQUICKeys(e.Suite, e.Data)
+			if err != nil {
+				c.closeWith(&quicError{code: quicInternalError, reason: err.Error()})
+				return
+			}
+			s := c.spaces[quicLevelSpace(e.Level)]
+			if e.Kind == tls.QUICSetReadSecret {
+				s.open = keys
+			} else {
+				s.seal = keys
+			}
+		case tls.QUICWriteData:
+			s := c.spaces[quicLevelSpace(e.Level)]
+			s.cryptoOut = append(s.cryptoOut, e.Data...)
+		case tls.QUICTransportParameters:
+			p, err := parseQUICParams(e.Data)
+			if err == nil && !c.server && !bytes.Equal(p.originalCID, c.odcid) {
+				err = errors.New("quic: original connection id mismatch")
+			}
+			if err != nil {
+				c.closeWith(&quicError{code: quicProtocolError, reason: err.Error()})
+				return
+			}
+			c.peer = p
+			c.maxData = p.maxData
+			c.maxStream = p.streamPeer
+			if c.server {
+				// stream is opened by client
+				c.maxStream = p.streamLocal
+			}
+		case tls.QUICHandshakeDone:
+			c.established = true
+			if c.server {
+				c.handshakeOK = true
+				c.confirm()
+			}
+			notify(c.readable)
+			notify(c.writable)
+		}
+	}
+}
+
+// handshake is confirmed, handshake keys are dropped
+func (c *quicConn) confirm() {
+	c.confirmed = true
+	c.discard(quicSpaceInitial)
+	c.discard(quicSpaceHandshake)
+}
+
+// drop keys and packets in flight of space
+func (c *quicConn) discard(space int) {
+	s := c.spaces[space]
+	if s.discarded {
+		return
+	}
+	for _, p := range s.sent {
+		c.inFlight -= p.size
+	}
+	*s = quicSpace{discarded: true, largestAcked: -1, largestRecv: -1}
+	c.ptoCount = 0
+}
+
+// close connection for err, peer is told
+func (c *quicConn) closeWith(err *quicError) {
+	if c.closing != nil || c.draining {
+		return
+	}
+	c.closing = err
+	c.fail(err, err)
+}
+
+// session is broken, called with lock held
+func (c *quicConn) fail(rerr, werr error) {
+	if c.rerr == nil {
+		c.rerr = rerr
+	}
+	if c.werr == nil {
+		c.werr = werr
+	}
+	notify(c.readable)
+	notify(c.writable)
+	notify(c.wake)
+}
+
+// datagram of peer from addr
+func (c *quicConn) input(p []byte, addr *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining || c.closeSent {
+		return
+	}
+	if !c.validated {
+		c.recvBytes += len(p)
+	}
+	now := time.Now()
+	for len(p) > 0 {
+		var rest []byte
+		var err error
+		if p[0]&0x80 != 0 {
+			rest, err = c.inputLong(p, addr, now)
+		} else {
+			err = c.inputShort(p, addr, now)
+		}
+		if err != nil {
+			break
+		}
+		p = rest
+	}
+	c.flush(now)
+	notify(c.wake)
+}
+
+// long header packet at head of datagram p, rest of p is returned
+func (c *quicConn) inputLong(p []byte, addr *net.UDPAddr, now time.Time) ([]byte, error) {
+	r := &quicReader{b: p[1:]}
+	version := binary.BigEndian.Uint32(r.bytes(4))
+	dcid := r.bytes(uint64(r.byte()))
+	scid := r.bytes(uint64(r.byte()))
+	if r.err || version != quicVersion {
+		return nil, errQUICPacket
+	}
+	var space int
+	switch typ := p[0] >> 4 & 0x03; typ {
+	case quicPacketInitial:
+		space = quicSpaceInitial
+		r.bytes(r.varint())
+	case quicPacketHandshake:
+		space = quicSpaceHandshake
+	default:
+		// 0-rtt isn't sent, nor retry by server
+		return nil, errQUICPacket
+	}
+	length := r.varint()
+	if r.err || uint64(len(r.b)) < length {
+		return nil, errQUICPacket
+	}
+	pnOffset := len(p) - len(r.b)
+	pkt, rest := p[:pnOffset+int(length)], p[pnOffset+int(length):]
+	if !bytes.Equal(dcid, c.scid) && !bytes.Equal(dcid, c.odcid) {
+		return rest, nil
+	}
+	if !c.process(space, pkt, pnOffset, addr, now) {
+		return rest, nil
+	}
+	if !c.resolved {
+		// client sends to id chosen by server from then on, and server
+		// answers to id of client
+		c.dcid = append([]byte(nil), scid...)
+		c.resolved = true
+	}
+	if c.server && space == quicSpaceHandshake && !c.validated {
+		c.validated = true
+		c.discard(quicSpaceInitial)
+	}
+	return rest, nil
+}
+
+func (c *quicConn) inputShort(p []byte, addr *net.UDPAddr, now time.Time) error {
+	if len(p) < 1+quicCIDLen || !bytes.Equal(p[1:1+quicCIDLen], c.scid) {
+		return errQUICPacket
+	}
+	c.process(quicSpaceApp, p, 1+quicCIDLen, addr, now)
+	return nil
+}
+
+// open packet pkt of space and handle its frames, false if it's dropped
+func (c *quicConn) process(space int, pkt []byte, pnOffset int, addr *net.UDPAddr, now time.Time) bool {
+	s := c.spaces[space]
+	if s.open == nil || s.discarded {
+		return false
+	}
+	pn, hdrLen, err := s.open.unprotect(pkt, pnOffset, s.largestRecv)
+	if err != nil {
+		return false
+	}
+	keys := s.open
+	update := space == quicSpaceApp && (pkt[0]&0x04 != 0) != c.keyPhase
+	if update {
+		// a packet of previous phase is reordered, or peer updates keys
+		if c.prevOpen != nil && pn < c.phaseStart {
+			keys, update = c.prevOpen, false
+		} else {
+			keys = s.open.next()
+		}
+	}
+	payload, err := keys.decrypt(pkt, hdrLen, pn)
+	if err != nil {
+		return false
+	}
+	if update {
+		// keys of this end follow those of peer
+		c.prevOpen, s.open, s.seal = s.open, keys, s.seal.next()
+		c.keyPhase = !c.keyPhase
+		c.phaseStart = pn
+	}
+	if !s.recv.add(pn) {
+		return false
+	}
+	if int64(pn) > s.largestRecv {
+		s.largestRecv = int64(pn)
+		s.recvTime = now
+		// peer moved to another address, such as rebinding of nat
+		if c.server && space == quicSpaceApp && addr.String() != c.raddr.String() {
+			c.raddr = addr
+		}
+	}
+	c.lastRecv = now
+	eliciting, err := c.frames(space, payload, now)
+	if err != nil {
+		var qe *quicError
+		if !errors.As(err, &qe) {
+			qe = &quicError{code: quicFrameEncoding, reason: err.Error()}
+		}
+		c.closeWith(qe)
+		return true
+	}
+	if eliciting {
+		if !s.ackPending {
+			s.ackDeadline = now
+			if space == quicSpaceApp {
+				s.ackDeadline = now.Add(quicAckDelay)
+			}
+		}
+		s.ackPending = true
+	}
+	return true
+}
+
+// frames of payload of a packet, true if it's ack-eliciting
+func (c *quicConn) frames(space int, payload []byte, now time.Time) (bool, error) {
+	r := &quicReader{b: payload}
+	eliciting := false
+	violation := func(reason string) (bool, error) {
+		return false, &quicError{code: quicProtocolError, reason: reason}
+	}
+	for len(r.b) > 0 && !r.err {
+		typ := r.varint()
+		if typ != quicFramePadding && typ != quicFrameAck && typ != quicFrameAckECN && typ != quicFrameClose && typ != quicFrameCloseApp {
+			eliciting = true
+		}
+		if space != quicSpaceApp {
+			switch typ {
+			case quicFramePadding, quicFramePing, quicFrameAck, quicFrameAckECN, quicFrameCrypto, quicFrameClose:
+			default:
+				return violation(fmt.Sprintf("frame %#x in handshake", typ))
+			}
+		}
+		switch {
+		case typ == quicFramePadding, typ == quicFramePing:
+		case typ == quicFrameAck, typ == quicFrameAckECN:
+			rs, delay := readAck(r, typ == quicFrameAckECN)
+			if !r.err {
+				c.onAck(space, rs, time.Duration(delay)*time.Microsecond, now)
+			}
+		case typ == quicFrameResetStream:
+			r.varint()
+			r.varint()
+			r.varint()
+			c.fail(errQUICReset, errQUICReset)
+		case typ == quicFrameStopSending:
+			r.varint()
+			r.varint()
+			if c.werr == nil {
+				c.werr = errQUICReset
+			}
+			notify(c.writable)
+		case typ == quicFrameCrypto:
+			off := r.varint()
+			data := r.bytes(r.varint())
+			if !r.err {
+				c.onCrypto(space, off, data)
+			}
+		case typ == quicFrameNewToken:
+			r.bytes(r.varint())
+		case typ >= quicFrameStream && typ <= quicFrameStream|0x07:
+			id := r.varint()
+			var off uint64
+			if typ&quicStreamOff != 0 {
+				off = r.varint()
+			}
+			var data []byte
+			if typ&quicStreamLen != 0 {
+				data = r.bytes(r.varint())
+			} else {
+				data = r.bytes(uint64(len(r.b)))
+			}
+			if r.err {
+				break
+			}
+			if id != 0 {
+				return violation(fmt.Sprintf("stream %d isn't allowed", id))
+			}
+			if err := c.onStream(off, data, typ&quicStreamFin != 0); err != nil {
+				return false, err
+			}
+		case typ == quicFrameMaxData:
+			c.maxData = max(c.maxData, r.varint())
+			notify(c.writable)
+		case typ == quicFrameMaxStreamData:
+			r.varint()
+			c.maxStream = max(c.maxStream, r.varint())
+			notify(c.writable)
+		case typ == quicFrameMaxStreamsBidi, typ == quicFrameMaxStreamsUni,
+			typ == quicFrameDataBlocked, typ == quicFrameStreamsBlocked, typ == quicFrameStreamsBlocked+1,
+			typ == quicFrameRetireCID:
+			r.varint()
+		case typ == quicFrameStreamBlocked:
+			r.varint()
+			r.varint()
+		case typ == quicFrameNewCID:
+			r.varint()
+			r.varint()
+			r.bytes(uint64(r.byte()))
+			r.bytes(16)
+		case typ == quicFramePathChallenge:
+			c.pathResp = append([]byte(nil), r.bytes(8)...)
+		case typ == quicFramePathResponse:
+			r.bytes(8)
+		case typ == quicFrameClose, typ == quicFrameCloseApp:
+			code := r.varint()
+			if typ == quicFrameClose {
+				r.varint()
+			}
+			reason := r.bytes(r.varint())
+			if r.err {
+				break
+			}
+			c.draining = true
+			if code == quicNoError {
+				c.fail(io.EOF, errQUICReset)
+			} else {
+				err := &quicError{code: code, reason: string(reason)}
+				c.fail(err, err)
+			}
+			return false, nil
+		case typ == quicFrameHandshakeDone:
+			if c.server {
+				return violation("handshake done from client")
+			}
+			if !c.confirmed {
+				c.confirm()
+			}
+		default:
+			return violation(fmt.Sprintf("unknown frame %#x", typ))
+		}
+	}
+	if r.err {
+		return false, errQUICPacket
+	}
+	return eliciting, nil
+}
+
+func (c *quicConn) onCrypto(space int, off uint64, data []byte) {
+	s := c.spaces[space]
+	if end := off + uint64(len(data)); end <= s.cryptoNext {
+		return
+	}
+	s.cryptoIn = quicInsert(s.cryptoIn, off, data)
+	var ready []byte
+	ready, s.cryptoNext, s.cryptoIn = quicAssemble(nil, s.cryptoNext, s.cryptoIn)
+	if len(ready) == 0 {
+		return
+	}
+	level := tls.QUICEncryptionLevelInitial
+	switch space {
+	case quicSpaceHandshake:
+		level = tls.QUICEncryptionLevelHandshake
+	case quicSpaceApp:
+		level = tls.QUICEncryptionLevelApplication
+	}
+	if err := c.tls.HandleData(level, ready); err != nil {
+		c.closeWith(quicTLSError(err))
+		return
+	}
+	c.tlsEvents()
+}
+
+// insert a copy of chunk of data at off, chunks are by offset
+func quicInsert(chunks []quicChunk, off uint64, data []byte) []quicChunk {
+	i := sort.Search(len(chunks), func(i int) bool { return chunks[i].off >= off })
+	if i < len(chunks) && chunks[i].off == off {
+		if len(chunks[i].data) < len(data) {
+			chunks[i].data = append([]byte(nil), data...)
+		}
+		return chunks
+	}
+	chunks = append(chunks, quicChunk{})
+	copy(chunks[i+1:], chunks[i:])
+	chunks[i] = quicChunk{off: off, data: append([]byte(nil), data...)}
+	return chunks
+}
+
+// append data of chunks from next to out, return out, next offset and
+// chunks left
+func quicAssemble(out []byte, next uint64, chunks []quicChunk) ([]byte, uint64, []quicChunk) {
+	for len(chunks) > 0 && chunks[0].off <= next {
+		ch := chunks[0]
+		if end := ch.off + uint64(len(ch.data)); end > next {
+			out = append(out, ch.data[next-ch.off:]...)
+			next = end
+		}
+		chunks = chunks[1:]
+	}
+	return out, next, chunks
+}
+
+func (c *quicConn) onStream(off uint64, data []byte, fin bool) error {
+	end := off + uint64(len(data))
+	if end > c.rmax {
+		return &quicError{code: quicFlowControlError, reason: "stream data beyond limit"}
+	}
+	if c.rfin >= 0 && (end > uint64(c.rfin) || fin && end != uint64(c.rfin)) || fin && end < c.rnext {
+		return &quicError{code: quicFinalSizeError, reason: "final size changed"}
+	}
+	if fin {
+		c.rfin = int64(end)
+	}
+	c.streamOpen = true
+	if end > c.rnext {
+		c.rpend = quicInsert(c.rpend, off, data)
+		n := len(c.rbuf)
+		c.rbuf, c.rnext, c.rpend = quicAssemble(c.rbuf, c.rnext, c.rpend)
+		if len(c.rbuf) == n && !fin {
+			return nil
+		}
+	}
+	notify(c.readable)
+	return nil
+}
+
+// ack of packets of space by peer
+func (c *quicConn) onAck(space int, rs quicRanges, delay time.Duration, now time.Time) {
+	s := c.spaces[space]
+	largest := rs[0].hi
+	if largest >= s.next {
+		c.closeWith(&quicError{code: quicProtocolError, reason: "ack of packet unsent"})
+		return
+	}
+	var newest *quicSent
+	kept := s.sent[:0]
+	for _, p := range s.sent {
+		if !rs.contains(p.pn) {
+			kept = append(kept, p)
+			continue
+		}
+		if p.pn == largest {
+			newest = p
+		}
+		c.acked(p)
+	}
+	clear(s.sent[len(kept):])
+	s.sent = kept
+	if int64(largest) > s.largestAcked {
+		s.largestAcked = int64(largest)
+	}
+	if newest != nil {
+		c.updateRTT(now.Sub(newest.time), delay, space == quicSpaceApp)
+	}
+	c.ptoCount = 0
+	c.detectLoss(space, now)
+	notify(c.writable)
+}
+
+func (c *quicConn) updateRTT(latest, delay time.Duration, app bool) {
+	if !c.hasRTT {
+		c.hasRTT = true
+		c.minRTT, c.srtt, c.rttvar = latest, latest, latest/2
+		return
+	}
+	c.minRTT = min(c.minRTT, latest)
+	if !app {
+		delay = 0
+	}
+	delay = min(delay, quicAckDelay)
+	if latest-delay >= c.minRTT {
+		latest -= delay
+	}
+	diff := c.srtt - latest
+	if diff < 0 {
+		diff = -diff
+	}
+	c.rttvar = (3*c.rttvar + diff) / 4
+	c.srtt = (7*c.srtt + latest) / 8
+}
+
+// packet is acked, its frames are done
+func (c *quicConn) acked(p *quicSent) {
+	c.inFlight -= p.size
+	if p.time.After(c.recovery) {
+		if c.cwnd < c.ssthresh {
+			c.cwnd += p.size
+		} else {
+			c.cwnd += quicMaxSize * p.size / c.cwnd
+		}
+	}
+	for _, f := range p.frames {
+		if f.kind != quicFrameStream {
+			continue
+		}
+		if f.off == 0 && f.n == 0 && !f.fin {
+			c.streamOpen = true
+			continue
+		}
+		c.streamAcked(f)
+	}
+}
+
+// data of frame is acked, sbuf is cut up to contiguous acked data
+func (c *quicConn) streamAcked(f quicFrame) {
+	if f.fin {
+		c.finAcked = true
+	}
+	lo, hi := f.off, f.off+uint64(f.n)
+	if hi <= c.sbase {
+		return
+	}
+	lo = max(lo, c.sbase)
+	i := sort.Search(len(c.sacked), func(i int) bool { return c.sacked[i].hi >= lo })
+	j := i
+	for j < len(c.sacked) && c.sacked[j].lo <= hi {
+		lo, hi = min(lo, c.sacked[j].lo), max(hi, c.sacked[j].hi)
+		j++
+	}
+	c.sacked = append(c.sacked[:i], append([]quicRange{{lo, hi}}, c.sacked[j:]...)...)
+	if first := c.sacked[0]; first.lo <= c.sbase {
+		c.sbuf = c.sbuf[first.hi-c.sbase:]
+		c.sbase = first.hi
+		c.sacked = c.sacked[1:]
+		notify(c.writable)
+	}
+}
+
+// lost packets of space are declared by packet and time threshold
+func (c *quicConn) detectLoss(space int, now time.Time) {
+	s := c.spaces[space]
+	s.lossTime = time.Time{}
+	if s.largestAcked < 0 {
+		return
+	}
+	rtt := quicInitialRTT
+	if c.hasRTT {
+		rtt = max(c.srtt, c.minRTT)
+	}
+	delay := max(rtt*9/8, time.Millisecond)
+	kept := s.sent[:0]
+	var lost *quicSent
+	for _, p := range s.sent {
+		if int64(p.pn) > s.largestAcked {
+			kept = append(kept, p)
+			continue
+		}
+		if int64(p.pn)+quicPacketThresh <= s.largestAcked || !now.Before(p.time.Add(delay)) {
+			c.lost(space, p)
+			lost = p
+			continue
+		}
+		if t := p.time.Add(delay); s.lossTime.IsZero() || t.Before(s.lossTime) {
+			s.lossTime = t
+		}
+		kept = append(kept, p)
+	}
+	clear(s.sent[len(kept):])
+	s.sent = kept
+	// one reduction of cwnd for losses of a round trip
+	if lost != nil && lost.time.After(c.recovery) {
+		c.recovery = now
+		c.ssthresh = max(c.cwnd/2, quicMinWindow)
+		c.cwnd = c.ssthresh
+	}
+}
+
+// frames of packet p are sent again
+func (c *quicConn) lost(space int, p *quicSent) {
+	c.inFlight -= p.size
+	s := c.spaces[space]
+	for _, f := range p.frames {
+		switch f.kind {
+		case quicFrameCrypto:
+			s.cryptoLost = append(s.cryptoLost, f)
+		case quicFrameStream:
+			if f.off == 0 && f.n == 0 && !f.fin {
+				c.openSent = false
+			} else {
+				c.slost = append(c.slost, f)
+				if f.fin {
+					c.finSent = false
+				}
+			}
+		case quicFrameMaxData:
+			c.maxSent = false
+		case quicFrameHandshakeDone:
+			c.handshakeOK = true
+		}
+	}
+}
+
+// probe timeout of rfc 9002, earliest of spaces with packets in flight
+func (c *quicConn) ptoTime() (time.Time, int) {
+	rtt, rttvar := quicInitialRTT, quicInitialRTT/2
+	if c.hasRTT {
+		rtt, rttvar = c.srtt, c.rttvar
+	}
+	base := (rtt + max(4*rttvar, time.Millisecond)) << min(c.ptoCount, 6)
+	var at time.Time
+	space := -1
+	for i, s := range c.spaces {
+		if s.discarded || s.seal == nil {
+			continue
+		}
+		if i == quicSpaceApp && !c.established {
+			break
+		}
+		// client keeps probing until handshake is confirmed, so server
+		// isn't stuck by amplification limit
+		if len(s.sent) == 0 && (c.server || c.confirmed || i == quicSpaceApp) {
+			continue
+		}
+		last := s.lastEliciting
+		if last.IsZero() {
+			last = c.lastSend
+		}
+		t := last.Add(base)
+		if i == quicSpaceApp {
+			t = t.Add(quicAckDelay << min(c.ptoCount, 6))
+		}
+		if at.IsZero() || t.Before(at) {
+			at, space = t, i
+		}
+	}
+	return at, space
+}
+
+// handle timers, called with lock held
+func (c *quicConn) onTimer(now time.Time) {
+	for i, s := range c.spaces {
+		if !s.lossTime.IsZero() && !now.Before(s.lossTime) {
+			c.detectLoss(i, now)
+		}
+	}
+	if at, space := c.ptoTime(); space >= 0 && !now.Before(at) {
+		c.ptoCount++
+		s := c.spaces[space]
+		for _, p := range s.sent {
+			c.lost(space, p)
+		}
+		clear(s.sent)
+		s.sent = s.sent[:0]
+		s.lastEliciting = now
+		c.probe[space] = true
+	}
+	if c.closed && !c.closeSent && c.closing == nil && !c.draining {
+		if !c.established || c.finAcked || now.After(c.lingerUntil) {
+			c.closing = &quicError{code: quicNoError}
+		}
+	}
+	if c.rerr == nil && now.Sub(c.lastRecv) >= c.idleTimeout() {
+		c.draining = true
+		c.fail(errQUICUnreachable, errQUICUnreachable)
+	}
+	if c.established && c.closing == nil && now.Sub(c.lastSend) >= quicKeepalive {
+		c.probe[quicSpaceApp] = true
+	}
+}
+
+// idle timeout of both ends
+func (c *quicConn) idleTimeout() time.Duration {
+	idle := quicIdle
+	if c.peer != nil && c.peer.idleTimeout > 0 {
+		idle = min(idle, time.Duration(c.peer.idleTimeout)*time.Millisecond)
+	}
+	return idle
+}
+
+// earliest timer, called with lock held
+func (c *quicConn) nextTimer(now time.Time) time.Time {
+	next := c.lastRecv.Add(c.idleTimeout())
+	earlier := func(t time.Time) {
+		if !t.IsZero() && t.Before(next) {
+			next = t
+		}
+	}
+	for _, s := range c.spaces {
+		earlier(s.lossTime)
+		if s.ackPending {
+			earlier(s.ackDeadline)
+		}
+	}
+	if at, space := c.ptoTime(); space >= 0 {
+		earlier(at)
+	}
+	if c.established {
+		earlier(c.lastSend.Add(quicKeepalive))
+	}
+	if c.closed {
+		earlier(c.lingerUntil)
+	}
+	return next
+}
+
+// drive timers and send until the session is released
+func (c *quicConn) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.wake:
+		case <-timer.C:
+		}
+		c.mu.Lock()
+		now := time.Now()
+		c.onTimer(now)
+		c.flush(now)
+		if c.closed && (c.closeSent || c.draining) {
+			c.mu.Unlock()
+			c.release()
+			return
+		}
+		next := c.nextTimer(now)
+		c.mu.Unlock()
+		timer.Reset(max(time.Until(next), time.Millisecond))
+	}
+}
+
+func (c *quicConn) release() {
+	close(c.released)
+	if c.ln != nil {
+		c.ln.remove(c)
+	} else {
+		c.conn.Close()
+	}
+}
+
+// send packets of all spaces as allowed, called with lock held
+func (c *quicConn) flush(now time.Time) {
+	if c.closeSent || c.draining {
+		return
+	}
+	if c.closing != nil {
+		c.sendClose()
+		return
+	}
+	for space := range c.spaces {
+		for c.sendPacket(space, now) {
+		}
+	}
+}
+
+// CONNECTION_CLOSE in the highest space peer can read
+func (c *quicConn) sendClose() {
+	c.closeSent = true
+	space := quicSpaceApp
+	if !c.established {
+		space = quicSpaceInitial
+		if s := c.spaces[quicSpaceHandshake]; s.seal != nil && !s.discarded {
+			space = quicSpaceHandshake
+		}
+	}
+	s := c.spaces[space]
+	if s.seal == nil || s.discarded {
+		return
+	}
+	frame := appendVarint(nil, quicFrameClose)
+	frame = appendVarint(frame, c.closing.code)
+	frame = appendVarint(frame, 0)
+	reason := c.closing.reason
+	if space != quicSpaceApp {
+		// peer isn't authenticated yet
+		reason = ""
+	}
+	frame = appendVarint(frame, uint64(len(reason)))
+	frame = append(frame, reason...)
+	c.writePacket(space, frame, nil, false, time.Now())
+}
+
+// room of a packet of space for frames
+func (c *quicConn) room(space int) int {
+	n := 1 + quicCIDLen + quicPNLen + quicTagLen
+	if space != quicSpaceApp {
+		// version, cid lengths, source cid, token length and 2 bytes length
+		n += 4 + 2 + quicCIDLen + 1 + 2
+	}
+	return quicMaxSize - n
+}
+
+// send a packet of space if anything is due, false if nothing is sent
+func (c *quicConn) sendPacket(space int, now time.Time) bool {
+	s := c.spaces[space]
+	if s.seal == nil || s.discarded {
+		return false
+	}
+	if !c.validated && c.sentBytes+quicMaxSize > 3*c.recvBytes {
+		return false
+	}
+	var ack []byte
+	if s.ackPending {
+		ack = appendAck(nil, s.recv, uint64(now.Sub(s.recvTime)/time.Microsecond))
+	}
+	// frames of data are limited by congestion window, except probes
+	var payload []byte
+	var frames []quicFrame
+	if c.probe[space] || c.inFlight+quicMaxSize <= c.cwnd {
+		payload, frames = c.dataFrames(space, c.room(space)-len(ack))
+	}
+	if len(payload) == 0 && c.probe[space] {
+		payload = append(payload, quicFramePing)
+	}
+	eliciting := len(payload) > 0
+	// acks of 1-rtt packets are delayed unless they go with other frames
+	if !eliciting && (ack == nil || space == quicSpaceApp && now.Before(s.ackDeadline)) {
+		return false
+	}
+	c.probe[space] = false
+	s.ackPending = false
+	c.writePacket(space, append(ack, payload...), frames, eliciting, now)
+	return true
+}
+
+// frames besides ack due in space
+func (c *quicConn) dataFrames(space int, room int) ([]byte, []quicFrame) {
+	s := c.spaces[space]
+	var b []byte
+	var frames []quicFrame
+
+	if space == quicSpaceApp {
+		if c.handshakeOK {
+			c.handshakeOK = false
+			b = append(b, quicFrameHandshakeDone)
+			frames = append(frames, quicFrame{kind: quicFrameHandshakeDone})
+		}
+		if c.pathResp != nil {
+			b = append(b, quicFramePathResponse)
+			b = append(b, c.pathResp...)
+			c.pathResp = nil
+		}
+		if c.maxSent {
+			c.maxSent = false
+			b = appendVarint(b, quicFrameMaxData)
+			b = appendVarint(b, c.rmax)
+			b = appendVarint(b, quicFrameMaxStreamData)
+			b = appendVarint(b, 0)
+			b = appendVarint(b, c.rmax)
+			frames = append(frames, quicFrame{kind: quicFrameMaxData})
+		}
+	}
+
+	// crypto data, lost first
+	for len(b) < room {
+		var f quicFrame
+		if len(s.cryptoLost) > 0 {
+			f = s.cryptoLost[0]
+			s.cryptoLost = s.cryptoLost[1:]
+		} else if s.cryptoSent < uint64(len(s.cryptoOut)) {
+			f = quicFrame{kind: quicFrameCrypto, off: s.cryptoSent, n: len(s.cryptoOut) - int(s.cryptoSent)}
+		} else {
+			break
+		}
+		n := min(f.n, room-len(b)-1-quicVarintLen(f.off)-2)
+		if n <= 0 {
+			if f.off < s.cryptoSent {
+				s.cryptoLost = append([]quicFrame{f}, s.cryptoLost...)
+			}
+			break
+		}
+		if n < f.n && f.off < s.cryptoSent {
+			s.cryptoLost = append([]quicFrame{{kind: quicFrameCrypto, off: f.off + uint64(n), n: f.n - n}}, s.cryptoLost...)
+		}
+		b = append(b, quicFrameCrypto)
+		b = appendVarint(b, f.off)
+		b = appendVarint(b, uint64(n))
+		b = append(b, s.cryptoOut[f.off:f.off+uint64(n)]...)
+		frames = append(frames, quicFrame{kind: quicFrameCrypto, off: f.off, n: n})
+		if end := f.off + uint64(n); end > s.cryptoSent {
+			s.cryptoSent = end
+		}
+	}
+
+	if space == quicSpaceApp && c.established && c.closing == nil {
+		b, frames = c.streamFrames(b, frames, room)
+	}
+	return b, frames
+}
+
+// stream frames of lost and new data
+func (c *quicConn) streamFrames(b []byte, frames []quicFrame, room int) ([]byte, []quicFrame) {
+	if !c.server && !c.streamOpen && !c.openSent && c.snext == 0 && len(c.sbuf) == 0 {
+		// open the stream, server speaks first in tunnel handshake
+		c.openSent = true
+		b = append(b, quicFrameStream|quicStreamLen, 0, 0)
+		return b, append(frames, quicFrame{kind: quicFrameStream})
+	}
+	if c.server && !c.streamOpen {
+		return b, frames
+	}
+	for len(b) < room {
+		var f quicFrame
+		if len(c.slost) > 0 {
+			f = c.slost[0]
+			c.slost = c.slost[1:]
+			// cut what's acked meanwhile
+			if end := f.off + uint64(f.n); end <= c.sbase && !(f.fin && !c.finAcked) {
+				continue
+			} else if f.off < c.sbase {
+				f.n, f.off = int(end-c.sbase), c.sbase
+			}
+		} else {
+			end := min(c.sbase+uint64(len(c.sbuf)), c.maxData, c.maxStream)
+			fin := c.finQueued && !c.finSent && end == c.sbase+uint64(len(c.sbuf))
+			if c.snext >= end && !(fin && c.snext == end) {
+				break
+			}
+			f = quicFrame{kind: quicFrameStream, off: c.snext, n: int(end - c.snext), fin: fin}
+		}
+		n := min(f.n, room-len(b)-1-1-quicVarintLen(f.off)-2)
+		if n < 0 || n == 0 && f.n > 0 {
+			c.slost = append([]quicFrame{f}, c.slost...)
+			break
+		}
+		fin := f.fin && n == f.n
+		if n < f.n && f.off < c.snext {
+			c.slost = append([]quicFrame{{kind: quicFrameStream, off: f.off + uint64(n), n: f.n - n, fin: f.fin}}, c.slost...)
+		}
+		typ := byte(quicFrameStream | quicStreamOff | quicStreamLen)
+		if fin {
+			typ |= quicStreamFin
+			c.finSent = true
+		}
+		b = append(b, typ, 0)
+		b = appendVarint(b, f.off)
+		b = appendVarint(b, uint64(n))
+		b = append(b, c.sbuf[f.off-c.sbase:f.off-c.sbase+uint64(n)]...)
+		frames = append(frames, quicFrame{kind: quicFrameStream, off: f.off, n: n, fin: fin})
+		if end := f.off + uint64(n); end > c.snext {
+			c.snext = end
+		}
+	}
+	return b, frames
+}
+
+// seal and send a packet of payload in space, an ack-eliciting one is
+// tracked for loss recovery
+func (c *quicConn) writePacket(space int, payload []byte, frames []quicFrame, eliciting bool, now time.Time) {
+	s := c.spaces[space]
+	pn := s.next
+	s.next++
+	// sample of header protection needs 4 bytes of payload
+	for len(payload) < 4 {
+		payload = append(payload, quicFramePadding)
+	}
+	var hdr []byte
+	if space == quicSpaceApp {
+		hdr = append([]byte{0x40 | (quicPNLen - 1)}, c.dcid...)
+		if c.keyPhase {
+			hdr[0] |= 0x04
+		}
+	} else {
+		typ := byte(quicPacketInitial)
+		if space == quicSpaceHandshake {
+			typ = quicPacketHandshake
+		}
+		hdr = append([]byte{0xc0 | typ<<4 | (quicPNLen - 1)}, 0, 0, 0, quicVersion)
+		hdr = append(hdr, byte(len(c.dcid)))
+		hdr = append(hdr, c.dcid...)
+		hdr = append(hdr, byte(len(c.scid)))
+		hdr = append(hdr, c.scid...)
+		if space == quicSpaceInitial {
+			// no token
+			hdr = append(hdr, 0)
+			// datagrams of client with initial packets are at least quicMaxSize
+			if pad := quicMaxSize - len(hdr) - 2 - quicPNLen - quicTagLen - len(payload); !c.server && pad > 0 {
+				payload = append(payload, make([]byte, pad)...)
+			}
+		}
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(quicPNLen+len(payload)+quicTagLen)|0x4000)
+	}
+	pnOffset := len(hdr)
+	hdr = binary.BigEndian.AppendUint32(hdr, uint32(pn))
+	p := s.seal.seal(hdr, pnOffset, pn, payload)
+	if c.ln == nil {
+		c.conn.Write(p)
+	} else {
+		c.conn.WriteTo(p, c.raddr)
+	}
+	c.lastSend = now
+	if !c.validated {
+		c.sentBytes += len(p)
+	}
+	if eliciting {
+		s.sent = append(s.sent, &quicSent{pn: pn, time: now, size: len(p), frames: frames})
+		s.lastEliciting = now
+		c.inFlight += len(p)
+	}
+	if !c.server && space == quicSpaceHandshake {
+		c.discard(quicSpaceInitial)
+	}
+}
+
+// client reads its own socket until it's closed
+func (c *quicConn) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-c.released:
+				return
+			default:
+			}
+			// such as icmp port unreachable, peer may come back
+			continue
+		}
+		c.input(buf[:n], c.raddr)
+	}
+}
+
+func (c *quicConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(c.rbuf) > 0 {
+			n := copy(p, c.rbuf)
+			c.rbuf = c.rbuf[n:]
+			c.rconsumed += uint64(n)
+			// window is moved when half of it is read
+			if c.rmax-c.rconsumed < quicWindow/2 {
+				c.rmax = c.rconsumed + quicWindow
+				c.maxSent = true
+				c.flush(time.Now())
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.rfin >= 0 && c.rnext == uint64(c.rfin) {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if err := c.rerr; err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.rdeadline
+		c.mu.Unlock()
+		if !waitDeadline(c.readable, c.released, deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *quicConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		c.mu.Lock()
+		if err := c.werr; err != nil {
+			c.mu.Unlock()
+			return written, err
+		}
+		if room := quicSendBuffer - len(c.sbuf); room > 0 {
+			n := min(room, len(p))
+			c.sbuf = append(c.sbuf, p[:n]...)
+			p, written = p[n:], written+n
+			c.flush(time.Now())
+			c.mu.Unlock()
+			notify(c.wake)
+			continue
+		}
+		deadline := c.wdeadline
+		c.mu.Unlock()
+		if !waitDeadline(c.writable, c.released, deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+	return written, nil
+}
+
+// data written is still sent in quicLinger with fin, then peer is told
+func (c *quicConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.lingerUntil = time.Now().Add(quicLinger)
+	if c.werr == nil {
+		c.finQueued = true
+	}
+	c.fail(net.ErrClosed, net.ErrClosed)
+	return nil
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.raddr
+}
+
+func (c *quicConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
+
+// tls state of the connection
+func (c *quicConn) ConnectionState() tls.ConnectionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tls.ConnectionState()
+}
+
+// connections of server by connection ids on one udp socket. The socket is
+// kept after Close until its connections are released, so tunnels survive
+// the listener as those of tcp
+type quicListener struct {
+	conn     *net.UDPConn
+	config   *tls.Config
+	mu       sync.Mutex
+	conns    map[string]*quicConn // by id of server, and first id chosen by client
+	accepted chan *quicConn
+	done     chan struct{}
+	closed   bool
+}
+
+func (l *quicListener) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				Error("quic listener %s read failed:%s", l.conn.LocalAddr(), err)
+				l.Close()
+			}
+			return
+		}
+		if c := l.lookup(buf[:n], addr); c != nil {
+			c.input(buf[:n], addr)
+		}
+	}
+}
+
+// connection of datagram p from addr, a new one is accepted for initial
+// packet of client
+func (l *quicListener) lookup(p []byte, addr *net.UDPAddr) *quicConn {
+	var dcid []byte
+	initial := false
+	if len(p) > 0 && p[0]&0x80 != 0 {
+		r := &quicReader{b: p[1:]}
+		version := binary.BigEndian.Uint32(r.bytes(4))
+		dcid = r.bytes(uint64(r.byte()))
+		initial = !r.err && version == quicVersion && p[0]>>4&0x03 == quicPacketInitial
+	} else if len(p) > quicCIDLen {
+		dcid = p[1 : 1+quicCIDLen]
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c := l.conns[string(dcid)]; c != nil {
+		return c
+	}
+	// client's initial packets are padded, so server never amplifies them
+	if !initial || len(p) < quicMaxSize || len(dcid) < quicCIDLen || l.closed {
+		return nil
+	}
+	c := newQUICConn(l.conn, addr, l, append([]byte(nil), dcid...))
+	select {
+	case l.accepted <- c:
+	default:
+		// backlog is full
+		c.Close()
+		return nil
+	}
+	l.conns[string(c.odcid)] = c
+	l.conns[string(c.scid)] = c
+	c.mu.Lock()
+	c.startTLS(tls.QUICServer(&tls.QUICConfig{TLSConfig: l.config}))
+	c.mu.Unlock()
+	return c
+}
+
+func (l *quicListener) remove(c *quicConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range [][]byte{c.odcid, c.scid} {
+		if l.conns[string(id)] == c {
+			delete(l.conns, string(id))
+		}
+	}
+	if l.closed && len(l.conns) == 0 {
+		l.conn.Close()
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "quic", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// connections accepted keep running
+func (l *quicListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	l.closed = true
+	close(l.done)
+	// connections are queued with lock held
+	for len(l.accepted) > 0 {
+		(<-l.accepted).Close()
+	}
+	if len(l.conns) == 0 {
+		l.conn.Close()
+	}
+	return nil
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
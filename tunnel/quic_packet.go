@@ -0,0 +1,523 @@
+//
+//   date  : 2015-09-21
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// wire format of quic version 1, rfc 9000 and 9001. Only what a tunnel
+// needs is spoken: one bidirectional stream, no 0-rtt, retry, version
+// negotiation, key update or new connection ids.
+const (
+	quicVersion = 1
+	quicCIDLen  = 8    // connection ids chosen by both ends
+	quicMaxSize = 1200 // max bytes of udp payload, no path mtu discovery
+	quicPNLen   = 4    // packet numbers are always sent in 4 bytes
+	quicTagLen  = 16
+
+	// long header packet types
+	quicPacketInitial   = 0
+	quicPacketZeroRTT   = 1
+	quicPacketHandshake = 2
+	quicPacketRetry     = 3
+)
+
+// packet number spaces
+const (
+	quicSpaceInitial = iota
+	quicSpaceHandshake
+	quicSpaceApp
+	quicSpaces
+)
+
+// frame types
+const (
+	quicFramePadding        = 0x00
+	quicFramePing           = 0x01
+	quicFrameAck            = 0x02
+	quicFrameAckECN         = 0x03
+	quicFrameResetStream    = 0x04
+	quicFrameStopSending    = 0x05
+	quicFrameCrypto         = 0x06
+	quicFrameNewToken       = 0x07
+	quicFrameStream         = 0x08 // 0x08-0x0f with bits of fin, len and off
+	quicFrameMaxData        = 0x10
+	quicFrameMaxStreamData  = 0x11
+	quicFrameMaxStreamsBidi = 0x12
+	quicFrameMaxStreamsUni  = 0x13
+	quicFrameDataBlocked    = 0x14
+	quicFrameStreamBlocked  = 0x15
+	quicFrameStreamsBlocked = 0x16 // and 0x17
+	quicFrameNewCID         = 0x18
+	quicFrameRetireCID      = 0x19
+	quicFramePathChallenge  = 0x1a
+	quicFramePathResponse   = 0x1b
+	quicFrameClose          = 0x1c
+	quicFrameCloseApp       = 0x1d
+	quicFrameHandshakeDone  = 0x1e
+
+	quicStreamFin = 0x01
+	quicStreamLen = 0x02
+	quicStreamOff = 0x04
+)
+
+// transport error codes
+const (
+	quicNoError          = 0x0
+	quicInternalError    = 0x1
+	quicFlowControlError = 0x3
+	quicFinalSizeError   = 0x6
+	quicFrameEncoding    = 0x7
+	quicProtocolError    = 0xa
+	quicCryptoError      = 0x100 // plus tls alert
+)
+
+// transport parameters
+const (
+	quicParamOriginalCID   = 0x00
+	quicParamIdleTimeout   = 0x01
+	quicParamMaxData       = 0x04
+	quicParamStreamLocal   = 0x05
+	quicParamStreamRemote  = 0x06
+	quicParamStreamsBidi   = 0x08
+	quicParamInitialSrcCID = 0x0f
+)
+
+var quicInitialSalt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+
+var errQUICPacket = errors.New("quic: bad packet")
+
+// number of quic variable-length integer encoding
+func quicVarintLen(v uint64) int {
+	switch {
+	case v < 1<<6:
+		return 1
+	case v < 1<<14:
+		return 2
+	case v < 1<<30:
+		return 4
+	}
+	return 8
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch quicVarintLen(v) {
+	case 1:
+		return append(b, byte(v))
+	case 2:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	case 4:
+		return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+	}
+	return binary.BigEndian.AppendUint64(b, v|0xc000000000000000)
+}
+
+// reads fields of frames and headers, a short read sets err and returns
+// zeros from then on
+type quicReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *quicReader) byte() byte {
+	if len(r.b) < 1 {
+		r.err = true
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *quicReader) bytes(n uint64) []byte {
+	if uint64(len(r.b)) < n {
+		r.err = true
+		r.b = nil
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *quicReader) varint() uint64 {
+	if len(r.b) < 1 {
+		r.err = true
+		return 0
+	}
+	n := 1 << (r.b[0] >> 6)
+	p := r.bytes(uint64(n))
+	if p == nil {
+		return 0
+	}
+	v := uint64(p[0] & 0x3f)
+	for _, b := range p[1:] {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// full packet number of truncated one of pnLen bytes, nearest to the
+// next expected, rfc 9000 appendix a.3
+func quicDecodePN(largest int64, truncated uint64, pnLen int) uint64 {
+	expected := uint64(largest + 1)
+	win := uint64(1) << (pnLen * 8)
+	hwin, mask := win/2, win-1
+	candidate := expected&^mask | truncated
+	if candidate+hwin <= expected && candidate < 1<<62-win {
+		return candidate + win
+	}
+	if candidate > expected+hwin && candidate >= win {
+		return candidate - win
+	}
+	return candidate
+}
+
+// packet protection keys of one direction of a packet number space
+type quicKeys struct {
+	aead   cipher.AEAD
+	iv     []byte
+	hp     func(sample []byte) []byte // 5 bytes of header protection mask
+	suite  uint16
+	secret []byte // of key update
+}
+
+func quicExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	out, err := hkdf.Expand(h, secret, string(info), length)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// hash and key length of tls cipher suite
+func quicSuite(suite uint16) (func() hash.Hash, int, error) {
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		return sha256.New, 16, nil
+	case tls.TLS_AES_256_GCM_SHA384:
+		return sha512.New384, 32, nil
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		return sha256.New, 32, nil
+	}
+	return nil, 0, fmt.Errorf("quic: unknown cipher suite %#x", suite)
+}
+
+// aead and iv of secret, header protection isn't changed by key update
+func (k *quicKeys) packetKeys(h func() hash.Hash, keyLen int) error {
+	key := quicExpandLabel(h, k.secret, "quic key", keyLen)
+	k.iv = quicExpandLabel(h, k.secret, "quic iv", 12)
+	if k.suite == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		k.aead = newChaCha20Poly1305(key)
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	k.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// keys of traffic secret of tls cipher suite
+func newQUICKeys(suite uint16, secret []byte) (*quicKeys, error) {
+	h, keyLen, err := quicSuite(suite)
+	if err != nil {
+		return nil, err
+	}
+	k := &quicKeys{suite: suite, secret: secret}
+	if err := k.packetKeys(h, keyLen); err != nil {
+		return nil, err
+	}
+	hp := quicExpandLabel(h, secret, "quic hp", keyLen)
+	if suite == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		hpKey := chachaKey(hp)
+		k.hp = func(sample []byte) []byte {
+			var block [64]byte
+			chachaBlock(&block, hpKey, binary.LittleEndian.Uint32(sample), sample[4:16])
+			return block[:5]
+		}
+		return k, nil
+	}
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	k.hp = func(sample []byte) []byte {
+		mask := make([]byte, aes.BlockSize)
+		hpBlock.Encrypt(mask, sample)
+		return mask[:5]
+	}
+	return k, nil
+}
+
+// keys of next key phase, rfc 9001 section 6
+func (k *quicKeys) next() *quicKeys {
+	h, keyLen, _ := quicSuite(k.suite)
+	n := &quicKeys{hp: k.hp, suite: k.suite}
+	n.secret = quicExpandLabel(h, k.secret, "quic ku", h().Size())
+	n.packetKeys(h, keyLen)
+	return n
+}
+
+// keys of initial packets derived from destination connection id chosen by
+// client, for sealing and opening packets of the end
+func quicInitialKeys(dcid []byte, server bool) (seal, open *quicKeys) {
+	secret, err := hkdf.Extract(sha256.New, dcid, quicInitialSalt)
+	if err != nil {
+		panic(err)
+	}
+	client := quicExpandLabel(sha256.New, secret, "client in", 32)
+	srv := quicExpandLabel(sha256.New, secret, "server in", 32)
+	if server {
+		client, srv = srv, client
+	}
+	seal, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, client)
+	open, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, srv)
+	return
+}
+
+func (k *quicKeys) nonce(pn uint64) []byte {
+	nonce := make([]byte, len(k.iv))
+	copy(nonce, k.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return nonce
+}
+
+// seal payload after header hdr whose packet number starts at pnOffset,
+// then protect the header
+func (k *quicKeys) seal(hdr []byte, pnOffset int, pn uint64, payload []byte) []byte {
+	out := make([]byte, len(hdr), len(hdr)+len(payload)+quicTagLen)
+	copy(out, hdr)
+	out = k.aead.Seal(out, k.nonce(pn), payload, hdr)
+	mask := k.hp(out[pnOffset+4 : pnOffset+4+16])
+	if out[0]&0x80 != 0 {
+		out[0] ^= mask[0] & 0x0f
+	} else {
+		out[0] ^= mask[0] & 0x1f
+	}
+	for i := 0; i < quicPNLen; i++ {
+		out[pnOffset+i] ^= mask[1+i]
+	}
+	return out
+}
+
+// remove header protection of packet p and open its payload in place,
+// largest is the largest packet number received in its space. Return
+// packet number and payload
+func (k *quicKeys) open(p []byte, pnOffset int, largest int64) (uint64, []byte, error) {
+	pn, hdrLen, err := k.unprotect(p, pnOffset, largest)
+	if err != nil {
+		return 0, nil, err
+	}
+	payload, err := k.decrypt(p, hdrLen, pn)
+	return pn, payload, err
+}
+
+// remove header protection of packet p in place, return packet number and
+// length of header
+func (k *quicKeys) unprotect(p []byte, pnOffset int, largest int64) (uint64, int, error) {
+	if len(p) < pnOffset+4+16 {
+		return 0, 0, errQUICPacket
+	}
+	mask := k.hp(p[pnOffset+4 : pnOffset+4+16])
+	if p[0]&0x80 != 0 {
+		p[0] ^= mask[0] & 0x0f
+	} else {
+		p[0] ^= mask[0] & 0x1f
+	}
+	pnLen := int(p[0]&0x03) + 1
+	var truncated uint64
+	for i := 0; i < pnLen; i++ {
+		p[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | uint64(p[pnOffset+i])
+	}
+	return quicDecodePN(largest, truncated, pnLen), pnOffset + pnLen, nil
+}
+
+// open payload of packet p whose header is unprotected
+func (k *quicKeys) decrypt(p []byte, hdrLen int, pn uint64) ([]byte, error) {
+	return k.aead.Open(p[hdrLen:hdrLen], k.nonce(pn), p[hdrLen:], p[:hdrLen])
+}
+
+// ranges of packet numbers received, largest first
+type quicRange struct {
+	lo, hi uint64
+}
+
+type quicRanges []quicRange
+
+// max ranges kept to ack, older ones are dropped
+const quicMaxRanges = 32
+
+// add pn, false if it's received already
+func (rs *quicRanges) add(pn uint64) bool {
+	r := *rs
+	// ranges before i are above pn
+	i := 0
+	for i < len(r) && r[i].lo > pn {
+		i++
+	}
+	if i < len(r) && pn <= r[i].hi {
+		return false
+	}
+	above := i > 0 && r[i-1].lo == pn+1
+	below := i < len(r) && r[i].hi+1 == pn
+	switch {
+	case above && below:
+		r[i-1].lo = r[i].lo
+		r = append(r[:i], r[i+1:]...)
+	case above:
+		r[i-1].lo = pn
+	case below:
+		r[i].hi = pn
+	default:
+		r = append(r, quicRange{})
+		copy(r[i+1:], r[i:])
+		r[i] = quicRange{pn, pn}
+	}
+	if len(r) > quicMaxRanges {
+		r = r[:quicMaxRanges]
+	}
+	*rs = r
+	return true
+}
+
+// ack frame of ranges, delay in microseconds
+func appendAck(b []byte, rs quicRanges, delay uint64) []byte {
+	b = append(b, quicFrameAck)
+	b = appendVarint(b, rs[0].hi)
+	b = appendVarint(b, delay>>3)
+	b = appendVarint(b, uint64(len(rs)-1))
+	b = appendVarint(b, rs[0].hi-rs[0].lo)
+	for i := 1; i < len(rs); i++ {
+		b = appendVarint(b, rs[i-1].lo-rs[i].hi-2)
+		b = appendVarint(b, rs[i].hi-rs[i].lo)
+	}
+	return b
+}
+
+// ranges and delay in microseconds of ack frame after its type
+func readAck(r *quicReader, ecn bool) (quicRanges, uint64) {
+	largest := r.varint()
+	delay := r.varint() << 3
+	count := r.varint()
+	first := r.varint()
+	if r.err || first > largest {
+		r.err = true
+		return nil, 0
+	}
+	rs := quicRanges{{largest - first, largest}}
+	for i := uint64(0); i < count && !r.err; i++ {
+		gap, n := r.varint(), r.varint()
+		lo := rs[len(rs)-1].lo
+		if lo < gap+2 || lo-gap-2 < n {
+			r.err = true
+			return nil, 0
+		}
+		hi := lo - gap - 2
+		rs = append(rs, quicRange{hi - n, hi})
+	}
+	if ecn {
+		r.varint()
+		r.varint()
+		r.varint()
+	}
+	return rs, delay
+}
+
+func (rs quicRanges) contains(pn uint64) bool {
+	for _, r := range rs {
+		if pn >= r.lo && pn <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// transport parameters, only those a tunnel uses
+type quicParams struct {
+	originalCID []byte // of server
+	srcCID      []byte
+	idleTimeout uint64 // ms, 0 if none
+	maxData     uint64
+	streamLocal uint64 // stream data limit of streams opened by the end
+	streamPeer  uint64 // stream data limit of streams opened by peer
+	streamsBidi uint64
+}
+
+func (p *quicParams) encode() []byte {
+	var b []byte
+	put := func(id uint64, v []byte) {
+		b = appendVarint(b, id)
+		b = appendVarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	putInt := func(id, v uint64) {
+		put(id, appendVarint(nil, v))
+	}
+	if p.originalCID != nil {
+		put(quicParamOriginalCID, p.originalCID)
+	}
+	put(quicParamInitialSrcCID, p.srcCID)
+	putInt(quicParamIdleTimeout, p.idleTimeout)
+	putInt(quicParamMaxData, p.maxData)
+	putInt(quicParamStreamLocal, p.streamLocal)
+	putInt(quicParamStreamRemote, p.streamPeer)
+	putInt(quicParamStreamsBidi, p.streamsBidi)
+	return b
+}
+
+func parseQUICParams(b []byte) (*quicParams, error) {
+	p := &quicParams{}
+	r := &quicReader{b: b}
+	for len(r.b) > 0 && !r.err {
+		id := r.varint()
+		v := r.bytes(r.varint())
+		vr := &quicReader{b: v}
+		switch id {
+		case quicParamOriginalCID:
+			p.originalCID = v
+		case quicParamInitialSrcCID:
+			p.srcCID = v
+		case quicParamIdleTimeout:
+			p.idleTimeout = vr.varint()
+		case quicParamMaxData:
+			p.maxData = vr.varint()
+		case quicParamStreamLocal:
+			p.streamLocal = vr.varint()
+		case quicParamStreamRemote:
+			p.streamPeer = vr.varint()
+		case quicParamStreamsBidi:
+			p.streamsBidi = vr.varint()
+		}
+		if vr.err {
+			r.err = true
+		}
+	}
+	if r.err {
+		return nil, errors.New("quic: bad transport parameters")
+	}
+	return p, nil
+}
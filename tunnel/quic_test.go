@@ -0,0 +1,309 @@
+//
+//   date  : 2015-09-21
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// keys of initial packets and header protection, rfc 9001 appendix a
+func TestQUICInitialKeys(t *testing.T) {
+	seal, open := quicInitialKeys(unhex(t, "8394c8f03e515708"), false)
+	for _, c := range []struct {
+		keys         *quicKeys
+		iv           string
+		sample, mask string
+	}{
+		{seal, "fa044b2f42a3fd3b46fb255c", "d1b1c98dd7689fb8ec11d242b123dc9b", "437b9aec36"},
+		{open, "0ac1493ca1905853b0bba03e", "2cd0991cd25b0aac406a5816b6394100", "2ec0d8356a"},
+	} {
+		if !bytes.Equal(c.keys.iv, unhex(t, c.iv)) {
+			t.Fatalf("unexpected iv %x", c.keys.iv)
+		}
+		if mask := c.keys.hp(unhex(t, c.sample)); !bytes.Equal(mask, unhex(t, c.mask)) {
+			t.Fatalf("unexpected mask %x", mask)
+		}
+	}
+
+	// server derives the same keys in turn
+	srvSeal, srvOpen := quicInitialKeys(unhex(t, "8394c8f03e515708"), true)
+	if !bytes.Equal(srvSeal.iv, open.iv) || !bytes.Equal(srvOpen.iv, seal.iv) {
+		t.Fatal("keys of server don't match those of client")
+	}
+	hdr := append([]byte{0xc3, 0, 0, 0, 1, 0, 0, 0x40, 0x19}, 0, 0, 0, 7)
+	p := seal.seal(hdr, 9, 7, []byte("hello, quic server"))
+	pn, payload, err := srvOpen.open(p, 9, -1)
+	if err != nil || pn != 7 || string(payload) != "hello, quic server" {
+		t.Fatalf("open packet failed: %d %q %v", pn, payload, err)
+	}
+}
+
+// short header packet protected by chacha20-poly1305, rfc 9001 appendix a.5
+func TestQUICChaCha(t *testing.T) {
+	secret := unhex(t, "9ac312a7f877468ebe69422748ad00a15443f18203a07d6060f688f30f21632b")
+	keys, err := newQUICKeys(tls.TLS_CHACHA20_POLY1305_SHA256, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys.iv, unhex(t, "e0459b3474bdd0e44a41c144")) {
+		t.Fatalf("unexpected iv %x", keys.iv)
+	}
+	p := unhex(t, "4cfe4189655e5cd55c41f69080575d7999c25a5bfb")
+	pn, payload, err := keys.open(p, 1, 654360563)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pn != 654360564 || !bytes.Equal(payload, []byte{0x01}) {
+		t.Fatalf("unexpected packet %d %x", pn, payload)
+	}
+	if _, _, err := keys.open(unhex(t, "4cfe4189655e5cd55c41f69080575d7999c25a5bfa"), 1, 654360563); err == nil {
+		t.Fatal("forged packet should be rejected")
+	}
+
+	// key update keeps header protection
+	next := keys.next()
+	if !bytes.Equal(next.secret, unhex(t, "1223504755036d556342ee9361d253421a826c9ecdf3c7148684b36b714881f9")) {
+		t.Fatalf("unexpected secret of next phase %x", next.secret)
+	}
+	hdr := []byte{0x40 | 0x04 | (quicPNLen - 1), 0, 0, 0, 9}
+	p = next.seal(hdr, 1, 9, []byte("next phase"))
+	if _, _, err := keys.open(append([]byte(nil), p...), 1, 8); err == nil {
+		t.Fatal("packet of next phase should be rejected by old keys")
+	}
+	if pn, payload, err := next.open(p, 1, 8); err != nil || pn != 9 || string(payload) != "next phase" {
+		t.Fatalf("open packet of next phase failed: %d %q %v", pn, payload, err)
+	}
+}
+
+func TestQUICPacketNumber(t *testing.T) {
+	// rfc 9000 appendix a.3
+	if pn := quicDecodePN(0xa82f30ea, 0x9b32, 2); pn != 0xa82f9b32 {
+		t.Fatalf("unexpected packet number %#x", pn)
+	}
+	if pn := quicDecodePN(-1, 0, 4); pn != 0 {
+		t.Fatalf("unexpected packet number %#x", pn)
+	}
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, 1<<62 - 1} {
+		b := appendVarint(nil, v)
+		r := &quicReader{b: b}
+		if got := r.varint(); got != v || r.err || len(b) != quicVarintLen(v) {
+			t.Fatalf("varint %d is decoded as %d", v, got)
+		}
+	}
+}
+
+func TestQUICAckRanges(t *testing.T) {
+	var rs quicRanges
+	for _, pn := range []uint64{0, 1, 2, 5, 9, 7, 8, 4, 12} {
+		if !rs.add(pn) {
+			t.Fatalf("packet %d is added twice", pn)
+		}
+	}
+	if rs.add(8) {
+		t.Fatal("duplicated packet should be dropped")
+	}
+	want := quicRanges{{12, 12}, {7, 9}, {4, 5}, {0, 2}}
+	if len(rs) != len(want) {
+		t.Fatalf("unexpected ranges %v", rs)
+	}
+	for i := range want {
+		if rs[i] != want[i] {
+			t.Fatalf("unexpected ranges %v", rs)
+		}
+	}
+
+	p := appendAck(nil, rs, 800)
+	r := &quicReader{b: p[1:]}
+	got, delay := readAck(r, false)
+	if r.err || len(r.b) != 0 || delay != 800 {
+		t.Fatalf("bad ack frame %x", p)
+	}
+	for pn := uint64(0); pn < 14; pn++ {
+		if got.contains(pn) != rs.contains(pn) {
+			t.Fatalf("ack of packet %d differs", pn)
+		}
+	}
+
+	for pn := uint64(100); pn < 200; pn += 2 {
+		rs.add(pn)
+	}
+	if len(rs) != quicMaxRanges || rs[0].hi != 198 {
+		t.Fatalf("unexpected %d ranges, largest %d", len(rs), rs[0].hi)
+	}
+}
+
+// tunnel over quic to server on a free udp port, dial maps its address to
+// the one client dials
+func newQUICPair(t *testing.T, dial func(server string) string) *testPair {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	srv := newTestCert(t, dir, "server", ca)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	server := Config{Listen: "quic://" + addr, TLSCert: srv.cert, TLSKey: srv.key}
+	client := Config{Backend: "quic://" + dial(addr), TLSCA: ca.cert}
+	p := newTestPair(t, server, client, func(p *testPair) {
+		for _, app := range []*App{p.server.app, p.client.app} {
+			app.transport = newQUICTransport(app)
+		}
+	})
+	return p
+}
+
+func TestPairQUIC(t *testing.T) {
+	p := newQUICPair(t, func(server string) string { return server })
+	data := strings.Repeat("hello", 100000)
+	if echoed := p.roundTrip(t, data); echoed != data {
+		t.Fatalf("unexpected echo of %d bytes", len(echoed))
+	}
+	hub := p.client.activeHubs()[0]
+	conn, ok := hub.tunnel.netConn().(*quicConn)
+	if !ok {
+		t.Fatalf("tunnel isn't over quic: %T", hub.tunnel.netConn())
+	}
+	if cert := peerCertificate(conn); cert == nil || cert.Subject.CommonName != "server" {
+		t.Fatalf("unexpected certificate of server: %v", cert)
+	}
+
+	c := Config{Listen: "127.0.0.1:8003", Backend: "quic://127.0.0.1:8001", Tunnels: 1, Secret: "s"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Obfs = ObfsPadding
+	if err := c.Validate(); err == nil {
+		t.Fatal("obfuscation over quic should be rejected")
+	}
+}
+
+// udp relay dropping some datagrams, upstream socket is replaced on rebind
+// as by nat of client
+type lossyRelay struct {
+	t        *testing.T
+	conn     *net.UDPConn
+	server   *net.UDPAddr
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	upstream *net.UDPConn
+	client   *net.UDPAddr
+}
+
+func newLossyRelay(t *testing.T, server string) *lossyRelay {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &lossyRelay{t: t, conn: conn, server: raddr, rnd: rand.New(rand.NewSource(1))}
+	r.rebind()
+	t.Cleanup(func() {
+		conn.Close()
+		r.mu.Lock()
+		r.upstream.Close()
+		r.mu.Unlock()
+	})
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.client = addr
+			upstream := r.upstream
+			drop := r.rnd.Intn(10) == 0
+			r.mu.Unlock()
+			if !drop {
+				upstream.WriteToUDP(buf[:n], r.server)
+			}
+		}
+	}()
+	return r
+}
+
+// forward datagrams from server by a new socket
+func (r *lossyRelay) rebind() {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.mu.Lock()
+	old := r.upstream
+	r.upstream = upstream
+	r.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			client := r.client
+			drop := r.rnd.Intn(10) == 0
+			r.mu.Unlock()
+			if !drop && client != nil {
+				r.conn.WriteToUDP(buf[:n], client)
+			}
+		}
+	}()
+}
+
+// lost packets are recovered, and server follows client to its new address
+func TestPairQUICLossyMigration(t *testing.T) {
+	var relay *lossyRelay
+	p := newQUICPair(t, func(server string) string {
+		relay = newLossyRelay(t, server)
+		return relay.conn.LocalAddr().String()
+	})
+	data := strings.Repeat("hello", 50000)
+	if echoed := p.roundTrip(t, data); echoed != data {
+		t.Fatalf("unexpected echo of %d bytes", len(echoed))
+	}
+	hub := p.client.activeHubs()[0]
+
+	relay.rebind()
+	relay.mu.Lock()
+	addr := relay.upstream.LocalAddr().String()
+	relay.mu.Unlock()
+	if echoed := p.roundTrip(t, data); echoed != data {
+		t.Fatalf("unexpected echo of %d bytes after rebind", len(echoed))
+	}
+	if hubs := p.client.activeHubs(); len(hubs) != 1 || hubs[0] != hub {
+		t.Fatal("tunnel is reset by rebind")
+	}
+	c := p.server.activeHubs()[0].tunnel.netConn().(*quicConn)
+	if raddr := c.RemoteAddr().String(); raddr != addr {
+		t.Fatalf("server sends to %s, want %s", raddr, addr)
+	}
+}
@@ -0,0 +1,260 @@
+//
+//   date  : 2015-10-05
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// what server does when a client exceeds its quota
+const (
+	QuotaReject   = "reject"   // refuse new links, established ones run on
+	QuotaThrottle = "throttle" // limit links of the client to Rate
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// byte quota of a client identity, link data of both directions is counted.
+// Days and months are of server local time
+type Quota struct {
+	Client  string `json:"client"`  // client id, empty for anonymous clients
+	Daily   int64  `json:"daily"`   // bytes per day, unlimited if 0
+	Monthly int64  `json:"monthly"` // bytes per calendar month, unlimited if 0
+	Action  string `json:"action"`  // reject or throttle, default reject
+	Rate    int64  `json:"rate"`    // bytes per second of throttled client in each direction
+}
+
+func (q *Quota) init() error {
+	switch q.Action {
+	case "":
+		q.Action = QuotaReject
+	case QuotaReject:
+	case QuotaThrottle:
+		if q.Rate <= 0 {
+			return fmt.Errorf("quota of client %q: throttle needs a positive rate", q.Client)
+		}
+	default:
+		return fmt.Errorf("quota of client %q: unknown action %s", q.Client, q.Action)
+	}
+	return nil
+}
+
+func (q *Quota) exceeded(daily, monthly int64) bool {
+	return (q.Daily > 0 && daily >= q.Daily) || (q.Monthly > 0 && monthly >= q.Monthly)
+}
+
+// quota of client id, nil if it has none
+func (app *App) quota(id string) *Quota {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	for _, q := range app.Quotas {
+		if q.Client == id {
+			return q
+		}
+	}
+	return nil
+}
+
+type usageStatus struct {
+	Client   string `json:"client"` // empty if anonymous
+	Up       int64  `json:"up"`     // bytes from client since server started
+	Down     int64  `json:"down"`   // bytes to client since server started
+	Daily    int64  `json:"daily"`  // bytes of today
+	Monthly  int64  `json:"monthly"`
+	Quota    *Quota `json:"quota,omitempty"`
+	Exceeded bool   `json:"exceeded"`
+}
+
+// traffic of a client identity, shared by all its tunnels
+type clientUsage struct {
+	id    string
+	table *usageTable
+
+	lock       sync.Mutex
+	up         int64
+	down       int64
+	day        time.Time // start of current day
+	month      time.Time // start of current month
+	dayBytes   int64
+	monthBytes int64
+
+	// quota is checked at most once a second while counting
+	checked   time.Time
+	exceeded  bool
+	rejected  bool         // exceeded with reject action
+	limit     rateLimiters // of exceeded client with throttle action
+	limitRate int64
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func startOfMonth(t time.Time) time.Time {
+	y, m, _ := t.Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+}
+
+// should be called with lock held, start new periods if they're over
+func (u *clientUsage) roll(now time.Time) {
+	if day := startOfDay(now); !day.Equal(u.day) {
+		u.day = day
+		u.dayBytes = 0
+	}
+	if month := startOfMonth(now); !month.Equal(u.month) {
+		u.month = month
+		u.monthBytes = 0
+	}
+}
+
+// should be called with lock held
+func (u *clientUsage) check(now time.Time) {
+	u.roll(now)
+	u.checked = now
+	q := u.table.quota(u.id)
+	u.exceeded = q != nil && q.exceeded(u.dayBytes, u.monthBytes)
+	u.rejected = u.exceeded && q.Action == QuotaReject
+
+	var rate int64
+	if u.exceeded && q.Action == QuotaThrottle {
+		rate = q.Rate
+	}
+	if rate != u.limitRate {
+		if rate > 0 {
+			Log("client %q exceeds quota, throttled to %d bytes per second", u.id, rate)
+		}
+		u.limit = newRateLimiters(rate)
+		u.limitRate = rate
+	}
+}
+
+// count link data from and to client, nil usage counts nothing
+func (u *clientUsage) add(up, down int) {
+	if u == nil {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	now := time.Now()
+	u.roll(now)
+	u.up += int64(up)
+	u.down += int64(down)
+	u.dayBytes += int64(up + down)
+	u.monthBytes += int64(up + down)
+	if now.Sub(u.checked) >= time.Second {
+		u.check(now)
+	}
+}
+
+// error if client exceeds quota of reject action
+func (u *clientUsage) allow() error {
+	if u == nil {
+		return nil
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.check(time.Now())
+	if u.rejected {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// limiters of throttled client, nil limiters never wait
+func (u *clientUsage) limiters() rateLimiters {
+	if u == nil {
+		return rateLimiters{}
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.limit
+}
+
+func (u *clientUsage) status() usageStatus {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.check(time.Now())
+	return usageStatus{
+		Client:   u.id,
+		Up:       u.up,
+		Down:     u.down,
+		Daily:    u.dayBytes,
+		Monthly:  u.monthBytes,
+		Quota:    u.table.quota(u.id),
+		Exceeded: u.exceeded,
+	}
+}
+
+// traffic of client identities on server since it started
+type usageTable struct {
+	sync.Mutex
+	clients map[string]*clientUsage
+	quota   func(id string) *Quota
+}
+
+func newUsageTable(quota func(id string) *Quota) *usageTable {
+	return &usageTable{
+		clients: make(map[string]*clientUsage),
+		quota:   quota,
+	}
+}
+
+// usage of client id, nil table returns nil
+func (t *usageTable) get(id string) *clientUsage {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	u := t.clients[id]
+	if u == nil {
+		u = &clientUsage{id: id, table: t}
+		t.clients[id] = u
+	}
+	return u
+}
+
+func (t *usageTable) list() []usageStatus {
+	if t == nil {
+		return []usageStatus{}
+	}
+	t.Lock()
+	clients := make([]*clientUsage, 0, len(t.clients))
+	for _, u := range t.clients {
+		clients = append(clients, u)
+	}
+	t.Unlock()
+
+	list := make([]usageStatus, 0, len(clients))
+	for _, u := range clients {
+		list = append(list, u.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+	return list
+}
+
+// start counting again from zero, false if client is unknown
+func (t *usageTable) reset(id string) bool {
+	if t == nil {
+		return false
+	}
+	t.Lock()
+	u := t.clients[id]
+	t.Unlock()
+	if u == nil {
+		return false
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.up, u.down, u.dayBytes, u.monthBytes = 0, 0, 0, 0
+	u.check(time.Now())
+	return true
+}
@@ -0,0 +1,80 @@
+//
+//   date  : 2015-10-05
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientUsage(t *testing.T) {
+	quotas := map[string]*Quota{
+		"alice": {Client: "alice", Daily: 100, Action: QuotaReject},
+		"bob":   {Client: "bob", Monthly: 100, Action: QuotaThrottle, Rate: 10},
+	}
+	table := newUsageTable(func(id string) *Quota { return quotas[id] })
+
+	alice := table.get("alice")
+	alice.add(60, 30)
+	if err := alice.allow(); err != nil {
+		t.Fatalf("alice should be allowed:%v", err)
+	}
+	alice.add(10, 0)
+	if err := alice.allow(); err != errQuotaExceeded {
+		t.Fatalf("alice should exceed quota:%v", err)
+	}
+
+	// a new day starts
+	alice.lock.Lock()
+	alice.day = alice.day.Add(-time.Hour * 24)
+	alice.lock.Unlock()
+	if err := alice.allow(); err != nil {
+		t.Fatalf("alice should be allowed in a new day:%v", err)
+	}
+
+	bob := table.get("bob")
+	bob.add(100, 0)
+	if err := bob.allow(); err != nil {
+		t.Fatalf("throttled client should be allowed:%v", err)
+	}
+	if limit := bob.limiters(); limit.send == nil || limit.recv == nil {
+		t.Fatal("bob should be throttled")
+	}
+	if limit := table.get("carol").limiters(); limit.send != nil {
+		t.Fatal("client without quota should not be throttled")
+	}
+
+	list := table.list()
+	if len(list) != 3 || list[0].Client != "alice" || list[0].Up != 70 || list[0].Down != 30 || list[0].Daily != 0 || list[0].Monthly != 100 {
+		t.Fatalf("unexpected usage:%+v", list)
+	}
+	if !list[1].Exceeded || list[1].Quota == nil {
+		t.Fatalf("unexpected usage of bob:%+v", list[1])
+	}
+	if !table.reset("bob") || table.reset("dave") {
+		t.Fatal("unexpected reset result")
+	}
+	if bob.limiters().send != nil {
+		t.Fatal("bob should not be throttled after reset")
+	}
+}
+
+func TestPairQuota(t *testing.T) {
+	p := newTestPair(t, Config{Quotas: []*Quota{{Daily: 10}}}, Config{})
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	waitFor(t, "traffic counted", func() bool {
+		list := p.server.usage.list()
+		return len(list) == 1 && list[0].Up == 5 && list[0].Down == 5
+	})
+	if echoed := p.roundTrip(t, "hello"); echoed != "" {
+		t.Fatalf("link should be rejected, echo:%q", echoed)
+	}
+	waitFor(t, "links released", func() bool {
+		return p.client.activeHubs()[0].LinkCount() == 0
+	})
+}
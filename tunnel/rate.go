@@ -0,0 +1,97 @@
+//
+//   date  : 2015-09-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// token bucket in bytes, burst is one second of rate. Tokens could be taken
+// in advance, then the taker waits until the debt is refilled, so waiters
+// are served in order.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// nil if rate is not positive, a nil limiter never waits
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// take n tokens, return how long to wait
+func (l *rateLimiter) take(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// return false if ctx is done before n bytes are allowed
+func (l *rateLimiter) wait(ctx context.Context, n int) bool {
+	if l == nil || n <= 0 {
+		return true
+	}
+	d := l.take(n)
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// limiters of both directions
+type rateLimiters struct {
+	send *rateLimiter // data read from local conn and sent to tunnel
+	recv *rateLimiter // data received from tunnel and written to local conn
+}
+
+func newRateLimiters(rate int64) rateLimiters {
+	return rateLimiters{
+		send: newRateLimiter(rate),
+		recv: newRateLimiter(rate),
+	}
+}
+
+// rate limit of each link and all links of the hub in bytes per second, for
+// each direction; 0 means unlimited
+func (self *Hub) SetRateLimit(link, hub int64) {
+	self.linkRate = link
+	self.rate = newRateLimiters(hub)
+}
+
+// wait until n bytes are allowed by limiters of link, hub, bulk class and
+// client exceeding quota
+func (self *Link) throttle(link, hub, bulk, client *rateLimiter, n int) bool {
+	return link.wait(self.ctx, n) && hub.wait(self.ctx, n) && bulk.wait(self.ctx, n) && client.wait(self.ctx, n)
+}
@@ -0,0 +1,41 @@
+//
+//   date  : 2015-09-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0) != nil {
+		t.Fatal("limiter should be disabled")
+	}
+	var l *rateLimiter
+	if !l.wait(context.Background(), 1<<20) {
+		t.Fatal("nil limiter should never wait")
+	}
+
+	l = newRateLimiter(1000)
+	// burst
+	if d := l.take(1000); d != 0 {
+		t.Fatalf("unexpected wait in burst:%v", d)
+	}
+	if d := l.take(500); d < time.Millisecond*400 || d > time.Millisecond*500 {
+		t.Fatalf("unexpected wait:%v", d)
+	}
+	// waiters queue up
+	if d := l.take(500); d < time.Millisecond*900 || d > time.Second {
+		t.Fatalf("unexpected wait:%v", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if l.wait(ctx, 1000) {
+		t.Fatal("wait should be canceled")
+	}
+}
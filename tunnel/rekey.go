@@ -0,0 +1,117 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// rekeying: an end of aes-256-gcm tunnel ratchets key of its direction after
+// writing RekeyBytes, or RekeyInterval since the last time. It sends
+// TUNNEL_REKEY as the last frame of a cipher chunk, then seals chunks by a
+// key derived from the old one by hkdf. Peer ratchets its reader when it
+// reads TUNNEL_REKEY, so connection and links go on. Old keys are dropped,
+// traffic sealed before isn't exposed if a later key leaks. Resumable
+// tunnels are not rekeyed, every resumption does a new handshake instead.
+
+var errRekey = errors.New("unexpected rekey")
+
+type rekeyState struct {
+	rd   *aeadReader
+	wr   *aeadWriter
+	rkey []byte
+	wkey []byte
+
+	bytes    int64 // bytes written under a key, ignored if 0
+	interval time.Duration
+	since    int64 // bytes written by tunnel at last rekey
+	last     time.Time
+}
+
+func nextKey(key []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, key, nil, "gotunnel rekey", len(key))
+}
+
+// peer could rekey if it's supported, and this end rekeys after bytes or
+// interval. should be called before any read or write
+func (t *Tunnel) setRekey(rd io.Reader, wr io.Writer, key []byte, bytes int64, interval time.Duration) {
+	if !t.has(capRekey) || t.sess != nil {
+		return
+	}
+	r, ok := rd.(*aeadReader)
+	w, ok2 := wr.(*aeadWriter)
+	if ok && ok2 {
+		t.rekey = &rekeyState{rd: r, wr: w, rkey: key, wkey: key, bytes: bytes, interval: interval, last: time.Now()}
+	}
+}
+
+func (t *Tunnel) rekeyDue() bool {
+	s := t.rekey
+	if s == nil {
+		return false
+	}
+	return (s.bytes > 0 && atomic.LoadInt64(&t.wbytes)-s.since >= s.bytes) ||
+		(s.interval > 0 && time.Since(s.last) >= s.interval)
+}
+
+// send TUNNEL_REKEY, and seal frames after it by next key. It's called by
+// pump only.
+func (t *Tunnel) writeRekey() error {
+	s := t.rekey
+	data := make([]byte, t.cmdSize())
+	data[0] = TUNNEL_REKEY
+	frame := t.encodeFrame(0, t.whead[:t.headSize()], data)
+	if _, err := t.writer.Write(frame); err != nil {
+		return err
+	}
+	if err := t.writer.Flush(); err != nil {
+		return err
+	}
+	key, err := nextKey(s.wkey)
+	if err != nil {
+		return err
+	}
+	aead, err := newAead(key)
+	if err != nil {
+		return err
+	}
+	s.wr.aead, s.wr.nonce = aead, newAeadNonce(aead.NonceSize(), s.wr.nonce[0])
+	s.wkey = key
+	s.since = atomic.AddInt64(&t.wbytes, int64(len(frame)))
+	s.last = time.Now()
+	atomic.AddInt64(&stats.Rekeys, 1)
+	Debug("%s rekey", t.desc)
+	return nil
+}
+
+func (t *Tunnel) isRekey(payload Payload) bool {
+	return payload.linkid == 0 && len(payload.data) >= t.cmdSize() && payload.data[0] == TUNNEL_REKEY
+}
+
+// peer rekeys, chunks after TUNNEL_REKEY are opened by next key
+func (t *Tunnel) onRekey() error {
+	s := t.rekey
+	// peer must flush TUNNEL_REKEY at the end of a chunk
+	if s == nil || t.reader.Buffered() > 0 || len(s.rd.left) > 0 {
+		return errRekey
+	}
+	key, err := nextKey(s.rkey)
+	if err != nil {
+		return err
+	}
+	aead, err := newAead(key)
+	if err != nil {
+		return err
+	}
+	s.rd.aead, s.rd.nonce = aead, newAeadNonce(aead.NonceSize(), s.rd.nonce[0])
+	s.rkey = key
+	return nil
+}
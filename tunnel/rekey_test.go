@@ -0,0 +1,32 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPairRekey(t *testing.T) {
+	for _, integrity := range []bool{false, true} {
+		p := newTestPair(t, Config{RekeyBytes: 4096}, Config{RekeyBytes: 4096, Integrity: integrity})
+		if !p.client.activeHubs()[0].tunnel.has(capRekey) {
+			t.Fatal("rekey isn't negotiated")
+		}
+		rekeys := atomic.LoadInt64(&stats.Rekeys)
+		data := strings.Repeat("rekey", PacketSize)
+		for i := 0; i < 4; i++ {
+			if got := p.roundTrip(t, data); got != data {
+				t.Fatalf("unexpected echo of %d bytes", len(got))
+			}
+		}
+		// both directions, every 4KB
+		if n := atomic.LoadInt64(&stats.Rekeys) - rekeys; n < 2*int64(len(data))/4096 {
+			t.Fatalf("unexpected rekeys:%d", n)
+		}
+	}
+}
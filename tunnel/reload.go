@@ -0,0 +1,79 @@
+//
+//   date  : 2015-08-18
+//   author: xjdrew
+//
+
+package tunnel
+
+func (app *App) acl() ACL {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	return app.ACL
+}
+
+// reload rules, acl, secrets, clients, quotas and log level from config, other fields are
+// ignored, Secret is kept if it's empty.
+// Tunnels and links are kept, listeners are rebuilt only for changed rules,
+// links of removed rules run until they are closed.
+func (app *App) Reload(c *Config) error {
+	config := *c
+	if err := loadSecrets(&config); err != nil {
+		return err
+	}
+	rules, err := app.buildRules(config.Rules)
+	if err != nil {
+		return err
+	}
+	for _, r := range config.ACL {
+		if err := r.init(); err != nil {
+			return err
+		}
+	}
+	for _, q := range config.Quotas {
+		if err := q.init(); err != nil {
+			return err
+		}
+	}
+
+	var added, removed []*Rule
+	app.lock.Lock()
+	for name, rule := range rules {
+		if old, ok := app.rules[name]; ok && old.equal(rule) {
+			rules[name] = old
+			continue
+		}
+		added = append(added, rule)
+	}
+	for name, old := range app.rules {
+		if rules[name] != old {
+			removed = append(removed, old)
+		}
+	}
+	app.Rules = config.Rules
+	app.rules = rules
+	app.ACL = config.ACL
+	app.Secrets = config.Secrets
+	app.Clients = config.Clients
+	app.Quotas = config.Quotas
+	if config.Secret != "" {
+		app.Secret = config.Secret
+	}
+	app.lock.Unlock()
+
+	if config.LogLevel != nil {
+		SetLogLevel(*config.LogLevel)
+	}
+	Log("reload config, %d rules added, %d rules removed, %d acl rules", len(added), len(removed), len(config.ACL))
+	if app.service == nil {
+		return nil
+	}
+	return app.service.reloadRules(added, removed)
+}
+
+func (cli *Client) Reload(config *Config) error {
+	return cli.app.Reload(config)
+}
+
+func (self *Server) Reload(config *Config) error {
+	return self.app.Reload(config)
+}
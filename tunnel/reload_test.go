@@ -0,0 +1,53 @@
+//
+//   date  : 2015-08-18
+//   author: xjdrew
+//
+
+package tunnel
+
+import "testing"
+
+func TestReloadRules(t *testing.T) {
+	app := &App{Config: Config{
+		Tunnels: 1,
+		Rules: []*Rule{
+			{Name: "ssh", Listen: "127.0.0.1:2222", Backend: "127.0.0.1:22"},
+			{Name: "web", Listen: "127.0.0.1:8080", Backend: "127.0.0.1:80"},
+		},
+	}}
+	if err := app.initRules(); err != nil {
+		t.Fatal(err)
+	}
+	ssh, web := app.findRule("ssh"), app.findRule("web")
+
+	level := uint(2)
+	config := &Config{
+		Rules: []*Rule{
+			{Name: "ssh", Listen: "127.0.0.1:2222", Backend: "127.0.0.1:22"},
+			{Name: "web", Listen: "127.0.0.1:8081", Backend: "127.0.0.1:80"},
+		},
+		ACL:      ACL{{Action: ACLDeny, Dest: "10.0.0.0/8"}},
+		LogLevel: &level,
+	}
+	defer SetLogLevel(GetLogLevel())
+	if err := app.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if app.findRule("ssh") != ssh {
+		t.Fatal("unchanged rule should be kept")
+	}
+	if r := app.findRule("web"); r == web || r.Listen != "127.0.0.1:8081" {
+		t.Fatal("changed rule should be replaced")
+	}
+	if len(app.acl()) != 1 || GetLogLevel() != level {
+		t.Fatal("acl or log level not reloaded")
+	}
+
+	config.ACL = ACL{{Action: "drop"}}
+	if err := app.Reload(config); err == nil {
+		t.Fatal("reload bad acl should fail")
+	}
+	if len(app.acl()) != 1 {
+		t.Fatal("acl should be kept if reload failed")
+	}
+}
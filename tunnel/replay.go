@@ -0,0 +1,92 @@
+//
+//   date  : 2015-10-01
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// seconds tokens are remembered, and max age of challenge of a ticket hello
+const DefaultReplayWindow = 30
+
+// tokens seen in the window. A token answering server's challenge is bound
+// to its random nonce, so a captured one fails against a fresh challenge;
+// tokens verified are remembered to tell such replays from wrong secrets.
+// A ticket hello carries a challenge of client itself instead, it's
+// rejected if older than the window or seen before.
+type replayCache struct {
+	sync.Mutex
+	window   time.Duration
+	seen     map[authToken]time.Time          // issue time of challenges of ticket hellos
+	answered map[[TaaTokenSize]byte]time.Time // tokens verified and when
+	swept    time.Time
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{
+		window:   window,
+		seen:     make(map[authToken]time.Time),
+		answered: make(map[[TaaTokenSize]byte]time.Time),
+	}
+}
+
+// check freshness of challenge of client whose ticket is verified, and
+// remember it; false if it's stale or seen before
+func (c *replayCache) check(challenge authToken, now time.Time) bool {
+	issued := time.Unix(0, int64(challenge.timestamp))
+	if now.Sub(issued) > c.window || issued.Sub(now) > c.window {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.sweep(now)
+	if _, ok := c.seen[challenge]; ok {
+		return false
+	}
+	c.seen[challenge] = issued
+	return true
+}
+
+// token sent by client is verified before in window
+func (c *replayCache) replayed(token []byte, now time.Time) bool {
+	var key [TaaTokenSize]byte
+	copy(key[:], token)
+	c.Lock()
+	defer c.Unlock()
+	c.sweep(now)
+	_, ok := c.answered[key]
+	return ok
+}
+
+// remember token verified
+func (c *replayCache) answer(token []byte, now time.Time) {
+	var key [TaaTokenSize]byte
+	copy(key[:], token)
+	c.Lock()
+	defer c.Unlock()
+	c.answered[key] = now
+}
+
+// entries out of window are rejected by timestamp or can't be verified
+// anyway, called with lock held
+func (c *replayCache) sweep(now time.Time) {
+	if now.Sub(c.swept) <= c.window {
+		return
+	}
+	for challenge, t := range c.seen {
+		if now.Sub(t) > c.window {
+			delete(c.seen, challenge)
+		}
+	}
+	for token, t := range c.answered {
+		if now.Sub(t) > c.window {
+			delete(c.answered, token)
+		}
+	}
+	c.swept = now
+}
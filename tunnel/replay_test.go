@@ -0,0 +1,129 @@
+//
+//   date  : 2015-10-01
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	c := newReplayCache(time.Second * 30)
+	now := time.Now()
+	token := authToken{challenge: 1, timestamp: uint64(now.UnixNano())}
+	if !c.check(token, now) {
+		t.Fatal("fresh token should pass")
+	}
+	if c.check(token, now.Add(time.Second)) {
+		t.Fatal("replayed token should be rejected")
+	}
+	if !c.check(authToken{challenge: 2, timestamp: token.timestamp}, now) {
+		t.Fatal("another challenge should pass")
+	}
+
+	stale := authToken{challenge: 3, timestamp: uint64(now.Add(-time.Minute).UnixNano())}
+	if c.check(stale, now) {
+		t.Fatal("stale token should be rejected")
+	}
+
+	// swept after window, they are rejected by timestamp anyway
+	later := now.Add(time.Minute)
+	if !c.check(authToken{challenge: 4, timestamp: uint64(later.UnixNano())}, later) || len(c.seen) != 1 {
+		t.Fatalf("expired tokens should be swept:%d", len(c.seen))
+	}
+}
+
+func TestReplayCacheTokens(t *testing.T) {
+	c := newReplayCache(time.Second * 30)
+	now := time.Now()
+	token := []byte("0123456789abcdef")
+	if c.replayed(token, now) {
+		t.Fatal("new token is replayed")
+	}
+	c.answer(token, now)
+	if !c.replayed(token, now.Add(time.Second)) {
+		t.Fatal("verified token should be replayed")
+	}
+	if c.replayed([]byte("fedcba9876543210"), now) {
+		t.Fatal("another token is replayed")
+	}
+	if c.replayed(token, now.Add(time.Minute)) || len(c.answered) != 0 {
+		t.Fatalf("expired tokens should be swept:%d", len(c.answered))
+	}
+}
+
+// a captured handshake of client is sent again to server
+func TestPairReplayHandshake(t *testing.T) {
+	const proxyAddr = "127.0.0.1:8009"
+	var lock sync.Mutex
+	var captured []byte
+	p := newTestPair(t, Config{}, Config{Backend: proxyAddr}, func(p *testPair) {
+		ln, err := p.network.Listen(proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				server, err := p.network.Dial(context.Background(), testTunnelAddr)
+				if err != nil {
+					conn.Close()
+					continue
+				}
+				go func() {
+					defer server.Close()
+					buf := make([]byte, 1024)
+					for {
+						n, err := conn.Read(buf)
+						if err != nil {
+							return
+						}
+						lock.Lock()
+						if len(captured) < 1024 {
+							captured = append(captured, buf[:n]...)
+						}
+						lock.Unlock()
+						server.Write(buf[:n])
+					}
+				}()
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, server)
+				}()
+			}
+		}()
+	})
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+
+	replays := atomic.LoadInt64(&stats.TokenReplayed)
+	conn, err := p.network.Dial(context.Background(), testTunnelAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	lock.Lock()
+	replayed := append([]byte(nil), captured...)
+	lock.Unlock()
+	go conn.Write(replayed)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	// challenge, then server closes the connection
+	if data, err := io.ReadAll(conn); err != nil || len(data) != int(TaaBlockSize) {
+		t.Fatalf("replayed handshake isn't rejected:%d bytes, %v", len(data), err)
+	}
+	if n := atomic.LoadInt64(&stats.TokenReplayed); n != replays+1 {
+		t.Fatalf("replay isn't counted:%d", n-replays)
+	}
+}
@@ -0,0 +1,167 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	errNoRoute  = errors.New("no route matched")
+	errHTTPHead = errors.New("http request head too large")
+	crlfcrlf    = []byte("\r\n\r\n")
+)
+
+// route of a routing listener, connections whose host matches Host are
+// forwarded to Service, or to Dest through a proxy service of server
+type Route struct {
+	Host    string `json:"host"`    // exact name, *.suffix for any subdomain, or * for all
+	Service string `json:"service"` // service of server, the rule's own by default
+	Dest    string `json:"dest"`    // host:port sent to a proxy service, :port uses the matched host
+}
+
+func (r *Route) match(host string) bool {
+	pattern := strings.ToLower(r.Host)
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	default:
+		return host == pattern
+	}
+}
+
+// the rule peeks host of accepted connections to choose a route
+func (r *Rule) routing() bool {
+	return r.SNI || r.HTTPHost
+}
+
+func (r *Rule) checkRoutes() error {
+	if !r.routing() {
+		if len(r.Routes) > 0 {
+			return errors.New("routes need sni or http_host")
+		}
+		return nil
+	}
+	if r.SNI && r.HTTPHost {
+		return errors.New("sni and http_host are exclusive")
+	}
+	if r.UDP || r.dynamic() || r.Reverse || (r.SNI && r.ListenCert != "") {
+		return errors.New("routing only works with tcp forwarding")
+	}
+	if len(r.Routes) == 0 {
+		return errors.New("routing needs routes")
+	}
+	for _, route := range r.Routes {
+		if route.Host == "" {
+			return errors.New("route without host")
+		}
+		if route.Dest != "" {
+			if _, _, err := net.SplitHostPort(route.Dest); err != nil {
+				return fmt.Errorf("route %s: %s", route.Host, err)
+			}
+		}
+	}
+	return nil
+}
+
+// first route matching host, host is case insensitive
+func (r *Rule) findRoute(host string) *Route {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, route := range r.Routes {
+		if route.match(host) {
+			return route
+		}
+	}
+	return nil
+}
+
+// peek host header of the first http request without consuming it, port is
+// stripped. The request head must fit in buffer of rd.
+func peekHTTPHost(rd *bufio.Reader) (string, error) {
+	var head []byte
+	for {
+		buf, err := rd.Peek(rd.Buffered() + 1)
+		if i := bytes.Index(buf, crlfcrlf); i >= 0 {
+			head = buf[:i+len(crlfcrlf)]
+			break
+		}
+		if err == bufio.ErrBufferFull {
+			return "", errHTTPHead
+		} else if err != nil {
+			return "", err
+		}
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return "", err
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.Trim(host, "[]"), nil
+}
+
+// peek host of conn by the rule's routing mode, then choose service and
+// destination of its link. conn returned replays data peeked.
+func (r *Rule) route(conn BiConn) (BiConn, string, string, error) {
+	if Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(Timeout) * time.Second))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	rd := bufio.NewReaderSize(conn, tlsRecordSize)
+	var host string
+	var err error
+	if r.SNI {
+		host, err = peekServerName(rd)
+	} else {
+		host, err = peekHTTPHost(rd)
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+	route := r.findRoute(host)
+	if route == nil {
+		return nil, "", "", fmt.Errorf("%w: %q", errNoRoute, host)
+	}
+
+	service, dest := route.Service, route.Dest
+	if service == "" {
+		service = r.Name
+	}
+	if strings.HasPrefix(dest, ":") {
+		if host == "" {
+			return nil, "", "", fmt.Errorf("%w: no host for %s", errNoRoute, dest)
+		}
+		dest = net.JoinHostPort(host, dest[1:])
+	}
+	if rd.Buffered() > 0 {
+		conn = &bufferedConn{BiConn: conn, rd: rd}
+	}
+	return conn, service, dest, nil
+}
+
+func routesEqual(a, b []*Route) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPeekHTTPHost(t *testing.T) {
+	cases := map[string]string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\nbody":  "example.com",
+		"GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n": "example.com",
+		"GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n":         "::1",
+		"GET / HTTP/1.0\r\n\r\n":                           "",
+	}
+	for req, host := range cases {
+		rd := bufio.NewReader(strings.NewReader(req))
+		got, err := peekHTTPHost(rd)
+		if err != nil || got != host {
+			t.Fatalf("unexpected host of %q:%q, %v", req, got, err)
+		}
+		if rd.Buffered() != len(req) {
+			t.Fatal("request should not be consumed")
+		}
+	}
+
+	head := "GET / HTTP/1.1\r\nX-Pad: " + strings.Repeat("x", 64) + "\r\n\r\n"
+	if _, err := peekHTTPHost(bufio.NewReaderSize(strings.NewReader(head), 32)); err != errHTTPHead {
+		t.Fatalf("unexpected err:%v", err)
+	}
+	if _, err := peekHTTPHost(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))); err != io.EOF {
+		t.Fatalf("unexpected err:%v", err)
+	}
+}
+
+func TestPairHTTPHostRoute(t *testing.T) {
+	const otherBackend = "127.0.0.1:8005"
+	server := Config{Rules: []*Rule{
+		{Name: "a", Backend: testBackendAddr},
+		{Name: "b", Backend: otherBackend},
+	}}
+	client := Config{Rules: []*Rule{
+		{Name: "web", Listen: testListenAddr, HTTPHost: true, Routes: []*Route{
+			{Host: "a.example.com", Service: "a"},
+			{Host: "*", Service: "b"},
+		}},
+	}}
+	p := newTestPair(t, server, client)
+
+	ln, err := p.network.Listen(otherBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "b")
+			conn.Close()
+		}
+	}()
+
+	send := func(req string) string {
+		conn, err := p.network.Dial(context.Background(), testListenAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, req)
+		conn.(BiConn).CloseWrite()
+		data, _ := io.ReadAll(conn)
+		return string(data)
+	}
+
+	// request head read for routing is sent with the rest
+	req := "POST / HTTP/1.1\r\nHost: a.example.com\r\nContent-Length: 5\r\n\r\nhello"
+	if echoed := send(req); echoed != req {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	if data := send("GET / HTTP/1.1\r\nHost: other.net\r\n\r\n"); data != "b" {
+		t.Fatalf("unexpected data:%q", data)
+	}
+
+	// failed routing releases hub
+	if data := send("not http"); data != "" {
+		t.Fatalf("unrouted connection should be closed:%q", data)
+	}
+	waitHubsReleased(t, p.client)
+}
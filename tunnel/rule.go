@@ -0,0 +1,293 @@
+//
+//   date  : 2015-06-26
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// forwarding rule, client listens on Listen and server dials Backend
+// for links created with the rule's name. With Socks5 or HTTPProxy, client
+// speaks the proxy protocol on Listen and server dials the destination
+// requested by proxy client. Reverse rule works in the other direction:
+// server listens on Listen and client dials Backend, so a service behind NAT
+// could be exposed by the server.
+type Rule struct {
+	Name      string `json:"name"`
+	Listen    string `json:"listen"`
+	Backend   string `json:"backend"`
+	UDP       bool   `json:"udp"`
+	Socks5    bool   `json:"socks5"`
+	HTTPProxy bool   `json:"http_proxy"` // accept http CONNECT requests
+	Reverse   bool   `json:"reverse"`
+
+	// like Socks5, but destination is the original one of connections
+	// redirected to Listen by iptables
+	Transparent bool `json:"transparent"`
+
+	IdleTimeout   int `json:"idle_timeout"`   // seconds, overrides Config.IdleTimeout if positive, disabled if negative
+	ProxyProtocol int `json:"proxy_protocol"` // send PROXY protocol header of version 1 or 2 to backend, tcp only
+
+	ConnectTimeout int `json:"connect_timeout"` // seconds to connect backend or destination, Config.DialTimeout if 0
+
+	Priority string `json:"priority"` // interactive, normal or bulk, default normal
+
+	NoCrypt bool `json:"nocrypt"` // data of links is authenticated but not encrypted
+
+	EarlyData bool `json:"early_data"` // first bytes of connections are sent with link creation
+
+	// tls of backend connections dialed by server, or by client for reverse rules
+	BackendTLS        bool   `json:"backend_tls"`
+	BackendServerName string `json:"backend_server_name"` // sni and verified name, host of backend by default
+	BackendCA         string `json:"backend_ca"`          // ca file to verify backend, system roots by default
+	BackendCert       string `json:"backend_cert"`        // client certificate presented to backend, optional
+	BackendKey        string `json:"backend_key"`
+	BackendInsecure   bool   `json:"backend_insecure"` // skip verifying backend certificate
+
+	// terminate tls of connections accepted on Listen
+	ListenCert string `json:"listen_cert"`
+	ListenKey  string `json:"listen_key"`
+
+	// client chooses route of accepted connections by server name of tls
+	// client hello, or by host header of http request
+	SNI      bool     `json:"sni"`
+	HTTPHost bool     `json:"http_host"`
+	Routes   []*Route `json:"routes"`
+
+	// the end dialing backend copies data sent to backend to Mirror, and
+	// captures data of both directions in pcap file Tap
+	Mirror string `json:"mirror"`
+	Tap    string `json:"tap"`
+
+	// the end dialing backend checks Backend and Failover every HealthCheck
+	// seconds by tcp connect, or by http GET of path HealthCheckHTTP. Links
+	// go to Failover while Backend is down, and are rejected if both are down
+	HealthCheck     int    `json:"health_check"`
+	HealthCheckHTTP string `json:"health_check_http"`
+	Failover        string `json:"failover"`
+
+	// links are balanced over Backends instead of Backend by BackendBalance:
+	// round-robin, least-conns or weighted, default round-robin
+	Backends       []*Target `json:"backends"`
+	BackendBalance string    `json:"backend_balance"`
+
+	// connections of each backend dialed ahead, so links skip tcp and tls
+	// handshakes of backend; each serves one link
+	BackendIdle int `json:"backend_idle"`
+
+	// the end dialing backend runs command Exec, path and arguments, for
+	// every link instead of dialing backend, and wires link to its stdio
+	Exec []string `json:"exec"`
+
+	// client connects destination directly if no tunnel could take a
+	// connection: the one requested by proxy client, or DirectBackend
+	Direct        bool   `json:"direct"`
+	DirectBackend string `json:"direct_backend"`
+
+	laddr    *net.TCPAddr
+	lpath    string // unix socket path of Listen, laddr is nil if it's set
+	priority uint8
+	echo     bool // built-in echo service
+
+	pool *backendPool // nil if there is no backend or it isn't dialed here
+
+	backendTLS *tls.Config // nil if backend is plain or not dialed here
+	listenTLS  *tls.Config // nil if accepted connections are plain or not accepted here
+}
+
+// destination is chosen by proxy client
+func (r *Rule) dynamic() bool {
+	return r.Socks5 || r.HTTPProxy || r.Transparent
+}
+
+func (r *Rule) String() string {
+	if r.Name == "" {
+		return "default"
+	}
+	return r.Name
+}
+
+// the unnamed default rule comes from Listen/Backend, client only use it
+// if there is no rule, server always use it for links without service
+func (app *App) initRules() error {
+	rules, err := app.buildRules(app.Rules)
+	if err != nil {
+		return err
+	}
+	app.rules = rules
+	return nil
+}
+
+func (app *App) buildRules(configs []*Rule) (map[string]*Rule, error) {
+	var rules []*Rule
+	if app.Tunnels == 0 || len(configs) == 0 {
+		rules = append(rules, &Rule{
+			Listen:    app.Listen,
+			Backend:   app.Backend,
+			UDP:       app.UDP,
+			Socks5:    app.Socks5,
+			HTTPProxy: app.HTTPProxy,
+
+			Transparent: app.Transparent,
+
+			ProxyProtocol: app.ProxyProtocol,
+
+			Priority: app.Priority,
+
+			NoCrypt: app.NoCrypt,
+
+			EarlyData: app.EarlyData,
+
+			Direct:        app.Direct,
+			DirectBackend: app.DirectBackend,
+		})
+	}
+
+	m := make(map[string]*Rule)
+	for _, rule := range append(rules, configs...) {
+		if _, ok := m[rule.Name]; ok {
+			return nil, fmt.Errorf("duplicated rule: %s", rule)
+		}
+
+		if rule.UDP && rule.dynamic() {
+			return nil, fmt.Errorf("rule %s: proxy mode doesn't support udp", rule)
+		}
+		if rule.Socks5 && rule.HTTPProxy || rule.Transparent && (rule.Socks5 || rule.HTTPProxy) {
+			return nil, fmt.Errorf("rule %s: socks5, http proxy and transparent are exclusive", rule)
+		}
+		if rule.Transparent && (rule.ListenCert != "" || strings.HasPrefix(rule.Listen, unixScheme)) {
+			return nil, fmt.Errorf("rule %s: transparent rule listens on plain tcp", rule)
+		}
+		if rule.ProxyProtocol < 0 || rule.ProxyProtocol > ProxyProtocolV2 {
+			return nil, fmt.Errorf("rule %s: unknown proxy protocol version %d", rule, rule.ProxyProtocol)
+		}
+		if rule.ProxyProtocol > 0 && rule.UDP {
+			return nil, fmt.Errorf("rule %s: proxy protocol doesn't support udp", rule)
+		}
+		prio, ok := priorities[rule.Priority]
+		if !ok {
+			return nil, fmt.Errorf("rule %s: unknown priority %s", rule, rule.Priority)
+		}
+		rule.priority = prio
+		if rule.NoCrypt {
+			Log("rule %s: nocrypt, data of its links is authenticated but not encrypted", rule)
+		}
+		if rule.Reverse && (rule.Name == "" || rule.UDP || rule.dynamic()) {
+			return nil, fmt.Errorf("rule %s: reverse rule should be named tcp rule", rule)
+		}
+		if rule.UDP && rule.tlsEnabled() {
+			return nil, fmt.Errorf("rule %s: tls doesn't support udp", rule)
+		}
+		if rule.UDP && (strings.HasPrefix(rule.Listen, unixScheme) || rule.hasUnixBackend()) {
+			return nil, fmt.Errorf("rule %s: unix socket doesn't support udp", rule)
+		}
+		if rule.BackendTLS && rule.BackendServerName == "" && rule.hasUnixBackend() {
+			return nil, fmt.Errorf("rule %s: tls to unix socket backend needs backend server name", rule)
+		}
+		if rule.UDP && (rule.Mirror != "" || rule.Tap != "") {
+			return nil, fmt.Errorf("rule %s: mirror and tap don't support udp", rule)
+		}
+		if err := rule.checkRoutes(); err != nil {
+			return nil, fmt.Errorf("rule %s: %s", rule, err)
+		}
+		if rule.HealthCheck < 0 || (rule.HealthCheck > 0 && rule.UDP) {
+			return nil, fmt.Errorf("rule %s: health check should be positive seconds of a tcp rule", rule)
+		}
+		if rule.HealthCheckHTTP != "" && !strings.HasPrefix(rule.HealthCheckHTTP, "/") {
+			return nil, fmt.Errorf("rule %s: health check http should be a path", rule)
+		}
+		if rule.Failover != "" && rule.HealthCheck == 0 {
+			return nil, fmt.Errorf("rule %s: failover needs health check", rule)
+		}
+		if rule.Backend != "" && len(rule.Backends) > 0 {
+			return nil, fmt.Errorf("rule %s: backend and backends are exclusive", rule)
+		}
+		switch rule.BackendBalance {
+		case "", backendRoundRobin, backendLeastConns, backendWeighted:
+		default:
+			return nil, fmt.Errorf("rule %s: unknown backend balance %s", rule, rule.BackendBalance)
+		}
+
+		if len(rule.Exec) > 0 && (rule.Exec[0] == "" || rule.Backend != "" || len(rule.Backends) > 0 || rule.UDP || rule.dynamic() ||
+			rule.HealthCheck > 0 || rule.BackendTLS || rule.ProxyProtocol > 0 || rule.Mirror != "" || rule.Tap != "") {
+			return nil, fmt.Errorf("rule %s: exec rule should be a tcp rule of a command without backend", rule)
+		}
+
+		if rule.Direct && (rule.UDP || rule.Reverse) {
+			return nil, fmt.Errorf("rule %s: direct works for tcp rules of client", rule)
+		}
+		if rule.Direct && !rule.dynamic() && rule.DirectBackend == "" {
+			return nil, fmt.Errorf("rule %s: direct needs direct backend", rule)
+		}
+		if rule.DirectBackend != "" && !rule.Direct {
+			return nil, fmt.Errorf("rule %s: direct backend needs direct", rule)
+		}
+
+		if rule.EarlyData && (rule.UDP || rule.Socks5 || rule.HTTPProxy) {
+			return nil, fmt.Errorf("rule %s: early data works for tcp rules without proxy handshake", rule)
+		}
+		if rule.BackendIdle < 0 || rule.BackendIdle > 0 && (rule.UDP || rule.ProxyProtocol > 0 || len(rule.Exec) > 0) {
+			return nil, fmt.Errorf("rule %s: backend idle should be positive count of a tcp rule without proxy protocol", rule)
+		}
+
+		var err error
+		dialing := rule.Reverse != (app.Tunnels == 0)
+		if !dialing {
+			if path, ok := unixPath(rule.Listen); ok {
+				rule.lpath = path
+			} else {
+				rule.laddr, err = net.ResolveTCPAddr("tcp", rule.Listen)
+			}
+		} else if len(rule.Exec) == 0 && (!rule.dynamic() || rule.Backend != "" || len(rule.Backends) > 0) {
+			// proxy rule could work without a default backend
+			rule.pool, err = rule.newBackendPool()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s", rule, err)
+		}
+
+		// tls is originated by the end dialing backend, and terminated by
+		// the end listening
+		if dialing {
+			rule.backendTLS, err = rule.backendTLSConfig()
+		} else {
+			rule.listenTLS, err = rule.listenTLSConfig()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: load tls failed: %s", rule, err)
+		}
+		m[rule.Name] = rule
+	}
+	return m, nil
+}
+
+func (app *App) findRule(name string) *Rule {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	return app.rules[name]
+}
+
+// rules with same config share listener after reload
+func (r *Rule) equal(o *Rule) bool {
+	return r.Name == o.Name && r.Listen == o.Listen && r.Backend == o.Backend &&
+		r.UDP == o.UDP && r.Socks5 == o.Socks5 && r.HTTPProxy == o.HTTPProxy && r.Reverse == o.Reverse &&
+		r.Transparent == o.Transparent &&
+		r.IdleTimeout == o.IdleTimeout && r.ProxyProtocol == o.ProxyProtocol && r.Priority == o.Priority &&
+		r.ConnectTimeout == o.ConnectTimeout && r.NoCrypt == o.NoCrypt && r.EarlyData == o.EarlyData &&
+		r.BackendTLS == o.BackendTLS && r.BackendServerName == o.BackendServerName && r.BackendCA == o.BackendCA &&
+		r.BackendCert == o.BackendCert && r.BackendKey == o.BackendKey && r.BackendInsecure == o.BackendInsecure &&
+		r.ListenCert == o.ListenCert && r.ListenKey == o.ListenKey &&
+		r.SNI == o.SNI && r.HTTPHost == o.HTTPHost && routesEqual(r.Routes, o.Routes) &&
+		r.Mirror == o.Mirror && r.Tap == o.Tap &&
+		r.HealthCheck == o.HealthCheck && r.HealthCheckHTTP == o.HealthCheckHTTP && r.Failover == o.Failover &&
+		targetsEqual(r.Backends, o.Backends) && r.BackendBalance == o.BackendBalance && r.BackendIdle == o.BackendIdle &&
+		slices.Equal(r.Exec, o.Exec) &&
+		r.Direct == o.Direct && r.DirectBackend == o.DirectBackend
+}
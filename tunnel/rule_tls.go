@@ -0,0 +1,124 @@
+//
+//   date  : 2015-10-09
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// max time of tls handshake with local or backend connections of a rule
+const ruleTLSTimeout = 10 * time.Second
+
+// tls of a rule's own connections, independent of tunnel tls. The end
+// dialing backend originates tls to it, the end listening terminates tls of
+// accepted connections, so plain text services could be exposed over tls and
+// tls services reached by plain text clients.
+func (r *Rule) tlsEnabled() bool {
+	return r.BackendTLS || r.ListenCert != "" || r.ListenKey != ""
+}
+
+// config of backend tls, called by the end dialing backend
+func (r *Rule) backendTLSConfig() (*tls.Config, error) {
+	if !r.BackendTLS {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         r.BackendServerName,
+		InsecureSkipVerify: r.BackendInsecure,
+	}
+	if r.BackendCert != "" || r.BackendKey != "" {
+		cert, err := loadKeyPair(r.BackendCert, r.BackendKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if r.BackendCA != "" {
+		pem, err := ioutil.ReadFile(r.BackendCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + r.BackendCA)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// config of listener tls, called by the end listening
+func (r *Rule) listenTLSConfig() (*tls.Config, error) {
+	if r.ListenCert == "" && r.ListenKey == "" {
+		return nil, nil
+	}
+	cert, err := loadKeyPair(r.ListenCert, r.ListenKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// tls conn closes write by close_notify then half closes the raw conn, so
+// peer sees eof as with tcp
+type tlsBiConn struct {
+	*tls.Conn
+	raw BiConn
+}
+
+func (c tlsBiConn) CloseRead() error {
+	return c.raw.CloseRead()
+}
+
+func (c tlsBiConn) CloseWrite() error {
+	c.Conn.CloseWrite()
+	return c.raw.CloseWrite()
+}
+
+func tlsHandshake(conn *tls.Conn, raw BiConn) (BiConn, error) {
+	conn.SetDeadline(time.Now().Add(ruleTLSTimeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsBiConn{Conn: conn, raw: raw}, nil
+}
+
+// terminate tls of an accepted connection if rule listens with tls
+func (r *Rule) acceptTLS(conn BiConn) (BiConn, error) {
+	if r.listenTLS == nil {
+		return conn, nil
+	}
+	return tlsHandshake(tls.Server(conn, r.listenTLS), conn)
+}
+
+// originate tls to backend dest if rule wraps backend in tls, dest names the
+// server unless ServerName is set
+func (r *Rule) dialTLS(conn BiConn, dest string) (BiConn, error) {
+	if r.backendTLS == nil {
+		return conn, nil
+	}
+	config := r.backendTLS
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(dest)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	return tlsHandshake(tls.Client(conn, config), conn)
+}
@@ -0,0 +1,89 @@
+//
+//   date  : 2015-10-09
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"testing"
+)
+
+const testTLSBackendAddr = "127.0.0.1:8004"
+
+// client terminates tls of local connection, server originates tls to an
+// echo backend, data is plain in the tunnel
+func TestPairRuleTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	srv := newTestCert(t, dir, "server", ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.x509)
+
+	server := Config{Rules: []*Rule{
+		{Name: "tls", Backend: testTLSBackendAddr, BackendTLS: true, BackendCA: ca.cert},
+	}}
+	client := Config{Rules: []*Rule{
+		{Name: "tls", Listen: testListenAddr, ListenCert: srv.cert, ListenKey: srv.key},
+	}}
+	p := newTestPair(t, server, client)
+
+	cert, err := tls.LoadX509KeyPair(srv.cert, srv.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := p.network.Listen(testTLSBackendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.CloseWrite()
+			}()
+		}
+	}()
+
+	c, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := tls.Client(c, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	defer conn.Close()
+	go func() {
+		io.WriteString(conn, "hello")
+		conn.CloseWrite()
+	}()
+	echoed, err := io.ReadAll(conn)
+	if err != nil || string(echoed) != "hello" {
+		t.Fatalf("unexpected echo:%q, %v", echoed, err)
+	}
+
+	// failed tls handshake releases hub
+	plain, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(plain, "not a client hello")
+	io.ReadAll(plain)
+	plain.Close()
+	waitHubsReleased(t, p.client)
+
+	// tls rule is tcp only
+	rules := []*Rule{{Name: "dns", Backend: "127.0.0.1:53", UDP: true, BackendTLS: true}}
+	if _, err := p.server.app.buildRules(rules); err == nil {
+		t.Fatal("udp rule with tls should be refused")
+	}
+}
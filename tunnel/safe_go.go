@@ -5,8 +5,60 @@
 
 package tunnel
 
+import (
+	"errors"
+	"sync/atomic"
+)
+
 func Recover() {
 	if err := recover(); err != nil {
 		LogStack("goroutine failed:%v", err)
 	}
 }
+
+// peer is told a link is closed for a bug of this end
+var errLinkPanic = errors.New("internal error")
+
+// deferred by goroutines of a link: a panic closes the link with an error
+// frame, while the hub and other links go on
+func (self *Link) recoverPanic(where string) {
+	if err := recover(); err != nil {
+		atomic.AddInt64(&stats.Panics, 1)
+		LogCurStack("link(%d) %s panic:%v", self.id, where, err)
+		self.abort()
+	}
+}
+
+func (self *Link) abort() {
+	self.SendReject(errLinkPanic)
+	self.cancel()
+}
+
+// deferred by handling a frame of link in dispatch loop: the link is closed
+// and dispatch goes on with the next frame. Peer is told even if the link
+// isn't created yet, so it doesn't wait forever.
+func (self *Hub) recoverFrame(linkid uint32) {
+	if err := recover(); err != nil {
+		atomic.AddInt64(&stats.Panics, 1)
+		LogCurStack("link(%d) dispatch panic:%v", linkid, err)
+		if link := self.getLink(linkid); link != nil {
+			link.abort()
+		} else if linkid != 0 {
+			arg := []byte(errLinkPanic.Error())
+			if self.tunnel.has(capCloseCode) {
+				arg = closeArg(closeFailed, errLinkPanic.Error())
+			}
+			self.sendCtrl(LINK_CLOSE, linkid, arg, priorityInteractive)
+		}
+	}
+}
+
+// deferred by reader and writer of tunnel: frames after a panic can't be
+// trusted, so the tunnel is closed and its links are reset, client reconnects
+func (t *Tunnel) recoverPanic(where string) {
+	if err := recover(); err != nil {
+		atomic.AddInt64(&stats.Panics, 1)
+		LogCurStack("%s %s panic:%v", t.desc, where, err)
+		t.Close()
+	}
+}
@@ -0,0 +1,47 @@
+//
+//   date  : 2015-10-08
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+// local conn of a link whose writes panic
+type panicConn struct {
+	*memConn
+}
+
+func (c panicConn) Write(b []byte) (int, error) {
+	panic("write to broken conn")
+}
+
+func TestPairLinkPanic(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{})
+	hub := p.client.activeHubs()[0]
+	panics := atomic.LoadInt64(&stats.Panics)
+
+	local, remote := memPipe("local", "remote")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hub.forward(panicConn{local}, p.client.app.findRule(""), &LinkArgs{})
+	}()
+	io.WriteString(remote, "hello")
+	<-done
+	if atomic.LoadInt64(&stats.Panics) != panics+1 {
+		t.Fatal("panic should be recovered and counted")
+	}
+
+	// hub keeps serving other links
+	if echoed := p.roundTrip(t, "again"); echoed != "again" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	waitFor(t, "links released", func() bool {
+		return hub.LinkCount() == 0 && p.server.activeHubs()[0].LinkCount() == 0
+	})
+}
@@ -0,0 +1,226 @@
+//
+//   date  : 2015-09-08
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// max time of exec: command printing a secret
+const secretExecTimeout = 10 * time.Second
+
+// previous secret still accepted by server during rotation
+type Secret struct {
+	Secret  string    `json:"secret"`
+	Expires time.Time `json:"expires"` // never expires if zero
+}
+
+func (s *Secret) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && now.After(s.Expires)
+}
+
+// secret of an identified client, a client could have several credentials
+// during rotation
+type Credential struct {
+	ID string `json:"id"`
+	Secret
+
+	// common name of client certificate proving the id, server only. A
+	// credential of certificate could leave secret empty, its client
+	// answers challenge with server secret
+	Cert string `json:"cert"`
+}
+
+// client uses Secret, server accepts Secret and unexpired Secrets
+func (app *App) secret() string {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	return app.Secret
+}
+
+func (app *App) secrets() []string {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+
+	now := time.Now()
+	secrets := []string{app.Secret}
+	for _, s := range app.Secrets {
+		if !s.expired(now) {
+			secrets = append(secrets, s.Secret)
+		}
+	}
+	return secrets
+}
+
+// unexpired secrets of client id, nil if client is unknown
+func (app *App) credentials(id string) []string {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+
+	now := time.Now()
+	var secrets []string
+	for _, c := range app.Clients {
+		if c.ID == id && c.Secret.Secret != "" && !c.expired(now) {
+			secrets = append(secrets, c.Secret.Secret)
+		}
+	}
+	return secrets
+}
+
+// id of client certificate of common name, empty if it's not mapped
+func (app *App) certOwner(cn string) string {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+
+	for _, c := range app.Clients {
+		if c.Cert != "" && c.Cert == cn {
+			return c.ID
+		}
+	}
+	return ""
+}
+
+// challenge is signed by the first secret, client answers with the secret it
+// has, return the auth of matched secret
+func findSecret(secrets []string, challenge, token []byte) *Taa {
+	for i, secret := range secrets {
+		a := NewTaa(secret)
+		a.SetCipherBlock(challenge)
+		if a.VerifyCipherBlock(token) {
+			if i > 0 {
+				Info("client uses previous secret %d", i)
+			}
+			return a
+		}
+	}
+	return nil
+}
+
+// a secret could be given by reference, so it's not shown in process list or
+// config file:
+//
+//   - env:NAME, environment variable NAME
+//   - file:PATH, content of file PATH, which shouldn't be accessible by
+//     group or others
+//   - exec:COMMAND ARGS..., output of command run without shell, such as
+//     a client of secret manager
+//
+// other values are secrets themselves. Trailing new lines are trimmed.
+func loadSecret(s string) (string, error) {
+	data, ok, err := readSecretRef(s)
+	if !ok {
+		return s, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// content of secret reference, ok is false if s is not a reference
+func readSecretRef(s string) (data []byte, ok bool, err error) {
+	kind, ref, _ := strings.Cut(s, ":")
+	switch kind {
+	case "env":
+		v, found := os.LookupEnv(ref)
+		if !found {
+			return nil, true, fmt.Errorf("secret env %s is not set", ref)
+		}
+		return []byte(v), true, nil
+	case "file":
+		if err := checkSecretFile(ref); err != nil {
+			return nil, true, err
+		}
+		data, err := os.ReadFile(ref)
+		return data, true, err
+	case "exec":
+		args := strings.Fields(ref)
+		if len(args) == 0 {
+			return nil, true, fmt.Errorf("secret exec: no command")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = &stderr
+		data, err := cmd.Output()
+		if err != nil {
+			return nil, true, fmt.Errorf("secret exec %s failed: %v %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return data, true, nil
+	}
+	return nil, false, nil
+}
+
+// secret file should be private to its owner, mode isn't checked on windows
+func checkSecretFile(file string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("secret file %s is accessible by group or others, mode %v", file, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// replace secret references of config by secrets, Secrets and Clients are
+// copied so those of caller are kept
+func loadSecrets(c *Config) error {
+	var err error
+	if c.Secret, err = loadSecret(c.Secret); err != nil {
+		return err
+	}
+	if c.ObfsKey, err = loadSecret(c.ObfsKey); err != nil {
+		return err
+	}
+	secrets := make([]*Secret, len(c.Secrets))
+	for i, s := range c.Secrets {
+		cp := *s
+		if cp.Secret, err = loadSecret(s.Secret); err != nil {
+			return err
+		}
+		secrets[i] = &cp
+	}
+	clients := make([]*Credential, len(c.Clients))
+	for i, cred := range c.Clients {
+		cp := *cred
+		if cp.Secret.Secret, err = loadSecret(cred.Secret.Secret); err != nil {
+			return fmt.Errorf("client %s: %v", cred.ID, err)
+		}
+		clients[i] = &cp
+	}
+	c.Secrets, c.Clients = secrets, clients
+	return nil
+}
+
+// certificate and private key, key could be a secret reference to pem.
+// Private key file accessible by others is logged
+func loadKeyPair(certFile, key string) (tls.Certificate, error) {
+	data, ok, err := readSecretRef(key)
+	if !ok {
+		if err := checkSecretFile(key); err != nil && !os.IsNotExist(err) {
+			Error("%v", err)
+		}
+		return tls.LoadX509KeyPair(certFile, key)
+	}
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(cert, data)
+}
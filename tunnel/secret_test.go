@@ -0,0 +1,152 @@
+//
+//   date  : 2015-09-08
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecretRotation(t *testing.T) {
+	app := &App{Config: Config{
+		Secret: "new",
+		Secrets: []*Secret{
+			{Secret: "old"},
+			{Secret: "expired", Expires: time.Now().Add(-time.Hour)},
+		},
+	}}
+	secrets := app.secrets()
+	if len(secrets) != 2 {
+		t.Fatalf("expired secret should be skipped:%v", secrets)
+	}
+
+	for _, secret := range []string{"new", "old", "expired"} {
+		server := NewTaa(secrets[0])
+		server.GenToken()
+		challenge := server.GenCipherBlock(nil)
+
+		client := NewTaa(secret)
+		token, verified := client.ExchangeCipherBlock(challenge)
+		if verified != (secret == "new") {
+			t.Fatalf("secret %s: unexpected verified %v", secret, verified)
+		}
+		if !verified {
+			token = client.ExchangeUnverifiedBlock(challenge)
+		}
+
+		a := findSecret(secrets, challenge, token)
+		if (a != nil) != (secret != "expired") {
+			t.Fatalf("secret %s: unexpected result", secret)
+		}
+		if a != nil && !bytes.Equal(a.key, client.key) {
+			t.Fatalf("secret %s: matched wrong secret", secret)
+		}
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	app := &App{Config: Config{
+		Secret: "shared",
+		Clients: []*Credential{
+			{ID: "office", Secret: Secret{Secret: "office"}},
+			{ID: "office", Secret: Secret{Secret: "office old", Expires: time.Now().Add(time.Hour)}},
+			{ID: "home", Secret: Secret{Secret: "home", Expires: time.Now().Add(-time.Hour)}},
+		},
+	}}
+	if secrets := app.credentials("office"); len(secrets) != 2 {
+		t.Fatalf("office should have 2 secrets:%v", secrets)
+	}
+	if secrets := app.credentials("home"); secrets != nil {
+		t.Fatalf("expired client should be rejected:%v", secrets)
+	}
+
+	server := NewTaa(app.secret())
+	server.GenToken()
+	challenge := server.GenCipherBlock(nil)
+
+	client := NewTaa("office old")
+	token := client.ExchangeUnverifiedBlock(challenge)
+	if findSecret(app.secrets(), challenge, token) != nil {
+		t.Fatal("client secret should not match shared secrets")
+	}
+	if findSecret(app.credentials("office"), challenge, token) == nil {
+		t.Fatal("client secret should match its credentials")
+	}
+}
+
+func TestLoadSecret(t *testing.T) {
+	t.Setenv("GOTUNNEL_TEST_SECRET", "from env")
+	dir := t.TempDir()
+	private := filepath.Join(dir, "private")
+	os.WriteFile(private, []byte("from file\n"), 0600)
+	public := filepath.Join(dir, "public")
+	os.WriteFile(public, []byte("from file\n"), 0644)
+
+	for _, c := range []struct {
+		ref    string
+		secret string
+		err    string
+	}{
+		{"plain secret", "plain secret", ""},
+		{"env:GOTUNNEL_TEST_SECRET", "from env", ""},
+		{"env:GOTUNNEL_TEST_UNSET", "", "not set"},
+		{"file:" + private, "from file", ""},
+		{"file:" + filepath.Join(dir, "missing"), "", "no such file"},
+		{"exec:echo from exec", "from exec", ""},
+		{"exec:false", "", "secret exec false failed"},
+	} {
+		secret, err := loadSecret(c.ref)
+		if c.err == "" && (err != nil || secret != c.secret) || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: unexpected secret %q, err:%v", c.ref, secret, err)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		if _, err := loadSecret("file:" + public); err == nil || !strings.Contains(err.Error(), "accessible by group or others") {
+			t.Errorf("public secret file is loaded, err:%v", err)
+		}
+	}
+
+	// references of config are replaced, those of caller are kept
+	c := Config{
+		Secret:  "env:GOTUNNEL_TEST_SECRET",
+		Secrets: []*Secret{{Secret: "file:" + private}},
+		Clients: []*Credential{{ID: "office", Secret: Secret{Secret: "exec:echo office"}}},
+	}
+	caller := c
+	if err := loadSecrets(&c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Secret != "from env" || c.Secrets[0].Secret != "from file" || c.Clients[0].Secret.Secret != "office" {
+		t.Fatalf("unexpected secrets:%+v", c)
+	}
+	if caller.Secrets[0].Secret != "file:"+private || caller.Clients[0].Secret.Secret != "exec:echo office" {
+		t.Fatal("secrets of caller are changed")
+	}
+}
+
+func TestLoadKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	cert := newTestCert(t, dir, "server", nil)
+	key, err := os.ReadFile(cert.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOTUNNEL_TEST_KEY", string(key))
+	for _, ref := range []string{cert.key, "env:GOTUNNEL_TEST_KEY", "file:" + cert.key} {
+		pair, err := loadKeyPair(cert.cert, ref)
+		if err != nil {
+			t.Fatalf("%s: %v", ref, err)
+		}
+		if !bytes.Equal(pair.Certificate[0], cert.x509.Raw) {
+			t.Fatalf("%s: unexpected certificate", ref)
+		}
+	}
+}
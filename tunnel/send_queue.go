@@ -0,0 +1,84 @@
+//
+//   date  : 2015-09-25
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"sync"
+)
+
+// bytes of data frames queued to write to a tunnel
+const DefaultSendQueue = 256 * 1024
+
+// frames buffered for each priority class
+const sendQueueFrames = 256
+
+// bounded bytes of data frames waiting to be written to tunnel. Links block
+// when it's full, so memory doesn't grow behind a slow tunnel
+type sendQueue struct {
+	cond   *sync.Cond
+	queued int64
+	limit  int64
+	closed bool
+}
+
+func newSendQueue(limit int64) *sendQueue {
+	return &sendQueue{
+		cond:  sync.NewCond(new(sync.Mutex)),
+		limit: limit,
+	}
+}
+
+// wait for room of n bytes, a frame larger than limit is admitted if queue
+// is empty. Return false if queue is closed
+func (q *sendQueue) acquire(n int) bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for !q.closed && q.queued > 0 && q.queued+int64(n) > q.limit {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return false
+	}
+	q.queued += int64(n)
+	return true
+}
+
+func (q *sendQueue) release(n int) {
+	q.cond.L.Lock()
+	q.queued -= int64(n)
+	q.cond.Broadcast()
+	q.cond.L.Unlock()
+}
+
+func (q *sendQueue) close() {
+	q.cond.L.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.cond.L.Unlock()
+}
+
+func (q *sendQueue) setLimit(limit int64) {
+	q.cond.L.Lock()
+	q.limit = limit
+	q.cond.Broadcast()
+	q.cond.L.Unlock()
+}
+
+// bytes queued
+func (q *sendQueue) size() int64 {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.queued
+}
+
+// max bytes of data frames queued to write to tunnel, DefaultSendQueue if
+// limit is not positive
+func (t *Tunnel) setSendQueue(limit int64) {
+	if limit <= 0 {
+		limit = DefaultSendQueue
+	}
+	t.queue.setLimit(limit)
+}
@@ -6,78 +6,524 @@
 package tunnel
 
 import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	app  *App
-	hubs map[*ServerHub]bool
-	rw   sync.Mutex
-	wg   sync.WaitGroup
+	app     *App
+	hubs    map[*ServerHub]bool
+	rw      sync.Mutex
+	wg      sync.WaitGroup
+	ln      net.Listener
+	rlns    map[*Rule]net.Listener // listeners of reverse rules
+	httpLns []net.Listener         // listeners of admin and metrics
+	replay  *replayCache           // challenges answered recently
+	banned  *banList               // sources failing handshakes, nil if disabled
+	usage   *usageTable            // traffic of client identities
+	stopped bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started time.Time
+
+	sessions map[[sessionIDSize]byte]*Tunnel // resumable tunnels
+
+	tickets cipher.AEAD // seals tickets, nil if disabled
+
+	handshaking int32 // accepted connections in handshake, atomic
 }
 
-func (self *Server) addHub(hub *ServerHub) {
+func (self *Server) addHub(hub *ServerHub) bool {
 	self.rw.Lock()
+	defer self.rw.Unlock()
+	if self.stopped {
+		return false
+	}
 	self.hubs[hub] = true
-	self.rw.Unlock()
+	if self.app.events != nil {
+		self.app.events.OnTunnelUp(hub.tunnelEvent())
+	}
+	return true
 }
 
 func (self *Server) removeHub(hub *ServerHub) {
 	self.rw.Lock()
 	delete(self.hubs, hub)
 	self.rw.Unlock()
+	if self.app.events != nil {
+		self.app.events.OnTunnelDown(hub.tunnelEvent())
+	}
+}
+
+func (self *Server) addSession(tunnel *Tunnel) {
+	self.rw.Lock()
+	self.sessions[tunnel.sess.id] = tunnel
+	self.rw.Unlock()
 }
 
-func (self *Server) handleConn(conn *net.TCPConn) {
+func (self *Server) removeSession(tunnel *Tunnel) {
+	self.rw.Lock()
+	delete(self.sessions, tunnel.sess.id)
+	self.rw.Unlock()
+}
+
+// tunnel of session, nil if it's closed or belongs to another client
+func (self *Server) findSession(id [sessionIDSize]byte, identity string) *Tunnel {
+	self.rw.Lock()
+	defer self.rw.Unlock()
+	tunnel := self.sessions[id]
+	if tunnel == nil || tunnel.identity != identity {
+		return nil
+	}
+	return tunnel
+}
+
+// rc4 is only accepted if server is configured as legacy, plain text only on tls
+func (self *Server) acceptCipher(suite uint8) bool {
+	if _, ok := cipherSuites[cipherName(suite)]; !ok {
+		return false
+	}
+	switch suite {
+	case cipherRC4:
+		return self.app.cipher == cipherRC4
+	case cipherNone:
+		return self.app.TLS
+	}
+	return true
+}
+
+func (self *Server) handleConn(raw net.Conn) {
 	defer self.wg.Done()
-	defer conn.Close()
+	defer raw.Close()
 	defer Recover()
 
-	Info("create tunnel: %v <-> %v", conn.LocalAddr(), conn.RemoteAddr())
+	log := rootLogger.With("peer", raw.RemoteAddr().String())
+	ip := sourceIP(raw.RemoteAddr())
+	// a ticket is rejected if server forgot it, such as after restart
+	authed, ticketRejected := false, false
+	defer func() {
+		if !authed && !ticketRejected {
+			atomic.AddInt64(&stats.HandshakeFailed, 1)
+			if self.banned.fail(ip, time.Now()) {
+				log.Error("ban %s for %ds after %d failed handshakes", ip, self.app.BanTime, self.app.BanThreshold)
+			}
+		}
+	}()
+	log.Info("create tunnel: %v <-> %v", raw.LocalAddr(), raw.RemoteAddr())
 
-	// authenticate connection
-	a := NewTaa(self.app.Secret)
-	a.GenToken()
+	hctx, cancel := self.app.handshakeContext(self.ctx)
+	defer cancel()
+	unbind := bindConn(hctx, raw)
+	release := func() {
+		unbind()
+		atomic.AddInt32(&self.handshaking, -1)
+	}
+	defer func() {
+		if release != nil {
+			if handshakeExpired(hctx, time.Now()) {
+				atomic.AddInt64(&stats.HandshakeTimeouts, 1)
+				log.Error("handshake timeout")
+			}
+			release()
+		}
+	}()
 
-	challenge := a.GenCipherBlock(nil)
-	Debug("challenge(%v), len %d, %v", conn.RemoteAddr(), len(challenge), challenge)
-	if _, err := conn.Write(challenge); err != nil {
-		Error("write challenge failed(%v):%s", conn.RemoteAddr(), err)
+	conn, err := self.app.transport.Handshake(raw, "")
+	if err != nil {
+		log.Error("%s handshake failed:%s", self.app.scheme, err)
+		self.app.authFailed(raw.RemoteAddr().String(), err)
 		return
 	}
 
-	token := make([]byte, TaaBlockSize)
-	if _, err := io.ReadFull(conn, token); err != nil {
-		Error("read token failed(%v):%s", conn.RemoteAddr(), err)
+	// identity proved by client certificate
+	var certID string
+	if cert := peerCertificate(conn); cert != nil {
+		certID = self.app.certOwner(cert.Subject.CommonName)
+		log.Debug("client certificate %q, identity %q", cert.Subject.CommonName, certID)
+	}
+
+	n, err := self.negotiate(conn, certID, log)
+	if err != nil {
+		ticketRejected = errors.Is(err, errTicketRejected)
+		self.app.authFailed(raw.RemoteAddr().String(), err)
+		return
+	}
+	log = n.log
+
+	rd, wr, err := newCipherStream(n.suite, conn, n.key, false)
+	if err != nil {
+		log.Error("create cipher stream failed:%s", err)
+		return
+	}
+
+	if n.caps&capTicket != 0 && !n.ticket {
+		if err = self.issueTicket(wr, n); err != nil {
+			log.Error("send ticket failed:%s", err)
+			return
+		}
+	}
+
+	// client asks for a new session, or resumes a broken tunnel by its id
+	var sess *session
+	var resumed *Tunnel
+	var peerReceived uint64
+	if n.caps&capResume != 0 {
+		var id [sessionIDSize]byte
+		if id, peerReceived, err = readResume(rd); err != nil {
+			log.Error("read resume failed:%s", err)
+			return
+		}
+		var received uint64
+		if id == ([sessionIDSize]byte{}) {
+			sess = newSession(newSessionID(), time.Duration(self.app.Resume)*time.Second, int(self.app.ResumeBuffer))
+			id = sess.id
+		} else if resumed = self.findSession(id, n.identity); resumed != nil {
+			if received, err = resumed.suspend(); err != nil {
+				resumed = nil
+			}
+		}
+		if sess == nil && resumed == nil {
+			id = [sessionIDSize]byte{}
+		}
+		if _, err = wr.Write(resumeMessage(id, received)); err != nil {
+			log.Error("send resume failed:%s", err)
+			return
+		}
+	}
+
+	release()
+	release = nil
+	if hctx.Err() != nil {
+		log.Error("handshake canceled:%s", hctx.Err())
 		return
 	}
 
-	Debug("token(%v), len %d, %v", conn.RemoteAddr(), len(token), token)
-	if !a.VerifyCipherBlock(token) {
-		Error("verify token failed(%v)", conn.RemoteAddr())
+	authed = true
+	self.banned.succeed(ip)
+	if n.caps&capResume != 0 && sess == nil {
+		if resumed == nil {
+			log.Error("resume failed:%s", errSessionLost)
+			return
+		}
+		gen, err := resumed.attach(conn, rd, wr, peerReceived)
+		if err != nil {
+			log.Error("resume failed:%s", err)
+			resumed.Close()
+			return
+		}
+		// connection is closed when it's replaced or tunnel is closed
+		resumed.waitDetached(gen)
 		return
 	}
 
-	hub := newServerHub(newTunnel(conn, a.GetRc4key()), self.app)
-	self.addHub(hub)
+	tunnel := newTunnel(conn, rd, wr)
+	tunnel.identity = n.identity
+	tunnel.integrity = n.integrity
+	tunnel.caps = n.caps
+	if sess != nil {
+		tunnel.setSession(sess)
+	}
+	tunnel.setPlain(rd, wr)
+	tunnel.setRekey(rd, wr, n.key, self.app.RekeyBytes, time.Duration(self.app.RekeyInterval)*time.Second)
+	tunnel.setCompress(n.compress, self.app.CompressThreshold)
+	tunnel.setSendQueue(self.app.SendQueue)
+	hub := newServerHub(self.ctx, tunnel, self.app, false, log)
+	hub.SetHeartbeat(self.app.heartbeat())
+	hub.SetRateLimit(self.app.LinkRate, self.app.HubRate)
+	hub.SetBulkRate(self.app.BulkRate)
+	hub.SetIdleTimeout(time.Duration(self.app.IdleTimeout) * time.Second)
+	hub.SetLinkMaxAge(time.Duration(self.app.LinkMaxAge) * time.Second)
+	hub.SetLinkIdAudit(self.app.linkIdAudit())
+	hub.SetAccessLog(self.app.accessLog)
+	hub.SetTracer(self.app.tracer)
+	hub.SetEventHandler(self.app.events)
+	hub.usage = self.usage.get(n.identity)
+	if !self.addHub(hub) {
+		hub.Close()
+		return
+	}
 	defer self.removeHub(hub)
+	if sess != nil {
+		self.addSession(tunnel)
+		defer self.removeSession(tunnel)
+	}
 
+	if age := self.app.tunnelMaxAge(); age > 0 {
+		go hub.expire(age)
+	}
 	hub.Start()
 }
 
-func (self *Server) listen() {
+// authenticate client and negotiate the tunnel, by ticket or by token and
+// key exchange. Failures are logged.
+func (self *Server) negotiate(conn net.Conn, certID string, log *Logger) (*negotiated, error) {
+	secrets := self.app.secrets()
+	a := NewTaa(secrets[0])
+	a.GenToken()
+
+	challenge := a.GenCipherBlock(nil)
+	log.Debug("challenge, len %d, %v", len(challenge), challenge)
+	if _, err := conn.Write(challenge); err != nil {
+		log.Error("write challenge failed:%s", err)
+		return nil, err
+	}
+
+	// token followed by proposed cipher suite and compress method
+	token := make([]byte, TaaBlockSize+2)
+	if _, err := io.ReadFull(conn, token); err != nil {
+		log.Error("read token failed:%s", err)
+		return nil, err
+	}
+
+	proposed, flags := token[TaaBlockSize], token[TaaBlockSize+1]
+	log.Debug("token, len %d, %v", len(token), token)
+	version, compress := unpackFlags(flags)
+	if version == handshakeTicket {
+		return self.acceptTicket(conn, token, certID, log)
+	}
+	integrity := compress&compressIntegrity != 0
+	compress &^= compressIntegrity
+	if version > handshakeVersion {
+		version = handshakeVersion
+	}
+	if self.replay.replayed(token[:TaaTokenSize], time.Now()) {
+		atomic.AddInt64(&stats.TokenReplayed, 1)
+		log.Error("reject replayed token")
+		return nil, errReplayed
+	}
+	// token is verified after client sends its identity
+	if version < handshakeIdentity {
+		if a = findSecret(secrets, challenge, token[:TaaBlockSize]); a == nil {
+			log.Error("verify token failed")
+			return nil, errVerifyToken
+		}
+	}
+
+	suite := proposed
+	if !self.acceptCipher(suite) {
+		suite = self.app.cipher
+	}
+	// decompression is cheap, accept any known method
+	if _, ok := compressMethods[compressName(compress)]; !ok {
+		compress = compressNone
+	}
+	flags = compress
+	if integrity {
+		flags |= compressIntegrity
+	}
+	answer := []byte{suite, packFlags(version, flags)}
+	if _, err := conn.Write(answer); err != nil {
+		log.Error("write cipher suite failed:%s", err)
+		return nil, err
+	}
+	if suite != proposed {
+		log.Error("reject cipher %s", cipherName(proposed))
+		return nil, errCipherMismatch
+	}
+
+	transcript := append(append(challenge, token...), answer...)
+	var identity string
+	if version >= handshakeIdentity {
+		msg, err := readMessage(conn)
+		if err != nil {
+			log.Error("read identity failed:%s", err)
+			return nil, err
+		}
+		transcript = append(transcript, msg...)
+		identity = string(msg[1:])
+		if certID != "" && identity != certID {
+			if identity != "" {
+				log.Error("client %s presents certificate of %s", identity, certID)
+				return nil, errVerifyToken
+			}
+			identity = certID
+		}
+		if identity != "" {
+			log = log.With("client", identity)
+			secrets = self.app.credentials(identity)
+		}
+		// identity of certificate without secret of its own
+		if len(secrets) == 0 && identity == certID {
+			secrets = self.app.secrets()
+		}
+		if a = findSecret(secrets, challenge, token[:TaaBlockSize]); a == nil {
+			log.Error("verify token failed")
+			return nil, errVerifyToken
+		}
+	} else if certID != "" {
+		identity = certID
+		log = log.With("client", identity)
+	}
+
+	self.replay.answer(token[:TaaTokenSize], time.Now())
+
+	caps := legacyCaps
+	if version >= handshakeCaps {
+		peerCaps, msg, err := readCaps(conn)
+		if err != nil {
+			log.Error("read capabilities failed:%s", err)
+			return nil, err
+		}
+		local := self.app.localCaps()
+		if _, err := conn.Write(capsMessage(local)); err != nil {
+			log.Error("send capabilities failed:%s", err)
+			return nil, err
+		}
+		transcript = append(append(transcript, msg...), capsMessage(local)...)
+		caps = local & peerCaps
+	}
+
+	n := &negotiated{suite: suite, version: version, compress: compress, integrity: integrity, caps: caps, identity: identity, log: log}
+	if version >= handshakeECDH {
+		var err error
+		if n.key, err = keyExchange(conn, a, transcript, false); err != nil {
+			log.Error("key exchange failed:%s", err)
+			return nil, err
+		}
+	} else if self.app.LegacyHandshake {
+		n.key = legacySessionKey(suite, a)
+	} else {
+		log.Error("reject legacy handshake")
+		return nil, errLegacyHandshake
+	}
+	log.Info("use handshake v%d, cipher %s, compress %s, integrity %v, caps %s", version, cipherName(suite), compressName(compress), integrity, capsString(caps))
+	return n, nil
+}
+
+func (self *Server) isStopped() bool {
+	self.rw.Lock()
+	defer self.rw.Unlock()
+	return self.stopped || self.ctx.Err() != nil
+}
+
+// stop accepting new tunnels
+func (self *Server) shutdown() {
+	self.rw.Lock()
+	defer self.rw.Unlock()
+	self.stopped = true
+	self.ln.Close()
+	for _, ln := range self.rlns {
+		ln.Close()
+	}
+}
+
+// should be called with lock held
+func (self *Server) startListener(rule *Rule) error {
+	ln, err := self.app.listenLink(rule)
+	if err != nil {
+		return err
+	}
+	self.rlns[rule] = ln
+	self.wg.Add(1)
+	go self.listenReverse(rule, ln)
+	return nil
+}
+
+func (self *Server) reloadRules(added, removed []*Rule) error {
+	self.rw.Lock()
+	defer self.rw.Unlock()
+	if self.stopped {
+		return nil
+	}
+
+	for _, rule := range removed {
+		rule.stopBackends()
+		if ln, ok := self.rlns[rule]; ok {
+			ln.Close()
+			delete(self.rlns, rule)
+		}
+	}
+	for _, rule := range added {
+		rule.startBackends(self.ctx, self.app)
+		if !rule.Reverse {
+			continue
+		}
+		if err := self.startListener(rule); err != nil {
+			return fmt.Errorf("rule %s: %s", rule, err)
+		}
+	}
+	return nil
+}
+
+// hub with least links
+func (self *Server) fetchHub() *ServerHub {
+	self.rw.Lock()
+	defer self.rw.Unlock()
+	var best *ServerHub
+	for hub := range self.hubs {
+		if hub.IsClosing() {
+			continue
+		}
+		if best == nil || hub.LinkCount() < best.LinkCount() {
+			best = hub
+		}
+	}
+	return best
+}
+
+func (self *Server) handleReverse(conn BiConn, rule *Rule) {
 	defer self.wg.Done()
+	defer conn.Close()
+	defer Recover()
 
-	ln, err := net.ListenTCP("tcp", self.app.laddr)
+	conn, err := rule.acceptTLS(conn)
 	if err != nil {
-		Panic("listen failed:%v", err)
+		Error("reverse service %s: accept tls failed, err:%v", rule, err)
+		return
+	}
+
+	hub := self.fetchHub()
+	if hub == nil {
+		Error("no active hub for reverse service %s", rule)
+		return
 	}
+	hub.forward(conn, rule, &LinkArgs{Service: rule.Name, Source: conn.RemoteAddr().String()})
+}
+
+// accept connections of reverse rule, and forward them to client
+func (self *Server) listenReverse(rule *Rule, ln net.Listener) {
+	defer self.wg.Done()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if self.isStopped() || errors.Is(err, net.ErrClosed) {
+				break
+			}
+			Error("reverse service %s acceept failed:%s", rule, err.Error())
+			if opErr, ok := err.(*net.OpError); ok {
+				if !opErr.Temporary() {
+					break
+				}
+			}
+			continue
+		}
+		Info("reverse service %s, new connection from %v", rule, conn.RemoteAddr())
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(time.Second * 60)
+		}
+		self.wg.Add(1)
+		go self.handleReverse(conn.(BiConn), rule)
+	}
+}
+
+func (self *Server) listen() {
+	defer self.wg.Done()
 
 	for {
-		conn, err := ln.AcceptTCP()
+		conn, err := self.ln.Accept()
 		if err != nil {
+			if self.isStopped() {
+				break
+			}
 			Error("back server acceept failed:%s", err.Error())
 			if opErr, ok := err.(*net.OpError); ok {
 				if !opErr.Temporary() {
@@ -86,23 +532,155 @@ func (self *Server) listen() {
 			}
 			continue
 		}
+		if self.banned.banned(sourceIP(conn.RemoteAddr()), time.Now()) {
+			atomic.AddInt64(&stats.BannedConns, 1)
+			Debug("back server, close connection from banned %v", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		// released by handleConn when handshake is done
+		if n := atomic.AddInt32(&self.handshaking, 1); self.app.MaxHandshakes > 0 && int(n) > self.app.MaxHandshakes {
+			atomic.AddInt32(&self.handshaking, -1)
+			atomic.AddInt64(&stats.HandshakesRejected, 1)
+			Debug("back server, close connection from %v for max handshakes", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
 		Debug("back server, new connection from %v", conn.RemoteAddr())
 		self.wg.Add(1)
 		go self.handleConn(conn)
 	}
 }
 
-func (self *Server) Start() error {
+func (self *Server) Start(ctx context.Context) error {
+	ln, err := self.app.transport.Listen()
+	if err != nil {
+		return err
+	}
+	self.ln = ln
+	self.ctx, self.cancel = context.WithCancel(ctx)
+	self.started = time.Now()
+	self.app.keepState(self.ctx, &self.wg, self.restoreState, self.snapshotState)
+	self.app.tracer.run(self.ctx, &self.wg)
+
+	if self.app.Metrics != "" {
+		ln, err := serveMetrics(self.ctx, self.app.Metrics, self.activeHubs)
+		if err != nil {
+			self.cancel()
+			self.shutdown()
+			return err
+		}
+		self.httpLns = append(self.httpLns, ln)
+	}
+	if self.app.Admin != "" {
+		ln, err := serveAdmin(self.ctx, self.app.Admin, self)
+		if err != nil {
+			self.cancel()
+			self.shutdown()
+			return err
+		}
+		self.httpLns = append(self.httpLns, ln)
+	}
+	if self.app.Debug != "" {
+		ln, err := serveDebug(self.ctx, self.app.Debug, self.activeHubs)
+		if err != nil {
+			self.cancel()
+			self.shutdown()
+			return err
+		}
+		self.httpLns = append(self.httpLns, ln)
+	}
+
+	self.rw.Lock()
+	for _, rule := range self.app.rules {
+		rule.startBackends(self.ctx, self.app)
+		if !rule.Reverse {
+			continue
+		}
+		if err := self.startListener(rule); err != nil {
+			self.rw.Unlock()
+			self.cancel()
+			self.shutdown()
+			return err
+		}
+	}
+	self.rw.Unlock()
+
 	self.wg.Add(1)
 	go self.listen()
+
+	// tear down everything if parent ctx is done
+	go func() {
+		<-self.ctx.Done()
+		self.shutdown()
+	}()
 	return nil
 }
 
+func (self *Server) Stop(ctx context.Context) error {
+	self.shutdown()
+
+	err := drainHubs(ctx, self.activeHubs())
+	if err != nil {
+		Error("drain hubs failed:%v", err)
+	}
+
+	self.cancel()
+	Log("tunnel server stopped")
+	return err
+}
+
 func (self *Server) Wait() {
 	self.wg.Wait()
 	Error("back hub quit")
 }
 
+func (self *Server) activeHubs() []*Hub {
+	self.rw.Lock()
+	defer self.rw.Unlock()
+	hubs := make([]*Hub, 0, len(self.hubs))
+	for hub := range self.hubs {
+		hubs = append(hubs, hub.Hub)
+	}
+	return hubs
+}
+
+func (self *Server) bans() *banList {
+	return self.banned
+}
+
+func (self *Server) clientUsage() *usageTable {
+	return self.usage
+}
+
+func (self *Server) openListeners() []io.Closer {
+	self.rw.Lock()
+	defer self.rw.Unlock()
+	if self.stopped {
+		return nil
+	}
+	lns := []io.Closer{self.ln}
+	for _, ln := range self.httpLns {
+		lns = append(lns, ln)
+	}
+	for _, ln := range self.rlns {
+		lns = append(lns, ln)
+	}
+	return lns
+}
+
+func (self *Server) status() *serviceStatus {
+	status := &serviceStatus{
+		Role:   "server",
+		Uptime: time.Since(self.started).Seconds(),
+		Hubs:   []hubStatus{},
+	}
+	for _, hub := range self.activeHubs() {
+		status.Hubs = append(status.Hubs, hub.snapshot(hub.LinkCount()))
+	}
+	return status
+}
+
 func (self *Server) Status() {
 	for hub := range self.hubs {
 		hub.Status()
@@ -110,8 +688,18 @@ func (self *Server) Status() {
 }
 
 func newServer(app *App) *Server {
-	return &Server{
-		app:  app,
-		hubs: make(map[*ServerHub]bool),
+	self := &Server{
+		app:    app,
+		hubs:   make(map[*ServerHub]bool),
+		rlns:   make(map[*Rule]net.Listener),
+		replay: newReplayCache(time.Duration(app.ReplayWindow) * time.Second),
+		banned: newBanList(app.BanThreshold, time.Duration(app.BanWindow)*time.Second, time.Duration(app.BanTime)*time.Second),
+		usage:  newUsageTable(app.quota),
+
+		sessions: make(map[[sessionIDSize]byte]*Tunnel),
+	}
+	if app.Ticket > 0 {
+		self.tickets = newTicketKey()
 	}
+	return self
 }
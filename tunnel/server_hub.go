@@ -6,43 +6,278 @@
 package tunnel
 
 import (
+	"context"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
+// serve links created by peer: server serves normal rules, client serves
+// reverse rules
 type ServerHub struct {
 	*Hub
-	app *App
+	app     *App
+	reverse bool
 }
 
-func (self *ServerHub) handleLink(linkid uint16, link *Link) {
-	defer self.Hub.ReleaseLink(linkid)
-	defer Recover()
+// dest is requested by proxy client, rule backend is used if it's empty
+func (self *ServerHub) handleLink(linkid uint32, link *Link, rule *Rule, dest string) {
+	defer self.releaseLink(link)
+	defer link.recoverPanic("handle")
 
-	conn, err := net.DialTCP("tcp", nil, self.app.baddr)
+	if err := self.applyPolicy(link, &dest); err != nil {
+		link.SendReject(err)
+		return
+	}
+
+	if rule.echo {
+		self.handleEchoLink(link)
+		return
+	}
+	if len(rule.Exec) > 0 {
+		self.handleExecLink(link, rule)
+		return
+	}
+	ctx := link.ctx
+	if rule.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(rule.ConnectTimeout)*time.Second)
+		defer cancel()
+	}
+	var c net.Conn
+	var target *backendTarget
+	var err error
+	dialSpan := link.span.child("dial", spanKindClient)
+	if dest != "" {
+		c, err = self.dial(ctx, link, rule, dest)
+	} else {
+		c, target, err = self.dialBackend(ctx, link, rule)
+		defer target.release()
+	}
+	if target != nil {
+		dest = target.addr
+	}
+	dialSpan.setAttr("gotunnel.dest", link.dest)
 	if err != nil {
-		Error("link(%d) connect to backend failed, err:%v", linkid, err)
-		link.SendClose()
+		dialSpan.setError(err.Error())
+		dialSpan.finish()
+		link.SendReject(err)
 		return
 	}
+	dialSpan.finish()
+
+	if rule.UDP {
+		self.handleUDPLink(link, c.(*net.UDPConn))
+		return
+	}
+
+	conn := c.(BiConn)
+	link.log.Info("new connection to %v", conn.RemoteAddr())
+
+	if rule.ProxyProtocol > 0 {
+		dst, _ := conn.RemoteAddr().(*net.TCPAddr)
+		header := proxyHeader(rule.ProxyProtocol, link.source, dst)
+		if _, err := conn.Write(header); err != nil {
+			link.log.Error("write proxy protocol header failed, err:%v", err)
+			link.setReason("proxy protocol failed")
+			conn.Close()
+			link.SendClose()
+			return
+		}
+	}
 
-	Info("link(%d) new connection to %v", linkid, conn.RemoteAddr())
+	if tc, ok := conn.(*net.TCPConn); ok {
+		self.app.tuneConn(tc)
+	}
 
-	conn.SetKeepAlive(true)
-	conn.SetKeepAlivePeriod(time.Second * 60)
+	// proxy protocol header is sent in plain before tls, which verifies
+	// name of dest. Connections dialed ahead have done tls.
+	if _, ready := c.(*idleConn); !ready {
+		if conn, err = rule.dialTLS(conn, dest); err != nil {
+			link.log.Error("tls to backend %s failed, err:%v", dest, err)
+			link.SendReject(err)
+			c.Close()
+			return
+		}
+	}
+	link.backend = true
+	link.tap = self.app.newTap(rule, link, link.dest)
+	defer link.tap.close()
+	link.SendConnected()
 	link.Pump(conn)
 }
 
-func (self *ServerHub) Ctrl(cmd *Cmd) bool {
+func (self *ServerHub) handleUDPLink(link *Link, conn *net.UDPConn) {
+	defer conn.Close()
+
+	link.log.Info("new udp session to %v", conn.RemoteAddr())
+	link.SendConnected()
+	link.Pump(udpConn{conn})
+}
+
+// resolve dest, check it by acl and connect its addresses in turn, link.dest
+// is set to the connected address
+func (self *ServerHub) dial(ctx context.Context, link *Link, rule *Rule, dest string) (net.Conn, error) {
+	link.dest = dest
+	addrs, err := self.app.acl().resolve(ctx, self.app.dns.resolve, self.tunnel.identity, dest)
+	if err != nil {
+		link.log.Error("check destination %s failed, err:%v", dest, err)
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		link.dest = addr
+		var c net.Conn
+		if rule.UDP {
+			c, err = self.app.dialer("udp").DialContext(ctx, "udp", addr)
+		} else {
+			c, err = self.app.dialLink(ctx, "tcp", addr)
+		}
+		if err == nil {
+			return c, nil
+		}
+		link.log.Error("connect to backend %s failed, err:%v", addr, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// unix socket is dialed directly, it's never a destination requested by
+// peer, so acl doesn't apply
+func (self *ServerHub) dialTarget(ctx context.Context, link *Link, rule *Rule, target *backendTarget) (net.Conn, error) {
+	if c := target.takeIdle(self.app.acl(), self.tunnel.identity); c != nil {
+		link.dest = target.addr
+		if _, ok := unixPath(target.addr); !ok {
+			link.dest = c.RemoteAddr().String()
+		}
+		return c, nil
+	}
+	path, ok := unixPath(target.addr)
+	if !ok {
+		return self.dial(ctx, link, rule, target.addr)
+	}
+	link.dest = target.addr
+	c, err := self.app.dialUnix(ctx, path)
+	if err != nil {
+		link.log.Error("connect to backend %s failed, err:%v", target.addr, err)
+	}
+	return c, err
+}
+
+// connect backends of rule in turn until one succeeds, connect timeout
+// covers all tries. Target of the connection counts the link until it's
+// released.
+func (self *ServerHub) dialBackend(ctx context.Context, link *Link, rule *Rule) (net.Conn, *backendTarget, error) {
+	var tried []*backendTarget
+	err := errBackendDown
+	for {
+		target := rule.pool.pick(tried)
+		if target == nil {
+			if len(tried) == 0 {
+				atomic.AddInt64(&stats.BackendDown, 1)
+				link.log.Error("service %s rejected, err:%v", rule, err)
+			}
+			return nil, nil, err
+		}
+		var c net.Conn
+		if c, err = self.dialTarget(ctx, link, rule, target); err == nil {
+			return c, target, nil
+		}
+		target.release()
+		tried = append(tried, target)
+		if ctx.Err() != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// refuse link created by peer, it's never created here. err tells peer why
+// if it's set
+func (self *ServerHub) rejectLink(linkid uint32, err error) {
+	var arg []byte
+	if err != nil && self.tunnel.has(capCloseCode) {
+		arg = closeArg(closeCode(err), err.Error())
+	}
+	self.Send(LINK_CLOSE, linkid, arg)
+	if self.tunnel.has(capLinkRelease) {
+		self.Send(LINK_RELEASE, linkid, nil)
+	}
+}
+
+func (self *ServerHub) Ctrl(cmd *Cmd, arg []byte) bool {
 	linkid := cmd.Linkid
 	switch cmd.Cmd {
 	case LINK_CREATE:
+		var args LinkArgs
+		if err := args.decode(arg); err != nil {
+			self.log.Error("link(%d) parse create args failed:%v", linkid, err)
+			self.rejectLink(linkid, nil)
+			return true
+		}
+		rule := self.app.serviceRule(args.Service)
+		if rule == nil {
+			self.log.Error("link(%d) unknown service:%s", linkid, args.Service)
+			self.rejectLink(linkid, nil)
+			return true
+		}
+
+		if rule.Reverse != self.reverse {
+			self.log.Error("link(%d) service %s is not served here", linkid, rule)
+			self.rejectLink(linkid, nil)
+			return true
+		}
+		if args.Dest != "" && !rule.dynamic() {
+			self.log.Error("link(%d) service %s doesn't allow destination %s", linkid, rule, args.Dest)
+			self.rejectLink(linkid, nil)
+			return true
+		}
+		if args.Dest == "" && rule.pool == nil && !rule.echo && len(rule.Exec) == 0 {
+			self.log.Error("link(%d) service %s has no backend", linkid, rule)
+			self.rejectLink(linkid, nil)
+			return true
+		}
+
+		if self.IsClosing() {
+			self.log.Error("link(%d) hub is closing, reject", linkid)
+			self.rejectLink(linkid, nil)
+			return true
+		}
+		if err := self.usage.allow(); err != nil {
+			self.log.Error("link(%d) client %q %s, reject", linkid, self.tunnel.identity, err)
+			self.rejectLink(linkid, err)
+			return true
+		}
+
 		link := self.NewLink(linkid)
 		if link != nil {
-			Info("link(%d) build link", linkid)
-			go self.handleLink(linkid, link)
+			link.service = rule.String()
+			if args.Source != "" {
+				link.source = args.Source
+				link.log = link.log.With("source", args.Source)
+			}
+			link.idleTimeout = self.idleTimeout(rule)
+			// priority of our rule wins, then creator's
+			prio, ok := priorities[args.Priority]
+			if rule.Priority != "" || !ok {
+				prio = rule.priority
+			}
+			link.setPriority(prio)
+			link.setNoCrypt(rule.NoCrypt || args.NoCrypt)
+			link.span = self.tracer.startRemote("link "+link.service, spanKindServer, args.TraceParent)
+			self.startSpan(link)
+			self.onLinkOpen(link)
+			link.log.Info("build link, service: %s", rule)
+			if args.Window > 0 {
+				link.acceptWindow(args.Window)
+			}
+			if args.EarlyData != "" {
+				link.putEarlyData(args.EarlyData)
+			}
+			go self.handleLink(linkid, link, rule, args.Dest)
 		} else {
-			Error("link(%d) id conflict", linkid)
+			self.log.Error("link(%d) id conflict", linkid)
 			self.Send(LINK_CLOSE, linkid, nil)
 		}
 		return true
@@ -50,10 +285,11 @@ func (self *ServerHub) Ctrl(cmd *Cmd) bool {
 	return false
 }
 
-func newServerHub(tunnel *Tunnel, app *App) *ServerHub {
+func newServerHub(ctx context.Context, tunnel *Tunnel, app *App, client bool, log *Logger) *ServerHub {
 	ServerHub := new(ServerHub)
 	ServerHub.app = app
-	hub := newHub(tunnel, false)
+	ServerHub.reverse = client
+	hub := newHub(ctx, tunnel, client, app.MaxLinks, log)
 	hub.SetCtrlDelegate(ServerHub)
 	ServerHub.Hub = hub
 	return ServerHub
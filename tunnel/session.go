@@ -0,0 +1,440 @@
+//
+//   date  : 2015-10-02
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const sessionIDSize = 16
+
+// default and min bytes of frames kept for replay, min holds acked frames
+// of full size
+const (
+	DefaultResumeBuffer = 4 << 20
+	minResumeBuffer     = ackFrames * (0xffff + 4)
+)
+
+// receiver acks after this many frames
+const ackFrames = 16
+
+var (
+	errTunnelClosed = errors.New("tunnel closed")
+	errSessionLost  = errors.New("session not found by server")
+	errResumeFrames = errors.New("peer received frames never sent")
+)
+
+// Tunnels negotiating capResume keep frames sent until peer acks them by
+// TUNNEL_ACK. If connection breaks, links are kept for a grace period, in
+// which client connects the same server again with session id, and both ends
+// replay frames peer hasn't received.
+type session struct {
+	id    [sessionIDSize]byte
+	grace time.Duration
+	limit int // max bytes of frames kept
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	gen    int  // incremented when connection is attached or broken
+	broken bool // waiting for another connection
+	closed bool
+
+	sent    [][]byte // frames not acked by peer
+	size    int      // bytes of sent
+	acked   uint64   // frames acked by peer, sequence of sent[0]
+	written uint64   // frames written to current connection
+
+	received   uint64 // frames received
+	ackSent    uint64 // received when last ack was sent
+	ackPending bool
+
+	attached time.Time // last resumed, zero if never
+	resumed  int
+
+	// client connects the same server to resume before ctx is done
+	redial func(ctx context.Context) error
+}
+
+func newSession(id [sessionIDSize]byte, grace time.Duration, limit int) *session {
+	if limit <= 0 {
+		limit = DefaultResumeBuffer
+	}
+	if limit < minResumeBuffer {
+		limit = minResumeBuffer
+	}
+	s := &session{id: id, grace: grace, limit: limit}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+func newSessionID() (id [sessionIDSize]byte) {
+	rand.Read(id[:])
+	return
+}
+
+// resume message: session id, zero if a new session is requested, and
+// frames received by sender. Server answers with its own, id is zero if
+// session is not found
+func resumeMessage(id [sessionIDSize]byte, received uint64) []byte {
+	msg := make([]byte, sessionIDSize+8)
+	copy(msg, id[:])
+	binary.LittleEndian.PutUint64(msg[sessionIDSize:], received)
+	return msg
+}
+
+func readResume(rd io.Reader) (id [sessionIDSize]byte, received uint64, err error) {
+	msg := make([]byte, sessionIDSize+8)
+	if _, err = io.ReadFull(rd, msg); err != nil {
+		return
+	}
+	copy(id[:], msg)
+	received = binary.LittleEndian.Uint64(msg[sessionIDSize:])
+	return
+}
+
+// enable resumption, should be called before any read or write
+func (t *Tunnel) setSession(s *session) {
+	t.sess = s
+}
+
+func (t *Tunnel) netConn() net.Conn {
+	if t.sess == nil {
+		return t.conn
+	}
+	t.sess.lock.Lock()
+	defer t.sess.lock.Unlock()
+	return t.conn
+}
+
+func (t *Tunnel) resumedCount() int {
+	if t.sess == nil {
+		return 0
+	}
+	t.sess.lock.Lock()
+	defer t.sess.lock.Unlock()
+	return t.sess.resumed
+}
+
+// true if tunnel is waiting to resume, or resumed in d
+func (t *Tunnel) resuming(d time.Duration) bool {
+	s := t.sess
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.broken || (!s.attached.IsZero() && time.Since(s.attached) < d)
+}
+
+// break current connection and wait for another one, false if tunnel isn't
+// resumable
+func (t *Tunnel) interrupt(err error) bool {
+	s := t.sess
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t.detach(s.gen, err)
+	return true
+}
+
+// should be called with lock held, nothing is done if connection of gen is
+// already replaced
+func (t *Tunnel) detach(gen int, err error) {
+	s := t.sess
+	if gen != s.gen || s.broken || s.closed {
+		return
+	}
+	Error("%s broken:%v, wait %v to resume", t.desc, err, s.grace)
+	t.conn.Close()
+	s.broken = true
+	s.gen++
+	s.cond.Broadcast()
+
+	gen = s.gen
+	if s.redial != nil {
+		go t.redialLoop(time.Now().Add(s.grace))
+		return
+	}
+	time.AfterFunc(s.grace, func() {
+		s.lock.Lock()
+		expired := s.broken && s.gen == gen
+		s.lock.Unlock()
+		if expired {
+			Error("%s resume timeout", t.desc)
+			t.Close()
+		}
+	})
+}
+
+// client side, retry until deadline
+func (t *Tunnel) redialLoop(deadline time.Time) {
+	defer Recover()
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	go func() {
+		select {
+		case <-t.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	delay := time.Millisecond * 100
+	for {
+		err := t.sess.redial(ctx)
+		if err == nil {
+			return
+		}
+		if err == errSessionLost || ctx.Err() != nil {
+			Error("%s resume failed:%v", t.desc, err)
+			t.Close()
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// detach current connection and return frames received, before answering
+// resume request of peer
+func (t *Tunnel) suspend() (uint64, error) {
+	s := t.sess
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, errTunnelClosed
+	}
+	if !s.broken {
+		t.detach(s.gen, errors.New("peer resumes"))
+	}
+	return s.received, nil
+}
+
+// frames received, while broken it's not changed
+func (t *Tunnel) receivedFrames() uint64 {
+	s := t.sess
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.received
+}
+
+// replace broken connection, frames peer hasn't received are replayed.
+// Return gen of the connection
+func (t *Tunnel) attach(conn net.Conn, rd io.Reader, wr io.Writer, peerReceived uint64) (int, error) {
+	s := t.sess
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || !s.broken {
+		return 0, errTunnelClosed
+	}
+	if peerReceived < s.acked || peerReceived > s.acked+uint64(len(s.sent)) {
+		return 0, errResumeFrames
+	}
+	s.trim(peerReceived)
+
+	bufsize := int(PacketSize) * 2
+	t.conn = conn
+	t.reader = bufio.NewReaderSize(rd, bufsize)
+	t.writer = bufio.NewWriterSize(wr, bufsize)
+	s.written = peerReceived
+	s.broken = false
+	s.gen++
+	s.attached = time.Now()
+	s.resumed++
+	s.ackPending = true
+	s.cond.Broadcast()
+	Info("%s resumed over %v <-> %v, replay %d frames", t.desc, conn.LocalAddr(), conn.RemoteAddr(), len(s.sent))
+	t.wakePump()
+	return s.gen, nil
+}
+
+// block until connection of gen is replaced or tunnel is closed
+func (t *Tunnel) waitDetached(gen int) {
+	s := t.sess
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.gen == gen && !s.closed {
+		s.cond.Wait()
+	}
+}
+
+func (t *Tunnel) closeSession() {
+	s := t.sess
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// should be called with lock held, drop frames acked by peer
+func (s *session) trim(acked uint64) {
+	if acked <= s.acked {
+		return
+	}
+	n := int(acked - s.acked)
+	for _, frame := range s.sent[:n] {
+		s.size -= len(frame)
+	}
+	s.sent = s.sent[n:]
+	s.acked = acked
+	s.cond.Broadcast()
+}
+
+// pump is woken by an empty payload to write pending ack or replay frames,
+// it's dropped if pump is busy, which checks them after every frame
+func (t *Tunnel) wakePump() {
+	select {
+	case t.wch[priorityInteractive] <- Payload{}:
+	default:
+	}
+}
+
+// connection of reader, wait if it's broken
+func (t *Tunnel) readConn() (net.Conn, *bufio.Reader, int, bool) {
+	s := t.sess
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.broken && !s.closed {
+		s.cond.Wait()
+	}
+	return t.conn, t.reader, s.gen, !s.closed
+}
+
+// count frame read from connection of gen, false if the connection is
+// replaced and frame should be dropped, peer will replay it
+func (t *Tunnel) receive(gen int) bool {
+	s := t.sess
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if gen != s.gen {
+		return false
+	}
+	s.received++
+	if s.received-s.ackSent >= ackFrames && !s.ackPending {
+		s.ackPending = true
+		s.cond.Broadcast()
+		t.wakePump()
+	}
+	return true
+}
+
+func (t *Tunnel) onAck(arg []byte) {
+	if len(arg) < 8 {
+		return
+	}
+	acked := binary.LittleEndian.Uint64(arg)
+	s := t.sess
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if acked <= s.acked+uint64(len(s.sent)) {
+		s.trim(acked)
+	}
+}
+
+// keep frame for replay and write it, frame is nil if pump is woken. Frames
+// are kept if connection is broken, error is returned only if tunnel is
+// closed
+func (t *Tunnel) writeSession(frame []byte) error {
+	s := t.sess
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if frame != nil {
+		// wait peer to ack, but keep acking its frames
+		for s.size+len(frame) > s.limit && len(s.sent) > 0 && !s.closed {
+			if !s.broken && (s.ackPending || s.written < s.acked+uint64(len(s.sent))) {
+				t.flushSession()
+				continue
+			}
+			s.cond.Wait()
+		}
+		if s.closed {
+			return errTunnelClosed
+		}
+		s.sent = append(s.sent, frame)
+		s.size += len(frame)
+	}
+	if s.closed {
+		return errTunnelClosed
+	}
+	t.flushSession()
+	return nil
+}
+
+// should be called with lock held, which is released while writing. Write
+// frames not written to current connection and pending ack
+func (t *Tunnel) flushSession() {
+	s := t.sess
+	for !s.broken && !s.closed {
+		frames := s.sent[s.written-s.acked:]
+		ack := s.ackPending
+		if len(frames) == 0 && !ack {
+			return
+		}
+		var ackFrame []byte
+		if ack {
+			ackFrame = t.encodeAck(s.received)
+			s.ackSent = s.received
+			s.ackPending = false
+		}
+		gen, w := s.gen, t.writer
+
+		s.lock.Unlock()
+		var err error
+		for _, frame := range frames {
+			if _, err = w.Write(frame); err != nil {
+				break
+			}
+		}
+		if err == nil && ackFrame != nil {
+			_, err = w.Write(ackFrame)
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		s.lock.Lock()
+
+		if gen != s.gen {
+			continue
+		}
+		if err != nil {
+			t.detach(gen, err)
+			return
+		}
+		s.written += uint64(len(frames))
+	}
+}
+
+// TUNNEL_ACK carries frames received, it's neither kept nor counted
+func (t *Tunnel) encodeAck(received uint64) []byte {
+	n := t.cmdSize()
+	data := make([]byte, n+8)
+	data[0] = TUNNEL_ACK
+	binary.LittleEndian.PutUint64(data[n:], received)
+	return t.encodeFrame(0, t.whead[:t.headSize()], data)
+}
+
+func (t *Tunnel) isAck(payload Payload) bool {
+	return payload.linkid == 0 && len(payload.data) >= t.cmdSize() && payload.data[0] == TUNNEL_ACK
+}
@@ -0,0 +1,154 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	errNotTLS     = errors.New("not a tls client hello")
+	errHelloShort = errors.New("tls client hello too short")
+)
+
+const (
+	tlsRecordHeadSize = 5
+	tlsRecordSize     = tlsRecordHeadSize + 1<<14 // max plain text record
+
+	tlsRecordHandshake = 0x16
+	tlsClientHello     = 0x01
+	tlsExtServerName   = 0x0000
+	tlsHostName        = 0x00
+)
+
+// peek server name of tls client hello in the first record, without consuming
+// it. Empty name is returned if client sends no sni.
+func peekServerName(rd *bufio.Reader) (string, error) {
+	head, err := rd.Peek(tlsRecordHeadSize)
+	if err != nil {
+		return "", err
+	}
+	if head[0] != tlsRecordHandshake {
+		return "", errNotTLS
+	}
+	n := int(binary.BigEndian.Uint16(head[3:]))
+	record, err := rd.Peek(tlsRecordHeadSize + n)
+	if err != nil {
+		return "", err
+	}
+	return parseServerName(record[tlsRecordHeadSize:])
+}
+
+// tls byte reader, every read is checked against the remaining data
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *tlsReader) uint8() (int, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := int((*r)[0])
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *tlsReader) uint16() (int, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := int(binary.BigEndian.Uint16(*r))
+	*r = (*r)[2:]
+	return v, true
+}
+
+// bytes prefixed by length of size 1 or 2
+func (r *tlsReader) vector(size int) (tlsReader, bool) {
+	var n int
+	var ok bool
+	if size == 1 {
+		n, ok = r.uint8()
+	} else {
+		n, ok = r.uint16()
+	}
+	if !ok || len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+// parse server name of a client hello handshake message, it must be whole
+func parseServerName(msg []byte) (string, error) {
+	r := tlsReader(msg)
+	typ, ok := r.uint8()
+	if !ok || typ != tlsClientHello {
+		return "", errNotTLS
+	}
+	// length, version and random
+	if !r.skip(3 + 2 + 32) {
+		return "", errHelloShort
+	}
+	// session id, cipher suites and compression methods
+	if _, ok := r.vector(1); !ok {
+		return "", errHelloShort
+	}
+	if _, ok := r.vector(2); !ok {
+		return "", errHelloShort
+	}
+	if _, ok := r.vector(1); !ok {
+		return "", errHelloShort
+	}
+	if len(r) == 0 {
+		// no extensions
+		return "", nil
+	}
+	exts, ok := r.vector(2)
+	if !ok {
+		return "", errHelloShort
+	}
+	for len(exts) > 0 {
+		typ, ok := exts.uint16()
+		if !ok {
+			return "", errHelloShort
+		}
+		ext, ok := exts.vector(2)
+		if !ok {
+			return "", errHelloShort
+		}
+		if typ != tlsExtServerName {
+			continue
+		}
+		names, ok := ext.vector(2)
+		if !ok {
+			return "", errHelloShort
+		}
+		for len(names) > 0 {
+			nameType, ok := names.uint8()
+			if !ok {
+				return "", errHelloShort
+			}
+			name, ok := names.vector(2)
+			if !ok {
+				return "", errHelloShort
+			}
+			if nameType == tlsHostName {
+				return string(name), nil
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
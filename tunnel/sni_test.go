@@ -0,0 +1,143 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// first record sent by a tls client of server name
+func clientHello(t testing.TB, name string) []byte {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go tls.Client(c1, &tls.Config{ServerName: name, InsecureSkipVerify: true}).Handshake()
+
+	head := make([]byte, tlsRecordHeadSize)
+	if _, err := io.ReadFull(c2, head); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, tlsRecordHeadSize+int(binary.BigEndian.Uint16(head[3:])))
+	copy(record, head)
+	if _, err := io.ReadFull(c2, record[tlsRecordHeadSize:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestPeekServerName(t *testing.T) {
+	for _, name := range []string{"example.com", ""} {
+		hello := clientHello(t, name)
+		rd := bufio.NewReader(bytes.NewReader(hello))
+		got, err := peekServerName(rd)
+		if err != nil || got != name {
+			t.Fatalf("unexpected server name:%q, %v", got, err)
+		}
+		if rd.Buffered() != len(hello) {
+			t.Fatal("client hello should not be consumed")
+		}
+	}
+	if _, err := peekServerName(bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n"))); err != errNotTLS {
+		t.Fatalf("unexpected err:%v", err)
+	}
+}
+
+func FuzzServerName(f *testing.F) {
+	f.Add(clientHello(f, "example.com")[tlsRecordHeadSize:])
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		parseServerName(msg)
+	})
+}
+
+func TestRouteMatch(t *testing.T) {
+	rule := &Rule{Name: "sni", SNI: true, Routes: []*Route{
+		{Host: "a.example.com", Service: "a"},
+		{Host: "*.example.com", Service: "b"},
+		{Host: "*", Service: "c"},
+	}}
+	cases := map[string]string{
+		"a.example.com":   "a",
+		"A.Example.COM.":  "a",
+		"x.example.com":   "b",
+		"x.y.example.com": "b",
+		"example.com":     "c",
+		"":                "c",
+	}
+	for host, service := range cases {
+		if route := rule.findRoute(host); route == nil || route.Service != service {
+			t.Fatalf("host %q should be routed to %s", host, service)
+		}
+	}
+}
+
+func TestPairSNIRoute(t *testing.T) {
+	const otherBackend = "127.0.0.1:8005"
+	server := Config{Rules: []*Rule{
+		{Name: "a", Backend: testBackendAddr},
+		{Name: "b", Backend: otherBackend},
+	}}
+	client := Config{Rules: []*Rule{
+		{Name: "sni", Listen: testListenAddr, SNI: true, Routes: []*Route{
+			{Host: "a.example.com", Service: "a"},
+			{Host: "*.example.org", Service: "b"},
+		}},
+	}}
+	p := newTestPair(t, server, client)
+
+	// other backend tells itself by a greeting
+	ln, err := p.network.Listen(otherBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "b")
+			conn.Close()
+		}
+	}()
+
+	send := func(hello []byte) []byte {
+		conn, err := p.network.Dial(context.Background(), testListenAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write(hello)
+		conn.(BiConn).CloseWrite()
+		data, _ := io.ReadAll(conn)
+		return data
+	}
+
+	// client hello is replayed to backend
+	hello := clientHello(t, "a.example.com")
+	if echoed := send(hello); !bytes.Equal(echoed, hello) {
+		t.Fatalf("unexpected echo of %d bytes", len(echoed))
+	}
+	if data := send(clientHello(t, "www.example.org")); string(data) != "b" {
+		t.Fatalf("unexpected data:%q", data)
+	}
+	if data := send(clientHello(t, "unknown.net")); len(data) != 0 {
+		t.Fatalf("unmatched connection should be closed:%q", data)
+	}
+
+	// failed routing releases hub
+	if data := send([]byte("not a client hello")); len(data) != 0 {
+		t.Fatalf("unrouted connection should be closed:%q", data)
+	}
+	waitHubsReleased(t, p.client)
+}
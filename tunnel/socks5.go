@@ -0,0 +1,135 @@
+//
+//   date  : 2015-08-03
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// rfc1928, only no authentication and CONNECT command are supported
+const (
+	socks5Version = 5
+
+	socks5NoAuth       = 0
+	socks5NoAcceptable = 0xff
+
+	socks5Connect = 1
+
+	socks5IPv4   = 1
+	socks5Domain = 3
+	socks5IPv6   = 4
+
+	socks5Succeeded        = 0
+	socks5GeneralFailure   = 1
+	socks5NotAllowed       = 2
+	socks5NetUnreachable   = 3
+	socks5HostUnreachable  = 4
+	socks5Refused          = 5
+	socks5CmdNotSupported  = 7
+	socks5AddrNotSupported = 8
+)
+
+var (
+	errSocks5Version = errors.New("errSocks5Version")
+	errSocks5Auth    = errors.New("errSocks5Auth")
+	errSocks5Cmd     = errors.New("errSocks5Cmd")
+	errSocks5Addr    = errors.New("errSocks5Addr")
+)
+
+func socks5Reply(conn io.Writer, rep uint8) error {
+	// bound address is unknown before server dials, always 0.0.0.0:0
+	_, err := conn.Write([]byte{socks5Version, rep, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// negotiate with local client, return requested destination as host:port.
+// Caller replies after server connects the destination, or at once if server
+// doesn't report it. If busy, request is answered with a general failure.
+func socks5Handshake(conn net.Conn, busy bool) (string, error) {
+	if Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(Timeout) * time.Second))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	// version, methods
+	buf := make([]byte, 256+2)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != socks5Version {
+		return "", errSocks5Version
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := uint8(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+			break
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5NoAcceptable {
+		return "", errSocks5Auth
+	}
+
+	// version, cmd, reserved, address type
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[0] != socks5Version {
+		return "", errSocks5Version
+	}
+	if buf[1] != socks5Connect {
+		socks5Reply(conn, socks5CmdNotSupported)
+		return "", errSocks5Cmd
+	}
+
+	var host string
+	switch buf[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := buf[:net.IPv4len]
+		if buf[3] == socks5IPv6 {
+			ip = buf[:net.IPv6len]
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5Domain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", err
+		}
+		name := buf[1 : 1+buf[0]]
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socks5Reply(conn, socks5AddrNotSupported)
+		return "", errSocks5Addr
+	}
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	if busy {
+		socks5Reply(conn, socks5GeneralFailure)
+		return "", errLinkIdBusy
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
@@ -0,0 +1,85 @@
+//
+//   date  : 2015-08-03
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSocks5Handshake(t *testing.T) {
+	cases := []struct {
+		req  []byte
+		dest string
+	}{
+		{[]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80}, "127.0.0.1:80"},
+		{append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 1, 187), "example.com:443"},
+		{[]byte{5, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 22}, "[::1]:22"},
+	}
+
+	for _, c := range cases {
+		local, remote := net.Pipe()
+		go func() {
+			local.Write([]byte{5, 2, 2, 0})
+			local.Write(c.req)
+		}()
+		done := make(chan []byte)
+		go func() {
+			reply := make([]byte, 12)
+			io.ReadFull(local, reply)
+			done <- reply
+		}()
+
+		dest, err := socks5Handshake(remote, false)
+		if err != nil {
+			t.Fatal("handshake failed:", err)
+		}
+		socks5Reply(remote, socks5Succeeded)
+		if dest != c.dest {
+			t.Fatalf("unexpected dest:%s, want %s", dest, c.dest)
+		}
+		if reply := <-done; !bytes.Equal(reply[:4], []byte{5, 0, 5, 0}) {
+			t.Fatalf("unexpected reply:%v", reply)
+		}
+		local.Close()
+		remote.Close()
+	}
+}
+
+func TestSocks5NoAcceptable(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		local.Write([]byte{5, 1, 2})
+		io.ReadFull(local, make([]byte, 2))
+	}()
+	if _, err := socks5Handshake(remote, false); err != errSocks5Auth {
+		t.Fatal("unexpected err:", err)
+	}
+}
+
+func TestSocks5Busy(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		local.Write([]byte{5, 1, 0})
+		local.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	}()
+	done := make(chan []byte)
+	go func() {
+		reply := make([]byte, 12)
+		io.ReadFull(local, reply)
+		done <- reply
+	}()
+	if _, err := socks5Handshake(remote, true); err != errLinkIdBusy {
+		t.Fatal("unexpected err:", err)
+	}
+	if reply := <-done; !bytes.Equal(reply[:4], []byte{5, 0, 5, socks5GeneralFailure}) {
+		t.Fatalf("unexpected reply:%v", reply)
+	}
+}
@@ -0,0 +1,94 @@
+//
+//   date  : 2015-09-30
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"time"
+)
+
+// tunnel index of standby hubs in logs
+const standbyTunnel = -1
+
+// hub authenticated and running, but not scheduled for links until a tunnel
+// takes it
+type standbyHub struct {
+	item     *HubItem
+	quit     chan struct{} // closed when hub quits
+	promoted chan struct{} // closed when a tunnel takes it
+}
+
+// take a live standby hub for tunnel of index, the tunnel owns it then. nil
+// if there is none
+func (cli *Client) takeStandby(index int) *HubItem {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	for i, sb := range cli.standbys {
+		select {
+		case <-sb.quit:
+			// removed by its slot
+			continue
+		default:
+		}
+		cli.standbys = append(cli.standbys[:i], cli.standbys[i+1:]...)
+		close(sb.promoted)
+		sb.item.tunnel = index
+		sb.item.quit = sb.quit
+		return sb.item
+	}
+	return nil
+}
+
+// remove sb if it's still standby, return false if a tunnel has taken it
+func (cli *Client) removeStandby(sb *standbyHub) bool {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	for i, other := range cli.standbys {
+		if other == sb {
+			cli.standbys = append(cli.standbys[:i], cli.standbys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// keep a standby hub connected, make another one once it's taken
+func (cli *Client) runStandby() {
+	Recover()
+
+	backoff := cli.app.backoff()
+	for !cli.isStopped() {
+		hub, err := cli.connectHub(cli.ctx, standbyTunnel)
+		if err != nil {
+			delay := backoff.Next()
+			Error("standby hub connect failed(%d):%v, retry in %v", backoff.Attempt(), err, delay)
+			select {
+			case <-time.After(delay):
+			case <-cli.ctx.Done():
+			}
+			continue
+		}
+		backoff.Reset()
+
+		sb := &standbyHub{item: hub, quit: make(chan struct{}), promoted: make(chan struct{})}
+		go func() {
+			hub.Start()
+			close(sb.quit)
+		}()
+		cli.lock.Lock()
+		cli.standbys = append(cli.standbys, sb)
+		cli.lock.Unlock()
+
+		select {
+		case <-sb.promoted:
+		case <-sb.quit:
+			// taken at the same time, or quit as standby
+			if cli.removeStandby(sb) {
+				Error("standby hub disconnected")
+				cli.serverReleased(hub.server)
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// with StateDir set, an end keeps a small state across restarts in
+// StateDir/state.json. It's saved every stateInterval and when the end
+// stops, to a temporary file synced and renamed over the old one, so a crash
+// leaves the last complete state. It's loaded at start:
+//
+//   - client: its identity, bytes sent and received by links since the first
+//     start, and failures and rtt of servers, so a restarted client goes on
+//     skipping failing servers and prefers the one it used last.
+//   - server: traffic of client identities, so daily and monthly quotas
+//     survive restarts, and bans not expired yet.
+//
+// Traffic of a client identity other than the one saved is dropped.
+
+const (
+	stateFile     = "state.json"
+	stateInterval = 10 * time.Second
+)
+
+type endpointState struct {
+	Addr      string        `json:"addr"`
+	Failures  int           `json:"failures,omitempty"`
+	DownUntil time.Time     `json:"down_until,omitempty"`
+	RTT       time.Duration `json:"rtt,omitempty"`
+}
+
+type usageState struct {
+	Client     string    `json:"client"`
+	Up         int64     `json:"up"`
+	Down       int64     `json:"down"`
+	Day        time.Time `json:"day"`
+	DayBytes   int64     `json:"day_bytes"`
+	Month      time.Time `json:"month"`
+	MonthBytes int64     `json:"month_bytes"`
+}
+
+type banState struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+type savedState struct {
+	Saved time.Time `json:"saved"`
+
+	// client
+	ClientID string          `json:"client_id,omitempty"`
+	Server   string          `json:"server,omitempty"` // connected last
+	Servers  []endpointState `json:"servers,omitempty"`
+	Sent     int64           `json:"sent,omitempty"`
+	Received int64           `json:"received,omitempty"`
+
+	// server
+	Usage []usageState `json:"usage,omitempty"`
+	Bans  []banState   `json:"bans,omitempty"`
+}
+
+// state saved in dir, empty if there is none
+func loadState(dir string) (*savedState, error) {
+	s := &savedState{}
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func saveState(dir string, s *savedState) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, stateFile+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, stateFile)); err != nil {
+		return err
+	}
+	// rename is durable once directory is synced, not supported everywhere
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// load state of StateDir, and save state taken by snapshot until ctx is
+// done. Nothing is done if StateDir is empty
+func (app *App) keepState(ctx context.Context, wg *sync.WaitGroup, restore func(*savedState), snapshot func() *savedState) {
+	dir := app.StateDir
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		Error("create state dir failed:%v", err)
+	}
+	s, err := loadState(dir)
+	if err != nil {
+		Error("load state failed, start over:%v", err)
+	} else {
+		restore(s)
+	}
+
+	save := func() {
+		s := snapshot()
+		s.Saved = time.Now()
+		if err := saveState(dir, s); err != nil {
+			Error("save state failed:%v", err)
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer Recover()
+		ticker := time.NewTicker(stateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-ctx.Done():
+				save()
+				return
+			}
+		}
+	}()
+}
+
+func (u *clientUsage) state() usageState {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return usageState{
+		Client:     u.id,
+		Up:         u.up,
+		Down:       u.down,
+		Day:        u.day,
+		DayBytes:   u.dayBytes,
+		Month:      u.month,
+		MonthBytes: u.monthBytes,
+	}
+}
+
+// counting goes on from saved traffic, periods over are started again
+func (u *clientUsage) restore(s usageState) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.up, u.down = s.Up, s.Down
+	u.day, u.dayBytes = s.Day, s.DayBytes
+	u.month, u.monthBytes = s.Month, s.MonthBytes
+	u.check(time.Now())
+}
+
+func (t *usageTable) state() []usageState {
+	t.Lock()
+	clients := make([]*clientUsage, 0, len(t.clients))
+	for _, u := range t.clients {
+		clients = append(clients, u)
+	}
+	t.Unlock()
+
+	list := make([]usageState, 0, len(clients))
+	for _, u := range clients {
+		list = append(list, u.state())
+	}
+	return list
+}
+
+// bans not expired
+func (b *banList) state(now time.Time) []banState {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	var list []banState
+	for ip, e := range b.entries {
+		if !e.until.IsZero() && now.Before(e.until) {
+			list = append(list, banState{IP: ip, Until: e.until})
+		}
+	}
+	return list
+}
+
+func (b *banList) restore(list []banState, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	for _, s := range list {
+		if now.Before(s.Until) {
+			b.entries[s.IP] = &banEntry{failures: b.threshold, first: now, until: s.Until}
+		}
+	}
+}
+
+func (self *Server) restoreState(s *savedState) {
+	for _, us := range s.Usage {
+		self.usage.get(us.Client).restore(us)
+	}
+	self.banned.restore(s.Bans, time.Now())
+}
+
+func (self *Server) snapshotState() *savedState {
+	return &savedState{
+		Usage: self.usage.state(),
+		Bans:  self.banned.state(time.Now()),
+	}
+}
+
+func (cli *Client) restoreState(s *savedState) {
+	if s.ClientID == cli.app.ClientID {
+		cli.traffic.restore(usageState{Up: s.Received, Down: s.Sent})
+	} else {
+		Info("client id changed from %q, traffic is counted again", s.ClientID)
+	}
+
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	now := time.Now()
+	for _, es := range s.Servers {
+		for _, ep := range cli.servers {
+			if ep.addr != es.Addr {
+				continue
+			}
+			ep.failures, ep.rtt = es.Failures, es.RTT
+			if now.Before(es.DownUntil) {
+				ep.downUntil = es.DownUntil
+			}
+			ep.last = ep.addr == s.Server
+		}
+	}
+}
+
+func (cli *Client) snapshotState() *savedState {
+	traffic := cli.traffic.state()
+	s := &savedState{
+		ClientID: cli.app.ClientID,
+		Received: traffic.Up,
+		Sent:     traffic.Down,
+	}
+
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	s.Server = cli.lastServer
+	for _, ep := range cli.servers {
+		s.Servers = append(s.Servers, endpointState{Addr: ep.addr, Failures: ep.failures, DownUntil: ep.downUntil, RTT: ep.rtt})
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSaveState(t *testing.T) {
+	dir := t.TempDir()
+	s, err := loadState(dir)
+	if err != nil || s.Server != "" || len(s.Usage) != 0 {
+		t.Fatalf("unexpected state without file:%+v, %v", s, err)
+	}
+
+	until := time.Now().Add(time.Hour).Round(0)
+	saved := &savedState{
+		ClientID: "alice",
+		Server:   "127.0.0.1:8001",
+		Servers:  []endpointState{{Addr: "127.0.0.1:8001", Failures: 2, RTT: time.Millisecond}},
+		Sent:     100,
+		Usage:    []usageState{{Client: "bob", Up: 1, Down: 2}},
+		Bans:     []banState{{IP: "10.0.0.1", Until: until}},
+	}
+	for i := 0; i < 2; i++ {
+		if err := saveState(dir, saved); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err = loadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ClientID != "alice" || s.Sent != 100 || s.Servers[0].Failures != 2 || s.Usage[0].Down != 2 || !s.Bans[0].Until.Equal(until) {
+		t.Fatalf("unexpected state:%+v", s)
+	}
+	// temporary files are removed
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("unexpected files:%v", entries)
+	}
+
+	os.WriteFile(dir+"/"+stateFile, []byte("{"), 0600)
+	if _, err := loadState(dir); err == nil {
+		t.Fatal("broken state should fail")
+	}
+}
+
+func TestBanListState(t *testing.T) {
+	now := time.Now()
+	b := newBanList(1, time.Minute, time.Minute)
+	b.fail("10.0.0.1", now)
+	b.fail("10.0.0.2", now.Add(-time.Hour))
+
+	other := newBanList(1, time.Minute, time.Minute)
+	other.restore(b.state(now), now)
+	if !other.banned("10.0.0.1", now) || other.banned("10.0.0.2", now) {
+		t.Fatal("unexpected bans restored")
+	}
+}
+
+func TestPairState(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{Servers: []string{"127.0.0.1:8004"}})
+	if got := p.roundTrip(t, "hello"); got != "hello" {
+		t.Fatalf("unexpected echo:%q", got)
+	}
+
+	// a restarted server counts on
+	s := p.server.snapshotState()
+	if len(s.Usage) != 1 || s.Usage[0].Up != 5 || s.Usage[0].Down != 5 {
+		t.Fatalf("unexpected usage:%+v", s.Usage)
+	}
+	server := newServer(p.server.app)
+	server.restoreState(s)
+	if u := server.usage.get("").status(); u.Up != 5 || u.Daily != 10 {
+		t.Fatalf("unexpected usage restored:%+v", u)
+	}
+
+	// a restarted client prefers the server it used
+	s = p.client.snapshotState()
+	if s.Sent != 5 || s.Received != 5 || s.Server != testTunnelAddr || len(s.Servers) != 2 {
+		t.Fatalf("unexpected client state:%+v", s)
+	}
+	s.Servers[0].RTT, s.Servers[1].RTT = time.Second, time.Millisecond
+	cli := newClient(p.client.app)
+	cli.restoreState(s)
+	if u := cli.traffic.status(); u.Up != 5 || u.Down != 5 {
+		t.Fatalf("unexpected traffic restored:%+v", u)
+	}
+	if ep := cli.pickServer(); ep.addr != testTunnelAddr {
+		t.Fatalf("unexpected server picked:%s", ep.addr)
+	}
+
+	// traffic of another identity
+	s.ClientID = "bob"
+	cli = newClient(p.client.app)
+	cli.restoreState(s)
+	if u := cli.traffic.status(); u.Up != 0 {
+		t.Fatalf("traffic of another client is restored:%+v", u)
+	}
+}
@@ -0,0 +1,78 @@
+//
+//   date  : 2015-10-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Stdio connects tunnels like client, relays one link of service over in
+// and out, and returns when the link is done, like netcat. It works as
+// ProxyCommand of ssh. Dest is the destination of a proxy service, empty
+// for others. Configured rules are not listened.
+func (app *App) Stdio(ctx context.Context, service, dest string, in io.Reader, out io.Writer) error {
+	if app.Tunnels == 0 {
+		return errors.New("stdio runs as client, tunnels should be positive")
+	}
+	if err := app.init(); err != nil {
+		return err
+	}
+	// priority and nocrypt of link come from the rule if it's configured
+	rule := app.findRule(service)
+	if rule == nil {
+		rule = &Rule{Name: service, priority: priorityNormal}
+	}
+	app.rules = nil
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cli := newClient(app)
+	app.service = cli
+	if err := cli.Start(ctx); err != nil {
+		return err
+	}
+	defer cli.Wait()
+	defer cancel()
+
+	item := cli.fetchHub(pipeAddr("stdio"))
+	if item == nil {
+		return errors.New("no active tunnel")
+	}
+	defer cli.dropHub(item)
+	linkid := item.AcquireId()
+	if linkid == 0 {
+		return errors.New("alloc linkid failed")
+	}
+	defer item.ReleaseId(linkid)
+
+	local, remote := memPipe("stdio", pipeAddr(rule.String()))
+	defer local.Close()
+	code := closeNormal
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer remote.Close()
+		item.forwardLink(linkid, remote, rule, &LinkArgs{Service: service, Dest: dest}, func(c uint8) error {
+			code = c
+			return nil
+		})
+	}()
+
+	// in may block forever, it's left to exit of process
+	go func() {
+		io.Copy(local, in)
+		local.CloseWrite()
+	}()
+	_, err := io.Copy(out, local)
+	<-done
+	if code != closeNormal {
+		return fmt.Errorf("link is rejected: %s", closeName(code))
+	}
+	return err
+}
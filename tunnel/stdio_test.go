@@ -0,0 +1,56 @@
+//
+//   date  : 2015-10-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPairStdio(t *testing.T) {
+	server := Config{Rules: []*Rule{{Name: "cat", Exec: []string{"cat"}}}}
+	p := newTestPair(t, server, Config{})
+	stdio := func(service string) (string, error) {
+		app := newTestApp(t, p.network, Config{Backend: testTunnelAddr, Listen: "127.0.0.1:8007", Tunnels: 1, Secret: "test secret"})
+		var out bytes.Buffer
+		err := app.Stdio(context.Background(), service, "", strings.NewReader("hello"), &out)
+		return out.String(), err
+	}
+
+	// link ends when backend closes after stdin is done
+	if out, err := stdio(""); err != nil || out != "hello" {
+		t.Fatalf("unexpected stdio:%q, %v", out, err)
+	}
+	if out, err := stdio("cat"); err != nil || out != "hello" {
+		t.Fatalf("unexpected exec:%q, %v", out, err)
+	}
+	if _, err := stdio("unknown"); err == nil {
+		t.Fatal("unknown service should fail")
+	}
+}
+
+func TestExecConfig(t *testing.T) {
+	app := &App{Config: Config{Listen: "127.0.0.1:0", Backend: "127.0.0.1:1"}}
+	for _, rule := range []*Rule{
+		{Name: "a", Exec: []string{""}},
+		{Name: "b", Exec: []string{"cat"}, Backend: "127.0.0.1:80"},
+		{Name: "c", Exec: []string{"cat"}, UDP: true},
+		{Name: "d", Exec: []string{"cat"}, Socks5: true},
+	} {
+		if _, err := app.buildRules([]*Rule{rule}); err == nil {
+			t.Fatalf("rule %s should be rejected", rule)
+		}
+	}
+	rules, err := app.buildRules([]*Rule{{Name: "a", Exec: []string{"cat"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules["a"].pool != nil {
+		t.Fatal("exec rule shouldn't have backend")
+	}
+}
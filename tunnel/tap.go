@@ -0,0 +1,135 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// read only tap of a link on the end dialing backend: data written to
+// backend is copied to Rule.Mirror, whose replies are discarded, and data of
+// both directions is appended to capture file Rule.Tap. The link never waits
+// for mirror, data is dropped if it's slow or unreachable.
+
+// chunks queued for mirror of a link
+const tapMirrorQueue = 64
+
+type linkTap struct {
+	log    *Logger
+	mirror chan []byte
+
+	lock    sync.Mutex // stream is written by both pumps
+	capture *pcapWriter
+	stream  *tcpStream
+}
+
+// tap of link to dest, nil if the rule has none
+func (app *App) newTap(rule *Rule, link *Link, dest string) *linkTap {
+	if rule.Mirror == "" && rule.Tap == "" {
+		return nil
+	}
+	t := &linkTap{log: link.log}
+	if rule.Tap != "" {
+		w, err := openTapFile(rule.Tap)
+		if err != nil {
+			link.log.Error("open tap file %s failed, err:%v", rule.Tap, err)
+		} else {
+			t.capture = w
+			t.stream = newTCPStream(link.source, dest)
+			t.write(true, tcpSyn, nil)
+			t.write(false, tcpSyn, nil)
+			t.write(true, 0, nil)
+		}
+	}
+	if rule.Mirror != "" {
+		t.mirror = make(chan []byte, tapMirrorQueue)
+		go t.runMirror(app, link, rule.Mirror)
+	}
+	return t
+}
+
+func (t *linkTap) write(fromClient bool, flags uint8, data []byte) {
+	t.lock.Lock()
+	pkts := t.stream.packets(fromClient, flags, data)
+	t.lock.Unlock()
+	if err := t.capture.writePackets(time.Now(), pkts); err != nil {
+		t.log.Error("write tap file failed, err:%v", err)
+	}
+}
+
+// data written to backend
+func (t *linkTap) onWrite(data []byte) {
+	if t == nil || len(data) == 0 {
+		return
+	}
+	if t.capture != nil {
+		t.write(true, tcpPsh, data)
+	}
+	if t.mirror != nil {
+		b := mpool.GetSize(len(data))
+		copy(b, data)
+		select {
+		case t.mirror <- b:
+		default:
+			mpool.Put(b)
+			atomic.AddInt64(&stats.MirrorDropped, int64(len(data)))
+		}
+	}
+}
+
+// data read from backend
+func (t *linkTap) onRead(data []byte) {
+	if t != nil && t.capture != nil {
+		t.write(false, tcpPsh, data)
+	}
+}
+
+// link is closed, no data is tapped after
+func (t *linkTap) close() {
+	if t == nil {
+		return
+	}
+	if t.capture != nil {
+		t.write(true, tcpFin, nil)
+		t.write(false, tcpFin, nil)
+	}
+	if t.mirror != nil {
+		close(t.mirror)
+	}
+}
+
+// copy data to mirror until link is closed, data is discarded if mirror
+// fails
+func (t *linkTap) runMirror(app *App, link *Link, addr string) {
+	defer Recover()
+
+	var conn net.Conn
+	c, err := app.dialLink(link.ctx, "tcp", addr)
+	if err != nil {
+		t.log.Error("connect to mirror %s failed, err:%v", addr, err)
+	} else {
+		conn = c
+		defer conn.Close()
+		go io.Copy(io.Discard, conn)
+	}
+	for b := range t.mirror {
+		if conn != nil {
+			if _, err := conn.Write(b); err != nil {
+				t.log.Error("write mirror %s failed, err:%v", addr, err)
+				conn.Close()
+				conn = nil
+			}
+		}
+		if conn == nil {
+			atomic.AddInt64(&stats.MirrorDropped, int64(len(b)))
+		}
+		mpool.Put(b)
+	}
+}
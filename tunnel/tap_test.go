@@ -0,0 +1,98 @@
+//
+//   date  : 2015-10-10
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestTCPStreamPacket(t *testing.T) {
+	for _, addrs := range [][2]string{{"10.0.0.1:1234", "10.0.0.2:80"}, {"[::1]:1234", "10.0.0.2:80"}, {"", "example.com:80"}} {
+		s := newTCPStream(addrs[0], addrs[1])
+		pkt := s.packet(true, tcpPsh, []byte("hello"))
+		ipLen := 20
+		if pkt[0]>>4 == 6 {
+			ipLen = 40
+		}
+		tcp := pkt[ipLen:]
+		var pseudo []byte
+		if ipLen == 20 {
+			if checksum(0, pkt[:20]) != 0 {
+				t.Fatal("bad ip checksum")
+			}
+			pseudo = append(append([]byte{}, pkt[12:20]...), 0, 6, 0, byte(len(tcp)))
+		} else {
+			pseudo = append(append([]byte{}, pkt[8:40]...), 0, 0, 0, byte(len(tcp)), 0, 0, 0, 6)
+		}
+		if checksum(sum(0, pseudo), tcp) != 0 {
+			t.Fatalf("bad tcp checksum of %v", addrs)
+		}
+		if binary.BigEndian.Uint32(tcp[4:]) != 1 || s.seq[0] != 6 || !bytes.Equal(tcp[20:], []byte("hello")) {
+			t.Fatalf("unexpected segment:%v", tcp)
+		}
+	}
+}
+
+func TestPairTap(t *testing.T) {
+	const mirrorAddr = "127.0.0.1:8006"
+	path := filepath.Join(t.TempDir(), "web.pcap")
+	server := Config{Rules: []*Rule{{Name: "web", Backend: testBackendAddr, Mirror: mirrorAddr, Tap: path}}}
+	client := Config{Rules: []*Rule{{Name: "web", Listen: testListenAddr}}}
+	p := newTestPair(t, server, client)
+
+	var lock sync.Mutex
+	var mirrored []byte
+	ln, err := p.network.Listen(mirrorAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		lock.Lock()
+		mirrored = data
+		lock.Unlock()
+	}()
+
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	waitFor(t, "mirror", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return string(mirrored) == "hello"
+	})
+
+	// handshake, data of both directions and fins
+	waitFor(t, "link closed", func() bool { return p.server.activeHubs()[0].LinkCount() == 0 })
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(data) != pcapMagic || binary.LittleEndian.Uint32(data[20:]) != pcapLinkTypeRaw {
+		t.Fatal("bad pcap header")
+	}
+	var payloads []string
+	for data = data[24:]; len(data) >= 16; {
+		n := int(binary.LittleEndian.Uint32(data[8:]))
+		payloads = append(payloads, string(data[16+40:16+n]))
+		data = data[16+n:]
+	}
+	if len(payloads) != 7 || payloads[3] != "hello" || payloads[4] != "hello" {
+		t.Fatalf("unexpected packets:%q", payloads)
+	}
+}
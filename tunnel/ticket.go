@@ -0,0 +1,374 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// With Ticket set on both ends, server sends a ticket after a full
+// handshake, sealed by a key of its process. Client presents it in the
+// first flight of its next connection, together with resume message if any,
+// instead of answering a challenge, so tunnel is up in one round trip:
+//
+//	client hello: token, suite, flags of version 5, 2 bytes length, ticket, binder
+//	server answer: suite, flags, mac; flags of version 0 if rejected
+//
+// token is a fresh challenge of client itself, checked by the replay cache,
+// and binder and mac are hmac of resumption secret of the ticket. The
+// session key is derived from the secret and client hello, there is no
+// forward secrecy until a full handshake. A rejected client drops its
+// ticket and does a full handshake over another connection.
+
+const (
+	ticketSecretSize = 32
+	ticketMaxSize    = 1024
+)
+
+var errTicketRejected = errors.New("ticket is rejected")
+
+// ticket kept by client for a server address
+type clientTicket struct {
+	ticket    []byte
+	secret    []byte
+	expire    time.Time
+	suite     uint8
+	compress  uint8
+	integrity bool
+	caps      uint32
+}
+
+// content of a ticket sealed by server
+type ticketState struct {
+	issued    int64 // unix seconds
+	suite     uint8
+	compress  uint8
+	integrity bool
+	caps      uint32
+	secret    []byte
+	identity  string
+}
+
+// aead sealing tickets by a random key, so tickets don't survive restart
+func newTicketKey() cipher.AEAD {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// resumption secret of a full handshake
+func ticketSecret(key []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, key, nil, "gotunnel ticket secret", ticketSecretSize)
+}
+
+func ticketMac(secret []byte, msg []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(msg)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// session key of a tunnel resumed by ticket
+func ticketKey(secret []byte, hello []byte) ([]byte, error) {
+	salt := sha256.Sum256(hello)
+	return hkdf.Key(sha256.New, secret, salt[:], "gotunnel ticket key", 32)
+}
+
+func sealTicket(aead cipher.AEAD, s *ticketState) []byte {
+	plain := make([]byte, 15, 15+len(s.secret)+1+len(s.identity))
+	binary.LittleEndian.PutUint64(plain, uint64(s.issued))
+	plain[8], plain[9] = s.suite, s.compress
+	if s.integrity {
+		plain[10] = 1
+	}
+	binary.LittleEndian.PutUint32(plain[11:], s.caps)
+	plain = append(plain, s.secret...)
+	plain = append(plain, byte(len(s.identity)))
+	plain = append(plain, s.identity...)
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plain, nil)
+}
+
+func openTicket(aead cipher.AEAD, ticket []byte) (*ticketState, error) {
+	if len(ticket) < aead.NonceSize() {
+		return nil, errTicketRejected
+	}
+	plain, err := aead.Open(nil, ticket[:aead.NonceSize()], ticket[aead.NonceSize():], nil)
+	if err != nil || len(plain) < 15+ticketSecretSize+1 {
+		return nil, errTicketRejected
+	}
+	s := &ticketState{
+		issued:    int64(binary.LittleEndian.Uint64(plain)),
+		suite:     plain[8],
+		compress:  plain[9],
+		integrity: plain[10] != 0,
+		caps:      binary.LittleEndian.Uint32(plain[11:]),
+		secret:    plain[15 : 15+ticketSecretSize],
+	}
+	id := plain[15+ticketSecretSize:]
+	if int(id[0]) != len(id)-1 {
+		return nil, errTicketRejected
+	}
+	s.identity = string(id[1:])
+	return s, nil
+}
+
+// send a ticket of the full handshake n: 4 bytes lifetime in seconds, 2
+// bytes length and ticket
+func (self *Server) issueTicket(wr io.Writer, n *negotiated) error {
+	secret, err := ticketSecret(n.key)
+	if err != nil {
+		return err
+	}
+	ticket := sealTicket(self.tickets, &ticketState{
+		issued:    time.Now().Unix(),
+		suite:     n.suite,
+		compress:  n.compress,
+		integrity: n.integrity,
+		caps:      n.caps,
+		secret:    secret,
+		identity:  n.identity,
+	})
+	msg := make([]byte, 6, 6+len(ticket))
+	binary.LittleEndian.PutUint32(msg, uint32(self.app.Ticket))
+	binary.LittleEndian.PutUint16(msg[4:], uint16(len(ticket)))
+	_, err = wr.Write(append(msg, ticket...))
+	return err
+}
+
+// verify ticket hello whose first bytes are read in token, and answer it
+func (self *Server) acceptTicket(conn net.Conn, token []byte, certID string, log *Logger) (*negotiated, error) {
+	suite := token[TaaBlockSize]
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		log.Error("read ticket failed:%s", err)
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint16(head))
+	if size > ticketMaxSize {
+		log.Error("read ticket failed:%s", errTicketRejected)
+		return nil, errVerifyToken
+	}
+	rest := make([]byte, size+sha256.Size)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		log.Error("read ticket failed:%s", err)
+		return nil, err
+	}
+	hello := append(append(token, head...), rest[:size]...)
+	binder := rest[size:]
+
+	reject := func(reason string) (*negotiated, error) {
+		atomic.AddInt64(&stats.TicketRejected, 1)
+		log.Info("reject ticket: %s", reason)
+		conn.Write([]byte{suite, packFlags(0, 0)})
+		return nil, errTicketRejected
+	}
+	if self.tickets == nil {
+		return reject("tickets are disabled")
+	}
+	s, err := openTicket(self.tickets, rest[:size])
+	if err != nil {
+		return reject("unknown ticket")
+	}
+	if time.Since(time.Unix(s.issued, 0)) > time.Duration(self.app.Ticket)*time.Second {
+		return reject("expired")
+	}
+	if s.caps&^self.app.localCaps() != 0 || s.suite != suite || !self.acceptCipher(suite) {
+		return reject("configuration changed")
+	}
+	if !hmac.Equal(binder, ticketMac(s.secret, hello, "client")) {
+		return reject("binder mismatch")
+	}
+	// revoked client or another certificate
+	if s.identity != certID && (certID != "" || len(self.app.credentials(s.identity)) == 0) {
+		return reject("identity changed")
+	}
+	var issued authToken
+	issued.fromBytes(token[:TaaTokenSize])
+	if !self.replay.check(issued, time.Now()) {
+		atomic.AddInt64(&stats.TokenReplayed, 1)
+		return reject("stale or replayed token")
+	}
+
+	flags := s.compress
+	if s.integrity {
+		flags |= compressIntegrity
+	}
+	answer := []byte{suite, packFlags(handshakeTicket, flags)}
+	mac := ticketMac(s.secret, append(hello[:len(hello):len(hello)], answer...), "server")
+	if _, err := conn.Write(append(answer, mac...)); err != nil {
+		log.Error("write ticket answer failed:%s", err)
+		return nil, err
+	}
+	key, err := ticketKey(s.secret, hello)
+	if err != nil {
+		return nil, err
+	}
+	if s.identity != "" {
+		log = log.With("client", s.identity)
+	}
+	atomic.AddInt64(&stats.TicketResumed, 1)
+	log.Info("resume by ticket, cipher %s, compress %s, integrity %v, caps %s", cipherName(suite), compressName(s.compress), s.integrity, capsString(s.caps))
+	return &negotiated{suite: suite, version: handshakeTicket, compress: s.compress, integrity: s.integrity, caps: s.caps, key: key, identity: s.identity, log: log, ticket: true}, nil
+}
+
+// unexpired ticket for server addr, nil if there is none
+func (cli *Client) ticket(addr string) *clientTicket {
+	if cli.app.Ticket <= 0 {
+		return nil
+	}
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	t := cli.tickets[addr]
+	if t != nil && time.Now().After(t.expire) {
+		delete(cli.tickets, addr)
+		return nil
+	}
+	return t
+}
+
+func (cli *Client) dropTicket(addr string) {
+	cli.lock.Lock()
+	delete(cli.tickets, addr)
+	cli.lock.Unlock()
+}
+
+// read ticket issued after full handshake n with server addr
+func (cli *Client) readTicket(rd io.Reader, addr string, n *negotiated) error {
+	head := make([]byte, 6)
+	if _, err := io.ReadFull(rd, head); err != nil {
+		return err
+	}
+	lifetime := time.Duration(binary.LittleEndian.Uint32(head)) * time.Second
+	size := int(binary.LittleEndian.Uint16(head[4:]))
+	if size > ticketMaxSize {
+		return errTicketRejected
+	}
+	ticket := make([]byte, size)
+	if _, err := io.ReadFull(rd, ticket); err != nil {
+		return err
+	}
+	secret, err := ticketSecret(n.key)
+	if err != nil {
+		return err
+	}
+	// server clock may run ahead of ours, leave a margin
+	if lifetime > time.Second {
+		lifetime -= time.Second
+	}
+	t := &clientTicket{
+		ticket:    ticket,
+		secret:    secret,
+		expire:    time.Now().Add(lifetime),
+		suite:     n.suite,
+		compress:  n.compress,
+		integrity: n.integrity,
+		caps:      n.caps,
+	}
+	cli.lock.Lock()
+	if cli.tickets == nil {
+		cli.tickets = make(map[string]*clientTicket)
+	}
+	cli.tickets[addr] = t
+	cli.lock.Unlock()
+	return nil
+}
+
+// present ticket t to server addr with resume message of resume, and
+// confirm server knows it. Failures are logged.
+func (cli *Client) ticketHandshake(conn net.Conn, addr string, t *clientTicket, resume *Tunnel, log *Logger) (*negotiated, error) {
+	a := NewTaa("")
+	a.GenToken()
+	token := a.token
+	flags := t.compress
+	if t.integrity {
+		flags |= compressIntegrity
+	}
+	hello := make([]byte, TaaBlockSize, int(TaaBlockSize)+4+len(t.ticket))
+	copy(hello, token.toBytes())
+	hello = append(hello, t.suite, packFlags(handshakeTicket, flags), 0, 0)
+	binary.LittleEndian.PutUint16(hello[TaaBlockSize+2:], uint16(len(t.ticket)))
+	hello = append(hello, t.ticket...)
+
+	key, err := ticketKey(t.secret, hello)
+	if err != nil {
+		return nil, err
+	}
+	rd, wr, err := newCipherStream(t.suite, conn, key, true)
+	if err != nil {
+		log.Error("create cipher stream failed:%s", err)
+		return nil, err
+	}
+
+	// server writes challenge at the same time
+	sent := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(append(hello[:len(hello):len(hello)], ticketMac(t.secret, hello, "client")...))
+		if err == nil && t.caps&capResume != 0 {
+			var id [sessionIDSize]byte
+			var received uint64
+			if resume != nil {
+				id, received = resume.sess.id, resume.receivedFrames()
+			}
+			_, err = wr.Write(resumeMessage(id, received))
+		}
+		sent <- err
+	}()
+	fail := func(err error) (*negotiated, error) {
+		conn.Close()
+		<-sent
+		return nil, err
+	}
+
+	challenge := make([]byte, TaaBlockSize)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		log.Error("read challenge failed:%s", err)
+		return fail(err)
+	}
+	answer := make([]byte, 2)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		log.Error("read ticket answer failed:%s", err)
+		return fail(err)
+	}
+	if version, _ := unpackFlags(answer[1]); version != handshakeTicket {
+		log.Info("ticket is rejected, do full handshake")
+		cli.dropTicket(addr)
+		return fail(errTicketRejected)
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, mac); err != nil {
+		log.Error("read ticket answer failed:%s", err)
+		return fail(err)
+	}
+	if !hmac.Equal(mac, ticketMac(t.secret, append(hello[:len(hello):len(hello)], answer...), "server")) {
+		log.Error("ticket answer mac mismatch")
+		cli.dropTicket(addr)
+		return fail(errKexMac)
+	}
+	if err := <-sent; err != nil {
+		log.Error("send ticket failed:%s", err)
+		return nil, err
+	}
+	log.Info("resume by ticket, cipher %s, compress %s, integrity %v, caps %s", cipherName(t.suite), compressName(t.compress), t.integrity, capsString(t.caps))
+	return &negotiated{suite: t.suite, version: handshakeTicket, compress: t.compress, integrity: t.integrity, caps: t.caps, key: key, ticket: true, rd: rd, wr: wr}, nil
+}
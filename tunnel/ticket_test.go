@@ -0,0 +1,106 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSealTicket(t *testing.T) {
+	aead := newTicketKey()
+	s := &ticketState{
+		issued:    1444700000,
+		suite:     cipherAES256GCM,
+		compress:  compressNone,
+		integrity: true,
+		caps:      localCaps | capTicket,
+		secret:    bytes.Repeat([]byte{7}, ticketSecretSize),
+		identity:  "alice",
+	}
+	ticket := sealTicket(aead, s)
+	got, err := openTicket(aead, ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.issued != s.issued || got.suite != s.suite || got.compress != s.compress || got.integrity != s.integrity ||
+		got.caps != s.caps || !bytes.Equal(got.secret, s.secret) || got.identity != s.identity {
+		t.Fatalf("unexpected ticket:%+v", got)
+	}
+
+	ticket[len(ticket)-1] ^= 1
+	if _, err := openTicket(aead, ticket); err != errTicketRejected {
+		t.Fatalf("tampered ticket is opened, err:%v", err)
+	}
+	// another server process
+	if _, err := openTicket(newTicketKey(), sealTicket(aead, s)); err != errTicketRejected {
+		t.Fatalf("ticket of another key is opened, err:%v", err)
+	}
+}
+
+func (cli *Client) ticketCount() int {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	return len(cli.tickets)
+}
+
+func TestPairTicket(t *testing.T) {
+	p := newTestPair(t, Config{Ticket: 60, Resume: 5}, Config{Ticket: 60, Resume: 5})
+	waitFor(t, "ticket", func() bool { return p.client.ticketCount() == 1 })
+
+	conn, err := p.network.Dial(context.Background(), testListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo := func(data string) {
+		if _, err := io.WriteString(conn, data); err != nil {
+			t.Fatalf("write failed:%v", err)
+		}
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != data {
+			t.Fatalf("unexpected echo:%q, %v", buf, err)
+		}
+	}
+	echo("hello")
+
+	// tunnel reconnects by ticket, and resumes in the same flight
+	resumed := atomic.LoadInt64(&stats.TicketResumed)
+	hub := p.client.activeHubs()[0]
+	hub.tunnel.netConn().Close()
+	echo(strings.Repeat("again", PacketSize))
+	if n := atomic.LoadInt64(&stats.TicketResumed); n != resumed+1 {
+		t.Fatalf("unexpected ticket resumes:%d", n-resumed)
+	}
+	if hubs := p.client.activeHubs(); len(hubs) != 1 || hubs[0] != hub {
+		t.Fatal("tunnel should be resumed")
+	}
+}
+
+func TestPairTicketRejected(t *testing.T) {
+	p := newTestPair(t, Config{Ticket: 60}, Config{Ticket: 60})
+	waitFor(t, "ticket", func() bool { return p.client.ticketCount() == 1 })
+	if got := p.roundTrip(t, "hello"); got != "hello" {
+		t.Fatalf("unexpected echo:%q", got)
+	}
+
+	// server forgets tickets as if it's restarted
+	p.server.tickets = newTicketKey()
+	rejected := atomic.LoadInt64(&stats.TicketRejected)
+	p.client.activeHubs()[0].tunnel.netConn().Close()
+
+	// client does a full handshake at once, and gets a new ticket
+	waitFor(t, "full handshake", func() bool {
+		return atomic.LoadInt64(&stats.TicketRejected) == rejected+1 && p.client.ticketCount() == 1
+	})
+	if got := p.roundTrip(t, "world"); got != "world" {
+		t.Fatalf("unexpected echo:%q", got)
+	}
+}
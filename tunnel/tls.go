@@ -0,0 +1,156 @@
+//
+//   date  : 2015-06-15
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+func newTLSConfig(app *App) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if app.TLSCert != "" || app.TLSKey != "" {
+		cert, err := loadKeyPair(app.TLSCert, app.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if app.TLSCA != "" {
+		pem, err := ioutil.ReadFile(app.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + app.TLSCA)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+	}
+
+	pins := make(map[string]bool)
+	for _, pin := range app.TLSPins {
+		pins[strings.ToLower(pin)] = true
+	}
+
+	if app.Tunnels == 0 {
+		if len(config.Certificates) == 0 {
+			return nil, errors.New("tls server need certificate and key")
+		}
+		if app.TLSClientAuth {
+			if config.ClientCAs == nil {
+				return nil, errors.New("tls client auth need ca")
+			}
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		// server pins client certificates only
+		if len(pins) > 0 && app.TLSClientAuth {
+			config.VerifyConnection = func(state tls.ConnectionState) error {
+				return verifyPins(pins, state)
+			}
+		}
+	} else {
+		// ServerName is set by server dialed
+		if len(pins) > 0 {
+			config.VerifyConnection = func(state tls.ConnectionState) error {
+				return verifyPins(pins, state)
+			}
+		}
+	}
+	return config, nil
+}
+
+// hex sha256 of subject public key info, pin of a certificate
+func certPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// any certificate in verified chains, peer's own or one of its ca, is pinned
+func verifyPins(pins map[string]bool, state tls.ConnectionState) error {
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			if pins[certPin(cert)] {
+				return nil
+			}
+		}
+	}
+	return errors.New("tls: no pinned public key in peer certificate chain")
+}
+
+// verified certificate of peer, nil if peer presents none or conn is not
+// over tls
+func peerCertificate(conn net.Conn) *x509.Certificate {
+	for {
+		var state tls.ConnectionState
+		switch c := conn.(type) {
+		case *tls.Conn:
+			state = c.ConnectionState()
+		case *quicConn:
+			state = c.ConnectionState()
+		case *wsConn:
+			conn = c.Conn
+			continue
+		case *obfsConn:
+			conn = c.Conn
+			continue
+		default:
+			return nil
+		}
+		if len(state.VerifiedChains) == 0 {
+			return nil
+		}
+		return state.VerifiedChains[0][0]
+	}
+}
+
+// wrap low level connection with obfuscation, tls and websocket if enabled,
+// server is the address dialed by client, empty on server side
+func (app *App) wrapConn(raw net.Conn, server string) (net.Conn, error) {
+	client := server != ""
+	if app.obfsKey != nil {
+		raw = newObfsConn(raw, app.Obfs, app.obfsKey, client)
+	}
+	conn := raw
+	if app.tlsConfig != nil {
+		var tlsConn *tls.Conn
+		if client {
+			host, _, err := net.SplitHostPort(server)
+			if err != nil {
+				return nil, err
+			}
+			config := app.tlsConfig.Clone()
+			config.ServerName = host
+			tlsConn = tls.Client(raw, config)
+		} else {
+			tlsConn = tls.Server(raw, app.tlsConfig)
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	switch app.scheme {
+	case "ws", "wss":
+		if client {
+			return wsClientHandshake(conn, server, app.wsPath)
+		}
+		return wsServerHandshake(conn, app.wsPath)
+	}
+	return conn, nil
+}
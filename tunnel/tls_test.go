@@ -0,0 +1,151 @@
+//
+//   date  : 2015-09-28
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pem files of a ca and a certificate of cn signed by it
+type testCert struct {
+	cert, key string
+	x509      *x509.Certificate
+}
+
+func newTestCert(t *testing.T, dir, cn string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent = ca.x509
+		caKey, err := os.ReadFile(ca.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(caKey)
+		if signer, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCert{cert: filepath.Join(dir, cn+".crt"), key: filepath.Join(dir, cn+".key")}
+	if c.x509, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(c.cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(c.key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return c
+}
+
+// tls handshake of client and server apps over pipe, return server side conn
+func tlsPair(t *testing.T, server, client *App) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := client.wrapConn(c1, client.tunnelAddr)
+		if err != nil {
+			c1.Close()
+			errc <- err
+			return
+		}
+		// server of tls 1.3 sends tickets and alert after client finished
+		go io.Copy(io.Discard, conn)
+		errc <- nil
+	}()
+	conn, err := server.wrapConn(c2, "")
+	if err != nil {
+		c2.Close()
+	}
+	if cerr := <-errc; err == nil {
+		err = cerr
+	}
+	return conn, err
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	srv := newTestCert(t, dir, "server", ca)
+	alice := newTestCert(t, dir, "alice", ca)
+
+	newApps := func(clientCert *testCert, pins []string) (*App, *App) {
+		server := &App{Config: Config{Listen: "127.0.0.1:8001", Backend: "127.0.0.1:8002", Secret: "s",
+			TLS: true, TLSCert: srv.cert, TLSKey: srv.key, TLSCA: ca.cert, TLSClientAuth: true, TLSPins: pins,
+			Clients: []*Credential{{ID: "alice", Cert: "alice"}}}}
+		client := &App{Config: Config{Listen: "127.0.0.1:8003", Backend: "127.0.0.1:8001", Secret: "s", Tunnels: 1,
+			TLS: true, TLSCA: ca.cert, TLSPins: pins}}
+		if clientCert != nil {
+			client.TLSCert, client.TLSKey = clientCert.cert, clientCert.key
+		}
+		for _, app := range []*App{server, client} {
+			if err := app.init(); err != nil {
+				t.Fatalf("init app failed:%v", err)
+			}
+		}
+		return server, client
+	}
+
+	server, client := newApps(alice, []string{certPin(ca.x509)})
+	conn, err := tlsPair(t, server, client)
+	if err != nil {
+		t.Fatalf("handshake failed:%v", err)
+	}
+	cert := peerCertificate(conn)
+	if cert == nil || server.certOwner(cert.Subject.CommonName) != "alice" {
+		t.Fatalf("unexpected client certificate:%v", cert)
+	}
+	// identity of certificate answers with server secret
+	if creds := server.credentials("alice"); creds != nil {
+		t.Fatalf("unexpected credentials:%v", creds)
+	}
+
+	server, client = newApps(nil, nil)
+	if _, err := tlsPair(t, server, client); err == nil {
+		t.Fatal("client without certificate should be rejected")
+	}
+
+	server, client = newApps(alice, []string{certPin(srv.x509)})
+	if _, err := tlsPair(t, server, client); err == nil {
+		t.Fatal("unpinned client certificate should be rejected")
+	}
+}
@@ -0,0 +1,475 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// a subset of toml enough for config files: tables, arrays of tables, dotted
+// and quoted keys, strings, integers, floats, booleans, offset date-times,
+// arrays and inline tables. Local dates and times are not supported. It's
+// parsed to the values json decodes, date-times become rfc3339 strings.
+
+type tomlParser struct {
+	data []byte
+	pos  int
+}
+
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	p := &tomlParser{data: data}
+	root := make(map[string]interface{})
+	cur := root
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return root, nil
+		}
+		if p.peek() == '[' {
+			p.pos++
+			array := p.skip('[')
+			path, err := p.keys()
+			if err != nil {
+				return nil, err
+			}
+			if !p.skip(']') || (array && !p.skip(']')) {
+				return nil, p.errorf("expect ] after table name")
+			}
+			if cur, err = p.table(root, path, array); err != nil {
+				return nil, err
+			}
+		} else {
+			path, err := p.keys()
+			if err != nil {
+				return nil, err
+			}
+			if !p.skip('=') {
+				return nil, p.errorf("expect = after key")
+			}
+			p.skipBlank()
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.set(cur, path, v); err != nil {
+				return nil, err
+			}
+		}
+		p.skipBlank()
+		p.skipComment()
+		if !p.eof() && !p.skipNewline() {
+			return nil, p.errorf("expect new line")
+		}
+	}
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	line := bytes.Count(p.data[:p.pos], []byte{'\n'}) + 1
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+func (p *tomlParser) hasPrefix(s string) bool {
+	return bytes.HasPrefix(p.data[p.pos:], []byte(s))
+}
+
+// skip blanks and c
+func (p *tomlParser) skip(c byte) bool {
+	p.skipBlank()
+	if p.peek() != c {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *tomlParser) skipBlank() {
+	for c := p.peek(); c == ' ' || c == '\t'; c = p.peek() {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if p.peek() != '#' {
+		return
+	}
+	for !p.eof() && p.peek() != '\n' {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipNewline() bool {
+	if p.hasPrefix("\r\n") {
+		p.pos += 2
+		return true
+	}
+	if p.peek() == '\n' {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// blanks, comments and new lines
+func (p *tomlParser) skipSpace() {
+	for {
+		p.skipBlank()
+		p.skipComment()
+		if !p.skipNewline() {
+			return
+		}
+	}
+}
+
+func isBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// dotted key
+func (p *tomlParser) keys() ([]string, error) {
+	var path []string
+	for {
+		p.skipBlank()
+		var key string
+		var err error
+		switch c := p.peek(); {
+		case c == '"':
+			key, err = p.basicString()
+		case c == '\'':
+			key, err = p.literalString()
+		default:
+			start := p.pos
+			for isBareKey(p.peek()) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, p.errorf("expect key")
+			}
+			key = string(p.data[start:p.pos])
+		}
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, key)
+		if !p.skip('.') {
+			return path, nil
+		}
+	}
+}
+
+// table of header, the last one of an array of tables
+func (p *tomlParser) table(root map[string]interface{}, path []string, array bool) (map[string]interface{}, error) {
+	m := root
+	for i, key := range path {
+		last := i == len(path)-1
+		switch v := m[key].(type) {
+		case nil:
+			t := make(map[string]interface{})
+			if last && array {
+				m[key] = []interface{}{t}
+			} else {
+				m[key] = t
+			}
+			m = t
+		case map[string]interface{}:
+			if last && array {
+				return nil, p.errorf("%s is a table, not an array of tables", strings.Join(path, "."))
+			}
+			m = v
+		case []interface{}:
+			if last && array {
+				t := make(map[string]interface{})
+				m[key] = append(v, t)
+				m = t
+				continue
+			}
+			var t map[string]interface{}
+			if len(v) > 0 {
+				t, _ = v[len(v)-1].(map[string]interface{})
+			}
+			if t == nil {
+				return nil, p.errorf("%s is not a table", strings.Join(path[:i+1], "."))
+			}
+			m = t
+		default:
+			return nil, p.errorf("%s is not a table", strings.Join(path[:i+1], "."))
+		}
+	}
+	return m, nil
+}
+
+func (p *tomlParser) set(m map[string]interface{}, path []string, value interface{}) error {
+	for i, key := range path[:len(path)-1] {
+		switch v := m[key].(type) {
+		case nil:
+			t := make(map[string]interface{})
+			m[key] = t
+			m = t
+		case map[string]interface{}:
+			m = v
+		default:
+			return p.errorf("%s is not a table", strings.Join(path[:i+1], "."))
+		}
+	}
+	key := path[len(path)-1]
+	if _, ok := m[key]; ok {
+		return p.errorf("duplicate key %s", strings.Join(path, "."))
+	}
+	m[key] = value
+	return nil
+}
+
+func (p *tomlParser) value() (interface{}, error) {
+	switch c := p.peek(); {
+	case p.hasPrefix(`"""`):
+		return p.multilineString(`"""`)
+	case p.hasPrefix(`'''`):
+		return p.multilineString(`'''`)
+	case c == '"':
+		return p.basicString()
+	case c == '\'':
+		return p.literalString()
+	case c == '[':
+		return p.array()
+	case c == '{':
+		return p.inlineTable()
+	case p.hasPrefix("true"):
+		p.pos += 4
+		return true, nil
+	case p.hasPrefix("false"):
+		p.pos += 5
+		return false, nil
+	}
+
+	start := p.pos
+	for c := p.peek(); isBareKey(c) || c == '+' || c == '.' || c == ':'; c = p.peek() {
+		p.pos++
+	}
+	// date and time could be separated by space
+	if p.pos-start == 10 && p.peek() == ' ' && p.pos+1 < len(p.data) && p.data[p.pos+1] >= '0' && p.data[p.pos+1] <= '9' {
+		p.pos++
+		for c := p.peek(); isBareKey(c) || c == '+' || c == '.' || c == ':'; c = p.peek() {
+			p.pos++
+		}
+	}
+	s := string(p.data[start:p.pos])
+	if s == "" {
+		return nil, p.errorf("expect value")
+	}
+	if len(s) >= 10 && s[4] == '-' && s[7] == '-' {
+		t, err := time.Parse(time.RFC3339Nano, strings.Replace(s, " ", "T", 1))
+		if err != nil {
+			return nil, p.errorf("bad date-time %s, only rfc3339 with offset is supported", s)
+		}
+		return t.Format(time.RFC3339Nano), nil
+	}
+	digits := strings.TrimLeft(s, "+-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+		return nil, p.errorf("leading zero of number %s", s)
+	}
+	if n, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return n, nil
+	}
+	if !strings.HasPrefix(digits, "0x") {
+		if f, err := strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, p.errorf("bad value %s", s)
+}
+
+func (p *tomlParser) basicString() (string, error) {
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if err := p.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (p *tomlParser) escape(b *strings.Builder) error {
+	if p.eof() {
+		return p.errorf("unterminated string")
+	}
+	c := p.data[p.pos]
+	p.pos++
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'e':
+		b.WriteByte(0x1b)
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.data) {
+			return p.errorf("bad unicode escape")
+		}
+		r, err := strconv.ParseUint(string(p.data[p.pos:p.pos+n]), 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return p.errorf("bad unicode escape")
+		}
+		p.pos += n
+		b.WriteRune(rune(r))
+	default:
+		return p.errorf("bad escape \\%c", c)
+	}
+	return nil
+}
+
+func (p *tomlParser) literalString() (string, error) {
+	p.pos++
+	start := p.pos
+	for p.peek() != '\'' {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		p.pos++
+	}
+	p.pos++
+	return string(p.data[start : p.pos-1]), nil
+}
+
+// multi-line basic or literal string, a new line right after the opening
+// delimiter is trimmed
+func (p *tomlParser) multilineString(delim string) (string, error) {
+	p.pos += len(delim)
+	p.skipNewline()
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		if p.hasPrefix(delim) {
+			p.pos += len(delim)
+			// at most two quotes just before the delimiter
+			for i := 0; i < 2 && p.peek() == delim[0]; i++ {
+				b.WriteByte(delim[0])
+				p.pos++
+			}
+			return b.String(), nil
+		}
+		c := p.data[p.pos]
+		p.pos++
+		if c != '\\' || delim == `'''` {
+			b.WriteByte(c)
+			continue
+		}
+		// backslash at the end of a line trims the line break and
+		// blanks after it
+		rest := p.pos
+		for rest < len(p.data) && (p.data[rest] == ' ' || p.data[rest] == '\t') {
+			rest++
+		}
+		if rest < len(p.data) && (p.data[rest] == '\n' || p.data[rest] == '\r') {
+			p.pos = rest
+			for c := p.peek(); c == ' ' || c == '\t' || c == '\n' || c == '\r'; c = p.peek() {
+				p.pos++
+			}
+			continue
+		}
+		if err := p.escape(&b); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (p *tomlParser) array() ([]interface{}, error) {
+	p.pos++
+	list := []interface{}{}
+	for {
+		p.skipSpace()
+		if p.peek() == ']' {
+			p.pos++
+			return list, nil
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return list, nil
+		default:
+			return nil, p.errorf("expect , or ] in array")
+		}
+	}
+}
+
+func (p *tomlParser) inlineTable() (map[string]interface{}, error) {
+	p.pos++
+	m := make(map[string]interface{})
+	if p.skip('}') {
+		return m, nil
+	}
+	for {
+		path, err := p.keys()
+		if err != nil {
+			return nil, err
+		}
+		if !p.skip('=') {
+			return nil, p.errorf("expect = after key")
+		}
+		p.skipBlank()
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.set(m, path, v); err != nil {
+			return nil, err
+		}
+		if p.skip('}') {
+			return m, nil
+		}
+		if !p.skip(',') {
+			return nil, p.errorf("expect , or } in inline table")
+		}
+	}
+}
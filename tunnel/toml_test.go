@@ -0,0 +1,89 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	doc := `
+# comment
+listen = "0.0.0.0:8001"   # trailing comment
+tunnels = 4
+rate = 1_000
+ratio = 0.5
+mask = 0xff
+tls = true
+"quoted key" = 'C:\path'
+a.b.c = -1
+banner = """
+first \
+  second
+third"""
+raw = '''
+\n is kept'''
+expires = 2015-10-01T00:00:00Z
+ports = [
+  80,
+  443, # https
+]
+mixed = [{ name = "x", n = [1, 2] }, {}]
+
+[[rules]]
+name = "ssh"
+listen = "127.0.0.1:2222"
+
+[[rules]]
+name = "dns"
+udp = true
+
+[rules.extra]
+id = "\u00e9"
+
+[acl.deep]
+k = "v"
+`
+	got, err := parseTOML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(got)
+	want := `{"a":{"b":{"c":-1}},"acl":{"deep":{"k":"v"}},"banner":"first second\nthird","expires":"2015-10-01T00:00:00Z",` +
+		`"listen":"0.0.0.0:8001","mask":255,"mixed":[{"n":[1,2],"name":"x"},{}],"ports":[80,443],"quoted key":"C:\\path",` +
+		`"rate":1000,"ratio":0.5,"raw":"\\n is kept",` +
+		`"rules":[{"listen":"127.0.0.1:2222","name":"ssh"},{"extra":{"id":"é"},"name":"dns","udp":true}],"tls":true,"tunnels":4}`
+	if string(data) != want {
+		t.Fatalf("unexpected parse:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	for _, c := range []struct {
+		doc string
+		err string
+	}{
+		{"a = 1\na = 2", "line 2: duplicate key a"},
+		{"a = 1\n[a]", "line 2: a is not a table"},
+		{"[a]\n[[a]]", "a is a table"},
+		{"a = \"open", "unterminated string"},
+		{"a = 1 b = 2", "expect new line"},
+		{"a = [1 2]", "expect , or ]"},
+		{"a = 012", "leading zero"},
+		{"a = 2015-10-01", "bad date-time"},
+		{"a = yes", "bad value"},
+		{"= 1", "expect key"},
+		{"[a\nb = 1", "expect ]"},
+		{`a = "\q"`, `bad escape`},
+	} {
+		_, err := parseTOML([]byte(c.doc))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: unexpected error:%v, want %q", c.doc, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// links are traced as opentelemetry spans: the creator's span starts when a
+// connection is accepted and is continued by the peer through traceparent of
+// link args, where backend dialing is a child span. First bytes each way are
+// events, spans end when links are released. Spans are exported in batches
+// to an otlp/http collector in json encoding.
+
+const (
+	traceInterval = 5 * time.Second // between batches exported
+	traceQueue    = 4096            // spans waiting export, more are dropped
+	traceTimeout  = 10 * time.Second
+)
+
+// kinds and status codes of otlp
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+)
+
+type traceAttr struct {
+	key   string
+	value interface{} // string, int64 or bool
+}
+
+type spanEvent struct {
+	name string
+	time time.Time
+}
+
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+
+	lock   sync.Mutex
+	end    time.Time
+	attrs  []traceAttr
+	events []spanEvent
+	err    string
+}
+
+type tracer struct {
+	endpoint string
+	sample   float64
+	client   *http.Client
+
+	lock  sync.Mutex
+	spans []*span // ended, waiting export
+}
+
+func newTracer(endpoint string, sample float64) *tracer {
+	return &tracer{
+		endpoint: endpoint,
+		sample:   sample,
+		client:   &http.Client{Timeout: traceTimeout},
+	}
+}
+
+// root span of a new trace if sampled, nil tracer traces nothing
+func (t *tracer) startRoot(name string, kind int) *span {
+	if t == nil || t.sample <= 0 {
+		return nil
+	}
+	if t.sample < 1 {
+		var b [8]byte
+		rand.Read(b[:])
+		if float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) >= t.sample {
+			return nil
+		}
+	}
+	s := t.newSpan(name, kind)
+	rand.Read(s.traceID[:])
+	return s
+}
+
+// span continuing traceparent of peer, or a new trace if it's empty. A trace
+// not sampled by peer isn't traced here either.
+func (t *tracer) startRemote(name string, kind int, traceparent string) *span {
+	if t == nil {
+		return nil
+	}
+	if traceparent == "" {
+		return t.startRoot(name, kind)
+	}
+	traceID, parent, sampled, err := parseTraceParent(traceparent)
+	if err != nil || !sampled {
+		return nil
+	}
+	s := t.newSpan(name, kind)
+	s.traceID = traceID
+	s.parent = parent
+	return s
+}
+
+func (t *tracer) newSpan(name string, kind int) *span {
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.id[:])
+	return s
+}
+
+func (t *tracer) add(s *span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.spans) >= traceQueue {
+		atomic.AddInt64(&stats.SpansDropped, 1)
+		return
+	}
+	t.spans = append(t.spans, s)
+}
+
+// export spans in batches until ctx is done, then the rest
+func (t *tracer) run(ctx context.Context, wg *sync.WaitGroup) {
+	if t == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer Recover()
+		ticker := time.NewTicker(traceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.flush(ctx)
+			case <-ctx.Done():
+				fctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				t.flush(fctx)
+				cancel()
+				return
+			}
+		}
+	}()
+}
+
+func (t *tracer) flush(ctx context.Context) {
+	t.lock.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.lock.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.export(ctx, spans); err != nil {
+		Error("export %d spans to %s failed:%v", len(spans), t.endpoint, err)
+		atomic.AddInt64(&stats.SpansDropped, int64(len(spans)))
+		return
+	}
+	atomic.AddInt64(&stats.SpansExported, int64(len(spans)))
+}
+
+func (t *tracer) export(ctx context.Context, spans []*span) error {
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// all methods of span are safe on nil, so callers needn't check sampling
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.attrs = append(s.attrs, traceAttr{key, value})
+	s.lock.Unlock()
+}
+
+func (s *span) addEvent(name string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.events = append(s.events, spanEvent{name, time.Now()})
+	s.lock.Unlock()
+}
+
+func (s *span) setError(err string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.err = err
+	s.lock.Unlock()
+}
+
+// child span in the same trace
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	c := s.tracer.newSpan(name, kind)
+	c.traceID = s.traceID
+	c.parent = s.id
+	return c
+}
+
+// span is exported once ended, only the first end counts
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.lock.Unlock()
+	if !ended {
+		s.tracer.add(s)
+	}
+}
+
+// w3c trace context of span, sampled
+func (s *span) traceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.id[:]))
+}
+
+var errTraceParent = errors.New("bad traceparent")
+
+func parseTraceParent(v string) (traceID [16]byte, parent [8]byte, sampled bool, err error) {
+	// version-traceid-parentid-flags, later versions may append fields
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' || (len(v) > 55 && v[55] != '-') {
+		err = errTraceParent
+		return
+	}
+	version, err1 := hex.DecodeString(v[:2])
+	_, err2 := hex.Decode(traceID[:], []byte(v[3:35]))
+	_, err3 := hex.Decode(parent[:], []byte(v[36:52]))
+	flags, err4 := hex.DecodeString(v[53:55])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || version[0] == 0xff ||
+		(version[0] == 0 && len(v) != 55) || traceID == [16]byte{} || parent == [8]byte{} {
+		err = errTraceParent
+		return
+	}
+	sampled = flags[0]&1 != 0
+	return
+}
+
+// json encoding of ExportTraceServiceRequest, ids are hex and 64 bits
+// integers are strings
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Events            []otlpEvent `json:"events,omitempty"`
+	Status            otlpStatus  `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttrs(attrs []traceAttr) []otlpAttr {
+	var list []otlpAttr
+	for _, attr := range attrs {
+		var v otlpValue
+		switch value := attr.value.(type) {
+		case string:
+			v.StringValue = &value
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		list = append(list, otlpAttr{Key: attr.key, Value: v})
+	}
+	return list
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpRequest(spans []*span) *otlpTraces {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "github.com/xjdrew/gotunnel"
+	for _, s := range spans {
+		s.lock.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Attributes:        otlpAttrs(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, e := range s.events {
+			o.Events = append(o.Events, otlpEvent{TimeUnixNano: unixNano(e.time), Name: e.name})
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{Code: spanStatusError, Message: s.err}
+		}
+		s.lock.Unlock()
+		scope.Spans = append(scope.Spans, o)
+	}
+
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = otlpAttrs([]traceAttr{{"service.name", "gotunnel"}})
+	return &otlpTraces{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+// reasons links close without error, others are errors of their spans
+var normalCloses = map[string]bool{
+	"closed":       true,
+	"peer closed":  true,
+	"canceled":     true,
+	"idle timeout": true,
+	"max age":      true,
+}
+
+// attributes of link known when it's created
+func (self *Hub) startSpan(link *Link) {
+	if link.span == nil {
+		return
+	}
+	link.span.setAttr("gotunnel.side", self.side())
+	link.span.setAttr("gotunnel.service", link.service)
+	link.span.setAttr("gotunnel.link_id", int64(link.id))
+	if self.tunnel.identity != "" {
+		link.span.setAttr("gotunnel.client", self.tunnel.identity)
+	}
+	if link.source != "" {
+		link.span.setAttr("gotunnel.source", link.source)
+	}
+}
+
+// span of a released link ends
+func (self *Hub) endSpan(link *Link) {
+	if link.span == nil {
+		return
+	}
+	up, down := self.linkTraffic(link)
+	reason := link.closeReason()
+	if link.dest != "" {
+		link.span.setAttr("gotunnel.dest", link.dest)
+	}
+	link.span.setAttr("gotunnel.bytes_up", up)
+	link.span.setAttr("gotunnel.bytes_down", down)
+	link.span.setAttr("gotunnel.close_reason", reason)
+	if !normalCloses[reason] {
+		link.span.setError(reason)
+	}
+	link.span.finish()
+}
@@ -0,0 +1,144 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestTraceParent(t *testing.T) {
+	tr := newTracer("http://127.0.0.1/v1/traces", 1)
+	s := tr.startRoot("link", spanKindClient)
+	traceID, parent, sampled, err := parseTraceParent(s.traceParent())
+	if err != nil || traceID != s.traceID || parent != s.id || !sampled {
+		t.Fatalf("unexpected traceparent %s: %v", s.traceParent(), err)
+	}
+
+	for _, v := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319g-b7ad6b7169203331-01",
+	} {
+		if _, _, _, err := parseTraceParent(v); err == nil {
+			t.Fatalf("bad traceparent %q is parsed", v)
+		}
+	}
+	// not sampled by peer
+	if s := tr.startRemote("link", spanKindServer, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"); s != nil {
+		t.Fatal("trace not sampled by peer is traced")
+	}
+	// later versions may append fields
+	if s := tr.startRemote("link", spanKindServer, "01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra"); s == nil || s.parent == [8]byte{} {
+		t.Fatal("trace of later version isn't continued")
+	}
+
+	if s := newTracer("http://127.0.0.1/v1/traces", -1).startRoot("link", spanKindClient); s != nil {
+		t.Fatal("new trace is started with negative sample")
+	}
+	var nilTracer *tracer
+	nilTracer.startRoot("link", spanKindClient).finish()
+}
+
+// otlp collector keeps spans received
+type testCollector struct {
+	*httptest.Server
+	lock  sync.Mutex
+	spans []otlpSpan
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	c := &testCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpTraces
+		if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *testCollector) received() []otlpSpan {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]otlpSpan(nil), c.spans...)
+}
+
+func spanAttr(s otlpSpan, key string) string {
+	for _, attr := range s.Attributes {
+		if attr.Key != key {
+			continue
+		}
+		switch {
+		case attr.Value.StringValue != nil:
+			return *attr.Value.StringValue
+		case attr.Value.IntValue != nil:
+			return *attr.Value.IntValue
+		}
+	}
+	return ""
+}
+
+func TestPairTrace(t *testing.T) {
+	collector := newTestCollector(t)
+	endpoint := collector.URL + "/v1/traces"
+	p := newTestPair(t, Config{Tracing: endpoint}, Config{Tracing: endpoint})
+	if echoed := p.roundTrip(t, "hello"); echoed != "hello" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+
+	spans := make(map[string]otlpSpan)
+	waitFor(t, "spans exported", func() bool {
+		p.client.app.tracer.flush(context.Background())
+		p.server.app.tracer.flush(context.Background())
+		for _, s := range collector.received() {
+			key := s.Name
+			if key != "dial" {
+				key = spanAttr(s, "gotunnel.side")
+			}
+			spans[key] = s
+		}
+		return len(spans) == 3
+	})
+
+	client, ok1 := spans["client"]
+	server, ok2 := spans["server"]
+	dial, ok3 := spans["dial"]
+	if !ok1 || !ok2 || !ok3 {
+		t.Fatalf("unexpected spans:%+v", spans)
+	}
+	if client.Kind != spanKindClient || client.ParentSpanID != "" ||
+		server.Kind != spanKindServer || server.TraceID != client.TraceID || server.ParentSpanID != client.SpanID ||
+		dial.TraceID != client.TraceID || dial.ParentSpanID != server.SpanID {
+		t.Fatalf("spans aren't in one trace:%+v", spans)
+	}
+	if spanAttr(dial, "gotunnel.dest") != testBackendAddr || spanAttr(server, "gotunnel.dest") != testBackendAddr {
+		t.Fatalf("unexpected dest:%+v", spans)
+	}
+	for _, s := range []otlpSpan{client, server} {
+		if spanAttr(s, "gotunnel.bytes_up") != "5" || spanAttr(s, "gotunnel.bytes_down") != "5" ||
+			spanAttr(s, "gotunnel.close_reason") != "closed" || s.Status.Code != 0 || len(s.Events) != 2 {
+			t.Fatalf("unexpected span:%+v", s)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+//
+//   date  : 2015-10-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// client listener of a transparent rule takes connections redirected to it
+// by iptables, so a gateway tunnels traffic of a whole lan without proxy
+// settings. Destination of link is the original one: REDIRECT keeps it in
+// conntrack, TPROXY keeps it as local address of connection. Server dials
+// it like a socks5 destination.
+
+var errNotRedirected = errors.New("connection isn't redirected")
+
+// listening socket is set transparent for TPROXY, REDIRECT works without it
+func listenTransparent(addr *net.TCPAddr) (net.Listener, error) {
+	if ln := takeListener(addr); ln != nil {
+		return ln, nil
+	}
+	var serr error
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		c.Control(func(fd uintptr) {
+			serr = setTransparent(fd, network)
+		})
+		return nil
+	}}
+	ln, err := lc.Listen(context.Background(), "tcp", addr.String())
+	if err == nil && serr != nil {
+		Log("listen %s: set transparent failed, only REDIRECT works, err:%v", addr, serr)
+	}
+	return ln, err
+}
+
+// original destination of conn accepted by rule
+func (r *Rule) originalDest(conn net.Conn) (string, error) {
+	local := conn.LocalAddr()
+	dest := local
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if raw, err := tc.SyscallConn(); err == nil {
+			var addr *net.TCPAddr
+			raw.Control(func(fd uintptr) {
+				addr, err = getOriginalDst(fd, local.(*net.TCPAddr).IP.To4() == nil)
+			})
+			if err == nil {
+				dest = addr
+			}
+		}
+	}
+	// a connection to listener itself would loop
+	if dest.String() == local.String() {
+		if _, port, _ := net.SplitHostPort(local.String()); port == strconv.Itoa(r.laddr.Port) {
+			return "", errNotRedirected
+		}
+	}
+	return dest.String(), nil
+}
@@ -0,0 +1,71 @@
+//
+//   date  : 2015-10-12
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestOriginalDest(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rule := &Rule{laddr: ln.Addr().(*net.TCPAddr)}
+	if _, err := rule.originalDest(conn); err != errNotRedirected {
+		t.Fatalf("unexpected err:%v", err)
+	}
+	// TPROXY keeps original destination as local address
+	rule.laddr = &net.TCPAddr{IP: net.IPv4zero, Port: 1}
+	if dest, err := rule.originalDest(conn); err != nil || dest != ln.Addr().String() {
+		t.Fatalf("unexpected dest:%s, %v", dest, err)
+	}
+}
+
+func TestPairTransparent(t *testing.T) {
+	server := Config{Rules: []*Rule{{Name: "lan", Transparent: true}}}
+	client := Config{Rules: []*Rule{{Name: "lan", Listen: testListenAddr, Transparent: true}}}
+	p := newTestPair(t, server, client)
+
+	// connection to listener itself isn't forwarded
+	if echoed := p.roundTrip(t, "hello"); echoed != "" {
+		t.Fatalf("unexpected echo:%q", echoed)
+	}
+	waitHubsReleased(t, p.client)
+	// server dials destination sent by client
+	app := newTestApp(t, p.network, Config{Backend: testTunnelAddr, Listen: "127.0.0.1:8007", Tunnels: 1, Secret: "test secret"})
+	var out bytes.Buffer
+	if err := app.Stdio(context.Background(), "lan", testBackendAddr, strings.NewReader("hello"), &out); err != nil || out.String() != "hello" {
+		t.Fatalf("unexpected echo:%q, %v", out.String(), err)
+	}
+
+	app = &App{Config: Config{Listen: "127.0.0.1:0", Backend: "127.0.0.1:1", Tunnels: 1}}
+	for _, rule := range []*Rule{
+		{Name: "a", Listen: "127.0.0.1:80", Transparent: true, Socks5: true},
+		{Name: "b", Listen: "127.0.0.1:80", Transparent: true, UDP: true},
+		{Name: "c", Listen: "unix:///tmp/lan.sock", Transparent: true},
+	} {
+		if _, err := app.buildRules([]*Rule{rule}); err == nil {
+			t.Fatalf("rule %s should be rejected", rule)
+		}
+	}
+}
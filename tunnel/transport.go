@@ -0,0 +1,65 @@
+//
+//   date  : 2015-09-21
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Transport carries tunnels between client and server, tunnel handshake and
+// hub run over conns it returns, so a transport is added without touching
+// hub and link logic
+type Transport interface {
+	// dial tunnel server of host:port addr, canceled if ctx is done
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	// listen on tunnel address
+	Listen() (net.Listener, error)
+	// transport level handshake on dialed or accepted conn, like tls and
+	// websocket upgrade. server is the address dialed by client, empty on
+	// server side. conn is closed by caller on error
+	Handshake(conn net.Conn, server string) (net.Conn, error)
+}
+
+// transports by scheme of tunnel address
+var transports = map[string]func(app *App) Transport{
+	"tcp":  newStreamTransport,
+	"ws":   newStreamTransport,
+	"wss":  newStreamTransport,
+	"kcp":  newKCPTransport,
+	"quic": newQUICTransport,
+}
+
+// tcp, optionally wrapped by tls and websocket
+type streamTransport struct {
+	app *App
+}
+
+func newStreamTransport(app *App) Transport {
+	return &streamTransport{app: app}
+}
+
+func (t *streamTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := t.app.dialTunnel(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.app.tuneConn(conn.(*net.TCPConn))
+	return conn, nil
+}
+
+func (t *streamTransport) Listen() (net.Listener, error) {
+	return listenTCP(t.app.laddr)
+}
+
+func (t *streamTransport) Handshake(conn net.Conn, server string) (net.Conn, error) {
+	if raw, ok := conn.(*net.TCPConn); ok && server == "" {
+		raw.SetKeepAlive(true)
+		raw.SetKeepAlivePeriod(time.Second * 60)
+	}
+	return t.app.wrapConn(conn, server)
+}
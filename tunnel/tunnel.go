@@ -12,99 +12,326 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var Timeout int64 // tunnel read/write timeout
 
 type Payload struct {
-	linkid uint16
+	linkid uint32
 	data   []byte
+	prio   uint8 // priority class
+	plain  bool  // data of nocrypt link
 }
 
 type Tunnel struct {
-	conn   *net.TCPConn  // low level conn
+	conn   net.Conn      // low level conn
 	writer *bufio.Writer // writer
 	reader *bufio.Reader // reader
-	wch    chan Payload  // write data chan
+	wch    priorityChans // write data chan of each priority class
+	queue  *sendQueue    // bytes of data frames in wch
 	closed chan struct{} // connection closed
 	once   sync.Once
 	desc   string // description
+	rbytes int64  // bytes read, atomic
+	wbytes int64  // bytes written, atomic
+
+	identity string // client id, empty if anonymous
+
+	caps uint32 // capabilities supported by both ends
+
+	wcomp *compressor // compress link data, nil if disabled
+	rcomp *compressor
+	frame []byte // compressed frame read
+
+	rhead [6]byte // frame head: linkid and size
+	whead [7]byte // frame head followed by compress flag
+
+	integrity bool // frames end with crc32c of head and body
+	rsum      [frameSumSize]byte
+	wsum      [frameSumSize]byte
+
+	sess *session // nil if not resumable
+
+	plain *aeadWriter // writes plain frames of nocrypt links, nil if not supported
+
+	rekey *rekeyState // nil if not supported
 }
 
 func (t *Tunnel) shutdown() {
-	t.conn.Close()
+	t.closeSession()
+	t.netConn().Close()
 	close(t.closed)
+	t.queue.close()
 }
 
 func (t *Tunnel) Close() {
 	t.once.Do(t.shutdown)
 }
 
+// enable compression of link data, should be called before any read or write
+func (t *Tunnel) setCompress(method uint8, threshold int) {
+	t.wcomp = newCompressor(method, threshold)
+	t.rcomp = newCompressor(method, threshold)
+	if t.rcomp != nil {
+		t.frame = make([]byte, 0xffff)
+	}
+}
+
 func (t *Tunnel) write(payload Payload) error {
+	if payload.plain && t.plain != nil {
+		return t.writePlain(payload)
+	}
+	return t.writeFrame(payload)
+}
+
+func (t *Tunnel) writeFrame(payload Payload) error {
 	defer mpool.Put(payload.data)
 
-	if err := binary.Write(t.writer, binary.LittleEndian, payload.linkid); err != nil {
-		return err
+	if t.sess != nil && payload.linkid == 0 && payload.data == nil {
+		// woken by wakePump
+		return t.writeSession(nil)
+	}
+
+	data := payload.data
+	hs := t.headSize()
+	head := t.whead[:hs]
+	if t.wcomp != nil && payload.linkid != 0 {
+		var f uint8
+		f, data = t.wcomp.encode(data)
+		head = append(head, f)
+	}
+	if t.sess != nil {
+		frame := t.encodeFrame(payload.linkid, head, data)
+		atomic.AddInt64(&t.wbytes, int64(len(frame)))
+		return t.writeSession(frame)
+	}
+
+	t.putId(head, payload.linkid)
+	size := len(head) - hs + len(data)
+	if t.integrity {
+		size += frameSumSize
 	}
-	if err := binary.Write(t.writer, binary.LittleEndian, uint16(len(payload.data))); err != nil {
+	binary.LittleEndian.PutUint16(head[hs-2:], uint16(size))
+	if _, err := t.writer.Write(head); err != nil {
 		return err
 	}
-	if _, err := t.writer.Write(payload.data); err != nil {
+	if _, err := t.writer.Write(data); err != nil {
 		return err
 	}
+	if t.integrity {
+		binary.LittleEndian.PutUint32(t.wsum[:], frameSum(head, data))
+		if _, err := t.writer.Write(t.wsum[:]); err != nil {
+			return err
+		}
+	}
 	if err := t.writer.Flush(); err != nil {
 		return err
 	}
+	atomic.AddInt64(&t.wbytes, int64(hs+size))
 	return nil
 }
 
+// frame head is link id and body size in little endian, link id takes 4 bytes
+// if both ends support capLinkId32, 2 bytes otherwise. Control messages carry
+// link id of the same width after cmd.
+func (t *Tunnel) idSize() int {
+	if t.has(capLinkId32) {
+		return 4
+	}
+	return 2
+}
+
+func (t *Tunnel) headSize() int {
+	return t.idSize() + 2
+}
+
+func (t *Tunnel) cmdSize() int {
+	return 1 + t.idSize()
+}
+
+func (t *Tunnel) putId(b []byte, linkid uint32) {
+	if t.idSize() == 4 {
+		binary.LittleEndian.PutUint32(b, linkid)
+	} else {
+		binary.LittleEndian.PutUint16(b, uint16(linkid))
+	}
+}
+
+// frame in a new buffer, head is followed by compress flag if data is
+// compressed
+func (t *Tunnel) encodeFrame(linkid uint32, head []byte, data []byte) []byte {
+	hs := t.headSize()
+	t.putId(head, linkid)
+	size := len(head) - hs + len(data)
+	if t.integrity {
+		size += frameSumSize
+	}
+	binary.LittleEndian.PutUint16(head[hs-2:], uint16(size))
+	frame := make([]byte, 0, hs+size)
+	frame = append(append(frame, head...), data...)
+	if t.integrity {
+		frame = binary.LittleEndian.AppendUint32(frame, frameSum(head, data))
+	}
+	return frame
+}
+
+// next payload to write, a higher priority class is served first if several
+// are waiting
+func (t *Tunnel) next() (Payload, bool) {
+	for _, prio := range priorityOrder {
+		select {
+		case payload := <-t.wch[prio]:
+			return payload, true
+		default:
+		}
+	}
+	select {
+	case payload := <-t.wch[priorityInteractive]:
+		return payload, true
+	case payload := <-t.wch[priorityNormal]:
+		return payload, true
+	case payload := <-t.wch[priorityBulk]:
+		return payload, true
+	case <-t.closed:
+		return Payload{}, false
+	}
+}
+
 func (t *Tunnel) pump() {
+	defer t.recoverPanic("write")
 	for {
-		select {
-		case payload := <-t.wch:
-			if err := t.write(payload); err != nil {
-				t.once.Do(t.shutdown)
-				Error("%s write failed:%v", t.desc, err)
-				return
-			}
-		case <-t.closed:
+		payload, ok := t.next()
+		if !ok {
 			Error("%s closed", t.desc)
 			return
 		}
+		n := len(payload.data)
+		err := t.write(payload)
+		if err == nil && t.rekeyDue() {
+			err = t.writeRekey()
+		}
+		if payload.linkid != 0 {
+			t.queue.release(n)
+		}
+		if err != nil {
+			t.once.Do(t.shutdown)
+			Error("%s write failed:%v", t.desc, err)
+			return
+		}
 	}
 }
 
+// block if send queue is full, control frames are not counted so dispatch
+// isn't blocked by data
 func (t *Tunnel) Write(payload Payload) bool {
+	n := len(payload.data)
+	if payload.linkid != 0 && !t.queue.acquire(n) {
+		return false
+	}
 	select {
-	case t.wch <- payload:
+	case t.wch[payload.prio] <- payload:
 		return true
 	case <-t.closed:
+		if payload.linkid != 0 {
+			t.queue.release(n)
+		}
 		return false
 	}
 }
 
+// a broken connection of resumable tunnel is replaced in silence, frames
+// received twice are dropped
 func (t *Tunnel) Read() (Payload, error) {
+	if t.sess == nil {
+		for {
+			payload, err := t.read(t.conn, t.reader)
+			if err != nil || !t.isRekey(payload) {
+				return payload, err
+			}
+			mpool.Put(payload.data)
+			if err := t.onRekey(); err != nil {
+				return Payload{}, err
+			}
+		}
+	}
+	for {
+		conn, reader, gen, ok := t.readConn()
+		if !ok {
+			return Payload{}, errTunnelClosed
+		}
+		payload, err := t.read(conn, reader)
+		if err != nil {
+			t.sess.lock.Lock()
+			t.detach(gen, err)
+			t.sess.lock.Unlock()
+			continue
+		}
+		if t.isAck(payload) {
+			t.onAck(payload.data[t.cmdSize():])
+			mpool.Put(payload.data)
+			continue
+		}
+		if !t.receive(gen) {
+			mpool.Put(payload.data)
+			continue
+		}
+		return payload, nil
+	}
+}
+
+func (t *Tunnel) read(conn net.Conn, reader *bufio.Reader) (Payload, error) {
 	var payload Payload
-	var linkid, sz uint16
 
 	// disable timeout when read packet head
-	t.conn.SetReadDeadline(time.Time{})
-	if err := binary.Read(t.reader, binary.LittleEndian, &linkid); err != nil {
+	conn.SetReadDeadline(time.Time{})
+	hs := t.headSize()
+	if _, err := io.ReadFull(reader, t.rhead[:hs]); err != nil {
 		return payload, err
 	}
-
-	if err := binary.Read(t.reader, binary.LittleEndian, &sz); err != nil {
+	// size of body, without checksum
+	linkid, n, err := parseHead(t.rhead[:hs], t.idSize(), t.integrity)
+	if err != nil {
+		atomic.AddInt64(&stats.FrameCorrupted, 1)
 		return payload, err
 	}
 
-	data := mpool.Get()[0:sz]
 	// timeout if can't read a packet in 10 seconds
 	if Timeout > 0 {
-		t.conn.SetReadDeadline(time.Now().Add(time.Duration(Timeout) * time.Second))
+		conn.SetReadDeadline(time.Now().Add(time.Duration(Timeout) * time.Second))
 	}
-	if _, err := io.ReadFull(t.reader, data); err != nil {
-		return payload, err
+
+	var data []byte
+	if t.rcomp != nil && linkid != 0 {
+		frame := t.frame[:n]
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return payload, err
+		}
+		if err := t.readSum(frame); err != nil {
+			return payload, err
+		}
+		data = mpool.Get()
+		n, err := t.rcomp.decode(data, frame)
+		if err != nil {
+			mpool.Put(data)
+			return payload, err
+		}
+		data = data[:n]
+	} else {
+		data = mpool.GetSize(n)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			mpool.Put(data)
+			return payload, err
+		}
+		if err := t.readSum(data); err != nil {
+			mpool.Put(data)
+			return payload, err
+		}
+	}
+	atomic.AddInt64(&t.rbytes, int64(hs+n))
+	if t.integrity {
+		atomic.AddInt64(&t.rbytes, frameSumSize)
 	}
 	payload.linkid = linkid
 	payload.data = data
@@ -115,20 +342,28 @@ func (self *Tunnel) String() string {
 	return self.desc
 }
 
-func newTunnel(conn *net.TCPConn, rc4key []byte) *Tunnel {
+// prometheus labels
+func (self *Tunnel) labels() string {
+	conn := self.netConn()
+	return fmt.Sprintf("local=%q,remote=%q,client=%q", conn.LocalAddr(), conn.RemoteAddr(), self.identity)
+}
+
+func newTunnel(conn net.Conn, rd io.Reader, wr io.Writer) *Tunnel {
 	desc := fmt.Sprintf("tunnel[%s <-> %s]", conn.LocalAddr(), conn.RemoteAddr())
-	conn.SetKeepAlive(true)
-	conn.SetKeepAlivePeriod(time.Second * 60)
 	bufsize := int(PacketSize) * 2
 	tunnel := &Tunnel{
-		writer: bufio.NewWriterSize(NewRC4Writer(conn, rc4key), bufsize),
-		reader: bufio.NewReaderSize(NewRC4Reader(conn, rc4key), bufsize),
-		wch:    make(chan Payload),
+		writer: bufio.NewWriterSize(wr, bufsize),
+		reader: bufio.NewReaderSize(rd, bufsize),
 		closed: make(chan struct{}),
+		queue:  newSendQueue(DefaultSendQueue),
+		caps:   legacyCaps,
 		conn:   conn,
 		desc:   desc,
 	}
 
+	for i := range tunnel.wch {
+		tunnel.wch[i] = make(chan Payload, sendQueueFrames)
+	}
 	go tunnel.pump()
 	return tunnel
 }
@@ -0,0 +1,184 @@
+//
+//   date  : 2015-09-23
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMPool(t *testing.T) {
+	p := NewMPool(PacketSize, 64)
+	if b := p.Get(); len(b) != PacketSize {
+		t.Fatalf("unexpected size:%d", len(b))
+	}
+	small := p.GetSize(10)
+	if len(small) != 10 || cap(small) != 64 {
+		t.Fatalf("unexpected small buffer:%d/%d", len(small), cap(small))
+	}
+	p.Put(small)
+	if b := p.GetSize(PacketSize + 1); len(b) != PacketSize+1 {
+		t.Fatalf("unexpected large buffer:%d", len(b))
+	}
+	if p.Alloced() != 2 || p.Freed() != 1 {
+		t.Fatalf("unexpected stats:%d/%d", p.Alloced(), p.Freed())
+	}
+}
+
+func newBenchTunnels() (*Tunnel, *Tunnel) {
+	c1, c2 := memPipe("a", "b")
+	return newTunnel(c1, c1, c1), newTunnel(c2, c2, c2)
+}
+
+// data frames written by pump and read by dispatch
+func BenchmarkTunnelData(b *testing.B) {
+	wt, rt := newBenchTunnels()
+	defer wt.Close()
+	defer rt.Close()
+
+	b.ReportAllocs()
+	b.SetBytes(PacketSize)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if !wt.Write(Payload{linkid: 1, data: mpool.Get()}) {
+				return
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		payload, err := rt.Read()
+		if err != nil {
+			b.Fatal(err)
+		}
+		mpool.Put(payload.data)
+	}
+}
+
+// control frames sent by hub
+func BenchmarkTunnelCtrl(b *testing.B) {
+	wt, rt := newBenchTunnels()
+	defer wt.Close()
+	defer rt.Close()
+	hub := newHub(context.Background(), wt, true, 0, rootLogger)
+
+	b.ReportAllocs()
+	arg := []byte{0, 0, 1, 0}
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if !hub.Send(LINK_WINDOW, 1, arg) {
+				return
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		payload, err := rt.Read()
+		if err != nil {
+			b.Fatal(err)
+		}
+		mpool.Put(payload.data)
+	}
+}
+
+func TestTunnelPriority(t *testing.T) {
+	tunnel := &Tunnel{closed: make(chan struct{})}
+	for i := range tunnel.wch {
+		tunnel.wch[i] = make(chan Payload, 1)
+	}
+	for _, prio := range []uint8{priorityBulk, priorityNormal, priorityInteractive} {
+		tunnel.wch[prio] <- Payload{prio: prio}
+	}
+	for _, prio := range priorityOrder {
+		if payload, ok := tunnel.next(); !ok || payload.prio != prio {
+			t.Fatalf("unexpected payload of class %d, want %d", payload.prio, prio)
+		}
+	}
+	close(tunnel.closed)
+	if _, ok := tunnel.next(); ok {
+		t.Fatal("closed tunnel should have no payload")
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue(100)
+	if !q.acquire(60) || !q.acquire(40) {
+		t.Fatal("acquire within limit failed")
+	}
+	acquired := make(chan bool)
+	go func() {
+		acquired <- q.acquire(10)
+	}()
+	q.release(60)
+	if !<-acquired || q.size() != 50 {
+		t.Fatalf("unexpected queued:%d", q.size())
+	}
+
+	// a large frame is admitted into empty queue
+	q.release(50)
+	if !q.acquire(1000) {
+		t.Fatal("large frame should be admitted")
+	}
+	go func() {
+		acquired <- q.acquire(10)
+	}()
+	q.close()
+	if <-acquired {
+		t.Fatal("closed queue should not admit")
+	}
+}
+
+func TestTunnelIntegrity(t *testing.T) {
+	wt, rt := newBenchTunnels()
+	defer wt.Close()
+	defer rt.Close()
+	wt.integrity = true
+	rt.integrity = true
+
+	data := mpool.Get()[:5]
+	copy(data, "hello")
+	wt.Write(Payload{linkid: 1, data: data})
+	payload, err := rt.Read()
+	if err != nil || string(payload.data) != "hello" {
+		t.Fatalf("unexpected payload:%q, %v", payload.data, err)
+	}
+
+	// frame of body "hellp" with checksum of "hello"
+	corrupted := atomic.LoadInt64(&stats.FrameCorrupted)
+	frame := []byte{1, 0, 9, 0, 'h', 'e', 'l', 'l', 'p', 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(frame[9:], frameSum(frame[:4], []byte("hello")))
+	go wt.conn.Write(frame)
+	if _, err := rt.Read(); err != errFrameChecksum {
+		t.Fatalf("unexpected error:%v", err)
+	}
+	if atomic.LoadInt64(&stats.FrameCorrupted) != corrupted+1 {
+		t.Fatal("corrupted frame should be counted")
+	}
+}
+
+func TestTunnelLinkId32(t *testing.T) {
+	wt, rt := newBenchTunnels()
+	defer wt.Close()
+	defer rt.Close()
+	wt.caps |= capLinkId32
+	rt.caps |= capLinkId32
+
+	linkid := uint32(3)<<linkGenShift | reverseLinkid32
+	data := mpool.Get()[:5]
+	copy(data, "hello")
+	wt.Write(Payload{linkid: linkid, data: data})
+	payload, err := rt.Read()
+	if err != nil || payload.linkid != linkid || string(payload.data) != "hello" {
+		t.Fatalf("unexpected payload:%d %q, %v", payload.linkid, payload.data, err)
+	}
+
+	// 6 bytes head of a raw frame
+	go wt.conn.Write([]byte{2, 0, 0, 1, 2, 0, 'h', 'i'})
+	payload, err = rt.Read()
+	if err != nil || payload.linkid != 1<<24|2 || string(payload.data) != "hi" {
+		t.Fatalf("unexpected payload:%d %q, %v", payload.linkid, payload.data, err)
+	}
+}
@@ -0,0 +1,206 @@
+//
+//   date  : 2015-06-23
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// udp session expires if no datagram in either direction
+var UDPTimeout = time.Second * 60
+
+// a read of it takes a whole datagram, the part beyond buffer is lost
+type datagramConn interface {
+	datagrams()
+}
+
+// client side udp session, keyed by source address
+// every datagram is carried by one link data frame
+type udpSession struct {
+	ln     *net.UDPConn
+	src    *net.UDPAddr
+	rch    chan []byte
+	rclose chan struct{}
+	ronce  sync.Once
+	active time.Time
+	lock   sync.Mutex
+}
+
+func (s *udpSession) touch() {
+	s.lock.Lock()
+	s.active = time.Now()
+	s.lock.Unlock()
+}
+
+func (s *udpSession) idle() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Since(s.active)
+}
+
+// queue datagram read by listener, drop if session is busy
+func (s *udpSession) put(data []byte) bool {
+	select {
+	case s.rch <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *udpSession) Read(p []byte) (int, error) {
+	for {
+		timer := time.NewTimer(UDPTimeout - s.idle())
+		select {
+		case data := <-s.rch:
+			timer.Stop()
+			s.touch()
+			n := copy(p, data)
+			mpool.Put(data)
+			return n, nil
+		case <-timer.C:
+			if s.idle() >= UDPTimeout {
+				return 0, io.EOF
+			}
+		case <-s.rclose:
+			timer.Stop()
+			return 0, io.EOF
+		}
+	}
+}
+
+func (s *udpSession) datagrams() {}
+
+func (s *udpSession) Write(p []byte) (int, error) {
+	s.touch()
+	return s.ln.WriteToUDP(p, s.src)
+}
+
+func (s *udpSession) Close() error {
+	return s.CloseRead()
+}
+
+func (s *udpSession) CloseRead() error {
+	s.ronce.Do(func() { close(s.rclose) })
+	return nil
+}
+
+func (s *udpSession) CloseWrite() error {
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr {
+	return s.ln.LocalAddr()
+}
+
+func (s *udpSession) RemoteAddr() net.Addr {
+	return s.src
+}
+
+func (s *udpSession) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *udpSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func newUDPSession(ln *net.UDPConn, src *net.UDPAddr) *udpSession {
+	return &udpSession{
+		ln:     ln,
+		src:    src,
+		rch:    make(chan []byte, 64),
+		rclose: make(chan struct{}),
+		active: time.Now(),
+	}
+}
+
+// server side connected udp socket to backend
+type udpConn struct {
+	*net.UDPConn
+}
+
+func (c udpConn) Read(p []byte) (int, error) {
+	c.UDPConn.SetReadDeadline(time.Now().Add(UDPTimeout))
+	return c.UDPConn.Read(p)
+}
+
+func (c udpConn) datagrams() {}
+
+func (c udpConn) CloseRead() error {
+	// wake up blocked reader
+	return c.UDPConn.SetReadDeadline(time.Now())
+}
+
+func (c udpConn) CloseWrite() error {
+	return nil
+}
+
+func (cli *Client) listenUDP(rule *Rule, ln *net.UDPConn) {
+	defer cli.wg.Done()
+
+	var lock sync.Mutex
+	sessions := make(map[string]*udpSession)
+	for {
+		buffer := mpool.Get()
+		n, src, err := ln.ReadFromUDP(buffer)
+		if err != nil {
+			mpool.Put(buffer)
+			if cli.isStopped() || errors.Is(err, net.ErrClosed) {
+				break
+			}
+			Log("read udp failed:%s", err.Error())
+			if opErr, ok := err.(*net.OpError); ok {
+				if !opErr.Temporary() {
+					break
+				}
+			}
+			continue
+		}
+
+		key := src.String()
+		lock.Lock()
+		session := sessions[key]
+		if session == nil {
+			hub := cli.fetchHub(src)
+			if hub == nil {
+				lock.Unlock()
+				mpool.Put(buffer)
+				Error("no active hub, drop datagram from %v", src)
+				continue
+			}
+			if !hub.Hub.tunnel.has(capUDP) {
+				lock.Unlock()
+				mpool.Put(buffer)
+				Error("server doesn't support udp, drop datagram from %v", src)
+				continue
+			}
+			Info("new udp session from %v", src)
+			session = newUDPSession(ln, src)
+			sessions[key] = session
+			go func() {
+				cli.handleConn(hub, session, rule)
+				lock.Lock()
+				delete(sessions, key)
+				lock.Unlock()
+			}()
+		}
+		lock.Unlock()
+
+		if !session.put(buffer[:n]) {
+			mpool.Put(buffer)
+			Debug("udp session(%v) busy, drop datagram", src)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+//
+//   date  : 2015-06-23
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// address of an echo server of udp, and a free address to listen
+func udpEcho(t *testing.T) (string, string) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		buf := make([]byte, PacketSize*2)
+		for {
+			n, src, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], src)
+		}
+	}()
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := free.LocalAddr().String()
+	free.Close()
+	return echo.LocalAddr().String(), listen
+}
+
+// send datagrams through a udp rule, and check they are echoed whole
+func udpRoundTrip(t *testing.T, listen string, datagrams [][]byte) {
+	conn, err := net.Dial("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, data := range datagrams {
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, PacketSize*2)
+	for _, data := range datagrams {
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], data) {
+			t.Fatalf("unexpected datagram of %d bytes, want %d", n, len(data))
+		}
+	}
+}
+
+func newUDPPair(t *testing.T, backend, listen string) *testPair {
+	server := Config{Rules: []*Rule{{Name: "dns", Backend: backend, UDP: true}}}
+	client := Config{Rules: []*Rule{{Name: "dns", Listen: listen, UDP: true}}}
+	return newTestPair(t, server, client)
+}
+
+// set LinkWindow for a test, the func returned is called with its pair.
+// Links outlive Wait of their pair, so it's restored once links of hubs
+// of the pair quit
+func setLinkWindow(t *testing.T, window int) func(p *testPair) {
+	old := LinkWindow
+	LinkWindow = window
+	var hubs []*Hub
+	t.Cleanup(func() {
+		for _, hub := range hubs {
+			waitFor(t, "links quit", func() bool { return hub.LinkCount() == 0 })
+		}
+		LinkWindow = old
+	})
+	return func(p *testPair) {
+		hubs = append(p.client.activeHubs(), p.server.activeHubs()...)
+	}
+}
+
+// a datagram read while window of link is partly used isn't cut
+func TestPairUDPWholeDatagram(t *testing.T) {
+	trackPair := setLinkWindow(t, PacketSize*3/2)
+	backend, listen := udpEcho(t)
+	p := newUDPPair(t, backend, listen)
+
+	// the first datagram leaves half a packet of window
+	udpRoundTrip(t, listen, [][]byte{bytes.Repeat([]byte{'a'}, PacketSize), bytes.Repeat([]byte{'b'}, PacketSize)})
+	trackPair(p)
+}
+
+// peer's window below a packet doesn't block datagrams forever
+func TestPairUDPSmallWindow(t *testing.T) {
+	trackPair := setLinkWindow(t, PacketSize/2)
+	backend, listen := udpEcho(t)
+	p := newUDPPair(t, backend, listen)
+
+	udpRoundTrip(t, listen, [][]byte{bytes.Repeat([]byte{'a'}, 3000), bytes.Repeat([]byte{'b'}, PacketSize/2), []byte("c")})
+	trackPair(p)
+}
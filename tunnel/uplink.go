@@ -0,0 +1,112 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// client spreads its tunnels over Uplinks, such as an lte and a dsl line:
+// tunnel i dials server from uplink i mod n. Links are balanced over hubs,
+// so over uplinks too; when an uplink fails, its tunnels reconnect, and
+// links go to the others meanwhile. An uplink is a local ip, or an
+// interface whose address is looked up on every dial, as ppp and dhcp
+// change it. On linux the socket is bound to the interface as well, so it
+// leaves by the interface without policy routing.
+
+type uplink struct {
+	ip  net.IP // nil if it's an interface
+	dev string
+}
+
+func parseUplinks(names []string) ([]*uplink, error) {
+	var uplinks []*uplink
+	for _, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("empty uplink")
+		}
+		uplinks = append(uplinks, &uplink{ip: net.ParseIP(name), dev: name})
+	}
+	return uplinks, nil
+}
+
+func (u *uplink) String() string {
+	return u.dev
+}
+
+// local address of the family to dial from
+func (u *uplink) localIP(ipv6 bool) (net.IP, error) {
+	if u.ip != nil {
+		if (u.ip.To4() == nil) != ipv6 {
+			return nil, fmt.Errorf("uplink %s: no address of the family", u)
+		}
+		return u.ip, nil
+	}
+	ifi, err := net.InterfaceByName(u.dev)
+	if err != nil {
+		return nil, fmt.Errorf("uplink %s: %s", u, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("uplink %s: %s", u, err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() || (ipnet.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		return ipnet.IP, nil
+	}
+	return nil, fmt.Errorf("uplink %s: no address of the family", u)
+}
+
+type uplinkKey struct{}
+
+// tunnel dialed with ctx goes by uplink of index
+func (app *App) withUplink(ctx context.Context, index int) context.Context {
+	if len(app.uplinks) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, uplinkKey{}, app.uplinks[index%len(app.uplinks)])
+}
+
+// dialer of tunnel connection to ip, from uplink of ctx if it's set
+func (app *App) tunnelDialer(ctx context.Context, network string, ip net.IP) (*net.Dialer, error) {
+	d := app.dialer(network)
+	u, ok := ctx.Value(uplinkKey{}).(*uplink)
+	if !ok {
+		return d, nil
+	}
+	local, err := u.localIP(ip.To4() == nil)
+	if err != nil {
+		return nil, err
+	}
+	if network == "udp" {
+		d.LocalAddr = &net.UDPAddr{IP: local}
+	} else {
+		d.LocalAddr = &net.TCPAddr{IP: local}
+	}
+	if u.ip != nil {
+		return d, nil
+	}
+	control := d.Control
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		var err error
+		c.Control(func(fd uintptr) {
+			err = setBindDevice(fd, u.dev)
+		})
+		return err
+	}
+	return d, nil
+}
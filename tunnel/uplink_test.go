@@ -0,0 +1,60 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestUplinkLocalIP(t *testing.T) {
+	uplinks, err := parseUplinks([]string{"127.0.0.1", "lo", "nonexistent0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := uplinks[0].localIP(false); err != nil || !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("unexpected ip:%v, %v", ip, err)
+	}
+	if _, err := uplinks[0].localIP(true); err == nil {
+		t.Fatal("ipv4 uplink has no ipv6 address")
+	}
+	if _, err := net.InterfaceByName("lo"); err == nil {
+		if ip, err := uplinks[1].localIP(false); err != nil || !ip.IsLoopback() {
+			t.Fatalf("unexpected ip of lo:%v, %v", ip, err)
+		}
+	}
+	if _, err := uplinks[2].localIP(false); err == nil {
+		t.Fatal("unknown interface should fail")
+	}
+	if _, err := parseUplinks([]string{""}); err == nil {
+		t.Fatal("empty uplink should fail")
+	}
+}
+
+func TestTunnelUplinks(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	app := &App{Config: Config{Uplinks: []string{"127.0.0.1", "127.0.0.2"}}}
+	if app.uplinks, err = parseUplinks(app.Uplinks); err != nil {
+		t.Fatal(err)
+	}
+
+	// tunnels are spread over uplinks by index
+	for index, want := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"} {
+		conn, err := app.dialTunnel(app.withUplink(context.Background(), index), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Skipf("dial from %s failed:%v", want, err)
+		}
+		conn.Close()
+		if local := conn.LocalAddr().(*net.TCPAddr); local.IP.String() != want {
+			t.Fatalf("tunnel %d dialed from %s, want %s", index, local.IP, want)
+		}
+	}
+}
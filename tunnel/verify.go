@@ -0,0 +1,123 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// verify dials every tunnel server of client and handshakes with it, so
+// reachability, secrets, certificates and options are checked, such as in a
+// deploy pipeline before cutover. Tunnels are closed once handshakes finish,
+// no link is created.
+
+type VerifyResult struct {
+	Server    string        `json:"server"`
+	Peer      string        `json:"peer,omitempty"`   // address connected
+	Connect   time.Duration `json:"connect"`          // time to connect, with tls and websocket handshakes
+	Handshake time.Duration `json:"handshake"`        // time of tunnel handshake after connected
+	Cipher    string        `json:"cipher,omitempty"` // negotiated
+	Compress  string        `json:"compress,omitempty"`
+	Integrity bool          `json:"integrity"`
+	Caps      []string      `json:"caps,omitempty"` // capabilities supported by both ends
+	Cert      string        `json:"cert,omitempty"` // subject of verified server certificate
+	Err       string        `json:"error,omitempty"`
+}
+
+func (r *VerifyResult) ok() bool {
+	return r.Err == ""
+}
+
+type VerifyResults []*VerifyResult
+
+func (rs VerifyResults) WriteTo(w io.Writer) (int64, error) {
+	var b []byte
+	for _, r := range rs {
+		if !r.ok() {
+			b = fmt.Appendf(b, "%s: failed after %v: %s\n", r.Server, (r.Connect + r.Handshake).Round(time.Millisecond), r.Err)
+			continue
+		}
+		b = fmt.Appendf(b, "%s: ok, peer %s, connect %v, handshake %v\n", r.Server, r.Peer,
+			r.Connect.Round(time.Microsecond), r.Handshake.Round(time.Microsecond))
+		b = fmt.Appendf(b, "  cipher %s, compress %s, integrity %v\n", r.Cipher, r.Compress, r.Integrity)
+		b = fmt.Appendf(b, "  caps %s\n", strings.Join(r.Caps, ","))
+		if r.Cert != "" {
+			b = fmt.Appendf(b, "  cert %s\n", r.Cert)
+		}
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// first error of results
+func (rs VerifyResults) Err() error {
+	for _, r := range rs {
+		if !r.ok() {
+			return fmt.Errorf("%s: %s", r.Server, r.Err)
+		}
+	}
+	return nil
+}
+
+// handshake with every tunnel server of client in turn, without listening
+// rules. Failures of servers are in results.
+func (app *App) Verify(ctx context.Context) (VerifyResults, error) {
+	if app.Tunnels == 0 {
+		return nil, errors.New("verify runs as client, tunnels should be positive")
+	}
+	if err := app.init(); err != nil {
+		return nil, err
+	}
+	app.rules = nil
+	cli := newClient(app)
+
+	var results VerifyResults
+	for i, server := range app.servers {
+		results = append(results, cli.verify(app.withUplink(ctx, i), i, server))
+	}
+	return results, nil
+}
+
+func (cli *Client) verify(ctx context.Context, index int, server string) *VerifyResult {
+	r := &VerifyResult{Server: server}
+	hctx, cancel := cli.app.handshakeContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	raw, err := cli.app.transport.Dial(hctx, server)
+	r.Connect = time.Since(start)
+	if err != nil {
+		r.Err = err.Error()
+		return r
+	}
+	r.Peer = raw.RemoteAddr().String()
+
+	start = time.Now()
+	tunnel, _, err := cli.handshakeConn(hctx, raw, index, server, nil)
+	r.Handshake = time.Since(start)
+	if err != nil {
+		r.Err = err.Error()
+		return r
+	}
+	defer tunnel.Close()
+
+	r.Cipher = cipherName(cli.app.cipher)
+	r.Compress = CompressNone
+	if tunnel.wcomp != nil {
+		r.Compress = cli.app.Compress
+	}
+	r.Integrity = tunnel.integrity
+	r.Caps = capsNames(tunnel.caps)
+	if cert := peerCertificate(tunnel.netConn()); cert != nil {
+		r.Cert = cert.Subject.String()
+	}
+	return r
+}
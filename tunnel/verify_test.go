@@ -0,0 +1,59 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPairVerify(t *testing.T) {
+	p := newTestPair(t, Config{}, Config{})
+	app := newTestApp(t, p.network, Config{
+		Backend:   testTunnelAddr,
+		Servers:   []string{"127.0.0.1:8009"},
+		Listen:    "127.0.0.1:8007",
+		Tunnels:   1,
+		Secret:    "test secret",
+		Compress:  CompressDeflate,
+		Integrity: true,
+	})
+	results, err := app.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("unexpected results:%+v", results)
+	}
+	r := results[0]
+	if !r.ok() || r.Server != testTunnelAddr || r.Cipher != CipherAES256GCM || r.Compress != CompressDeflate ||
+		!r.Integrity || !strings.Contains(strings.Join(r.Caps, ","), "echo") {
+		t.Fatalf("unexpected result:%+v", r)
+	}
+	// nothing listens on the other server
+	if results[1].ok() || results.Err() == nil {
+		t.Fatalf("unexpected result:%+v", results[1])
+	}
+	var b bytes.Buffer
+	results.WriteTo(&b)
+	if !strings.Contains(b.String(), testTunnelAddr+": ok") || !strings.Contains(b.String(), "127.0.0.1:8009: failed") {
+		t.Fatalf("unexpected report:%s", b.String())
+	}
+
+	// no tunnel is left on server
+	waitFor(t, "tunnels closed", func() bool { return len(p.server.activeHubs()) == 1 })
+
+	app = newTestApp(t, p.network, Config{Backend: testTunnelAddr, Listen: "127.0.0.1:8007", Tunnels: 1, Secret: "wrong secret"})
+	results, err = app.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ok() {
+		t.Fatalf("wrong secret is verified:%+v", results[0])
+	}
+}
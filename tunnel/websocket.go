@@ -0,0 +1,246 @@
+//
+//   date  : 2015-06-18
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// max payload of control frame
+const wsMaxControlSize = 125
+
+var errWebSocketFrame = errors.New("errWebSocketFrame")
+
+// websocket connection, every Write is sent as a binary message
+type wsConn struct {
+	net.Conn
+	rd      *bufio.Reader
+	client  bool       // client must mask frames
+	left    uint64     // unread payload of current frame
+	mask    []byte     // mask of current frame
+	maskPos int        // mask offset of current frame
+	wlock   sync.Mutex // write lock, pong is written by reader
+	rhead   [14]byte   // read frame head buffer
+	whead   [14]byte   // write frame head buffer
+}
+
+func (c *wsConn) readHead() (opcode byte, sz uint64, mask []byte, err error) {
+	head := c.rhead[:2]
+	if _, err = io.ReadFull(c.rd, head); err != nil {
+		return
+	}
+	opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	sz = uint64(head[1] & 0x7f)
+	switch sz {
+	case 126:
+		if _, err = io.ReadFull(c.rd, c.rhead[2:4]); err != nil {
+			return
+		}
+		sz = uint64(binary.BigEndian.Uint16(c.rhead[2:4]))
+	case 127:
+		if _, err = io.ReadFull(c.rd, c.rhead[2:10]); err != nil {
+			return
+		}
+		sz = binary.BigEndian.Uint64(c.rhead[2:10])
+	}
+	if masked {
+		mask = c.rhead[10:14]
+		if _, err = io.ReadFull(c.rd, mask); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *wsConn) writeFrame(opcode byte, p []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	head := c.whead[:2]
+	head[0] = 0x80 | opcode
+	sz := len(p)
+	switch {
+	case sz < 126:
+		head[1] = byte(sz)
+	case sz <= 0xffff:
+		head[1] = 126
+		head = head[:4]
+		binary.BigEndian.PutUint16(head[2:], uint16(sz))
+	default:
+		head[1] = 127
+		head = head[:10]
+		binary.BigEndian.PutUint64(head[2:], uint64(sz))
+	}
+
+	frame := make([]byte, 0, len(head)+4+sz)
+	if c.client {
+		head[1] |= 0x80
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, head...)
+		frame = append(frame, mask[:]...)
+		for i, b := range p {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, head...)
+		frame = append(frame, p...)
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		opcode, sz, mask, err := c.readHead()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case wsBinary, wsText, wsContinuation:
+			c.left = sz
+			c.mask = mask
+			c.maskPos = 0
+		case wsPing, wsPong, wsClose:
+			if sz > wsMaxControlSize {
+				return 0, errWebSocketFrame
+			}
+			payload := make([]byte, sz)
+			if _, err := io.ReadFull(c.rd, payload); err != nil {
+				return 0, err
+			}
+			if opcode == wsClose {
+				c.writeFrame(wsClose, nil)
+				return 0, io.EOF
+			}
+			if opcode == wsPing {
+				for i := range payload {
+					if mask != nil {
+						payload[i] ^= mask[i%4]
+					}
+				}
+				if err := c.writeFrame(wsPong, payload); err != nil {
+					return 0, err
+				}
+			}
+		default:
+			return 0, errWebSocketFrame
+		}
+	}
+
+	if uint64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.rd.Read(p)
+	if c.mask != nil {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[(c.maskPos+i)%4]
+		}
+		c.maskPos += n
+	}
+	c.left -= uint64(n)
+	return n, err
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func wsClientHandshake(conn net.Conn, host, path string) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n", path, host, key)
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade failed: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, errors.New("websocket accept key mismatch")
+	}
+	return &wsConn{Conn: conn, rd: rd, client: true}, nil
+}
+
+func wsServerHandshake(conn net.Conn, path string) (net.Conn, error) {
+	rd := bufio.NewReader(conn)
+	req, err := http.ReadRequest(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	reject := func(status int) error {
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+		return fmt.Errorf("websocket upgrade rejected: %s %s", req.Method, req.URL)
+	}
+
+	if req.Method != "GET" || req.URL.Path != path {
+		return nil, reject(http.StatusNotFound)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+		return nil, reject(http.StatusBadRequest)
+	}
+
+	resp := fmt.Sprintf("HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", wsAcceptKey(key))
+	if _, err := io.WriteString(conn, resp); err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: conn, rd: rd}, nil
+}
@@ -0,0 +1,51 @@
+//
+//   date  : 2015-06-18
+//   author: xjdrew
+//
+
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWebSocket(t *testing.T) {
+	c1, c2 := net.Pipe()
+	done := make(chan net.Conn)
+	go func() {
+		conn, err := wsServerHandshake(c2, "/tunnel")
+		if err != nil {
+			t.Error("server handshake failed:", err)
+		}
+		done <- conn
+	}()
+
+	client, err := wsClientHandshake(c1, "example.com", "/tunnel")
+	if err != nil {
+		t.Fatal("client handshake failed:", err)
+	}
+	server := <-done
+	if server == nil {
+		t.FailNow()
+	}
+
+	input := "hello, world"
+	go client.Write([]byte(input))
+	output := make([]byte, len(input))
+	if _, err := io.ReadFull(server, output); err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != input {
+		t.Fatalf("unexpected output:%s", output)
+	}
+
+	go server.Write([]byte(input))
+	if _, err := io.ReadFull(client, output); err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != input {
+		t.Fatalf("unexpected output:%s", output)
+	}
+}
@@ -0,0 +1,117 @@
+//
+//   date  : 2015-09-27
+//   author: xjdrew
+//
+
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/xjdrew/gotunnel/tunnel"
+)
+
+// start new binary and exit after draining
+const SIG_UPGRADE = syscall.SIGUSR2
+
+// fd of pipe, new process writes a byte to it once started
+const readyFdEnv = "GOTUNNEL_READY_FD"
+
+// max time to wait for new process to start
+const upgradeTimeout = time.Second * 30
+
+// start the binary at the same path with the same arguments, passing
+// listening sockets to it; old process stops accepting and drains once the
+// new one is started, and keeps serving if it fails
+func upgrade(app *tunnel.App) error {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	files, err := app.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	// exec.Cmd takes fds by File.Fd, which turns the shared socket into
+	// blocking mode and hangs accepting of our listeners, so fork by raw fds
+	fds := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	for _, f := range append(files, wr) {
+		fd, err := rawFd(f)
+		if err != nil {
+			wr.Close()
+			return err
+		}
+		fds = append(fds, fd)
+	}
+	env := append(os.Environ(),
+		tunnel.UpgradeFdsEnv+"="+strconv.Itoa(len(files)),
+		readyFdEnv+"="+strconv.Itoa(len(fds)-1))
+	pid, err := syscall.ForkExec(path, os.Args, &syscall.ProcAttr{Env: env, Files: fds})
+	wr.Close()
+	if err != nil {
+		return err
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	// pipe is closed without a byte if new process exits
+	rd.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	var b [1]byte
+	if _, err := rd.Read(b[:]); err != nil {
+		proc.Kill()
+		proc.Wait()
+		return fmt.Errorf("new process not ready: %s", err)
+	}
+	tunnel.Log("new process %d started, drain", pid)
+	proc.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	return app.Stop(ctx)
+}
+
+// fd of f, without turning it into blocking mode like File.Fd
+func rawFd(f *os.File) (uintptr, error) {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd uintptr
+	if err := conn.Control(func(raw uintptr) { fd = raw }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+// tell old process of graceful upgrade that we are serving
+func notifyReady() {
+	defer os.Unsetenv(readyFdEnv)
+	fd, err := strconv.Atoi(os.Getenv(readyFdEnv))
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
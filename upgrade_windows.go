@@ -0,0 +1,18 @@
+//
+//   date  : 2015-09-27
+//   author: xjdrew
+//
+
+package main
+
+import (
+	"errors"
+
+	"github.com/xjdrew/gotunnel/tunnel"
+)
+
+func upgrade(app *tunnel.App) error {
+	return errors.New("graceful upgrade is not supported on windows")
+}
+
+func notifyReady() {}
@@ -0,0 +1,27 @@
+//
+//   date  : 2015-10-13
+//   author: xjdrew
+//
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/xjdrew/gotunnel/tunnel"
+)
+
+// handshake with every tunnel server of client like it starts, report them
+// to stdout, and fail if any fails. Interrupt stops it early.
+func runVerify(app *tunnel.App) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	results, err := app.Verify(ctx)
+	if err != nil {
+		return err
+	}
+	results.WriteTo(os.Stdout)
+	return results.Err()
+}